@@ -0,0 +1,9 @@
+// command sd-perf-profiler runs configurable perf profiles and uploads
+// them to the StackDriver Profiler API in Google Cloud.
+package main
+
+import "github.com/droyo/cloud-profiler-perf/pkg/agent"
+
+func main() {
+	agent.Main()
+}
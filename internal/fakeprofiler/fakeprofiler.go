@@ -0,0 +1,405 @@
+// Package fakeprofiler is an in-memory Cloud Profiler API, for the
+// agent's end-to-end tests. A Server holds
+// CreateProfile calls, as the API does until it wants a profile, and
+// answers them as a test scripts it to, with profile requests at a given
+// cadence or with errors and the retry delays the API advises. It checks
+// the profiles uploaded to it as the API would, and records them.
+//
+// The profilertest package exports the Server to programs that embed the
+// cloud-profiler-perf packages.
+package fakeprofiler
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	pprof "github.com/google/pprof/profile"
+	cloudprofiler "google.golang.org/genproto/googleapis/devtools/cloudprofiler/v2"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultDuration is the duration of the profiles a Server asks for,
+// unless a Step gives one.
+const DefaultDuration = 10 * time.Second
+
+// A Step is how a Server answers one CreateProfile call.
+type Step struct {
+	// Delay is how long the call is held before it is answered, as
+	// the API holds calls until it wants a profile.
+	Delay time.Duration
+	// Err, if set, is returned rather than a profile request, such as
+	// status.Error(codes.Unavailable, "").
+	Err error
+	// RetryDelay, with an Err of code Aborted, is sent as the delay
+	// the server advises before a retry.
+	RetryDelay time.Duration
+	// Type is the type of profile asked for; by default, the first
+	// the caller offers. A type the caller does not offer fails the
+	// call with code Internal, as the API would never ask for it.
+	Type cloudprofiler.ProfileType
+	// Duration is the duration of the profile; DefaultDuration if
+	// zero.
+	Duration time.Duration
+	// Labels are the labels of the profile asked for.
+	Labels map[string]string
+}
+
+// A Call is a CreateProfile call made to a Server.
+type Call struct {
+	Request *cloudprofiler.CreateProfileRequest
+	// Time is when the call was made.
+	Time time.Time
+}
+
+// An Upload is a profile uploaded to a Server.
+type Upload struct {
+	Profile *cloudprofiler.Profile
+	// Offline is true for profiles uploaded with CreateOfflineProfile,
+	// rather than in answer to a request.
+	Offline bool
+	Time    time.Time
+}
+
+// Parse parses the pprof-encoded data of the profile.
+func (u Upload) Parse() (*pprof.Profile, error) {
+	return pprof.ParseData(u.Profile.ProfileBytes)
+}
+
+// A Server is an in-memory ProfilerService. Its methods are safe to call
+// from several goroutines.
+type Server struct {
+	// Addr is the host:port the server listens on.
+	Addr string
+
+	srv  *grpc.Server
+	conn *grpc.ClientConn
+
+	mu sync.Mutex
+	// scripted answers, and the cadence of the answers once they are
+	// used up
+	steps []Step
+	every time.Duration
+	types []cloudprofiler.ProfileType
+	turn  int
+	last  time.Time
+	// closed, and replaced, when steps are added
+	added chan struct{}
+	// profiles asked for and not yet uploaded, by name
+	issued map[string]*cloudprofiler.Profile
+	n      int
+	// errors returned by the next uploads
+	uploadErrs []error
+	calls      []Call
+	uploads    []Upload
+	// closed, and replaced, on every upload
+	uploaded chan struct{}
+}
+
+// NewServer starts a Server listening on a local port.
+func NewServer() (*Server, error) {
+	return Listen("127.0.0.1:0")
+}
+
+// Listen starts a Server listening on addr, such as for a program run
+// apart from the test to connect to.
+func Listen(addr string) (*Server, error) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		Addr:     lis.Addr().String(),
+		srv:      grpc.NewServer(),
+		added:    make(chan struct{}),
+		issued:   make(map[string]*cloudprofiler.Profile),
+		uploaded: make(chan struct{}),
+	}
+	cloudprofiler.RegisterProfilerServiceServer(s.srv, s)
+	go s.srv.Serve(lis)
+	s.conn, err = grpc.Dial(s.Addr, grpc.WithInsecure())
+	if err != nil {
+		s.srv.Stop()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Client returns a client of the server.
+func (s *Server) Client() cloudprofiler.ProfilerServiceClient {
+	return cloudprofiler.NewProfilerServiceClient(s.conn)
+}
+
+// Close stops the server, failing the calls in progress.
+func (s *Server) Close() {
+	s.conn.Close()
+	s.srv.Stop()
+}
+
+// Script adds steps to the answers of the next CreateProfile calls, in
+// order. Calls made while there are no steps, and no cadence, wait for
+// some to be added.
+func (s *Server) Script(steps ...Step) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.steps = append(s.steps, steps...)
+	close(s.added)
+	s.added = make(chan struct{})
+}
+
+// Every makes the server ask for a profile every interval once the
+// scripted steps are used up, of each of types in turn, or of the first
+// type the caller offers if none are given.
+func (s *Server) Every(interval time.Duration, types ...cloudprofiler.ProfileType) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.every, s.types, s.turn = interval, types, 0
+	close(s.added)
+	s.added = make(chan struct{})
+}
+
+// FailUploads makes the next uploads fail with errs, in order.
+func (s *Server) FailUploads(errs ...error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.uploadErrs = append(s.uploadErrs, errs...)
+}
+
+// Requests returns the CreateProfile requests made so far.
+func (s *Server) Requests() []*cloudprofiler.CreateProfileRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	requests := make([]*cloudprofiler.CreateProfileRequest, len(s.calls))
+	for i, c := range s.calls {
+		requests[i] = c.Request
+	}
+	return requests
+}
+
+// Calls returns the CreateProfile calls made so far.
+func (s *Server) Calls() []Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Call(nil), s.calls...)
+}
+
+// Uploads returns the profiles uploaded so far.
+func (s *Server) Uploads() []Upload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Upload(nil), s.uploads...)
+}
+
+// WaitUploads waits until n profiles have been uploaded, and returns
+// them, or ctx's error if it is done first.
+func (s *Server) WaitUploads(ctx context.Context, n int) ([]Upload, error) {
+	for {
+		s.mu.Lock()
+		uploads, wait := s.uploads, s.uploaded
+		s.mu.Unlock()
+		if len(uploads) >= n {
+			return append([]Upload(nil), uploads...), nil
+		}
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// nextStep returns the answer to the next call, or a channel closed once
+// there may be one.
+func (s *Server) nextStep() (Step, <-chan struct{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.steps) > 0 {
+		step := s.steps[0]
+		s.steps = s.steps[1:]
+		return step, nil, true
+	}
+	if s.every <= 0 {
+		return Step{}, s.added, false
+	}
+	var step Step
+	if !s.last.IsZero() {
+		step.Delay = time.Until(s.last.Add(s.every))
+	}
+	if len(s.types) > 0 {
+		step.Type = s.types[s.turn%len(s.types)]
+		s.turn++
+	}
+	// counted from when it is due, so slow callers do not drift
+	s.last = time.Now().Add(step.Delay)
+	return step, nil, true
+}
+
+// contextError returns the gRPC error of a call whose ctx is done.
+func contextError(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return status.Error(codes.DeadlineExceeded, ctx.Err().Error())
+	}
+	return status.Error(codes.Canceled, ctx.Err().Error())
+}
+
+// CreateProfile answers req with the next step.
+func (s *Server) CreateProfile(ctx context.Context, req *cloudprofiler.CreateProfileRequest) (*cloudprofiler.Profile, error) {
+	s.mu.Lock()
+	s.calls = append(s.calls, Call{Request: req, Time: time.Now()})
+	s.mu.Unlock()
+	var step Step
+	for {
+		next, wait, ok := s.nextStep()
+		if ok {
+			step = next
+			break
+		}
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, contextError(ctx)
+		}
+	}
+	if step.Delay > 0 {
+		t := time.NewTimer(step.Delay)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return nil, contextError(ctx)
+		}
+	}
+	if step.Err != nil {
+		if step.RetryDelay > 0 {
+			b, err := proto.Marshal(&errdetails.RetryInfo{RetryDelay: ptypes.DurationProto(step.RetryDelay)})
+			if err == nil {
+				grpc.SetTrailer(ctx, metadata.Pairs("google.rpc.retryinfo-bin", string(b)))
+			}
+		}
+		return nil, step.Err
+	}
+	if len(req.ProfileType) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "no profile types offered")
+	}
+	t := step.Type
+	if t == cloudprofiler.ProfileType_PROFILE_TYPE_UNSPECIFIED {
+		t = req.ProfileType[0]
+	}
+	offered := false
+	for _, o := range req.ProfileType {
+		offered = offered || o == t
+	}
+	if !offered {
+		return nil, status.Errorf(codes.Internal, "fakeprofiler: scripted a %s profile, but the caller offers %v", t, req.ProfileType)
+	}
+	duration := step.Duration
+	if duration <= 0 {
+		duration = DefaultDuration
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.n++
+	profile := &cloudprofiler.Profile{
+		Name:        fmt.Sprintf("%s/profiles/%d", req.Parent, s.n),
+		ProfileType: t,
+		Deployment:  req.Deployment,
+		Duration:    ptypes.DurationProto(duration),
+		Labels:      step.Labels,
+	}
+	s.issued[profile.Name] = proto.Clone(profile).(*cloudprofiler.Profile)
+	return profile, nil
+}
+
+// CreateOfflineProfile records the profile of req, which must hold a
+// valid pprof profile.
+func (s *Server) CreateOfflineProfile(ctx context.Context, req *cloudprofiler.CreateOfflineProfileRequest) (*cloudprofiler.Profile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.uploadError(); err != nil {
+		return nil, err
+	}
+	if err := checkProfile(req.Profile); err != nil {
+		return nil, err
+	}
+	s.n++
+	profile := proto.Clone(req.Profile).(*cloudprofiler.Profile)
+	profile.Name = fmt.Sprintf("%s/profiles/%d", req.Parent, s.n)
+	s.upload(profile, true)
+	return profile, nil
+}
+
+// UpdateProfile records the profile of req, which must have been asked
+// for and not yet uploaded, be of the type and deployment asked for, and
+// hold a valid pprof profile.
+func (s *Server) UpdateProfile(ctx context.Context, req *cloudprofiler.UpdateProfileRequest) (*cloudprofiler.Profile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.uploadError(); err != nil {
+		return nil, err
+	}
+	issued, ok := s.issued[req.Profile.GetName()]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "profile %q was not asked for, or was already uploaded", req.Profile.GetName())
+	}
+	switch {
+	case req.Profile.ProfileType != issued.ProfileType:
+		return nil, status.Errorf(codes.InvalidArgument, "profile %q is a %s profile, but a %s profile was asked for", issued.Name, req.Profile.ProfileType, issued.ProfileType)
+	case !sameDeployment(req.Profile.Deployment, issued.Deployment):
+		return nil, status.Errorf(codes.InvalidArgument, "profile %q is of deployment %v, but was asked for by %v", issued.Name, req.Profile.Deployment, issued.Deployment)
+	}
+	if err := checkProfile(req.Profile); err != nil {
+		return nil, err
+	}
+	delete(s.issued, req.Profile.Name)
+	profile := proto.Clone(req.Profile).(*cloudprofiler.Profile)
+	s.upload(profile, false)
+	return profile, nil
+}
+
+// sameDeployment reports whether a and b are the same project and
+// target. The labels of an upload may differ from those of the request.
+func sameDeployment(a, b *cloudprofiler.Deployment) bool {
+	return a.GetProjectId() == b.GetProjectId() && a.GetTarget() == b.GetTarget()
+}
+
+// checkProfile rejects an upload of profile with code InvalidArgument,
+// as the API does, unless it holds a valid pprof profile.
+func checkProfile(profile *cloudprofiler.Profile) error {
+	if len(profile.GetProfileBytes()) == 0 {
+		return status.Error(codes.InvalidArgument, "no profile data")
+	}
+	p, err := pprof.ParseData(profile.ProfileBytes)
+	if err == nil {
+		err = p.CheckValid()
+	}
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid profile: %s", err)
+	}
+	return nil
+}
+
+// uploadError returns the error the next upload fails with, if any. s.mu
+// must be held.
+func (s *Server) uploadError() error {
+	if len(s.uploadErrs) == 0 {
+		return nil
+	}
+	err := s.uploadErrs[0]
+	s.uploadErrs = s.uploadErrs[1:]
+	return err
+}
+
+// upload records profile. s.mu must be held.
+func (s *Server) upload(profile *cloudprofiler.Profile, offline bool) {
+	s.uploads = append(s.uploads, Upload{Profile: profile, Offline: offline, Time: time.Now()})
+	close(s.uploaded)
+	s.uploaded = make(chan struct{})
+}
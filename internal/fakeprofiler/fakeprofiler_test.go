@@ -0,0 +1,219 @@
+package fakeprofiler
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	pprof "github.com/google/pprof/profile"
+	cloudprofiler "google.golang.org/genproto/googleapis/devtools/cloudprofiler/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/droyo/cloud-profiler-perf/pkg/uploader"
+)
+
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+func testRequest() *cloudprofiler.CreateProfileRequest {
+	return &cloudprofiler.CreateProfileRequest{
+		Parent:      "projects/test",
+		Deployment:  &cloudprofiler.Deployment{ProjectId: "test", Target: "app"},
+		ProfileType: []cloudprofiler.ProfileType{cloudprofiler.ProfileType_CPU, cloudprofiler.ProfileType_WALL},
+	}
+}
+
+// testProfileBytes returns a valid pprof profile of one sample.
+func testProfileBytes(t *testing.T) []byte {
+	t.Helper()
+	p := &pprof.Profile{
+		SampleType: []*pprof.ValueType{{Type: "samples", Unit: "count"}},
+		Sample:     []*pprof.Sample{{Value: []int64{1}}},
+	}
+	var buf bytes.Buffer
+	if err := p.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCreateProfileLongPoll(t *testing.T) {
+	s := newTestServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := s.Client().CreateProfile(ctx, testRequest()); status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("with nothing scripted, got %v, want DeadlineExceeded", err)
+	}
+
+	answered := make(chan *cloudprofiler.Profile, 1)
+	go func() {
+		profile, err := s.Client().CreateProfile(context.Background(), testRequest())
+		if err != nil {
+			t.Error(err)
+		}
+		answered <- profile
+	}()
+	select {
+	case <-answered:
+		t.Fatal("call answered before any steps were scripted")
+	case <-time.After(100 * time.Millisecond):
+	}
+	s.Script(Step{Type: cloudprofiler.ProfileType_WALL, Duration: time.Second})
+	profile := <-answered
+	if profile.GetProfileType() != cloudprofiler.ProfileType_WALL || profile.Name != "projects/test/profiles/1" {
+		t.Errorf("got %v, want the WALL profile projects/test/profiles/1", profile)
+	}
+	if calls := s.Calls(); len(calls) != 2 || calls[1].Time.Before(calls[0].Time) {
+		t.Errorf("got calls %v, want two, in order", calls)
+	}
+}
+
+func TestCreateProfileDelay(t *testing.T) {
+	s := newTestServer(t)
+	const delay = 200 * time.Millisecond
+	s.Script(Step{Delay: delay})
+	start := time.Now()
+	profile, err := s.Client().CreateProfile(context.Background(), testRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Errorf("answered after %v, want at least %v", elapsed, delay)
+	}
+	if profile.ProfileType != cloudprofiler.ProfileType_CPU {
+		t.Errorf("got a %s profile, want the first type offered", profile.ProfileType)
+	}
+}
+
+func TestCreateProfileRetryDelay(t *testing.T) {
+	s := newTestServer(t)
+	s.Script(
+		Step{Err: status.Error(codes.Aborted, "not now"), RetryDelay: 90 * time.Second},
+		Step{Err: status.Error(codes.Unavailable, "down")},
+		Step{Type: cloudprofiler.ProfileType_HEAP},
+	)
+	var md metadata.MD
+	_, err := s.Client().CreateProfile(context.Background(), testRequest(), grpc.Trailer(&md))
+	if d, ok := uploader.RetryDelay(err, md); !ok || d != 90*time.Second {
+		t.Errorf("got retry delay %v, %v from %v, want 1m30s", d, ok, err)
+	}
+	md = nil
+	_, err = s.Client().CreateProfile(context.Background(), testRequest(), grpc.Trailer(&md))
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("got %v, want Unavailable", err)
+	}
+	if d, ok := uploader.RetryDelay(err, md); ok {
+		t.Errorf("got retry delay %v without one scripted", d)
+	}
+	if _, err := s.Client().CreateProfile(context.Background(), testRequest()); status.Code(err) != codes.Internal {
+		t.Errorf("asking for a type not offered, got %v, want Internal", err)
+	}
+}
+
+func TestUpdateProfile(t *testing.T) {
+	s := newTestServer(t)
+	s.Script(Step{})
+	ctx := context.Background()
+	issued, err := s.Client().CreateProfile(ctx, testRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := testProfileBytes(t)
+	with := func(f func(p *cloudprofiler.Profile)) *cloudprofiler.UpdateProfileRequest {
+		p := &cloudprofiler.Profile{
+			Name:         issued.Name,
+			ProfileType:  issued.ProfileType,
+			Deployment:   &cloudprofiler.Deployment{ProjectId: "test", Target: "app", Labels: map[string]string{"zone": "z"}},
+			ProfileBytes: data,
+		}
+		f(p)
+		return &cloudprofiler.UpdateProfileRequest{Profile: p}
+	}
+	tests := []struct {
+		name string
+		req  *cloudprofiler.UpdateProfileRequest
+		want codes.Code
+	}{
+		{"not asked for", with(func(p *cloudprofiler.Profile) { p.Name = "projects/test/profiles/9" }), codes.NotFound},
+		{"wrong type", with(func(p *cloudprofiler.Profile) { p.ProfileType = cloudprofiler.ProfileType_HEAP }), codes.InvalidArgument},
+		{"wrong target", with(func(p *cloudprofiler.Profile) { p.Deployment.Target = "other" }), codes.InvalidArgument},
+		{"wrong project", with(func(p *cloudprofiler.Profile) { p.Deployment.ProjectId = "other" }), codes.InvalidArgument},
+		{"no data", with(func(p *cloudprofiler.Profile) { p.ProfileBytes = nil }), codes.InvalidArgument},
+		{"invalid data", with(func(p *cloudprofiler.Profile) { p.ProfileBytes = []byte("not a profile") }), codes.InvalidArgument},
+		{"valid", with(func(p *cloudprofiler.Profile) {}), codes.OK},
+		{"uploaded twice", with(func(p *cloudprofiler.Profile) {}), codes.NotFound},
+	}
+	for _, test := range tests {
+		if _, err := s.Client().UpdateProfile(ctx, test.req); status.Code(err) != test.want {
+			t.Errorf("%s: got %v, want %s", test.name, err, test.want)
+		}
+	}
+	uploads := s.Uploads()
+	if len(uploads) != 1 || uploads[0].Offline || uploads[0].Profile.Name != issued.Name {
+		t.Fatalf("got uploads %v, want only %s", uploads, issued.Name)
+	}
+	if p, err := uploads[0].Parse(); err != nil || len(p.Sample) != 1 {
+		t.Errorf("got %v, %v, want the profile uploaded", p, err)
+	}
+}
+
+func TestFailUploads(t *testing.T) {
+	s := newTestServer(t)
+	s.Script(Step{})
+	ctx := context.Background()
+	issued, err := s.Client().CreateProfile(ctx, testRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	issued.ProfileBytes = testProfileBytes(t)
+	s.FailUploads(status.Error(codes.Unavailable, "down"))
+	req := &cloudprofiler.UpdateProfileRequest{Profile: issued}
+	if _, err := s.Client().UpdateProfile(ctx, req); status.Code(err) != codes.Unavailable {
+		t.Errorf("got %v, want the scripted failure", err)
+	}
+	if _, err := s.Client().UpdateProfile(ctx, req); err != nil {
+		t.Errorf("retry failed: %v", err)
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	if uploads, err := s.WaitUploads(waitCtx, 1); err != nil || len(uploads) != 1 {
+		t.Errorf("got %v, %v, want the one upload", uploads, err)
+	}
+}
+
+func TestEvery(t *testing.T) {
+	s := newTestServer(t)
+	const interval = 100 * time.Millisecond
+	s.Every(interval, cloudprofiler.ProfileType_WALL, cloudprofiler.ProfileType_CPU)
+	var got []cloudprofiler.ProfileType
+	var last time.Time
+	for i := 0; i < 3; i++ {
+		profile, err := s.Client().CreateProfile(context.Background(), testRequest())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if now := time.Now(); !last.IsZero() && now.Sub(last) < interval/2 {
+			t.Errorf("profile %d asked for %v after the last, want about %v", i, now.Sub(last), interval)
+		}
+		last = time.Now()
+		got = append(got, profile.ProfileType)
+	}
+	want := []cloudprofiler.ProfileType{cloudprofiler.ProfileType_WALL, cloudprofiler.ProfileType_CPU, cloudprofiler.ProfileType_WALL}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got types %v, want %v", got, want)
+			break
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package agent
+
+import (
+	"expvar"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Failed calls to the profiler API are counted in the status under
+// "api-errors" by what an operator would do about them, rather than by
+// status code, so that alerts can say "permission errors > 0" without
+// matching log lines. Every class is present from the start, at zero.
+// The counts are also logged in the summary when the agent exits.
+
+// Classes of API errors.
+const (
+	// the project is out of quota, or the server asks the agent to
+	// slow down
+	apiQuota = "quota"
+	// the credentials are missing, rejected, or lack the agent role
+	apiPermission = "permission"
+	// the project, service or labels of the deployment are refused
+	apiInvalidDeployment = "invalid-deployment"
+	// the profile exceeds the size the API accepts
+	apiTooLarge = "payload-too-large"
+	// the API or the network failed, and may succeed if retried
+	apiTransient = "transient"
+	// anything else, such as errors of the agent's own making
+	apiOther = "other"
+)
+
+var apiErrors = new(expvar.Map).Init()
+
+func init() {
+	for _, class := range []string{apiQuota, apiPermission, apiInvalidDeployment, apiTooLarge, apiTransient, apiOther} {
+		apiErrors.Add(class, 0)
+	}
+	agentStatus.Set("api-errors", apiErrors)
+}
+
+// classifyAPIError returns the class of err, an error returned by a call
+// to the profiler API.
+func classifyAPIError(err error) string {
+	s, ok := status.FromError(err)
+	if !ok {
+		return apiOther
+	}
+	msg := strings.ToLower(s.Message())
+	switch s.Code() {
+	case codes.ResourceExhausted:
+		// also how gRPC refuses messages over its size limit
+		if strings.Contains(msg, "larger than max") || strings.Contains(msg, "too large") {
+			return apiTooLarge
+		}
+		return apiQuota
+	case codes.PermissionDenied, codes.Unauthenticated:
+		return apiPermission
+	case codes.InvalidArgument, codes.NotFound, codes.FailedPrecondition, codes.OutOfRange:
+		if strings.Contains(msg, "too large") || strings.Contains(msg, "exceeds") {
+			return apiTooLarge
+		}
+		return apiInvalidDeployment
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Aborted, codes.Internal, codes.Canceled, codes.Unknown:
+		return apiTransient
+	}
+	return apiOther
+}
+
+// countAPIError counts err, if it is not nil, in the status.
+func countAPIError(err error) {
+	if err != nil {
+		apiErrors.Add(classifyAPIError(err), 1)
+	}
+}
@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	cloudprofiler "google.golang.org/genproto/googleapis/devtools/cloudprofiler/v2"
+)
+
+// An auditRecord describes one uploaded profile. Records are written one
+// per line as JSON.
+type auditRecord struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Project string    `json:"project"`
+	Target  string    `json:"target"`
+	Name    string    `json:"name"`
+	Size    int       `json:"size"`
+	SHA256  string    `json:"sha256"`
+}
+
+// An auditLog is an append-only local record of every profile the
+// agent has uploaded, so that what left the host can be accounted for
+// independently of the profiler API.
+type auditLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{file: file}, nil
+}
+
+// record appends an entry for profile, which must have been uploaded.
+// The record is synced to disk before record returns.
+func (l *auditLog) record(profile *cloudprofiler.Profile) error {
+	if l == nil {
+		return nil
+	}
+	sum := sha256.Sum256(profile.ProfileBytes)
+	rec := auditRecord{
+		Time:   time.Now().UTC(),
+		Type:   profile.ProfileType.String(),
+		Name:   profile.Name,
+		Size:   len(profile.ProfileBytes),
+		SHA256: hex.EncodeToString(sum[:]),
+	}
+	if d := profile.Deployment; d != nil {
+		rec.Project = d.ProjectId
+		rec.Target = d.Target
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.file.Write(line); err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
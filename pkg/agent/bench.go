@@ -0,0 +1,278 @@
+package agent
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	cloudprofiler "google.golang.org/genproto/googleapis/devtools/cloudprofiler/v2"
+)
+
+// In bench mode the agent measures its own overhead on the local host, to
+// help choose a sampling frequency and profile duration before enabling
+// it across a fleet. Nothing is uploaded.
+//
+// The latency perf adds is measured on a probe standing in for a
+// latency-sensitive service: every benchProbeInterval, it wakes up and
+// does a fixed amount of work, and its latency is the time from when it
+// should have woken to when the work is done. The probe runs during the
+// idle baseline too, so that its own cost is not counted as perf's.
+const benchCommand = "bench"
+
+const (
+	benchProbeInterval = time.Millisecond
+	// bytes hashed by the probe each time it wakes
+	benchProbeWork = 64 << 10
+)
+
+// A benchResult is the measured cost of one collection.
+type benchResult struct {
+	freq     int
+	duration time.Duration
+	samples  uint64
+	// CPU time used by perf while recording, and by the conversion
+	perfCPU, convertCPU time.Duration
+	// share of the host's CPU time above that of an idle baseline of
+	// the same duration, in percent
+	hostOverhead float64
+	// sizes of perf.data and of the converted profile
+	dataBytes, pprofBytes int64
+	// wall time to convert and symbolize the recording
+	convertTime time.Duration
+	// 99th percentile latency of the probe while perf recorded, and
+	// without perf
+	latency, baseLatency time.Duration
+}
+
+// probeLatency runs the latency probe until stop is closed, and returns
+// the 99th percentile of its latencies.
+func probeLatency(stop <-chan struct{}) time.Duration {
+	buf := make([]byte, benchProbeWork)
+	var latencies []time.Duration
+	for {
+		due := time.Now().Add(benchProbeInterval)
+		select {
+		case <-stop:
+			return percentile(latencies, 0.99)
+		case <-time.After(benchProbeInterval):
+		}
+		sha256.Sum256(buf)
+		latencies = append(latencies, time.Since(due))
+	}
+}
+
+func percentile(d []time.Duration, p float64) time.Duration {
+	if len(d) == 0 {
+		return 0
+	}
+	sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+	return d[int(float64(len(d)-1)*p)]
+}
+
+// withProbe runs f while the latency probe runs, and returns the
+// probe's 99th percentile latency.
+func withProbe(f func() error) (time.Duration, error) {
+	stop := make(chan struct{})
+	result := make(chan time.Duration)
+	go func() { result <- probeLatency(stop) }()
+	err := f()
+	close(stop)
+	return <-result, err
+}
+
+// cpuUsed returns the CPU time used by the agent and its waited-for
+// children, such as perf and pprof.
+func cpuUsed() time.Duration {
+	return rusageCPU(syscall.RUSAGE_SELF) + rusageCPU(syscall.RUSAGE_CHILDREN)
+}
+
+// rusageCPU returns the CPU time used by who, the agent or its
+// waited-for children.
+func rusageCPU(who int) time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(who, &ru); err != nil {
+		return 0
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+// hostBusy returns the busy and total CPU time of the host, in clock
+// ticks, while f runs.
+func hostBusy(f func() error) (busy, total uint64, err error) {
+	idle0, total0, err := cpuTimes()
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := f(); err != nil {
+		return 0, 0, err
+	}
+	idle1, total1, err := cpuTimes()
+	if err != nil {
+		return 0, 0, err
+	}
+	total = total1 - total0
+	return total - (idle1 - idle0), total, nil
+}
+
+func busyPercent(busy, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(busy) / float64(total)
+}
+
+// runBench runs the bench subcommand with its arguments args: flags
+// choosing the frequencies and durations to try, followed by the perf
+// record options to measure them with.
+func runBench(args []string) error {
+	fs := flag.NewFlagSet(benchCommand, flag.ContinueOnError)
+	freqList := fs.String("frequencies", "49,99,499,999", "comma-separated sampling `frequencies` to measure")
+	durList := fs.String("durations", "10s", "comma-separated profile `durations` to measure")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	var freqs []int
+	for _, s := range strings.Split(*freqList, ",") {
+		f, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || f <= 0 {
+			return fmt.Errorf("invalid frequency %q", s)
+		}
+		freqs = append(freqs, f)
+	}
+	var durations []time.Duration
+	for _, s := range strings.Split(*durList, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(s))
+		if err != nil || d < time.Second {
+			return fmt.Errorf("invalid duration %q, must be at least 1s", s)
+		}
+		durations = append(durations, d)
+	}
+	perfArgs := fs.Args()
+	if len(perfArgs) == 0 {
+		perfArgs = []string{"-ag"}
+	}
+	for _, arg := range perfArgs {
+		if arg == "--" {
+			return errors.New("bench stops perf itself after each duration; give only perf record options")
+		}
+	}
+
+	tmpdir, err := ioutil.TempDir("", filepath.Base(os.Args[0]))
+	if err != nil {
+		return fmt.Errorf("failed to create temp directory: %s", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	ctx := context.Background()
+	a := &agent{
+		ctx:     ctx,
+		tmpdir:  tmpdir,
+		convert: newConverterPool(ctx, 1),
+		binaries: binaryFilter{
+			allow: allowBinaries,
+			deny:  denyBinaries,
+		},
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "FREQ\tDURATION\tSAMPLES\tPERF CPU\tCONVERT CPU\tHOST OVERHEAD\tP99 LATENCY\tPERF.DATA\tPPROF\tCONVERT TIME\t")
+	for _, d := range durations {
+		var baseBusy, baseTotal uint64
+		baseLatency, err := withProbe(func() error {
+			var err error
+			baseBusy, baseTotal, err = hostBusy(func() error {
+				time.Sleep(d)
+				return nil
+			})
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("could not measure baseline CPU usage: %s", err)
+		}
+		for _, f := range freqs {
+			r, err := a.benchOne(perfArgs, f, d, busyPercent(baseBusy, baseTotal))
+			if err != nil {
+				return err
+			}
+			r.baseLatency = baseLatency
+			fmt.Fprintf(w, "%d\t%v\t%d\t%v\t%v\t%.2f%%\t%v (%+v)\t%s\t%s\t%v\t\n",
+				r.freq, r.duration, r.samples,
+				r.perfCPU.Round(time.Millisecond), r.convertCPU.Round(time.Millisecond),
+				r.hostOverhead,
+				r.latency.Round(time.Microsecond), (r.latency - r.baseLatency).Round(time.Microsecond),
+				byteSize(r.dataBytes), byteSize(r.pprofBytes),
+				r.convertTime.Round(time.Millisecond))
+		}
+	}
+	return w.Flush()
+}
+
+// benchOne records and converts a profile at freq for duration. baseline
+// is the host's busy percentage without perf running.
+func (a *agent) benchOne(perfArgs []string, freq int, duration time.Duration, baseline float64) (benchResult, error) {
+	r := benchResult{freq: freq, duration: duration}
+	args := setPerfOption(append([]string{"record"}, perfArgs...), "-F", "--freq", strconv.Itoa(freq))
+	dir, err := a.newWorkDir(cloudprofiler.ProfileType_CPU)
+	if err != nil {
+		return r, err
+	}
+	defer os.RemoveAll(dir)
+	data, converted := filepath.Join(dir, "perf.data"), filepath.Join(dir, "perf.pprof")
+
+	var stderr string
+	var busy, total uint64
+	// perf's alone, as the probe runs in the agent
+	cpu0 := rusageCPU(syscall.RUSAGE_CHILDREN)
+	latency, err := withProbe(func() error {
+		var err error
+		busy, total, err = hostBusy(func() error {
+			var err error
+			stderr, err = runPerfCommand(dir, exec.Command("perf", args...), duration, nil)
+			return err
+		})
+		return err
+	})
+	if err != nil {
+		return r, err
+	}
+	r.latency = latency
+	r.perfCPU = rusageCPU(syscall.RUSAGE_CHILDREN) - cpu0
+	r.hostOverhead = busyPercent(busy, total) - baseline
+	r.samples = parsePerfStats(stderr).samples
+	if info, err := os.Stat(data); err == nil {
+		r.dataBytes = info.Size()
+	}
+
+	cpu0 = cpuUsed()
+	start := time.Now()
+	if _, _, err := a.convertFile(converted, data, new(cycleStats)); err != nil {
+		return r, fmt.Errorf("could not convert profile at %d Hz: %s", freq, err)
+	}
+	r.convertTime = time.Since(start)
+	r.convertCPU = cpuUsed() - cpu0
+	if info, err := os.Stat(converted); err == nil {
+		r.pprofBytes = info.Size()
+	}
+	return r, nil
+}
+
+func byteSize(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
@@ -0,0 +1,106 @@
+package agent
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+
+	pprof "github.com/google/pprof/profile"
+)
+
+// A binaryFilter decides which binaries may be symbolized and appear in
+// uploaded profiles. Some hosts run third-party software whose symbols
+// or presence must not leave the machine.
+//
+// Patterns are shell globs. A pattern containing a slash is matched
+// against the binary's full path, otherwise against its base name. A
+// pattern ending in a slash matches everything beneath that directory.
+type binaryFilter struct {
+	// If not empty, only binaries matching one of these patterns are
+	// kept.
+	allow []string
+	// Binaries matching any of these patterns are removed.
+	deny []string
+}
+
+func (f binaryFilter) empty() bool {
+	return len(f.allow) == 0 && len(f.deny) == 0
+}
+
+// excluded reports whether the binary at path should be left out of
+// symbolization and uploads.
+func (f binaryFilter) excluded(path string) bool {
+	for _, pattern := range f.deny {
+		if matchBinary(pattern, path) {
+			return true
+		}
+	}
+	if len(f.allow) == 0 {
+		return false
+	}
+	for _, pattern := range f.allow {
+		if matchBinary(pattern, path) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchBinary(pattern, path string) bool {
+	if strings.HasSuffix(pattern, "/") {
+		return strings.HasPrefix(path, pattern)
+	}
+	if !strings.Contains(pattern, "/") {
+		path = filepath.Base(path)
+	}
+	ok, _ := filepath.Match(pattern, path)
+	return ok
+}
+
+// strip removes every sample with a frame in an excluded binary, so
+// that neither the binary's symbols nor its share of the profile are
+// uploaded. The returned profile no longer refers to excluded mappings.
+func (f binaryFilter) strip(p *pprof.Profile) *pprof.Profile {
+	if f.empty() {
+		return p
+	}
+	excluded := make(map[*pprof.Mapping]bool)
+	for _, m := range p.Mapping {
+		if f.excluded(m.File) {
+			excluded[m] = true
+		}
+	}
+	if len(excluded) == 0 {
+		return p
+	}
+
+	var dropped int
+	samples := p.Sample[:0]
+	for _, s := range p.Sample {
+		if sampleInMappings(s, excluded) {
+			dropped++
+			continue
+		}
+		samples = append(samples, s)
+	}
+	p.Sample = samples
+	if dropped == 0 {
+		return p
+	}
+	log.Printf("removed %d samples in %d excluded binaries", dropped, len(excluded))
+	addComment(p, fmt.Sprintf("removed %d samples in excluded binaries", dropped))
+
+	// Compact drops the mappings, locations and functions that are no
+	// longer referenced by any sample.
+	return p.Compact()
+}
+
+func sampleInMappings(s *pprof.Sample, mappings map[*pprof.Mapping]bool) bool {
+	for _, loc := range s.Location {
+		if loc.Mapping != nil && mappings[loc.Mapping] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,351 @@
+package agent
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// The ebpf collector samples CPUs with perf events of its own, each
+// running a BPF program that counts the kernel and user stacks it
+// interrupts in a map, as parca-agent does; nothing is copied to user
+// space until the recording ends. The program is assembled here rather
+// than compiled from C, so it needs neither clang nor BTF, only a kernel
+// with BPF programs attachable to perf events (4.9 or later).
+
+// The BPF syscall number, the size of the registers that precede
+// sample_period in struct bpf_perf_event_data, and where the registers
+// holding a function's first argument and return value are in them,
+// differ by architecture.
+type bpfArch struct {
+	syscall   uintptr
+	regsSize  int16
+	arg0, ret int16
+}
+
+var bpfArchs = map[string]bpfArch{
+	// di and ax of struct pt_regs
+	"amd64": {syscall: 321, regsSize: 21 * 8, arg0: 14 * 8, ret: 10 * 8},
+	// x0 of struct user_pt_regs
+	"arm64": {syscall: 280, regsSize: 34 * 8, arg0: 0, ret: 0},
+}
+
+// Commands of the bpf syscall.
+const (
+	bpfMapCreate     = 0
+	bpfMapLookupElem = 1
+	bpfMapUpdateElem = 2
+	bpfMapGetNextKey = 4
+	bpfProgLoad      = 5
+)
+
+const (
+	bpfMapTypeHash       = 1
+	bpfMapTypeStackTrace = 7
+	bpfProgTypeKprobe    = 2
+	bpfProgTypePerfEvent = 7
+)
+
+// Helper functions the program calls, and their flags.
+const (
+	bpfFuncMapLookupElem     = 1
+	bpfFuncMapUpdateElem     = 2
+	bpfFuncMapDeleteElem     = 3
+	bpfFuncGetCurrentPidTgid = 14
+	bpfFuncGetStackID        = 27
+
+	bpfFUserStack = 1 << 8
+	bpfAny        = 0
+	bpfNoExist    = 1
+)
+
+// The maps the program fills: stack traces of up to the kernel's
+// default maximum depth by ID, and sample counts and periods keyed by
+// pid and stack IDs.
+const (
+	bpfMaxStackDepth  = 127
+	bpfStackEntries   = 8192
+	bpfCountEntries   = 16384
+	bpfCountKeySize   = 12
+	bpfCountValueSize = 16
+)
+
+// The IDs bpf_get_stackid returns for a sample without a stack of that
+// kind, such as the user stack of a kernel thread, and for a stack that
+// collided with another or found the map full.
+const (
+	stackNone = -int32(syscall.EFAULT)
+	stackLost = -int32(syscall.EEXIST)
+)
+
+// perf_event_open(2) constants.
+const (
+	perfTypeSoftware    = 1
+	perfCountSWCPUClock = 0
+	perfAttrSize        = 112
+	perfFlagFDCloexec   = 8
+
+	attrDisabled      = 1 << 0
+	attrExcludeUser   = 1 << 4
+	attrExcludeKernel = 1 << 5
+
+	perfEventIOCEnable  = 0x2400
+	perfEventIOCDisable = 0x2401
+	perfEventIOCSetBPF  = 0x40042408
+)
+
+func bpfPointer(b []byte) uint64 {
+	if len(b) == 0 {
+		return 0
+	}
+	return uint64(uintptr(unsafe.Pointer(&b[0])))
+}
+
+// A bpfMap is a BPF map with keys and values of fixed sizes.
+type bpfMap struct {
+	fd               int
+	keySize, valSize int
+}
+
+func newBPFMap(typ, keySize, valSize, entries uint32) (*bpfMap, error) {
+	attr := make([]byte, 20)
+	binary.LittleEndian.PutUint32(attr[0:], typ)
+	binary.LittleEndian.PutUint32(attr[4:], keySize)
+	binary.LittleEndian.PutUint32(attr[8:], valSize)
+	binary.LittleEndian.PutUint32(attr[12:], entries)
+	fd, err := bpf(bpfMapCreate, attr)
+	if err != nil {
+		return nil, fmt.Errorf("could not create BPF map: %s", err)
+	}
+	return &bpfMap{fd: fd, keySize: int(keySize), valSize: int(valSize)}, nil
+}
+
+func (m *bpfMap) elemAttr(key, value []byte) []byte {
+	attr := make([]byte, 32)
+	binary.LittleEndian.PutUint32(attr[0:], uint32(m.fd))
+	binary.LittleEndian.PutUint64(attr[8:], bpfPointer(key))
+	binary.LittleEndian.PutUint64(attr[16:], bpfPointer(value))
+	return attr
+}
+
+func (m *bpfMap) lookup(key []byte) ([]byte, error) {
+	value := make([]byte, m.valSize)
+	_, err := bpf(bpfMapLookupElem, m.elemAttr(key, value))
+	runtime.KeepAlive(key)
+	return value, err
+}
+
+func (m *bpfMap) update(key, value []byte) error {
+	_, err := bpf(bpfMapUpdateElem, m.elemAttr(key, value))
+	runtime.KeepAlive(key)
+	runtime.KeepAlive(value)
+	return err
+}
+
+// each calls fn with every key in m.
+func (m *bpfMap) each(fn func(key []byte)) error {
+	var key []byte
+	for {
+		next := make([]byte, m.keySize)
+		_, err := bpf(bpfMapGetNextKey, m.elemAttr(key, next))
+		runtime.KeepAlive(key)
+		runtime.KeepAlive(next)
+		if err == syscall.ENOENT {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		fn(next)
+		key = next
+	}
+}
+
+func (m *bpfMap) close() { syscall.Close(m.fd) }
+
+// A bpfInsn is one instruction of a BPF program.
+type bpfInsn struct {
+	code     uint8
+	dst, src uint8
+	off      int16
+	imm      int32
+}
+
+// Registers, and instruction classes and operations.
+const (
+	r0, r1, r2, r3, r4, r6, r7, r8, r10 = 0, 1, 2, 3, 4, 6, 7, 8, 10
+
+	bpfLdImm64   = 0x18
+	bpfLdxMemDW  = 0x79
+	bpfStMemW    = 0x62
+	bpfStMemDW   = 0x7a
+	bpfStxMemW   = 0x63
+	bpfStxMemDW  = 0x7b
+	bpfStxXaddDW = 0xdb
+	bpfAdd64Imm  = 0x07
+	bpfRsh64Imm  = 0x77
+	bpfMov64Imm  = 0xb7
+	bpfMov64Reg  = 0xbf
+	bpfJeqImm    = 0x15
+	bpfCall      = 0x85
+	bpfExit      = 0x95
+
+	// the immediate of a bpfLdImm64 is a map fd
+	bpfPseudoMapFD = 1
+)
+
+// ldMapFD loads the map fd into dst; it takes two instructions.
+func ldMapFD(dst uint8, fd int) []bpfInsn {
+	return []bpfInsn{{code: bpfLdImm64, dst: dst, src: bpfPseudoMapFD, imm: int32(fd)}, {}}
+}
+
+// bpfStackCounter assembles the program run on every sample. It counts
+// the sample, and adds its period, under the key {pid, user stack id,
+// kernel stack id} of counts, storing the stacks in stacks:
+//
+//	key.pid = bpf_get_current_pid_tgid() >> 32;
+//	key.user = bpf_get_stackid(ctx, stacks, BPF_F_USER_STACK);
+//	key.kernel = bpf_get_stackid(ctx, stacks, 0);
+//	if ((v = bpf_map_lookup_elem(counts, &key))) {
+//		__sync_fetch_and_add(&v->count, 1);
+//		__sync_fetch_and_add(&v->period, ctx->sample_period);
+//	} else {
+//		struct value init = {1, ctx->sample_period};
+//		bpf_map_update_elem(counts, &key, &init, BPF_NOEXIST);
+//	}
+//	return 0;
+func bpfStackCounter(stacks, counts *bpfMap, regsSize int16) []bpfInsn {
+	var p []bpfInsn
+	add := func(insns ...bpfInsn) { p = append(p, insns...) }
+	add(bpfInsn{code: bpfMov64Reg, dst: r6, src: r1})
+	add(bpfInsn{code: bpfLdxMemDW, dst: r7, src: r6, off: regsSize})
+	add(bpfInsn{code: bpfCall, imm: bpfFuncGetCurrentPidTgid})
+	add(bpfInsn{code: bpfRsh64Imm, dst: r0, imm: 32})
+	add(bpfInsn{code: bpfStxMemW, dst: r10, src: r0, off: -16})
+	for i, flags := range []int32{bpfFUserStack, 0} {
+		add(ldMapFD(r2, stacks.fd)...)
+		add(bpfInsn{code: bpfMov64Reg, dst: r1, src: r6})
+		add(bpfInsn{code: bpfMov64Imm, dst: r3, imm: flags})
+		add(bpfInsn{code: bpfCall, imm: bpfFuncGetStackID})
+		add(bpfInsn{code: bpfStxMemW, dst: r10, src: r0, off: int16(-12 + 4*i)})
+	}
+	add(ldMapFD(r1, counts.fd)...)
+	add(bpfInsn{code: bpfMov64Reg, dst: r2, src: r10})
+	add(bpfInsn{code: bpfAdd64Imm, dst: r2, imm: -16})
+	add(bpfInsn{code: bpfCall, imm: bpfFuncMapLookupElem})
+	add(bpfInsn{code: bpfJeqImm, dst: r0, off: 5})
+	add(bpfInsn{code: bpfMov64Imm, dst: r1, imm: 1})
+	add(bpfInsn{code: bpfStxXaddDW, dst: r0, src: r1})
+	add(bpfInsn{code: bpfStxXaddDW, dst: r0, src: r7, off: 8})
+	add(bpfInsn{code: bpfMov64Imm, dst: r0})
+	add(bpfInsn{code: bpfExit})
+	add(bpfInsn{code: bpfStMemDW, dst: r10, off: -32, imm: 1})
+	add(bpfInsn{code: bpfStxMemDW, dst: r10, src: r7, off: -24})
+	add(ldMapFD(r1, counts.fd)...)
+	add(bpfInsn{code: bpfMov64Reg, dst: r2, src: r10})
+	add(bpfInsn{code: bpfAdd64Imm, dst: r2, imm: -16})
+	add(bpfInsn{code: bpfMov64Reg, dst: r3, src: r10})
+	add(bpfInsn{code: bpfAdd64Imm, dst: r3, imm: -32})
+	add(bpfInsn{code: bpfMov64Imm, dst: r4, imm: bpfNoExist})
+	add(bpfInsn{code: bpfCall, imm: bpfFuncMapUpdateElem})
+	add(bpfInsn{code: bpfMov64Imm, dst: r0})
+	add(bpfInsn{code: bpfExit})
+	return p
+}
+
+// loadBPFProgram loads insns as a program of type progType, returning
+// the verifier's complaints if it is rejected.
+func loadBPFProgram(progType uint32, insns []bpfInsn) (int, error) {
+	code := make([]byte, 8*len(insns))
+	for i, in := range insns {
+		b := code[8*i:]
+		b[0] = in.code
+		b[1] = in.src<<4 | in.dst
+		binary.LittleEndian.PutUint16(b[2:], uint16(in.off))
+		binary.LittleEndian.PutUint32(b[4:], uint32(in.imm))
+	}
+	// bpf_get_stackid is only available to GPL-compatible programs
+	license := []byte("GPL\x00")
+	verifierLog := make([]byte, 1<<16)
+	attr := make([]byte, 48)
+	binary.LittleEndian.PutUint32(attr[0:], progType)
+	binary.LittleEndian.PutUint32(attr[4:], uint32(len(insns)))
+	binary.LittleEndian.PutUint64(attr[8:], bpfPointer(code))
+	binary.LittleEndian.PutUint64(attr[16:], bpfPointer(license))
+	binary.LittleEndian.PutUint32(attr[24:], 1)
+	binary.LittleEndian.PutUint32(attr[28:], uint32(len(verifierLog)))
+	binary.LittleEndian.PutUint64(attr[32:], bpfPointer(verifierLog))
+	// kernels before 5.0 only load kprobe programs built for them
+	binary.LittleEndian.PutUint32(attr[40:], linuxVersionCode())
+	fd, err := bpf(bpfProgLoad, attr)
+	runtime.KeepAlive(code)
+	runtime.KeepAlive(license)
+	runtime.KeepAlive(verifierLog)
+	if err != nil {
+		if msg := strings.TrimSpace(cString(verifierLog)); msg != "" {
+			return -1, fmt.Errorf("could not load BPF program: %s; %s", err, msg)
+		}
+		return -1, fmt.Errorf("could not load BPF program: %s", err)
+	}
+	return fd, nil
+}
+
+// linuxVersionCode returns the running kernel's version as the
+// LINUX_VERSION_CODE it was built with, or 0 if it cannot be read.
+func linuxVersionCode() uint32 {
+	release, err := ioutil.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return 0
+	}
+	m := releaseRegexp.FindStringSubmatch(string(release))
+	if m == nil {
+		return 0
+	}
+	var code uint32
+	for _, s := range m[1:] {
+		n, _ := strconv.Atoi(s)
+		if n > 255 {
+			n = 255
+		}
+		code = code<<8 | uint32(n)
+	}
+	return code
+}
+
+var releaseRegexp = regexp.MustCompile(`^(\d+)\.(\d+)(?:\.(\d+))?`)
+
+// onlineCPUs returns the CPUs that can be sampled.
+func onlineCPUs() ([]int, error) {
+	data, err := ioutil.ReadFile("/sys/devices/system/cpu/online")
+	if err != nil {
+		return nil, err
+	}
+	var cpus []int
+	// a list of ranges, such as 0-3,5
+	for _, r := range strings.Split(strings.TrimSpace(string(data)), ",") {
+		bounds := strings.SplitN(r, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("malformed CPU list %q", data)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, fmt.Errorf("malformed CPU list %q", data)
+			}
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	if len(cpus) == 0 {
+		return nil, errors.New("no CPUs are online")
+	}
+	return cpus, nil
+}
@@ -0,0 +1,90 @@
+package agent
+
+import (
+	"encoding/binary"
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"github.com/droyo/cloud-profiler-perf/pkg/perf"
+)
+
+// The system calls of the BPF collectors, bpf(2) and perf_event_open(2),
+// are Linux's. Elsewhere, the stubs in bpf_other.go fail them, and the
+// ebpf collector and HEAP profiles are reported unsupported at startup.
+
+func bpf(cmd int, attr []byte) (int, error) {
+	arch, ok := bpfArchs[runtime.GOARCH]
+	if !ok {
+		return -1, fmt.Errorf("BPF is not supported on %s", runtime.GOARCH)
+	}
+	r, _, errno := syscall.Syscall(arch.syscall, uintptr(cmd), uintptr(unsafe.Pointer(&attr[0])), uintptr(len(attr)))
+	runtime.KeepAlive(attr)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(r), nil
+}
+
+// Before 5.11, the kernel charges BPF maps to RLIMIT_MEMLOCK, which is
+// too low for the stack map by default.
+func raiseMemlockLimit() {
+	const rlimitMemlock = 8
+	unlimited := syscall.Rlimit{Cur: ^uint64(0), Max: ^uint64(0)}
+	syscall.Setrlimit(rlimitMemlock, &unlimited)
+}
+
+// openCPUClock opens a disabled cpu-clock event sampling cpu at freq Hz,
+// in the code mode allows.
+func openCPUClock(cpu, freq int, mode execMode) (int, error) {
+	attr := make([]byte, perfAttrSize)
+	binary.LittleEndian.PutUint32(attr[0:], perfTypeSoftware)
+	binary.LittleEndian.PutUint32(attr[4:], uint32(len(attr)))
+	binary.LittleEndian.PutUint64(attr[8:], perfCountSWCPUClock)
+	binary.LittleEndian.PutUint64(attr[16:], uint64(freq))
+	flags := uint64(attrDisabled | perf.AttrFreq)
+	switch mode {
+	case modeUser:
+		flags |= attrExcludeKernel
+	case modeKernel:
+		flags |= attrExcludeUser
+	}
+	binary.LittleEndian.PutUint64(attr[40:], flags)
+	fd, _, errno := syscall.Syscall6(syscall.SYS_PERF_EVENT_OPEN, uintptr(unsafe.Pointer(&attr[0])),
+		^uintptr(0), uintptr(cpu), ^uintptr(0), perfFlagFDCloexec, 0)
+	runtime.KeepAlive(attr)
+	if errno != 0 {
+		return -1, fmt.Errorf("perf_event_open on CPU %d: %s", cpu, errno)
+	}
+	return int(fd), nil
+}
+
+// openUprobe opens a disabled uprobe on cpu at offset into the file at
+// path, a return probe if config says so.
+func openUprobe(pmu uint32, config uint64, path string, offset uint64, cpu int) (int, error) {
+	name := append([]byte(path), 0)
+	attr := make([]byte, perfAttrSize)
+	binary.LittleEndian.PutUint32(attr[0:], pmu)
+	binary.LittleEndian.PutUint32(attr[4:], uint32(len(attr)))
+	binary.LittleEndian.PutUint64(attr[8:], config)
+	binary.LittleEndian.PutUint64(attr[16:], 1)
+	binary.LittleEndian.PutUint64(attr[40:], attrDisabled)
+	binary.LittleEndian.PutUint64(attr[56:], bpfPointer(name))
+	binary.LittleEndian.PutUint64(attr[64:], offset)
+	fd, _, errno := syscall.Syscall6(syscall.SYS_PERF_EVENT_OPEN, uintptr(unsafe.Pointer(&attr[0])),
+		^uintptr(0), uintptr(cpu), ^uintptr(0), perfFlagFDCloexec, 0)
+	runtime.KeepAlive(attr)
+	runtime.KeepAlive(name)
+	if errno != 0 {
+		return -1, fmt.Errorf("could not probe %s at %#x on CPU %d: %s", path, offset, cpu, errno)
+	}
+	return int(fd), nil
+}
+
+func ioctl(fd int, req, arg uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, arg); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package agent
+
+import (
+	"errors"
+	"runtime"
+)
+
+var errNoBPF = errors.New("BPF is not supported on " + runtime.GOOS)
+
+func bpf(cmd int, attr []byte) (int, error) { return -1, errNoBPF }
+
+func raiseMemlockLimit() {}
+
+func openCPUClock(cpu, freq int, mode execMode) (int, error) { return -1, errNoBPF }
+
+func openUprobe(pmu uint32, config uint64, path string, offset uint64, cpu int) (int, error) {
+	return -1, errNoBPF
+}
+
+func ioctl(fd int, req, arg uintptr) error { return errNoBPF }
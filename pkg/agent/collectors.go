@@ -0,0 +1,225 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+
+	cloudprofiler "google.golang.org/genproto/googleapis/devtools/cloudprofiler/v2"
+
+	"github.com/droyo/cloud-profiler-perf/pkg/uploader"
+)
+
+// Names of profile types in the -profile-types matrix.
+var profileTypeNames = map[string]cloudprofiler.ProfileType{
+	"cpu":        cloudprofiler.ProfileType_CPU,
+	"wall":       cloudprofiler.ProfileType_WALL,
+	"heap":       cloudprofiler.ProfileType_HEAP,
+	"threads":    cloudprofiler.ProfileType_THREADS,
+	"contention": cloudprofiler.ProfileType_CONTENTION,
+	"peak-heap":  cloudprofiler.ProfileType_PEAK_HEAP,
+	"heap-alloc": cloudprofiler.ProfileType_HEAP_ALLOC,
+}
+
+// parseProfileTypes parses a matrix such as "cpu=on,wall=off" into the
+// set of enabled profile types. Types not named keep their default:
+// only cpu is enabled.
+func parseProfileTypes(s string) (map[cloudprofiler.ProfileType]bool, error) {
+	enabled := map[cloudprofiler.ProfileType]bool{
+		cloudprofiler.ProfileType_CPU: true,
+	}
+	for _, field := range strings.Split(s, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			kv = strings.SplitN(field, ":", 2)
+		}
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("profile type %q must be given as type=on or type=off", field)
+		}
+		name, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		t, ok := profileTypeNames[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown profile type %q", name)
+		}
+		switch value {
+		case "on", "true":
+			enabled[t] = true
+		case "off", "false":
+			delete(enabled, t)
+		default:
+			return nil, fmt.Errorf("profile type %s must be on or off, not %q", name, value)
+		}
+	}
+	if len(enabled) == 0 {
+		return nil, fmt.Errorf("no profile types are enabled")
+	}
+	return enabled, nil
+}
+
+// A collectorBackend makes the collectors of -collector, and keeps what
+// they record with in order between profiles.
+type collectorBackend struct {
+	// newCollector returns the collector of a for profile type t on a
+	// host with caps, or an error if it cannot collect t.
+	newCollector func(a *agent, t cloudprofiler.ProfileType, caps capabilities) (uploader.Collector, error)
+	// beforeCycle, if set, is called before each profile is asked
+	// for, and may wait until one can be recorded.
+	beforeCycle func(a *agent)
+	// afterCycle, if set, is called after each profile is uploaded.
+	afterCycle func(a *agent)
+}
+
+// The backends of -collector. What is specific to the operating system
+// and tools a profile is recorded with stays behind these; the agent's
+// loop, and the conversion and upload of the recordings, are shared, so
+// a backend for another system, such as one running dtrace, is added by
+// registering it here.
+var collectorBackends = map[string]collectorBackend{
+	collectorPerf: {
+		newCollector: newPerfCollector,
+		beforeCycle:  (*agent).waitForSpace,
+		afterCycle:   (*agent).checkLeak,
+	},
+	collectorEBPF: {
+		newCollector: newEBPFCollector,
+		beforeCycle:  (*agent).waitForSpace,
+	},
+}
+
+// beforeCycle calls the beforeCycle hook of a's backend, if it has one.
+func (a *agent) beforeCycle() {
+	if f := a.backend.beforeCycle; f != nil {
+		f(a)
+	}
+}
+
+// afterCycle calls the afterCycle hook of a's backend, if it has one.
+func (a *agent) afterCycle() {
+	if f := a.backend.afterCycle; f != nil {
+		f(a)
+	}
+}
+
+// newCollectors returns the collectors of a for each enabled profile
+// type, made by the named backend unless -config gives the type a pprof
+// URL, and makes the backend a's. It returns an error if a type is enabled that the backend cannot
+// collect, or that this host cannot.
+//
+// Every profile goes through the uploader.Collector interface, so other
+// backends, such as scrapes of pprof endpoints, can be added without
+// changing the upload loop.
+func newCollectors(a *agent, backend string, enabled map[cloudprofiler.ProfileType]bool, caps capabilities) (map[cloudprofiler.ProfileType]uploader.Collector, error) {
+	b, ok := collectorBackends[backend]
+	if !ok {
+		return nil, fmt.Errorf("unknown -collector %q", backend)
+	}
+	a.backend = b
+	collectors := make(map[cloudprofiler.ProfileType]uploader.Collector, len(enabled))
+	for t := range enabled {
+		var c uploader.Collector
+		var err error
+		if target := conf.profiles[t].pprof; target != "" {
+			c, err = newPprofCollector(a, t, target)
+		} else {
+			c, err = b.newCollector(a, t, caps)
+		}
+		if err != nil {
+			return nil, err
+		}
+		collectors[t] = c
+	}
+	return collectors, nil
+}
+
+// newPerfCollector returns the collector running perf record for
+// profile type t: the CPU command of a, or one derived from it unless
+// -config gives the type one of its own. HEAP profiles, which perf
+// cannot record, are traced with uprobes instead; see heap.go.
+func newPerfCollector(a *agent, t cloudprofiler.ProfileType, caps capabilities) (uploader.Collector, error) {
+	if t == cloudprofiler.ProfileType_HEAP {
+		return newHeapCollector(a)
+	}
+	cpu := a.perf
+	base, own := a.typePerf[t]
+	if !own {
+		base = cpu
+	}
+	args := base.Args[2:]
+	switch t {
+	case cloudprofiler.ProfileType_CPU:
+		return &perfCollector{agent: a, cmd: cpu}, nil
+	case cloudprofiler.ProfileType_WALL:
+		// off-CPU samples, weighted by the time threads spend
+		// blocked, alongside the on-CPU ones
+		if !caps.has("off-cpu") {
+			if !schedSwitchTraceable() {
+				return nil, fmt.Errorf("WALL profiles need off-CPU profiling (kernel 5.19, perf 6.0) or the sched:sched_switch tracepoint, but this host has %s and no tracefs", caps)
+			}
+			// the off-CPU time is traced separately; see
+			// offcpu.go
+			return &perfCollector{agent: a, cmd: base}, nil
+		}
+		if !hasPerfOption(args, "--off-cpu") {
+			args = addPerfOptions(args, "--off-cpu")
+		}
+	case cloudprofiler.ProfileType_HEAP_ALLOC:
+		// page faults, which happen when memory is first
+		// touched, stand in for allocations; such profiles are
+		// labelled, as they are not of allocations
+		if !own {
+			args = replacePerfEvents(args, "page-faults")
+		}
+	case cloudprofiler.ProfileType_CONTENTION:
+		// waits on futexes; see contention.go
+		if !futexTraceable() {
+			return nil, errors.New("CONTENTION profiles need the syscalls:sys_enter_futex tracepoint, but this host has no tracefs or syscall tracepoints")
+		}
+		if !own {
+			args = contentionArgs(args)
+		}
+	default:
+		return nil, fmt.Errorf("profile type %s cannot be collected by this agent", t)
+	}
+	cmd := new(exec.Cmd)
+	*cmd = *base
+	cmd.Args = append(base.Args[:2:2], args...)
+	return &perfCollector{agent: a, cmd: cmd}, nil
+}
+
+// recordsPageFaults reports whether perf record arguments args record
+// page faults.
+func recordsPageFaults(args []string) bool {
+	for _, e := range perfEvents(args) {
+		switch strings.TrimSuffix(e, eventModifier(e)) {
+		case "page-faults", "faults":
+			return true
+		}
+	}
+	return false
+}
+
+// perfCommands returns the perf commands of a: the CPU command, and
+// those -config gives other profile types.
+func (a *agent) perfCommands() []*exec.Cmd {
+	cmds := []*exec.Cmd{a.perf}
+	for _, cmd := range a.typePerf {
+		cmds = append(cmds, cmd)
+	}
+	return cmds
+}
+
+// profileTypes returns the types a has collectors for, in a stable
+// order.
+func (a *agent) profileTypes() []cloudprofiler.ProfileType {
+	types := make([]cloudprofiler.ProfileType, 0, len(a.collectors))
+	for t := range a.collectors {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
@@ -0,0 +1,135 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	cloudprofiler "google.golang.org/genproto/googleapis/devtools/cloudprofiler/v2"
+
+	pprof "github.com/google/pprof/profile"
+)
+
+// Some organizations' analysis tooling relies on provenance the agent's
+// own comments do not carry, such as a build or release ID. With
+// -comment-template, every profile the agent uploads also carries the
+// output of a Go text/template, one comment per non-blank line. The
+// template is executed with a commentData, and may read environment
+// variables with env, as in {{env "RELEASE_ID"}}. It is tried at startup,
+// so that a template naming a field that does not exist stops the agent
+// rather than every upload; one that fails later is logged, and the
+// profile uploaded without its comments.
+
+// What a comment template is executed with.
+type commentData struct {
+	Hostname string
+	// the agent's instance ID, and its version
+	Instance     string
+	AgentVersion string
+	Project      string
+	Service      string
+	// the version label of the deployment, if any
+	Version string
+	// the profile type, such as CPU
+	Type string
+	// the version named by the last deploy announced with -deploy-flag,
+	// if any
+	DeployVersion string
+	// what started the profile: api, for a profile the API asked for,
+	// push, or run
+	Trigger string
+	// the labels of the profile
+	Labels map[string]string
+	Time   time.Time
+}
+
+// A commentTemplate renders the -comment-template.
+type commentTemplate struct {
+	tmpl *template.Template
+	// the fields every profile's data is filled in with
+	base commentData
+}
+
+// loadCommentTemplate parses the template in the file at path, and tries
+// it with sample data.
+func loadCommentTemplate(path, instance string) (*commentTemplate, error) {
+	text, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("-comment-template: %s", err)
+	}
+	tmpl, err := template.New(path).Funcs(template.FuncMap{"env": os.Getenv}).Parse(string(text))
+	if err != nil {
+		return nil, fmt.Errorf("-comment-template: %s", err)
+	}
+	c := &commentTemplate{tmpl: tmpl}
+	c.base.Hostname, _ = os.Hostname()
+	c.base.Instance = instance
+	c.base.AgentVersion = agentVersion
+	sample := c.base
+	sample.Type = cloudprofiler.ProfileType_CPU.String()
+	sample.Trigger = "api"
+	sample.Time = time.Now()
+	if _, err := c.render(sample); err != nil {
+		return nil, fmt.Errorf("-comment-template: %s", err)
+	}
+	return c, nil
+}
+
+// render returns the comments the template produces for data.
+func (c *commentTemplate) render(data commentData) ([]string, error) {
+	var buf bytes.Buffer
+	if err := c.tmpl.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	var comments []string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			comments = append(comments, line)
+		}
+	}
+	return comments, nil
+}
+
+// profileTrigger returns what started the collection of profile.
+func (a *agent) profileTrigger(profile *cloudprofiler.Profile) string {
+	switch {
+	case a.target != nil:
+		return "run"
+	case profile.Name != "":
+		// only the API names profiles before they are uploaded
+		return "api"
+	}
+	return "push"
+}
+
+// addTemplateComments adds the comments of the -comment-template, if
+// there is one, for profile to p, its converted profile.
+func (a *agent) addTemplateComments(profile *cloudprofiler.Profile, p *pprof.Profile) {
+	c := a.comments
+	if c == nil {
+		return
+	}
+	data := c.base
+	data.Project = a.project
+	data.Service = a.service
+	data.Version = a.labels["version"]
+	data.Type = profile.ProfileType.String()
+	if a.deploy != nil {
+		data.DeployVersion = a.deploy.version
+	}
+	data.Trigger = a.profileTrigger(profile)
+	data.Labels = profile.Labels
+	data.Time = time.Now()
+	comments, err := c.render(data)
+	if err != nil {
+		logWarnf("failed to execute -comment-template: %s", err)
+		return
+	}
+	for _, comment := range comments {
+		addComment(p, comment)
+	}
+}
@@ -0,0 +1,614 @@
+package agent
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	cloudprofiler "google.golang.org/genproto/googleapis/devtools/cloudprofiler/v2"
+)
+
+// A -config file holds what would otherwise take a long command line,
+// and what flags cannot say: labels, and a perf command or pprof URL,
+// duration and frequency for each profile type. Its top-level keys are
+// the names of flags, apart from a few sections:
+//
+//	service: checkout
+//	project: my-project
+//	labels:
+//	  team: payments
+//	profiles:
+//	  cpu:
+//	    perf: -ag -F 99
+//	    duration: 10s
+//	  wall:
+//	    perf: [-g, -F, "49", -e, cpu-clock]
+//	    duration: 30s
+//	upload:
+//	  api: cloudprofiler.googleapis.com:443
+//	  spool: /var/spool/profiler
+//	jobs:
+//	  - name: web
+//	    service: web
+//	    cgroup: system.slice/web.service
+//	  - name: db
+//	    service: db
+//	    cgroup: system.slice/postgresql.service
+//
+// Flags given on the command line take precedence over the file, and the
+// settings of a job over those of the file. Each job is profiled by an
+// agent process of its own, run with -job, so that jobs cannot get in
+// each other's way.
+
+// A config is a -config file.
+type config struct {
+	settings
+	jobs []jobConfig
+}
+
+type jobConfig struct {
+	name string
+	settings
+}
+
+// settings are what the file or one of its jobs sets.
+type settings struct {
+	flags    []configFlag
+	labels   map[string]string
+	profiles map[cloudprofiler.ProfileType]profileConfig
+}
+
+type configFlag struct {
+	name string
+	// more than one for repeatable flags
+	values []string
+	line   int
+}
+
+// A profileConfig is how a profile type is collected.
+type profileConfig struct {
+	// "on" or "off", if set
+	enabled string
+	// arguments to perf record
+	perf  []string
+	limit profileLimit
+	// the base URL of the net/http/pprof handlers the profiles are
+	// fetched from instead, if set
+	pprof string
+}
+
+// The flags that may be grouped under upload.
+var uploadFlags = map[string]bool{
+	"api":             true,
+	"credentials":     true,
+	"impersonate":     true,
+	"google-apis-vip": true,
+	"late-symbols":    true,
+	"symbolizer":      true,
+	"audit-log":       true,
+	"spool":           true,
+	"spool-order":     true,
+	"spool-max-age":   true,
+	"spool-key":       true,
+	"spool-kms-key":   true,
+	"spool-max-bytes": true,
+}
+
+// Flags that write to a file or directory, which jobs must not share.
+var jobFileFlags = []string{"status-file", "audit-log", "events-file", "spool"}
+
+// The configuration of this agent, or of its job, once loaded; empty
+// without -config.
+var conf settings
+
+// configure loads the -config file, if any, and applies it, or the
+// settings of the -job. It returns the configuration instead if its jobs
+// are to be run.
+func configure() (*config, error) {
+	if *configPath == "" {
+		if *jobName != "" {
+			return nil, errors.New("-job needs -config")
+		}
+		return nil, nil
+	}
+	c, err := loadConfig(*configPath)
+	if err != nil {
+		return nil, err
+	}
+	s := c.settings
+	switch commandLine.Arg(0) {
+	case benchCommand, symbolizeCommand, symbolizeServerCommand, uploadCommand:
+	default:
+		if *jobName != "" {
+			if s, err = c.job(*jobName); err != nil {
+				return nil, err
+			}
+			log.SetPrefix(*jobName + ": ")
+		} else if len(c.jobs) > 0 {
+			return c, nil
+		}
+	}
+	return nil, s.apply()
+}
+
+func loadConfig(path string) (*config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	root, err := parseYAML(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	c := new(config)
+	if root == nil {
+		return c, nil
+	}
+	if root.kind != yamlMapping {
+		return nil, fmt.Errorf("%s: %s", path, root.errorf("expected a mapping of settings"))
+	}
+	if err := c.parse(root); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return c, nil
+}
+
+func (c *config) parse(root *yamlNode) error {
+	for i, key := range root.keys {
+		if key != "jobs" {
+			continue
+		}
+		n := root.items[i]
+		if n.kind != yamlSequence {
+			return n.errorf("jobs must be a sequence")
+		}
+		names := make(map[string]bool)
+		for _, item := range n.items {
+			if item.kind != yamlMapping {
+				return item.errorf("a job must be a mapping of settings")
+			}
+			name := item.get("name")
+			if name == nil || name.kind != yamlScalar || name.value == "" {
+				return item.errorf("a job must have a name")
+			}
+			if names[name.value] {
+				return name.errorf("duplicate job %q", name.value)
+			}
+			names[name.value] = true
+			job := jobConfig{name: name.value}
+			if err := job.parse(item, true); err != nil {
+				return err
+			}
+			c.jobs = append(c.jobs, job)
+		}
+	}
+	return c.settings.parse(root, false)
+}
+
+func (s *settings) parse(n *yamlNode, job bool) error {
+	for i, key := range n.keys {
+		v := n.items[i]
+		switch key {
+		case "name":
+			if !job {
+				return v.errorf("name is a setting of jobs")
+			}
+		case "jobs":
+			if job {
+				return v.errorf("jobs cannot be nested")
+			}
+		case "labels":
+			if err := s.parseLabels(v); err != nil {
+				return err
+			}
+		case "profiles":
+			if err := s.parseProfiles(v); err != nil {
+				return err
+			}
+		case "upload":
+			if v.kind != yamlMapping {
+				return v.errorf("upload must be a mapping of settings")
+			}
+			for j, name := range v.keys {
+				if !uploadFlags[name] {
+					return v.items[j].errorf("%s is not an upload setting", name)
+				}
+				if err := s.parseFlag(name, v.items[j]); err != nil {
+					return err
+				}
+			}
+		default:
+			if err := s.parseFlag(key, v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *settings) parseFlag(name string, v *yamlNode) error {
+	f := commandLine.Lookup(name)
+	switch {
+	case name == "config" || name == "job":
+		return v.errorf("-%s cannot be set in the configuration", name)
+	case f == nil:
+		return v.errorf("unknown setting %q", name)
+	}
+	for _, old := range s.flags {
+		if old.name == name {
+			return v.errorf("-%s is set more than once", name)
+		}
+	}
+	cf := configFlag{name: name, line: v.line}
+	switch v.kind {
+	case yamlScalar:
+		cf.values = []string{v.value}
+	case yamlSequence:
+		if _, ok := f.Value.(*listFlag); !ok {
+			return v.errorf("-%s takes one value", name)
+		}
+		for _, item := range v.items {
+			if item.kind != yamlScalar {
+				return item.errorf("values of -%s must be scalars", name)
+			}
+			cf.values = append(cf.values, item.value)
+		}
+	default:
+		return v.errorf("-%s must be given a value", name)
+	}
+	s.flags = append(s.flags, cf)
+	return nil
+}
+
+func (s *settings) parseLabels(n *yamlNode) error {
+	if n.kind != yamlMapping {
+		return n.errorf("labels must be a mapping of names to values")
+	}
+	s.labels = make(map[string]string, len(n.keys))
+	for i, name := range n.keys {
+		v := n.items[i]
+		switch {
+		case !labelNameRegexp.MatchString(name):
+			return v.errorf("label name %q must be lower case letters, digits and hyphens", name)
+		case v.kind != yamlScalar:
+			return v.errorf("the value of label %s must be a scalar", name)
+		case len(v.value) > maxLabelValue:
+			return v.errorf("the value of label %s is longer than %d bytes", name, maxLabelValue)
+		}
+		s.labels[name] = v.value
+	}
+	return nil
+}
+
+func (s *settings) parseProfiles(n *yamlNode) error {
+	if n.kind != yamlMapping {
+		return n.errorf("profiles must be a mapping of profile types")
+	}
+	s.profiles = make(map[cloudprofiler.ProfileType]profileConfig, len(n.keys))
+	for i, name := range n.keys {
+		v := n.items[i]
+		t, ok := profileTypeNames[name]
+		if !ok {
+			return v.errorf("unknown profile type %q", name)
+		}
+		if v.kind == yamlScalar && v.value == "" {
+			// listed without settings, and so enabled
+			s.profiles[t] = profileConfig{}
+			continue
+		}
+		if v.kind != yamlMapping {
+			return v.errorf("profile type %s must be a mapping of settings", name)
+		}
+		var p profileConfig
+		for j, key := range v.keys {
+			setting := v.items[j]
+			if setting.kind != yamlScalar && key != "perf" {
+				return setting.errorf("%s %s must be a scalar", name, key)
+			}
+			value := setting.value
+			switch key {
+			case "enabled":
+				switch value {
+				case "on", "true", "yes":
+					p.enabled = "on"
+				case "off", "false", "no":
+					p.enabled = "off"
+				default:
+					return setting.errorf("%s enabled must be on or off, not %q", name, value)
+				}
+			case "perf":
+				args, err := perfSettingArgs(setting)
+				if err != nil {
+					return err
+				}
+				if len(args) > 0 && args[0] == "record" {
+					args = args[1:]
+				}
+				p.perf = args
+			case "pprof":
+				if !strings.HasPrefix(value, "http://") && !strings.HasPrefix(value, "https://") {
+					return setting.errorf("%s pprof: %q is not an http or https URL", name, value)
+				}
+				if _, ok := pprofHandlers[t]; !ok {
+					return setting.errorf("%s profiles cannot be fetched from net/http/pprof", name)
+				}
+				p.pprof = value
+			case "duration":
+				d, err := time.ParseDuration(value)
+				if err != nil || d < 0 {
+					return setting.errorf("%s duration: invalid duration %q", name, value)
+				}
+				p.limit.duration, p.limit.hasDuration = d, true
+			case "frequency":
+				var err error
+				if p.limit.freq, err = strconv.Atoi(strings.TrimSuffix(value, "Hz")); err != nil || p.limit.freq <= 0 {
+					return setting.errorf("%s frequency: invalid frequency %q", name, value)
+				}
+			default:
+				return setting.errorf("unknown setting %q of profile type %s", key, name)
+			}
+		}
+		if p.pprof != "" && p.perf != nil {
+			return v.errorf("profile type %s cannot have both a perf command and a pprof URL", name)
+		}
+		if p.limit.freq == 0 && t != cloudprofiler.ProfileType_CPU {
+			// the frequency of the CPU command is what the agent
+			// adjusts; the frequencies of other types are set
+			// relative to it
+			p.limit.freq = perfFrequency(p.perf)
+		}
+		s.profiles[t] = p
+	}
+	return nil
+}
+
+// perfSettingArgs returns the perf arguments of a perf setting, a
+// sequence of arguments or a string of them separated by white space.
+func perfSettingArgs(n *yamlNode) ([]string, error) {
+	switch n.kind {
+	case yamlScalar:
+		return strings.Fields(n.value), nil
+	case yamlSequence:
+		var args []string
+		for _, item := range n.items {
+			if item.kind != yamlScalar {
+				return nil, item.errorf("perf arguments must be scalars")
+			}
+			args = append(args, item.value)
+		}
+		return args, nil
+	}
+	return nil, n.errorf("perf must be a string or sequence of arguments")
+}
+
+// job returns the settings of the job name, those of the file included.
+func (c *config) job(name string) (settings, error) {
+	var job *jobConfig
+	for i := range c.jobs {
+		if c.jobs[i].name == name {
+			job = &c.jobs[i]
+		}
+	}
+	if job == nil {
+		return settings{}, fmt.Errorf("the configuration has no job %q", name)
+	}
+	s := settings{
+		flags:    append([]configFlag(nil), job.flags...),
+		labels:   make(map[string]string),
+		profiles: make(map[cloudprofiler.ProfileType]profileConfig),
+	}
+	for _, f := range c.flags {
+		if !job.hasFlag(f.name) {
+			s.flags = append(s.flags, f)
+		}
+	}
+	for _, labels := range []map[string]string{c.labels, job.labels} {
+		for k, v := range labels {
+			s.labels[k] = v
+		}
+	}
+	for t, p := range c.profiles {
+		s.profiles[t] = p
+	}
+	for t, p := range job.profiles {
+		// field by field
+		merged := s.profiles[t]
+		if p.enabled != "" {
+			merged.enabled = p.enabled
+		}
+		if p.perf != nil {
+			merged.perf, merged.pprof = p.perf, ""
+		}
+		if p.pprof != "" {
+			merged.perf, merged.pprof = nil, p.pprof
+		}
+		if p.limit.hasDuration {
+			merged.limit.duration, merged.limit.hasDuration = p.limit.duration, true
+		}
+		if p.limit.freq > 0 {
+			merged.limit.freq = p.limit.freq
+		}
+		s.profiles[t] = merged
+	}
+	return s, nil
+}
+
+func (s *settings) hasFlag(name string) bool {
+	for _, f := range s.flags {
+		if f.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *settings) flagValue(name string) string {
+	for _, f := range s.flags {
+		if f.name == name {
+			return strings.Join(f.values, ",")
+		}
+	}
+	return ""
+}
+
+// apply sets the flags s sets but the command line does not, and makes
+// s the agent's configuration.
+func (s settings) apply() error {
+	given := make(map[string]bool)
+	commandLine.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	for _, f := range s.flags {
+		if given[f.name] {
+			continue
+		}
+		_, isBool := commandLine.Lookup(f.name).Value.(interface{ IsBoolFlag() bool })
+		for _, v := range f.values {
+			if isBool {
+				switch v {
+				case "on", "yes":
+					v = "true"
+				case "off", "no":
+					v = "false"
+				}
+			}
+			if err := commandLine.Set(f.name, v); err != nil {
+				return fmt.Errorf("-config: line %d: invalid value %q for -%s: %s", f.line, v, f.name, err)
+			}
+		}
+	}
+	if !given["profile-types"] {
+		var types []string
+		for name, t := range profileTypeNames {
+			if p, ok := s.profiles[t]; ok {
+				enabled := p.enabled
+				if enabled == "" {
+					enabled = "on"
+				}
+				types = append(types, name+"="+enabled)
+			}
+		}
+		if len(types) > 0 {
+			*profileTypes += "," + strings.Join(types, ",")
+		}
+	}
+	conf = s
+	return nil
+}
+
+// perf returns the arguments to perf record the configuration gives
+// profile type t, if any.
+func (s settings) perf(t cloudprofiler.ProfileType) []string {
+	return s.profiles[t].perf
+}
+
+// hasPerf reports whether the configuration gives any profile type a
+// perf command.
+func (s settings) hasPerf() bool {
+	for _, p := range s.profiles {
+		if len(p.perf) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// runJobs runs an agent process for each job of c, until one fails or
+// the agent is stopped.
+func runJobs(c *config) error {
+	switch {
+	case commandLine.NArg() > 0:
+		return errors.New("-config with jobs cannot be combined with run or a perf command")
+	case *tuiMode:
+		return errors.New("-config with jobs cannot be combined with -tui")
+	case *readyUpload:
+		return errors.New("-config with jobs cannot be combined with -ready-after-upload")
+	}
+	given := make(map[string]bool)
+	commandLine.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	for _, name := range jobFileFlags {
+		if given[name] {
+			return fmt.Errorf("-config with jobs cannot be combined with -%s, which would be shared by every job", name)
+		}
+		users := make(map[string]string)
+		for _, job := range c.jobs {
+			s, _ := c.job(job.name)
+			path := s.flagValue(name)
+			if path == "" {
+				continue
+			}
+			if other, ok := users[path]; ok {
+				return fmt.Errorf("-config: jobs %s and %s both have %s %s", other, job.name, name, path)
+			}
+			users[path] = job.name
+		}
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	// the jobs report ready through this process
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "NOTIFY_SOCKET=") {
+			env = append(env, kv)
+		}
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	type exit struct {
+		job string
+		err error
+	}
+	exits := make(chan exit, len(c.jobs))
+	var cmds []*exec.Cmd
+	stop := func(s os.Signal) {
+		for _, cmd := range cmds {
+			cmd.Process.Signal(s)
+		}
+	}
+	for _, job := range c.jobs {
+		cmd := exec.Command(exe, append(os.Args[1:], "-job", job.name)...)
+		cmd.Stdout, cmd.Stderr, cmd.Env = os.Stdout, os.Stderr, env
+		if err := cmd.Start(); err != nil {
+			stop(syscall.SIGTERM)
+			return fmt.Errorf("failed to start job %s: %s", job.name, err)
+		}
+		log.Printf("started job %s as process %d", job.name, cmd.Process.Pid)
+		cmds = append(cmds, cmd)
+		go func(name string) {
+			exits <- exit{name, cmd.Wait()}
+		}(job.name)
+	}
+	markReady()
+
+	var failed error
+	for running := len(cmds); running > 0; {
+		select {
+		case s := <-sig:
+			log.Printf("received %s, stopping jobs", s)
+			stop(s)
+		case e := <-exits:
+			running--
+			if e.err == nil {
+				log.Printf("job %s exited", e.job)
+				continue
+			}
+			logErrorf("job %s failed: %s", e.job, e.err)
+			if failed == nil {
+				failed = fmt.Errorf("job %s failed: %s", e.job, e.err)
+				stop(syscall.SIGTERM)
+			}
+		}
+	}
+	return failed
+}
@@ -0,0 +1,153 @@
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Container runtimes place each container in its own cgroup, whose name
+// contains the container ID. The layout depends on the runtime, on
+// whether the cgroupfs or systemd cgroup driver is used, and on the
+// cgroup version:
+//
+//	/docker/<id>                                         docker, cgroupfs
+//	/system.slice/docker-<id>.scope                      docker, systemd
+//	/kubepods/burstable/pod<uid>/<id>                    kubelet, cgroupfs
+//	/kubepods.slice/kubepods-burstable.slice/
+//	    kubepods-burstable-pod<uid>.slice/crio-<id>.scope          CRI-O, systemd
+//	    kubepods-burstable-pod<uid>.slice/cri-containerd-<id>.scope containerd, systemd
+//	/machine.slice/libpod-<id>.scope                     podman
+//
+// The systemd driver escapes the dashes in pod UIDs as underscores.
+var (
+	containerScopeRegexp = regexp.MustCompile(`^(?:docker|crio|cri-containerd|containerd|libpod)-([0-9a-f]{64})\.scope$`)
+	containerDirRegexp   = regexp.MustCompile(`^([0-9a-f]{64})$`)
+	podRegexp            = regexp.MustCompile(`pod([0-9a-f]{8}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{12})`)
+)
+
+// A container identifies the container a process runs in.
+type container struct {
+	id     string
+	podUID string
+	// The container's cgroup, relative to the root of the hierarchy
+	// perf uses for per-cgroup events.
+	cgroup string
+}
+
+func (c container) shortID() string {
+	if len(c.id) > 12 {
+		return c.id[:12]
+	}
+	return c.id
+}
+
+// parseProcCgroup returns the cgroup of a process from the contents of
+// /proc/<pid>/cgroup. perf uses the v1 perf_event controller if it is
+// mounted, and the unified hierarchy otherwise.
+func parseProcCgroup(data string) (string, bool) {
+	var unified string
+	var found bool
+	for _, line := range strings.Split(data, "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if parts[0] == "0" && parts[1] == "" {
+			unified, found = parts[2], true
+			continue
+		}
+		for _, ctrl := range strings.Split(parts[1], ",") {
+			if ctrl == "perf_event" {
+				return parts[2], true
+			}
+		}
+	}
+	return unified, found
+}
+
+// parseContainer extracts the container and pod IDs from a cgroup path.
+// It returns false if the cgroup does not belong to a container.
+func parseContainer(cgroup string) (container, bool) {
+	c := container{cgroup: cgroup}
+	for _, dir := range strings.Split(cgroup, "/") {
+		if strings.Contains(dir, "conmon") {
+			// CRI-O's monitor process, not the container
+			return container{}, false
+		}
+		if m := containerScopeRegexp.FindStringSubmatch(dir); m != nil {
+			c.id = m[1]
+		} else if m := containerDirRegexp.FindStringSubmatch(dir); m != nil {
+			c.id = m[1]
+		}
+		if m := podRegexp.FindStringSubmatch(dir); m != nil {
+			c.podUID = strings.Replace(m[1], "_", "-", -1)
+		}
+	}
+	return c, c.id != ""
+}
+
+// processContainer returns the container pid runs in.
+func processContainer(pid int) (container, bool) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return container{}, false
+	}
+	cgroup, ok := parseProcCgroup(string(data))
+	if !ok {
+		return container{}, false
+	}
+	return parseContainer(cgroup)
+}
+
+// findContainer looks for a running process in the container whose ID
+// starts with prefix, and returns its container.
+func findContainer(prefix string) (container, error) {
+	if len(prefix) < 4 {
+		return container{}, fmt.Errorf("container ID %q is too short", prefix)
+	}
+	paths, _ := filepath.Glob("/proc/[0-9]*/cgroup")
+	var match *container
+	for _, path := range paths {
+		pid, err := strconv.Atoi(filepath.Base(filepath.Dir(path)))
+		if err != nil {
+			continue
+		}
+		c, ok := processContainer(pid)
+		if !ok || !strings.HasPrefix(c.id, prefix) {
+			continue
+		}
+		if match != nil && match.id != c.id {
+			return container{}, fmt.Errorf("container ID %q is ambiguous: %s, %s", prefix, match.shortID(), c.shortID())
+		}
+		match = &c
+	}
+	if match == nil {
+		return container{}, fmt.Errorf("no running process in container %s", prefix)
+	}
+	return *match, nil
+}
+
+// cgroupOptions returns the perf record options that limit a system-wide
+// recording to the cgroup. perf applies -G to the events before it, so
+// an event is added if args do not already name one.
+func cgroupOptions(args []string, cgroup string) []string {
+	var opts []string
+	if !systemWide(args) {
+		opts = append(opts, "-a")
+	}
+	n := len(perfEvents(args))
+	if n == 0 {
+		opts = append(opts, "-e", "cycles")
+		n = 1
+	}
+	// -G takes one cgroup for each event
+	cgroups := make([]string, n)
+	for i := range cgroups {
+		cgroups[i] = cgroup
+	}
+	return append(opts, "-G", strings.Join(cgroups, ","))
+}
@@ -0,0 +1,194 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	pprof "github.com/google/pprof/profile"
+)
+
+// CONTENTION profiles are recorded by tracing the futex system call, on
+// which the locks of pthreads, glibc and most runtimes wait when they
+// are contended, in the processes the CPU command records. Each wait,
+// from a thread's entry into futex with a waiting operation to its
+// return, becomes a sample of the stack it waited in, with the time it
+// waited as its delay; waits still in progress at the end of the
+// recording are counted until then. Condition variables and semaphores
+// wait on futexes too, so threads parked for lack of work show up as
+// well.
+
+// The futex tracepoints, recorded at every occurrence.
+const (
+	futexEnterEvent = "syscalls:sys_enter_futex/period=1/"
+	futexExitEvent  = "syscalls:sys_exit_futex/period=1/"
+)
+
+// Where the kernel exposes the futex entry tracepoint.
+var futexEnterPaths = []string{
+	"/sys/kernel/tracing/events/syscalls/sys_enter_futex",
+	"/sys/kernel/debug/tracing/events/syscalls/sys_enter_futex",
+}
+
+// The futex operations that wait, less the private and clock flags.
+var futexWaitOps = map[uint64]bool{
+	0:  true, // FUTEX_WAIT
+	6:  true, // FUTEX_LOCK_PI
+	9:  true, // FUTEX_WAIT_BITSET
+	11: true, // FUTEX_WAIT_REQUEUE_PI
+	13: true, // FUTEX_LOCK_PI2
+}
+
+const futexCmdMask = 0x7f
+
+// futexTraceable reports whether the futex tracepoints can be recorded
+// on this host.
+func futexTraceable() bool {
+	for _, path := range futexEnterPaths {
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// contentionArgs derives the perf record arguments of CONTENTION
+// profiles from those of the CPU command, recording the same processes.
+func contentionArgs(args []string) []string {
+	args = removePerfEvents(args)
+	opts := []string{"-e", futexEnterEvent, "-e", futexExitEvent}
+	if !callGraphs(args) {
+		opts = append(opts, "-g")
+	}
+	return addPerfOptions(args, opts...)
+}
+
+// futexContention returns the contention profile of the futex trace at
+// path.
+func futexContention(path string) (*pprof.Profile, error) {
+	p := &pprof.Profile{
+		SampleType: []*pprof.ValueType{
+			{Type: "contentions", Unit: "count"},
+			{Type: "delay", Unit: "nanoseconds"},
+		},
+		DefaultSampleType: "delay",
+		PeriodType:        &pprof.ValueType{Type: "contentions", Unit: "count"},
+		Period:            1,
+	}
+	cmd := exec.Command("perf", "script", "-i", path, "--ns", "-F", "tid,time,event,trace,ip,sym,dso")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	waited, waits, span, err := addFutexWaits(p, out)
+	if werr := cmd.Wait(); werr != nil && err == nil {
+		err = fmt.Errorf("perf script failed: %s; %s", werr, bytes.TrimSpace(stderr.Bytes()))
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.DurationNanos = int64(span)
+	p.TimeNanos = time.Now().Add(-span).UnixNano()
+	log.Printf("traced %v waiting on futexes over %d waits", waited, waits)
+	addComment(p, fmt.Sprintf("%v waiting on futexes over %d waits, traced with syscalls:sys_enter_futex", waited.Round(time.Millisecond), waits))
+	return p, nil
+}
+
+var (
+	futexOpRegexp  = regexp.MustCompile(`\bop: (0x[0-9a-f]+)`)
+	futexRetRegexp = regexp.MustCompile(`^syscalls:sys_exit_futex:\s+(0x[0-9a-f]+)`)
+)
+
+// A futexWait is a thread's wait on a futex, awaiting its return.
+type futexWait struct {
+	time  int64
+	stack []*pprof.Location
+}
+
+// addFutexWaits reads the output of perf script for a futex trace,
+// adding to p a sample for every wait. Waits that ended at once, because
+// the futex had changed, are not counted.
+func addFutexWaits(p *pprof.Profile, r io.Reader) (waited time.Duration, waits int, span time.Duration, err error) {
+	b := newProfileBuilder(p)
+	pending := make(map[int]*futexWait)
+	var first, last int64
+	var in *futexWait
+	add := func(tid int, until int64) {
+		w := pending[tid]
+		delete(pending, tid)
+		if w == nil || len(w.stack) == 0 || until <= w.time {
+			return
+		}
+		b.addSample(w.stack, 1, until-w.time)
+		waited += time.Duration(until - w.time)
+		waits++
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := scriptFrameRegexp.FindStringSubmatch(line); m != nil {
+			if in != nil {
+				addr, _ := strconv.ParseUint(m[1], 16, 64)
+				in.stack = append(in.stack, b.location(addr, m[2], m[3]))
+			}
+			continue
+		}
+		m := scriptEventRegexp.FindStringSubmatch(line)
+		if m == nil {
+			in = nil
+			continue
+		}
+		tid, _ := strconv.Atoi(m[1])
+		sec, _ := strconv.ParseInt(m[2], 10, 64)
+		nsec, _ := strconv.ParseInt(m[3], 10, 64)
+		now := sec*int64(time.Second) + nsec
+		if first == 0 {
+			first = now
+		}
+		last = now
+		in = nil
+		switch rest := m[4]; {
+		case strings.HasPrefix(rest, "syscalls:sys_enter_futex:"):
+			op := futexOpRegexp.FindStringSubmatch(rest)
+			if op == nil {
+				continue
+			}
+			if n, err := strconv.ParseUint(op[1], 0, 64); err == nil && futexWaitOps[n&futexCmdMask] {
+				in = &futexWait{time: now}
+				pending[tid] = in
+			}
+		case strings.HasPrefix(rest, "syscalls:sys_exit_futex:"):
+			if ret := futexRetRegexp.FindStringSubmatch(rest); ret != nil {
+				if n, err := strconv.ParseUint(ret[1], 0, 64); err == nil && int64(n) == -int64(syscall.EAGAIN) {
+					// the futex changed before the thread
+					// could sleep
+					delete(pending, tid)
+					continue
+				}
+			}
+			add(tid, now)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return waited, waits, 0, err
+	}
+	for tid := range pending {
+		add(tid, last)
+	}
+	return waited, waits, time.Duration(last - first), nil
+}
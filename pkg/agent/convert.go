@@ -0,0 +1,186 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+
+	pprof "github.com/google/pprof/profile"
+
+	"github.com/droyo/cloud-profiler-perf/pkg/perf"
+)
+
+// A conversion is a request to symbolize and convert a single perf.data
+// file to pprof format.
+type conversion struct {
+	// symbols is empty to leave the profile unsymbolized
+	dst, src, symbols string
+	// symbols is an existing tree, such as a symbol store, rather than
+	// one to build from the host's binaries
+	prebuilt bool
+
+	// where binaries replaced since they were mapped are copied to
+	replaced string
+	// binaries that should not be symbolized
+	filter binaryFilter
+	// symbolizes src in place of this host, if set
+	remote *symbolService
+	// run perf inject --jit on src before symbolizing it
+	jit bool
+
+	// set if src was damaged and only part of it could be converted
+	partial bool
+	// binaries symbolized, and those that could not be
+	linked, failed int
+	// binaries replaced on disk by another build since they were mapped
+	mismatched []string
+
+	// when the job should have been symbolized by, if set, and what
+	// it does if it has not: a -late-conversion policy
+	deadline time.Time
+	late     string
+	// set if the job was converted without symbols to keep to the
+	// schedule
+	hurried bool
+
+	done chan error
+}
+
+// A converterPool runs conversions on a fixed number of worker
+// goroutines. Symbolizing a large perf.data file can consume a full CPU
+// and a lot of memory for several seconds, so when more than one profile
+// is waiting to be converted we queue them rather than running every
+// conversion at once.
+type converterPool struct {
+	jobs chan *conversion
+}
+
+// newConverterPool starts n conversion workers. The workers run until
+// ctx is cancelled.
+func newConverterPool(ctx context.Context, n int) *converterPool {
+	if n < 1 {
+		n = 1
+	}
+	pool := &converterPool{jobs: make(chan *conversion)}
+	for i := 0; i < n; i++ {
+		go pool.work(ctx)
+	}
+	log.Printf("started %d conversion workers", n)
+	return pool
+}
+
+func (pool *converterPool) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-pool.jobs:
+			job.done <- job.run()
+		}
+	}
+}
+
+// convert symbolizes and converts the perf.data file job.src to the
+// pprof file job.dst, using job.symbols as the scratch directory for the
+// symbol lookup tree. It blocks until a worker is available and the
+// conversion is complete, or ctx is cancelled.
+func (pool *converterPool) convert(ctx context.Context, job *conversion) error {
+	job.done = make(chan error, 1)
+	select {
+	case pool.jobs <- job:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-job.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (job *conversion) run() error {
+	salvaged, err := perf.Salvage(job.src, false)
+	if err != nil {
+		logWarnf("could not check %s for damage: %s", job.src, err)
+	}
+	job.partial = salvaged
+	if err := job.hurry(); err != nil {
+		return err
+	}
+	if job.jit && job.symbols != "" {
+		jitted, err := injectJIT(job.src)
+		if err != nil {
+			logWarnf("not symbolizing JIT-compiled code: %s", err)
+		}
+		defer removeJitted(jitted)
+	}
+	if job.remote != nil && job.symbols != "" {
+		if job.linked, job.failed, err = job.remote.symbolize(job.dst, job.src, job.filter); err == nil {
+			return nil
+		}
+		logWarnf("symbolization by %s failed, converting %s here: %s", job.remote.addr, job.src, err)
+	}
+	if job.symbols != "" && !job.prebuilt {
+		if job.linked, job.failed, job.mismatched, err = buildSymbolLookup(job.symbols, job.src, job.replaced, job.filter); err != nil {
+			return err
+		}
+		if err := job.hurry(); err != nil {
+			return err
+		}
+	}
+	err = perf.ToPprof(job.dst, job.src, job.symbols)
+	if err != nil && !job.partial {
+		// The header was intact, but there may be garbage in the
+		// middle of the data section.
+		if ok, serr := perf.Salvage(job.src, true); serr == nil && ok {
+			job.partial = true
+			logWarnf("retrying conversion of salvaged %s after: %s", job.src, err)
+			err = perf.ToPprof(job.dst, job.src, job.symbols)
+		}
+	}
+	return err
+}
+
+// convertFile converts the perf.data file src to the pprof file dst and
+// parses the result, accounting for it in cycle. The returned bool is true
+// if src was damaged and the profile only contains the part of it that
+// could be salvaged.
+func (a *agent) convertFile(dst, src string, cycle *cycleStats) (*pprof.Profile, bool, error) {
+	job := &conversion{
+		dst:      dst,
+		src:      src,
+		symbols:  filepath.Join(filepath.Dir(src), "binaries"),
+		replaced: filepath.Join(a.tmpdir, replacedDir),
+		filter:   a.binaries,
+		remote:   a.remote,
+		jit:      a.jit,
+		deadline: cycle.deadline,
+		late:     a.lateConversion,
+	}
+	if a.late != nil {
+		// symbolized elsewhere
+		job.symbols = ""
+	}
+	err := a.convert.convert(a.ctx, job)
+	cycle.addConversion(job)
+	if err == errBehindSchedule {
+		return nil, false, behindSchedule(src)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	p, err := readPprof(dst)
+	if err != nil {
+		return nil, false, fmt.Errorf("could not parse converted profile: %s", err)
+	}
+	if job.partial {
+		addComment(p, src+" was damaged; this profile contains only its complete records")
+	}
+	if job.hurried {
+		addComment(p, src+" was converted without symbols, as symbolizing it would have delayed the next profile")
+	}
+	return p, job.partial, nil
+}
@@ -0,0 +1,127 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/oauth"
+	"google.golang.org/grpc/status"
+)
+
+// reloadableCredentials are per-RPC credentials that can be loaded again
+// from their source. Service account keys get rotated underneath long
+// running agents, and a cached token source will keep failing with the
+// old key until it is rebuilt.
+type reloadableCredentials struct {
+	load func() (credentials.PerRPCCredentials, error)
+
+	mu    sync.RWMutex
+	creds credentials.PerRPCCredentials
+}
+
+// loadCredentials loads the credentials given on the command line, or the
+// application default credentials.
+func (a *agent) loadCredentials() (credentials.PerRPCCredentials, error) {
+	if *impersonated != "" {
+		ts, err := impersonate(a.ctx, *credsJSON, *impersonated, requiredScopes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load credentials to impersonate %s: %s", *impersonated, err)
+		}
+		return oauth.TokenSource{TokenSource: ts}, nil
+	}
+	if *credsJSON != "" {
+		ts, err := credentialsFromFile(a.ctx, *credsJSON, requiredScopes...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load credentials file: %s", err)
+		}
+		return oauth.TokenSource{TokenSource: ts}, nil
+	}
+	ts, err := defaultTokenSource(a.ctx, requiredScopes...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load application default credentials: %s", err)
+	}
+	return oauth.TokenSource{TokenSource: ts}, nil
+}
+
+// tokenSource returns a source of tokens with scopes for the credentials
+// given on the command line, for the APIs the agent calls over HTTP.
+func (a *agent) tokenSource(scopes ...string) (oauth2.TokenSource, error) {
+	if *impersonated != "" {
+		return impersonate(a.ctx, *credsJSON, *impersonated, scopes)
+	}
+	if *credsJSON != "" {
+		ts, err := credentialsFromFile(a.ctx, *credsJSON, scopes...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load credentials file: %s", err)
+		}
+		return ts, nil
+	}
+	return defaultTokenSource(a.ctx, scopes...)
+}
+
+func newReloadableCredentials(load func() (credentials.PerRPCCredentials, error)) (*reloadableCredentials, error) {
+	creds, err := load()
+	if err != nil {
+		return nil, err
+	}
+	return &reloadableCredentials{load: load, creds: creds}, nil
+}
+
+func (c *reloadableCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	c.mu.RLock()
+	creds := c.creds
+	c.mu.RUnlock()
+	return creds.GetRequestMetadata(ctx, uri...)
+}
+
+func (c *reloadableCredentials) RequireTransportSecurity() bool {
+	return true
+}
+
+// reload loads the credentials from their source again. The current
+// credentials are kept if that fails.
+func (c *reloadableCredentials) reload() error {
+	creds, err := c.load()
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.creds = creds
+	c.mu.Unlock()
+	return nil
+}
+
+// useCredentials loads the credentials the agent calls the API with.
+func (a *agent) useCredentials() error {
+	creds, err := newReloadableCredentials(a.loadCredentials)
+	if err != nil {
+		return err
+	}
+	a.creds = creds
+	return nil
+}
+
+// credentialError reports whether err was caused by credentials that
+// were rejected or could not be refreshed.
+func credentialError(err error) bool {
+	s, ok := status.FromError(err)
+	return ok && s.Code() == codes.Unauthenticated
+}
+
+// refreshCredentials reloads the agent's credentials after the API
+// rejected them. It returns false if there is nothing to retry with.
+func (a *agent) refreshCredentials(err error) bool {
+	if a.creds == nil || !credentialError(err) {
+		return false
+	}
+	logWarnf("credentials rejected (%s), reloading", err)
+	if err := a.creds.reload(); err != nil {
+		logErrorf("failed to reload credentials: %s", err)
+		return false
+	}
+	return true
+}
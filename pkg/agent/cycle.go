@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	pprof "github.com/google/pprof/profile"
+)
+
+// Every profile the agent records carries comments accounting for the
+// cycle that produced it: what perf captured and lost, how many binaries
+// could be symbolized, and how long the conversion took. A profile that
+// looks off can then be explained after the fact, without the agent's
+// logs.
+
+// cycleStats accumulates the accounting of one profiling cycle. The
+// segments of a time-sliced recording are converted concurrently, hence
+// the lock.
+type cycleStats struct {
+	perf perfStats
+	// time spent converting the recording
+	converting time.Duration
+	// when the recording should have been symbolized by, if set
+	deadline time.Time
+
+	mu sync.Mutex
+	// binaries linked into the symbol lookup tree, and those whose
+	// symbols could not be found
+	linked, failed int
+	// paths of binaries replaced by another build since they were
+	// mapped
+	mismatched map[string]bool
+	// conversions done without symbols to keep to the schedule
+	hurried int
+}
+
+func (st *cycleStats) addConversion(job *conversion) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.linked += job.linked
+	st.failed += job.failed
+	if job.hurried {
+		st.hurried++
+	}
+	for _, path := range job.mismatched {
+		if st.mismatched == nil {
+			st.mismatched = make(map[string]bool)
+		}
+		st.mismatched[path] = true
+	}
+}
+
+// mismatches returns the paths of binaries whose build on disk was not
+// the one recorded, in order.
+func (st *cycleStats) mismatches() []string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	paths := make([]string, 0, len(st.mismatched))
+	for path := range st.mismatched {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// annotate adds the accounting of the cycle to p, the profile it produced.
+func (st *cycleStats) annotate(p *pprof.Profile) {
+	addComment(p, fmt.Sprintf("perf captured %d samples, lost %d chunks and %.2f%% of samples; %d distinct stacks in the profile",
+		st.perf.samples, st.perf.lostChunks, st.perf.lostPercent, len(p.Sample)))
+	st.mu.Lock()
+	linked, failed := st.linked, st.failed
+	st.mu.Unlock()
+	addComment(p, fmt.Sprintf("symbols found for %d binaries, missing for %d; converted in %v",
+		linked, failed, st.converting.Round(time.Millisecond)))
+	if paths := st.mismatches(); len(paths) > 0 {
+		addComment(p, fmt.Sprintf("replaced by another build since they were mapped, and symbolized from preserved copies where found: %s",
+			strings.Join(paths, ", ")))
+	}
+}
@@ -0,0 +1,195 @@
+package agent
+
+import (
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/droyo/cloud-profiler-perf/pkg/symbolize"
+)
+
+// Distributions strip the binaries of their packages, and publish the
+// debug symbols separately. When neither a binary nor an installed debug
+// file has a line table, the converter would name only its exported
+// functions, if any. With debuginfod servers, from $DEBUGINFOD_URLS and
+// -debuginfod, the agent fetches the debug file of each such build ID,
+// keeps it in a cache by build ID, and links it into the symbol lookup
+// tree, where the converter completes the binary with it. A build ID no
+// server has is not asked for again until the agent restarts.
+
+// The directory, in the agent's temporary directory, debug files are
+// cached in.
+const debuginfodDir = "debuginfod"
+
+// the client of the -debuginfod servers, if any
+var debuginfod *debuginfodClient
+
+// debuginfodServers returns the servers named in flag and in
+// $DEBUGINFOD_URLS, separated by spaces or commas.
+func debuginfodServers(flag string) []string {
+	var servers []string
+	seen := make(map[string]bool)
+	split := func(r rune) bool { return r == ' ' || r == ',' }
+	for _, s := range append(strings.FieldsFunc(flag, split), strings.FieldsFunc(os.Getenv("DEBUGINFOD_URLS"), split)...) {
+		s = strings.TrimRight(s, "/")
+		if !seen[s] {
+			seen[s] = true
+			servers = append(servers, s)
+		}
+	}
+	return servers
+}
+
+// A debuginfodClient fetches debug files from debuginfod servers.
+type debuginfodClient struct {
+	servers []string
+	cache   string
+	client  *http.Client
+
+	// held while fetching, so that conversions needing the same
+	// file do not fetch it twice
+	mu sync.Mutex
+	// build IDs no server has
+	missing map[string]bool
+}
+
+func newDebuginfodClient(servers []string, cache string) *debuginfodClient {
+	return &debuginfodClient{
+		servers: servers,
+		cache:   cache,
+		client:  &http.Client{Timeout: 2 * time.Minute},
+		missing: make(map[string]bool),
+	}
+}
+
+// debugFile returns the path of the debug file of build ID id, fetching
+// it if it is not in the cache, or "" if no server has it.
+func (c *debuginfodClient) debugFile(id string) string {
+	if c == nil || len(id) < 3 || strings.ContainsAny(id, "/.") {
+		return ""
+	}
+	path := filepath.Join(c.cache, id, "debuginfo")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+	if c.missing[id] {
+		return ""
+	}
+	for _, server := range c.servers {
+		err := c.fetch(server+"/buildid/"+id+"/debuginfo", path, id)
+		if err == nil {
+			log.Printf("fetched debug symbols of build %s from %s", id, server)
+			return path
+		}
+		if err != errNotFound {
+			logWarnf("could not fetch debug symbols of build %s: %s", id, err)
+		}
+	}
+	c.missing[id] = true
+	return ""
+}
+
+var errNotFound = errors.New("not found")
+
+// fetch downloads the debug file at url to path, checking that it has
+// build ID id.
+func (c *debuginfodClient) fetch(url, path, id string) error {
+	resp, err := c.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return errNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".debuginfo")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, resp.Body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if got, err := symbolize.BuildID(tmp.Name()); err != nil || got != id {
+		return fmt.Errorf("%s is not the debug file of build %s", url, id)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// hasLineTable reports whether the ELF file at path has a line table.
+func hasLineTable(path string) bool {
+	f, err := elf.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	return f.Section(".debug_line") != nil || f.Section(".zdebug_line") != nil
+}
+
+// linkDebugFile links the debug file of the binary at path, with build
+// ID id, into the symbol lookup tree dst if neither the binary nor an
+// installed debug file has a line table, and a debuginfod server has
+// one. It reports whether it did. path may be empty if the binary
+// itself could not be found.
+func linkDebugFile(dst, path, id string) (bool, error) {
+	if debuginfod == nil || len(id) < 3 {
+		return false, nil
+	}
+	if path != "" && hasLineTable(path) {
+		return false, nil
+	}
+	if hasLineTable(filepath.Join(symbolize.DebugDir, ".build-id", id[:2], id[2:]+".debug")) {
+		return false, nil
+	}
+	debug := debuginfod.debugFile(id)
+	if debug == "" {
+		return false, nil
+	}
+	abs, err := filepath.Abs(debug)
+	if err != nil {
+		return false, err
+	}
+	link := filepath.Join(dst, id[:2], id[2:]+".debug")
+	if err := os.MkdirAll(filepath.Dir(link), 0777); err != nil {
+		return false, err
+	}
+	if err := os.Symlink(abs, link); err != nil && !os.IsExist(err) {
+		return false, err
+	}
+	return true, nil
+}
+
+// debuginfodAddrs returns the addresses of the debuginfod servers.
+func debuginfodAddrs() []string {
+	if debuginfod == nil {
+		return nil
+	}
+	var addrs []string
+	for _, s := range debuginfod.servers {
+		if addr := urlAddr(s); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
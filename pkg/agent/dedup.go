@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	pprof "github.com/google/pprof/profile"
+)
+
+// A skipError is returned in place of a profile that was deliberately
+// not uploaded.
+type skipError struct {
+	// why, in a form suitable for counting skips by
+	kind   string
+	reason string
+}
+
+func (e *skipError) Error() string { return "skipped: " + e.reason }
+
+// profileDigest returns a hash of the samples in p that does not depend on
+// when it was recorded or on the order the converter emitted samples in.
+func profileDigest(p *pprof.Profile) string {
+	lines := make([]string, 0, len(p.Sample))
+	var b strings.Builder
+	for _, s := range p.Sample {
+		b.Reset()
+		fmt.Fprint(&b, s.Value)
+		for _, loc := range s.Location {
+			if len(loc.Line) == 0 || loc.Line[0].Function == nil {
+				fmt.Fprintf(&b, " %#x", loc.Address)
+				continue
+			}
+			for _, line := range loc.Line {
+				fmt.Fprintf(&b, " %s:%d", line.Function.Name, line.Line)
+			}
+		}
+		keys := make([]string, 0, len(s.Label))
+		for k := range s.Label {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(&b, " %s=%v", k, s.Label[k])
+		}
+		lines = append(lines, b.String())
+	}
+	sort.Strings(lines)
+
+	h := sha256.New()
+	for _, line := range lines {
+		io.WriteString(h, line)
+		io.WriteString(h, "\n")
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func totalSamples(p *pprof.Profile) int64 {
+	var n int64
+	for _, s := range p.Sample {
+		if len(s.Value) > 0 {
+			n += s.Value[0]
+		}
+	}
+	return n
+}
+
+// A deduplicator suppresses uploads of a profile identical to the one
+// before it. This happens on idle hosts, where every profile contains the
+// same handful of samples in the kernel's idle loop and uploading them
+// costs quota without telling anybody anything.
+type deduplicator struct {
+	// Only profiles with at most this many samples are considered
+	// idle. Zero disables deduplication.
+	idleSamples int64
+	last        string
+}
+
+// check returns a *skipError if p is identical to the previous idle
+// profile.
+func (d *deduplicator) check(p *pprof.Profile) error {
+	if d.idleSamples <= 0 {
+		return nil
+	}
+	if n := totalSamples(p); n > d.idleSamples {
+		d.last = ""
+		return nil
+	}
+	digest := profileDigest(p)
+	if digest == d.last {
+		return &skipError{kind: "idle-duplicate", reason: fmt.Sprintf("idle profile identical to the previous one (%.12s)", digest)}
+	}
+	d.last = digest
+	return nil
+}
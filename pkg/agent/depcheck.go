@@ -0,0 +1,108 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// A dependency problem found at startup, along with how to fix it.
+type depProblem struct {
+	problem, fix string
+}
+
+// A depReport is every problem found by checkDependencies. It is
+// reported as a single error so that they can all be fixed at once.
+type depReport []depProblem
+
+func (r depReport) Error() string {
+	var b strings.Builder
+	if len(r) == 1 {
+		b.WriteString("1 problem must be fixed before profiling:")
+	} else {
+		fmt.Fprintf(&b, "%d problems must be fixed before profiling:", len(r))
+	}
+	for _, p := range r {
+		fmt.Fprintf(&b, "\n  - %s\n    fix: %s", p.problem, p.fix)
+	}
+	return b.String()
+}
+
+var programHints = map[string]string{
+	"perf": "install perf: linux-perf (Debian), linux-tools-$(uname -r) (Ubuntu), or perf (Fedora, RHEL)",
+}
+
+func readSysctl(name string) (int, bool) {
+	data, err := ioutil.ReadFile("/proc/sys/" + strings.Replace(name, ".", "/", -1))
+	if err != nil {
+		return 0, false
+	}
+	v, err := strconv.Atoi(string(bytes.TrimSpace(data)))
+	return v, err == nil
+}
+
+// checkDependencies verifies that the programs the agent runs are
+// installed, and that the kernel allows the configured perf command to
+// record what it asks for, so that a misconfigured host is caught at
+// startup rather than on the first profile.
+func (a *agent) checkDependencies() error {
+	var report depReport
+	var programs []string
+	if a.ebpf {
+		if err := probeBPF(); err != nil {
+			report = append(report, depProblem{
+				problem: err.Error(),
+				fix:     "run the agent as root, or with CAP_BPF and CAP_PERFMON, on kernel 4.9 or later",
+			})
+		}
+	} else {
+		programs = append(programs, "perf")
+	}
+	for _, prog := range programs {
+		if _, err := exec.LookPath(prog); err != nil {
+			report = append(report, depProblem{
+				problem: prog + " is not in PATH",
+				fix:     programHints[prog],
+			})
+		}
+	}
+
+	privs := readPrivileges()
+	args := a.perf.Args[2:]
+	if paranoid, ok := readSysctl("kernel.perf_event_paranoid"); ok && !privs.perfEvents() {
+		switch {
+		case paranoid > 2:
+			report = append(report, depProblem{
+				problem: fmt.Sprintf("kernel.perf_event_paranoid is %d, which forbids perf events to an agent running as %s", paranoid, privs),
+				fix:     "grant the agent CAP_PERFMON (see RUNNING WITHOUT ROOT), run it as root, or sysctl -w kernel.perf_event_paranoid=2",
+			})
+		case systemWide(args) && paranoid > 0:
+			report = append(report, depProblem{
+				problem: fmt.Sprintf("kernel.perf_event_paranoid is %d, which forbids system-wide profiling to an agent running as %s", paranoid, privs),
+				fix:     "grant the agent CAP_PERFMON (see RUNNING WITHOUT ROOT), run it as root, sysctl -w kernel.perf_event_paranoid=0, or profile specific processes with -follow-children",
+			})
+		case a.mode != modeUser && paranoid > 1:
+			report = append(report, depProblem{
+				problem: fmt.Sprintf("kernel.perf_event_paranoid is %d, which forbids sampling kernel code to an agent running as %s", paranoid, privs),
+				fix:     "grant the agent CAP_PERFMON (see RUNNING WITHOUT ROOT), run it as root, sysctl -w kernel.perf_event_paranoid=1, or use -exclude-kernel",
+			})
+		}
+	}
+	if kptr, ok := readSysctl("kernel.kptr_restrict"); ok && a.mode != modeUser {
+		if kptr >= 2 || (kptr == 1 && !privs.symbols()) {
+			report = append(report, depProblem{
+				problem: fmt.Sprintf("kernel.kptr_restrict is %d, which hides kernel symbol addresses", kptr),
+				fix:     "grant the agent CAP_SYSLOG (kernel.kptr_restrict=1 only), sysctl -w kernel.kptr_restrict=0, or use -exclude-kernel",
+			})
+		}
+	}
+	report = append(report, a.privilegeProblems(privs)...)
+	report = append(report, vipProblems()...)
+	if len(report) > 0 {
+		return report
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package agent
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	cloudprofiler "google.golang.org/genproto/googleapis/devtools/cloudprofiler/v2"
+)
+
+// With -deploy-flag, deployment tooling tells the agent a rollout is
+// under way by creating a file, into which it may write the version being
+// deployed, and removing it once the rollout is done. While the file
+// exists no profile is collected, and a profile whose recording overlaps
+// a deploy is not uploaded, so no profile mixes the old and new versions.
+// The version the file named becomes the deployment's version label once
+// it is removed, and the first profile after the deploy is labeled
+// deployed-version with it.
+
+// A flag file older than this is assumed to have been left behind by a
+// failed deploy, and is ignored.
+const deployFlagMaxAge = time.Hour
+
+type deployGate struct {
+	path string
+
+	// the deploy last seen in progress
+	inProgress bool
+	version    string
+	// a stale flag has been reported
+	stale bool
+}
+
+// read reports whether a deploy is in progress, and the version it
+// deploys if the flag file names one.
+func (g *deployGate) read() (bool, string) {
+	info, err := os.Stat(g.path)
+	if err != nil {
+		g.stale = false
+		return false, ""
+	}
+	if age := time.Since(info.ModTime()); age > deployFlagMaxAge {
+		if !g.stale {
+			logWarnf("ignoring deploy flag %s: not updated for %v", g.path, age.Round(time.Minute))
+			g.stale = true
+		}
+		return false, ""
+	}
+	data, err := ioutil.ReadFile(g.path)
+	if err != nil {
+		return true, ""
+	}
+	return true, strings.TrimSpace(string(data))
+}
+
+func deploySkip(version string, during bool) *skipError {
+	what := "deploy"
+	if version != "" {
+		what += " of " + version
+	}
+	if during {
+		return &skipError{kind: "deploy", reason: what + " started during the recording"}
+	}
+	return &skipError{kind: "deploy", reason: what + " in progress"}
+}
+
+// checkDeploy returns a *skipError while a deploy is in progress. Once
+// one has completed, it updates the deployment's version label and labels
+// profile with the new version.
+func (a *agent) checkDeploy(profile *cloudprofiler.Profile) error {
+	g := a.deploy
+	if g == nil {
+		return nil
+	}
+	if on, version := g.read(); on {
+		if !g.inProgress || version != g.version {
+			log.Printf("deferring collection until %s is removed", g.path)
+		}
+		g.inProgress, g.version = true, version
+		return deploySkip(version, false)
+	}
+	if !g.inProgress {
+		return nil
+	}
+	g.inProgress = false
+	if g.version == "" {
+		log.Printf("deploy complete, resuming collection")
+		setProfileLabel(profile, "deployed-version", "unknown")
+		return nil
+	}
+	log.Printf("deploy of %s complete, resuming collection", g.version)
+	labels := map[string]string{"version": g.version}
+	for k, v := range a.labels {
+		if k != "version" {
+			labels[k] = v
+		}
+	}
+	// the map may be in use by a request in flight
+	a.labels = labels
+	setProfileLabel(profile, "deployed-version", g.version)
+	return nil
+}
+
+// deployStarted returns a *skipError if a deploy began while a profile
+// was being recorded.
+func (a *agent) deployStarted() error {
+	if a.deploy == nil {
+		return nil
+	}
+	g := a.deploy
+	if on, version := g.read(); on {
+		g.inProgress, g.version = true, version
+		return deploySkip(version, true)
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	cloudprofiler "google.golang.org/genproto/googleapis/devtools/cloudprofiler/v2"
+
+	"github.com/droyo/cloud-profiler-perf/pkg/uploader"
+)
+
+// Once the filesystem of the agent's temporary directory is full, of
+// bytes or of inodes, perf fails to write its recording and the
+// converter its output, and every cycle after fails the same way, with
+// errors that seldom say why. The agent instead checks for free space
+// before asking for a profile, and waits, with growing intervals, while
+// there is too little. A recording or conversion that fills the
+// filesystem anyway is stopped at once and its files removed, and the
+// next cycle waits for room for a recording as large. With
+// -fallback-dir, the agent moves its temporary directory there, such as
+// to a tmpfs, the first time its own filesystem fills up.
+
+// The reason profiles are skipped, and the next one deferred, for lack
+// of space.
+const skipDiskFull = "disk-full"
+
+// A diskGuard keeps the agent from recording on a full filesystem.
+type diskGuard struct {
+	// minimum free bytes and inodes; zero disables the check
+	minBytes, minInodes int64
+	// where a new temporary directory is made when the agent's own
+	// filesystem is full, if set
+	fallback string
+	// the temporary directory made under fallback, once it is
+	fellBack string
+	// the size of the files of the last recording that filled the
+	// filesystem, which the next one needs room for
+	need int64
+}
+
+// diskFull reports whether err says a filesystem is out of space or
+// inodes, or the user out of their quota, whether it is a system call's
+// or in the output of perf or the converter.
+func diskFull(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, strings.ToLower(syscall.ENOSPC.Error())) ||
+		strings.Contains(msg, strings.ToLower(syscall.EDQUOT.Error()))
+}
+
+// freeSpace returns the bytes and inodes available to the agent on the
+// filesystem of dir. Filesystems that allocate inodes on demand report
+// -1 inodes.
+func freeSpace(dir string) (bytes, inodes int64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, 0, err
+	}
+	inodes = -1
+	if st.Files > 0 {
+		inodes = int64(st.Ffree)
+	}
+	return int64(st.Bavail) * int64(st.Bsize), inodes, nil
+}
+
+// check returns an error if the filesystem of dir, the agent's temporary
+// directory, has too little room for a cycle. Filesystems whose free
+// space cannot be read are passed.
+func (g *diskGuard) check(dir string) error {
+	bytes, inodes, err := freeSpace(dir)
+	if err != nil {
+		return nil
+	}
+	if need := g.minBytes + g.need; need > 0 && bytes < need {
+		return fmt.Errorf("%d bytes free in %s, %d needed", bytes, dir, need)
+	}
+	if g.minInodes > 0 && inodes >= 0 && inodes < g.minInodes {
+		return fmt.Errorf("%d inodes free in %s, %d needed", inodes, dir, g.minInodes)
+	}
+	g.need = 0
+	return nil
+}
+
+// moveToFallback makes a new temporary directory under -fallback-dir
+// and makes it the agent's temporary directory, if it has not already.
+func (a *agent) moveToFallback() bool {
+	g := &a.disk
+	if g.fallback == "" || g.fellBack != "" {
+		return false
+	}
+	dir, err := ioutil.TempDir(g.fallback, filepath.Base(os.Args[0]))
+	if err != nil {
+		logWarnf("could not make a temporary directory in -fallback-dir %s: %s", g.fallback, err)
+		return false
+	}
+	log.Printf("filesystem of %s is full, using temporary directory %s", a.tmpdir, dir)
+	g.fellBack = dir
+	g.need = 0
+	// nothing recorded in the old directory is needed any more
+	os.RemoveAll(a.tmpdir)
+	a.tmpdir = dir
+	if err := lockTmpDir(dir); err != nil {
+		logWarnf("could not lock %s: %s", dir, err)
+	}
+	return true
+}
+
+// diskFilled handles err, a failed recording or conversion of profile
+// that filled the filesystem, whose work directory has been removed, and
+// returns the *skipError it is reported as.
+func (a *agent) diskFilled(profile *cloudprofiler.Profile, err error) error {
+	logAt(levelWarn, profileFields(profile), "filesystem full while collecting %s profile, removed its files: %s", profile.ProfileType, err)
+	a.moveToFallback()
+	return &skipError{kind: skipDiskFull, reason: err.Error()}
+}
+
+// waitForSpace returns once the filesystem of the temporary directory has
+// room for a cycle, moving to -fallback-dir if it is full and waiting
+// otherwise.
+func (a *agent) waitForSpace() {
+	err := a.disk.check(a.tmpdir)
+	if err == nil {
+		return
+	}
+	if a.moveToFallback() {
+		if err = a.disk.check(a.tmpdir); err == nil {
+			return
+		}
+	}
+	logWarnf("not profiling until there is more space: %s", err)
+	emitEvent(eventDeferred, skipDiskFull, cloudprofiler.ProfileType_PROFILE_TYPE_UNSPECIFIED, err.Error())
+	for attempt := 1; err != nil; attempt++ {
+		wait := uploader.Backoff(attempt)
+		setPhase("waiting for disk space", wait)
+		time.Sleep(wait)
+		err = a.disk.check(a.tmpdir)
+	}
+	log.Print("enough disk space again, profiling resumes")
+}
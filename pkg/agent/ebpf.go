@@ -0,0 +1,519 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	cloudprofiler "google.golang.org/genproto/googleapis/devtools/cloudprofiler/v2"
+
+	"github.com/droyo/cloud-profiler-perf/pkg/perf"
+	"github.com/droyo/cloud-profiler-perf/pkg/symbolize"
+	"github.com/droyo/cloud-profiler-perf/pkg/uploader"
+)
+
+// With -collector=ebpf, CPU profiles are recorded by the program of
+// bpf.go instead of perf record, for hosts without the perf tool. The
+// stacks it counted are written out as a perf.data file, with the
+// mappings of the processes they were taken in, so that the recording
+// is converted, symbolized and uploaded like one of perf record.
+const (
+	collectorPerf = "perf"
+	collectorEBPF = "ebpf"
+)
+
+// An ebpfCollector records CPU profiles of every CPU with BPF.
+type ebpfCollector struct {
+	agent *agent
+}
+
+// newEBPFCollector returns the BPF collector of a for profile type t,
+// which must be CPU.
+func newEBPFCollector(a *agent, t cloudprofiler.ProfileType, _ capabilities) (uploader.Collector, error) {
+	if t != cloudprofiler.ProfileType_CPU {
+		return nil, fmt.Errorf("profile type %s cannot be collected with -collector=ebpf", t)
+	}
+	return &ebpfCollector{agent: a}, nil
+}
+
+func (c *ebpfCollector) Collect(ctx context.Context, profile *cloudprofiler.Profile) ([]byte, error) {
+	return c.agent.inWorkDir(profile, func(dir string) ([]byte, error) {
+		return c.record(ctx, dir, profile)
+	})
+}
+
+// record records profile in the work directory dir.
+func (c *ebpfCollector) record(ctx context.Context, dir string, profile *cloudprofiler.Profile) ([]byte, error) {
+	a := c.agent
+	freq := a.frequency(profile.ProfileType)
+	setProfileLabel(profile, "collector", collectorEBPF)
+	if a.small != "" {
+		setProfileLabel(profile, "perf-defaults", "small-vm")
+	}
+	if freq != a.sampler.frequency {
+		setProfileLabel(profile, "sampling-frequency", strconv.Itoa(freq))
+	}
+	timeout, err := ptypes.Duration(profile.Duration)
+	if err != nil {
+		timeout = defaultProfileDuration
+	}
+
+	var before procSnapshot
+	if a.inventory > 0 {
+		before = takeProcSnapshot()
+	}
+	a.markPending(dir, profile)
+	setPhase("recording", timeout)
+	rec, err := recordBPF(ctx, freq, a.mode, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := rec.writePerfData(filepath.Join(dir, "perf.data")); err != nil {
+		return nil, err
+	}
+	var cycle cycleStats
+	cycle.perf = rec.stats()
+	var top []procUsage
+	if !before.time.IsZero() {
+		top = topProcesses(before, takeProcSnapshot(), a.inventory)
+	}
+	return a.convertRecording(dir, profile, freq, false, &cycle, top, nil, nil)
+}
+
+// A bpfSample is a stack the program counted, and the total period of
+// its samples.
+type bpfSample struct {
+	pid           uint32
+	user, kernel  []uint64
+	count, period uint64
+}
+
+type bpfRecording struct {
+	freq       int
+	mode       execMode
+	start, end time.Time
+	samples    []bpfSample
+	// samples whose stacks did not fit in the stack map
+	lost uint64
+}
+
+// probeBPF reports whether this host lets the agent load the program.
+func probeBPF() error {
+	arch, ok := bpfArchs[runtime.GOARCH]
+	if !ok {
+		return fmt.Errorf("BPF is not supported on %s", runtime.GOARCH)
+	}
+	raiseMemlockLimit()
+	stacks, err := newBPFMap(bpfMapTypeStackTrace, 4, bpfMaxStackDepth*8, 1)
+	if err != nil {
+		return err
+	}
+	defer stacks.close()
+	counts, err := newBPFMap(bpfMapTypeHash, bpfCountKeySize, bpfCountValueSize, 1)
+	if err != nil {
+		return err
+	}
+	defer counts.close()
+	prog, err := loadBPFProgram(bpfProgTypePerfEvent, bpfStackCounter(stacks, counts, arch.regsSize))
+	if err != nil {
+		return err
+	}
+	return syscall.Close(prog)
+}
+
+// recordBPF samples every CPU at freq Hz for duration, or until ctx is
+// done.
+func recordBPF(ctx context.Context, freq int, mode execMode, duration time.Duration) (*bpfRecording, error) {
+	arch, ok := bpfArchs[runtime.GOARCH]
+	if !ok {
+		return nil, fmt.Errorf("BPF is not supported on %s", runtime.GOARCH)
+	}
+	raiseMemlockLimit()
+	stacks, err := newBPFMap(bpfMapTypeStackTrace, 4, bpfMaxStackDepth*8, bpfStackEntries)
+	if err != nil {
+		return nil, err
+	}
+	defer stacks.close()
+	counts, err := newBPFMap(bpfMapTypeHash, bpfCountKeySize, bpfCountValueSize, bpfCountEntries)
+	if err != nil {
+		return nil, err
+	}
+	defer counts.close()
+	prog, err := loadBPFProgram(bpfProgTypePerfEvent, bpfStackCounter(stacks, counts, arch.regsSize))
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(prog)
+	cpus, err := onlineCPUs()
+	if err != nil {
+		return nil, err
+	}
+	var events []int
+	defer func() {
+		for _, fd := range events {
+			syscall.Close(fd)
+		}
+	}()
+	for _, cpu := range cpus {
+		fd, err := openCPUClock(cpu, freq, mode)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, fd)
+		if err := ioctl(fd, perfEventIOCSetBPF, uintptr(prog)); err != nil {
+			return nil, fmt.Errorf("could not attach BPF program to CPU %d: %s", cpu, err)
+		}
+	}
+
+	rec := &bpfRecording{freq: freq, mode: mode, start: time.Now()}
+	log.Printf("sampling %d CPUs at %d Hz with BPF for %v", len(cpus), freq, duration)
+	for _, fd := range events {
+		ioctl(fd, perfEventIOCEnable, 0)
+	}
+	t := time.NewTimer(duration)
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+		t.Stop()
+	}
+	for _, fd := range events {
+		ioctl(fd, perfEventIOCDisable, 0)
+	}
+	rec.end = time.Now()
+	return rec, rec.read(stacks, counts)
+}
+
+// stackReader returns a function reading the stack of an ID from
+// stacks, which reports false for stacks that were lost.
+func stackReader(stacks *bpfMap) func(id int32) ([]uint64, bool) {
+	traces := make(map[int32][]uint64)
+	return func(id int32) ([]uint64, bool) {
+		switch {
+		case id == stackNone:
+			return nil, true
+		case id < 0:
+			return nil, false
+		}
+		if t, ok := traces[id]; ok {
+			return t, true
+		}
+		key := make([]byte, 4)
+		binary.LittleEndian.PutUint32(key, uint32(id))
+		value, err := stacks.lookup(key)
+		if err != nil {
+			return nil, false
+		}
+		var t []uint64
+		for ; len(value) >= 8 && le64(value) != 0; value = value[8:] {
+			t = append(t, le64(value))
+		}
+		traces[id] = t
+		return t, true
+	}
+}
+
+func (rec *bpfRecording) read(stacks, counts *bpfMap) error {
+	trace := stackReader(stacks)
+	var err error
+	iterErr := counts.each(func(key []byte) {
+		value, lookupErr := counts.lookup(key)
+		if lookupErr != nil {
+			err = lookupErr
+			return
+		}
+		s := bpfSample{pid: le32(key), count: le64(value), period: le64(value[8:])}
+		user, userOK := trace(int32(le32(key[4:])))
+		kernel, kernelOK := trace(int32(le32(key[8:])))
+		if !userOK || !kernelOK {
+			rec.lost += s.count
+			return
+		}
+		if len(user) == 0 && len(kernel) == 0 {
+			return
+		}
+		s.user, s.kernel = user, kernel
+		rec.samples = append(rec.samples, s)
+	})
+	if iterErr != nil {
+		return fmt.Errorf("could not read BPF sample counts: %s", iterErr)
+	}
+	if err != nil {
+		return fmt.Errorf("could not read BPF sample counts: %s", err)
+	}
+	sort.Slice(rec.samples, func(i, j int) bool { return rec.samples[i].pid < rec.samples[j].pid })
+	return nil
+}
+
+func (rec *bpfRecording) stats() perfStats {
+	st := perfStats{samples: rec.lost}
+	for _, s := range rec.samples {
+		st.samples += s.count
+	}
+	if st.samples > 0 {
+		st.lostPercent = 100 * float64(rec.lost) / float64(st.samples)
+	}
+	if rec.lost > 0 {
+		logWarnf("lost %d of %d BPF samples to a full stack map", rec.lost, st.samples)
+	}
+	return st
+}
+
+// A procMap is an executable mapping read from /proc/<pid>/maps.
+type procMap struct {
+	start, end, pgoff uint64
+	file, buildID     string
+}
+
+// readProcMaps returns the executable mappings of process pid. The build
+// ID of each file is read through /proc/<pid>/map_files, which works
+// whatever mount namespace the process is in and after the file has been
+// deleted; ids caches them by device and inode.
+func readProcMaps(pid uint32, ids map[string]string) []procMap {
+	dir := fmt.Sprintf("/proc/%d", pid)
+	f, err := os.Open(dir + "/maps")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var maps []procMap
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// address perms offset dev inode pathname
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || !strings.Contains(fields[1], "x") {
+			continue
+		}
+		bounds := strings.SplitN(fields[0], "-", 2)
+		if len(bounds) != 2 {
+			continue
+		}
+		var m procMap
+		var errs [3]error
+		m.start, errs[0] = strconv.ParseUint(bounds[0], 16, 64)
+		m.end, errs[1] = strconv.ParseUint(bounds[1], 16, 64)
+		m.pgoff, errs[2] = strconv.ParseUint(fields[2], 16, 64)
+		if errs[0] != nil || errs[1] != nil || errs[2] != nil {
+			continue
+		}
+		m.file = strings.Join(fields[5:], " ")
+		if strings.HasPrefix(m.file, "/") {
+			key := fields[3] + " " + fields[4]
+			id, ok := ids[key]
+			if !ok {
+				// named without the zero padding of maps
+				id, _ = symbolize.BuildID(fmt.Sprintf("%s/map_files/%x-%x", dir, m.start, m.end))
+				ids[key] = id
+			}
+			m.buildID = id
+		}
+		maps = append(maps, m)
+	}
+	return maps
+}
+
+// kernelText returns the address of the kernel's _text, or 0 if
+// kallsyms hides it.
+func kernelText() uint64 {
+	f, err := os.Open("/proc/kallsyms")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 3 && (fields[2] == "_text" || fields[2] == "_stext") {
+			addr, _ := strconv.ParseUint(fields[0], 16, 64)
+			return addr
+		}
+	}
+	return 0
+}
+
+// kernelBuildID returns the build ID of the running kernel.
+func kernelBuildID() string {
+	notes, err := ioutil.ReadFile("/sys/kernel/notes")
+	if err != nil {
+		return ""
+	}
+	return symbolize.NoteBuildID(notes, binary.LittleEndian)
+}
+
+// writePerfData writes rec to path as a perf.data file of one cpu-clock
+// event. The mappings of each process are those it has when the
+// recording ends, so frames of a process that exited before then are
+// left unsymbolized. Since the program counts samples rather than time
+// them, the first sample is stamped with the start of the recording and
+// the others with its end, which gives the profile its duration.
+func (rec *bpfRecording) writePerfData(path string) error {
+	const headerSize = 104
+	const attrSize = perfAttrSize + 16
+	sampleType := uint64(perf.SampleIP | perf.SampleTID | perf.SampleTime | perf.SamplePeriod | perf.SampleCallchain)
+	flags := uint64(perf.AttrFreq)
+	switch rec.mode {
+	case modeUser:
+		flags |= attrExcludeKernel
+	case modeKernel:
+		flags |= attrExcludeUser
+	}
+
+	var data bytes.Buffer
+	writeRecord := func(typ uint32, misc uint16, fields ...interface{}) {
+		var body bytes.Buffer
+		for _, f := range fields {
+			binary.Write(&body, binary.LittleEndian, f)
+		}
+		binary.Write(&data, binary.LittleEndian, perf.EventHeader{
+			Type: typ,
+			Misc: misc,
+			Size: uint16(perf.EventHeaderSize + body.Len()),
+		})
+		data.Write(body.Bytes())
+	}
+	type buildID struct{ id, file string }
+	var buildIDs []buildID
+	seen := make(map[buildID]bool)
+	addBuildID := func(id, file string) {
+		if b := (buildID{id, file}); id != "" && !seen[b] {
+			seen[b] = true
+			buildIDs = append(buildIDs, b)
+		}
+	}
+
+	text := kernelText()
+	if text == 0 {
+		// kallsyms hides kernel addresses, which will not be
+		// symbolized; map the kernel half of the address space
+		text = 1 << 63
+	}
+	writeRecord(perf.RecordMmap, perf.MiscKernel, perf.KernelPID, uint32(0),
+		text, ^uint64(0)-text, text, paddedName("[kernel.kallsyms]_text"))
+	addBuildID(kernelBuildID(), "[kernel.kallsyms]")
+
+	ids := make(map[string]string)
+	mapped := make(map[uint32]bool)
+	for _, s := range rec.samples {
+		if s.pid == 0 || mapped[s.pid] {
+			continue
+		}
+		mapped[s.pid] = true
+		for _, m := range readProcMaps(s.pid, ids) {
+			// the build ID is given in the record, as processes
+			// in different containers may map different builds
+			// under one path
+			var id [20]byte
+			misc, idSize := uint16(perf.MiscUser), 0
+			if b, err := hex.DecodeString(m.buildID); err == nil && len(b) > 0 && len(b) <= len(id) {
+				misc |= perf.MiscMmapBuildID
+				idSize = copy(id[:], b)
+			}
+			writeRecord(perf.RecordMmap2, misc, s.pid, s.pid, m.start, m.end-m.start, m.pgoff,
+				uint8(idSize), [3]byte{}, id, uint32(syscall.PROT_READ|syscall.PROT_EXEC), uint32(0),
+				paddedName(m.file))
+			addBuildID(m.buildID, m.file)
+		}
+	}
+
+	t := uint64(rec.start.UnixNano())
+	var samples uint64
+	for _, s := range rec.samples {
+		var callchain []uint64
+		misc := uint16(perf.MiscUser)
+		if len(s.kernel) > 0 {
+			misc = perf.MiscKernel
+			callchain = append(append(callchain, perf.ContextKernel), s.kernel...)
+		}
+		if len(s.user) > 0 {
+			callchain = append(append(callchain, perf.ContextUser), s.user...)
+		}
+		ip := callchain[1]
+		for i := uint64(0); i < s.count; i++ {
+			period := s.period / s.count
+			if i == 0 {
+				period += s.period % s.count
+			}
+			writeRecord(perf.RecordSample, misc, ip, s.pid, s.pid, t, period, uint64(len(callchain)), callchain)
+			t = uint64(rec.end.UnixNano())
+		}
+		samples += s.count
+	}
+
+	var features bytes.Buffer
+	for _, b := range buildIDs {
+		var id [24]byte
+		raw, _ := hex.DecodeString(b.id)
+		id[20] = byte(copy(id[:20], raw))
+		name := paddedName(b.file)
+		misc := uint16(perf.MiscUser)
+		if b.file == "[kernel.kallsyms]" {
+			misc = perf.MiscKernel
+		}
+		binary.Write(&features, binary.LittleEndian, perf.EventHeader{
+			Misc: misc | perf.MiscBuildIDSize,
+			Size: uint16(perf.EventHeaderSize + 4 + len(id) + len(name)),
+		})
+		binary.Write(&features, binary.LittleEndian, perf.KernelPID)
+		features.Write(id[:])
+		features.Write(name)
+	}
+
+	hdr := perf.FileHeader{Size: headerSize, AttrSize: attrSize}
+	copy(hdr.Magic[:], perf.Magic)
+	hdr.Attrs = perf.FileSection{Offset: headerSize, Size: attrSize}
+	hdr.Data = perf.FileSection{Offset: headerSize + attrSize, Size: uint64(data.Len())}
+	hdr.Features[0] = 1 << perf.FeatureBuildID
+	featuresAt := hdr.Data.Offset + hdr.Data.Size + 16
+
+	attr := make([]byte, attrSize)
+	binary.LittleEndian.PutUint32(attr[0:], perfTypeSoftware)
+	binary.LittleEndian.PutUint32(attr[4:], perfAttrSize)
+	binary.LittleEndian.PutUint64(attr[8:], perfCountSWCPUClock)
+	binary.LittleEndian.PutUint64(attr[16:], uint64(rec.freq))
+	binary.LittleEndian.PutUint64(attr[24:], sampleType)
+	binary.LittleEndian.PutUint64(attr[40:], flags)
+	// the event has no IDs: samples need none to find their attr
+
+	var out bytes.Buffer
+	binary.Write(&out, binary.LittleEndian, hdr)
+	out.Write(attr)
+	out.Write(data.Bytes())
+	binary.Write(&out, binary.LittleEndian, perf.FileSection{Offset: featuresAt, Size: uint64(features.Len())})
+	out.Write(features.Bytes())
+	log.Printf("wrote %d BPF samples of %d processes to %s", samples, len(mapped), path)
+	return ioutil.WriteFile(path, out.Bytes(), 0666)
+}
+
+// paddedName returns name NUL-terminated and padded to a multiple of 8
+// bytes, as perf.data records hold file names.
+func paddedName(name string) []byte {
+	b := make([]byte, (len(name)+8)&^7)
+	copy(b, name)
+	return b
+}
+
+func le32(b []byte) uint32 { return binary.LittleEndian.Uint32(b) }
+func le64(b []byte) uint64 { return binary.LittleEndian.Uint64(b) }
+
+// cString returns the NUL-terminated string at the start of b.
+func cString(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,177 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// With -restrict-egress, the agent refuses to connect anywhere but the
+// endpoints its configuration needs: the profiler API, the services its
+// credentials are obtained from, and those of the features enabled, such
+// as the -heartbeat-url. The check is made by the dialer the agent's own
+// connections go through, on the address actually connected to, against
+// the addresses the allowed names resolved to, which are looked up again
+// at most every egressResolveInterval. It guards against the agent being
+// misconfigured into sending profiles elsewhere, not against a
+// compromised agent: DNS lookups are not restricted, nor are the
+// processes the agent runs, such as perf and pprof, or the GCE metadata
+// client of the credentials library, which dials on its own.
+
+// How often the allowed names may be resolved again, when a connection
+// is made to an address they did not resolve to.
+const egressResolveInterval = time.Minute
+
+// Endpoints credentials are obtained from.
+var credentialEndpoints = []string{
+	"oauth2.googleapis.com:443",
+	"accounts.google.com:443",
+	"www.googleapis.com:443",
+	// the GCE metadata server, for application default credentials
+	"metadata.google.internal:80",
+	"169.254.169.254:80",
+}
+
+// An egressPolicy is the set of host:port addresses the agent may
+// connect to.
+type egressPolicy struct {
+	allowed map[string]bool
+
+	mu sync.Mutex
+	// addresses the allowed host names last resolved to, and when
+	resolved   map[string]bool
+	resolvedAt time.Time
+}
+
+func newEgressPolicy(addrs []string) *egressPolicy {
+	p := &egressPolicy{allowed: make(map[string]bool), resolved: make(map[string]bool)}
+	for _, addr := range addrs {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			p.allowed[strings.ToLower(addr)] = true
+		}
+	}
+	return p
+}
+
+// urlAddr returns the host:port a URL connects to.
+func urlAddr(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return ""
+	}
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "http" {
+		return u.Hostname() + ":80"
+	}
+	return u.Hostname() + ":443"
+}
+
+// resolve looks up the addresses of the allowed host names again.
+func (p *egressPolicy) resolve() {
+	resolved := make(map[string]bool)
+	for addr := range p.allowed {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			continue
+		}
+		ips, err := net.LookupHost(host)
+		if err != nil {
+			continue
+		}
+		for _, ip := range ips {
+			resolved[net.JoinHostPort(ip, port)] = true
+		}
+	}
+	p.mu.Lock()
+	p.resolved = resolved
+	p.resolvedAt = time.Now()
+	p.mu.Unlock()
+}
+
+// permits reports whether the agent may connect to addr, an ip:port.
+func (p *egressPolicy) permits(addr string) bool {
+	if p.allowed[addr] {
+		return true
+	}
+	p.mu.Lock()
+	ok, stale := p.resolved[addr], time.Since(p.resolvedAt) > egressResolveInterval
+	p.mu.Unlock()
+	if ok || !stale {
+		return ok
+	}
+	// the allowed names may resolve to new addresses
+	p.resolve()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.resolved[addr]
+}
+
+// control is a net.Dialer Control function enforcing p.
+func (p *egressPolicy) control(network, addr string, _ syscall.RawConn) error {
+	if !p.permits(addr) {
+		logWarnf("refusing %s connection to %s: not an allowed endpoint", network, addr)
+		return fmt.Errorf("connection to %s is not allowed by -restrict-egress", addr)
+	}
+	return nil
+}
+
+// The dialer every network connection of the agent goes through.
+var agentDialer = &net.Dialer{
+	Timeout:   30 * time.Second,
+	KeepAlive: 30 * time.Second,
+}
+
+func dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return agentDialer.DialContext(ctx, network, vipAddr(addr))
+}
+
+func init() {
+	// used by every HTTP client that does not set its own transport,
+	// including those of the credentials libraries
+	http.DefaultTransport.(*http.Transport).DialContext = dialContext
+}
+
+// restrictEgress allows the agent to connect only to the endpoints its
+// configuration needs and those in extra.
+func restrictEgress(extra []string) {
+	addrs := append(strings.Split(*serverAddr, ","), credentialEndpoints...)
+	if *impersonated != "" {
+		addrs = append(addrs, "iamcredentials.googleapis.com:443")
+	}
+	if *lateSymbols != "" {
+		addrs = append(addrs, "storage.googleapis.com:443")
+	}
+	if *spoolKMSKey != "" {
+		addrs = append(addrs, kmsEndpoint)
+	}
+	if *symbolServer != "" {
+		addrs = append(addrs, *symbolServer)
+	}
+	if *heartbeatURL != "" {
+		addrs = append(addrs, urlAddr(*heartbeatURL))
+	}
+	addrs = append(addrs, webhookAddrs()...)
+	addrs = append(addrs, debuginfodAddrs()...)
+	addrs = append(addrs, pprofAddrs()...)
+	if *k8sLabels != "" || *kubeMode {
+		if host := kubernetesAPIAddr(); host != "" {
+			addrs = append(addrs, host)
+		}
+	}
+	addrs = append(addrs, vipEndpoints()...)
+	addrs = append(addrs, proxyAddrs()...)
+	addrs = append(addrs, extra...)
+	policy := newEgressPolicy(addrs)
+	policy.resolve()
+	agentDialer.Control = policy.control
+	log.Printf("restricting connections to %s", strings.Join(addrs, ", "))
+}
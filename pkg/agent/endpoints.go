@@ -0,0 +1,323 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+
+	cloudprofiler "google.golang.org/genproto/googleapis/devtools/cloudprofiler/v2"
+
+	"github.com/droyo/cloud-profiler-perf/pkg/uploader"
+)
+
+const (
+	// time allowed for a TCP handshake when measuring latency
+	probeTimeout = 2 * time.Second
+	// time allowed to establish a connection to an endpoint
+	dialTimeout = 30 * time.Second
+	// consecutive Unavailable errors before moving to another endpoint
+	failoverAfter = 3
+)
+
+// An endpoint is one address of an API front end. Each address a host
+// name resolves to is a separate endpoint, so that the closest front end
+// can be preferred over whichever the resolver lists first.
+type endpoint struct {
+	// host:port of the API, as given on the command line
+	api string
+	// ip:port to connect to
+	addr string
+	// proxy to connect through, to api rather than addr
+	proxy *url.URL
+	rtt   time.Duration
+}
+
+func (e endpoint) String() string {
+	switch {
+	case e.proxy != nil:
+		return fmt.Sprintf("%s (via %s)", e.api, e.proxy.Host)
+	case e.addr == e.api:
+		return e.api
+	}
+	return fmt.Sprintf("%s (%s)", e.api, e.addr)
+}
+
+// dialAddr returns the address a connection to e is made to.
+func (e endpoint) dialAddr() string {
+	if e.proxy != nil {
+		return proxyAddr(e.proxy)
+	}
+	return e.addr
+}
+
+// rankEndpoints resolves the host:port addresses in apis, and orders
+// their endpoints by how long a TCP handshake with them takes.
+// Endpoints that could not be reached go last, and addresses that could
+// not be resolved are tried as they are. Their proxies must have been
+// checked by newEndpointSet.
+func rankEndpoints(apis []string) []endpoint {
+	var list []endpoint
+	for _, api := range apis {
+		if proxy, _ := apiProxy(api); proxy != nil {
+			list = append(list, endpoint{api: api, addr: api, proxy: proxy})
+			continue
+		}
+		host, port, err := net.SplitHostPort(api)
+		if err != nil {
+			list = append(list, endpoint{api: api, addr: api})
+			continue
+		}
+		ips := vipIPs(host)
+		if ips == nil {
+			ips, err = net.LookupHost(host)
+		}
+		if err != nil || len(ips) == 0 {
+			logWarnf("could not resolve %s: %v", host, err)
+			list = append(list, endpoint{api: api, addr: api})
+			continue
+		}
+		for _, ip := range ips {
+			list = append(list, endpoint{api: api, addr: net.JoinHostPort(ip, port)})
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := range list {
+		wg.Add(1)
+		go func(e *endpoint) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+			defer cancel()
+			start := time.Now()
+			conn, err := dialContext(ctx, "tcp", e.dialAddr())
+			if err != nil {
+				e.rtt = -1
+				return
+			}
+			e.rtt = time.Since(start)
+			conn.Close()
+		}(&list[i])
+	}
+	wg.Wait()
+
+	sort.SliceStable(list, func(i, j int) bool {
+		a, b := list[i].rtt, list[j].rtt
+		if a < 0 || b < 0 {
+			return b < 0 && a >= 0
+		}
+		return a < b
+	})
+	return list
+}
+
+// An endpointSet is the ranked list of endpoints the agent may use, and
+// which one it is using.
+type endpointSet struct {
+	// held while the endpoint in use is read or changed, as with
+	// -pipeline calls are made from more than one goroutine; never
+	// held while dialing
+	mu       sync.Mutex
+	apis     []string
+	list     []endpoint
+	cur      int
+	failures int
+	conn     *grpc.ClientConn
+	// set while a failover is dialing, so that only one does
+	failing bool
+}
+
+// newEndpointSet ranks the endpoints of apis, comma-separated host:port
+// addresses, or returns an error if a proxy to reach them through is not
+// supported.
+func newEndpointSet(apis string) (*endpointSet, error) {
+	set := &endpointSet{apis: strings.Split(apis, ",")}
+	for _, api := range set.apis {
+		if _, err := apiProxy(api); err != nil {
+			return nil, err
+		}
+	}
+	set.list = rankEndpoints(set.apis)
+	for _, e := range set.list {
+		if e.rtt >= 0 {
+			log.Printf("endpoint %s: %v", e, e.rtt)
+		} else {
+			log.Printf("endpoint %s: unreachable", e)
+		}
+	}
+	return set, nil
+}
+
+func (a *agent) dialEndpoint(ctx context.Context, e endpoint) (*grpc.ClientConn, error) {
+	host, _, err := net.SplitHostPort(e.api)
+	if err != nil {
+		host = e.api
+	}
+	opts := []grpc.DialOption{
+		grpc.WithBlock(),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			if e.proxy != nil {
+				return dialProxy(ctx, e.proxy, addr)
+			}
+			return dialContext(ctx, "tcp", addr)
+		}),
+		grpc.WithAuthority(e.api),
+	}
+	if a.transport != nil {
+		opts = append(opts, a.transport)
+	} else {
+		config, err := apiTLSConfig(host)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts,
+			grpc.WithPerRPCCredentials(a.creds),
+			grpc.WithTransportCredentials(credentials.NewTLS(config)))
+	}
+	if a.keepalive > 0 {
+		opts = append(opts, uploader.Keepalive(a.keepalive))
+	}
+	if project := userQuotaProject(); project != "" {
+		opts = append(opts, grpc.WithUnaryInterceptor(quotaProjectInterceptor(project)))
+	}
+	return grpc.DialContext(ctx, e.addr, opts...)
+}
+
+// connect connects to the first endpoint that accepts a connection,
+// starting with the one after the current endpoint if next is true.
+// Calls keep using the current endpoint until the new one is connected.
+func (a *agent) connect(next bool) error {
+	set := a.endpoints
+	set.mu.Lock()
+	start, list := set.cur, set.list
+	set.mu.Unlock()
+	if next {
+		start++
+		if start >= len(list) {
+			// we have been through every endpoint; the latencies
+			// may have changed since they were measured
+			list = rankEndpoints(set.apis)
+			start = 0
+			set.mu.Lock()
+			set.list = list
+			set.mu.Unlock()
+		}
+	}
+	var lastErr error
+	for i := 0; i < len(list); i++ {
+		n := (start + i) % len(list)
+		e := list[n]
+		log.Println("connecting to", e, "...")
+		ctx, cancel := context.WithTimeout(a.ctx, dialTimeout)
+		conn, err := a.dialEndpoint(ctx, e)
+		cancel()
+		if err != nil {
+			logWarnf("error dialing %s: %s", e, err)
+			lastErr = err
+			continue
+		}
+		set.mu.Lock()
+		old := set.conn
+		set.conn = conn
+		set.cur = n
+		set.failures = 0
+		a.addr = e.String()
+		a.ProfilerServiceClient = cloudprofiler.NewProfilerServiceClient(conn)
+		set.mu.Unlock()
+		if old != nil {
+			old.Close()
+		}
+		endpointName.Set(e.String())
+		statusConn.Store(conn)
+		log.Printf("connected to %s in status %s", e, conn.GetState())
+		return nil
+	}
+	return fmt.Errorf("could not connect to %s: %s", strings.Join(set.apis, ", "), lastErr)
+}
+
+// api returns the client of the current endpoint, and its address.
+func (a *agent) api() (cloudprofiler.ProfilerServiceClient, string) {
+	a.endpoints.mu.Lock()
+	defer a.endpoints.mu.Unlock()
+	return a.ProfilerServiceClient, a.addr
+}
+
+// An apiClient is the API client of an agent, for the uploader package:
+// each call goes to the current endpoint, its outcome is recorded, and a
+// call rejected for its credentials is made once more if they could be
+// reloaded.
+type apiClient struct{ a *agent }
+
+func (c apiClient) call(f func(cloudprofiler.ProfilerServiceClient) error) error {
+	for refreshed := false; ; refreshed = true {
+		client, _ := c.a.api()
+		err := f(client)
+		c.a.endpointError(err)
+		if err == nil || refreshed || !c.a.refreshCredentials(err) {
+			return err
+		}
+	}
+}
+
+func (c apiClient) CreateProfile(ctx context.Context, in *cloudprofiler.CreateProfileRequest, opts ...grpc.CallOption) (profile *cloudprofiler.Profile, err error) {
+	err = c.call(func(client cloudprofiler.ProfilerServiceClient) error {
+		profile, err = client.CreateProfile(ctx, in, opts...)
+		return err
+	})
+	return profile, err
+}
+
+func (c apiClient) CreateOfflineProfile(ctx context.Context, in *cloudprofiler.CreateOfflineProfileRequest, opts ...grpc.CallOption) (profile *cloudprofiler.Profile, err error) {
+	err = c.call(func(client cloudprofiler.ProfilerServiceClient) error {
+		profile, err = client.CreateOfflineProfile(ctx, in, opts...)
+		return err
+	})
+	return profile, err
+}
+
+func (c apiClient) UpdateProfile(ctx context.Context, in *cloudprofiler.UpdateProfileRequest, opts ...grpc.CallOption) (profile *cloudprofiler.Profile, err error) {
+	err = c.call(func(client cloudprofiler.ProfilerServiceClient) error {
+		profile, err = client.UpdateProfile(ctx, in, opts...)
+		return err
+	})
+	return profile, err
+}
+
+// endpointError records the outcome of a request to the current
+// endpoint, and moves to another endpoint after sustained Unavailable
+// errors.
+func (a *agent) endpointError(err error) {
+	countAPIError(err)
+	set := a.endpoints
+	set.mu.Lock()
+	if s, ok := status.FromError(err); !ok || s.Code() != codes.Unavailable {
+		set.failures = 0
+		set.mu.Unlock()
+		return
+	}
+	set.failures++
+	if set.failures < failoverAfter || len(set.list) < 2 || set.failing {
+		set.mu.Unlock()
+		return
+	}
+	set.failing = true
+	logWarnf("%s unavailable for %d requests, failing over", a.addr, set.failures)
+	set.mu.Unlock()
+
+	if err := a.connect(true); err != nil {
+		logErrorf("failover failed: %s", err)
+	}
+	set.mu.Lock()
+	set.failing = false
+	set.mu.Unlock()
+}
@@ -0,0 +1,102 @@
+package agent
+
+import (
+	"encoding/json"
+	"expvar"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	cloudprofiler "google.golang.org/genproto/googleapis/devtools/cloudprofiler/v2"
+)
+
+// A cycle that ends without an upload is reported as an event with a
+// machine-readable reason, so that a fleet dashboard can tell a host that
+// sends no profiles because it is idle or busy from one that is broken.
+// Each event is logged as JSON, counted by reason in the status, and
+// appended to the -events-file, if given.
+
+// Outcomes of cycles reported as events.
+const (
+	// the profile was deliberately not collected or uploaded; the
+	// reason is the kind of the skipError
+	eventSkipped = "skipped"
+	// collecting or uploading the profile failed; the reason is the
+	// kind of error counted in the status
+	eventAborted = "aborted"
+	// the next profile was put off
+	eventDeferred = "deferred"
+)
+
+// Reasons of deferred events.
+const deferQuota = "cpu-quota"
+
+// A cycleEvent is a line of the events file.
+type cycleEvent struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	Reason string    `json:"reason"`
+	Type   string    `json:"type,omitempty"`
+	Detail string    `json:"detail"`
+}
+
+var (
+	abortKinds = new(expvar.Map).Init()
+	lastEvent  = new(expvar.String)
+
+	// the -events-file, if any
+	events *eventLog
+)
+
+func init() {
+	agentStatus.Set("aborts", abortKinds)
+	agentStatus.Set("last-event", lastEvent)
+}
+
+// An eventLog is a file events are appended to, one per line.
+type eventLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func openEventLog(path string) (*eventLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &eventLog{file: file}, nil
+}
+
+func (l *eventLog) write(line []byte) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := l.file.Write(append(line, '\n'))
+	return err
+}
+
+// emitEvent reports an event of a cycle for a profile of type t, which
+// is unspecified if the event does not concern one profile.
+func emitEvent(event, reason string, t cloudprofiler.ProfileType, detail string) {
+	e := cycleEvent{
+		Time:   time.Now().UTC(),
+		Event:  event,
+		Reason: reason,
+		Detail: detail,
+	}
+	if t != cloudprofiler.ProfileType_PROFILE_TYPE_UNSPECIFIED {
+		e.Type = t.String()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	log.Printf("event: %s", line)
+	lastEvent.Set(string(line))
+	if err := events.write(line); err != nil {
+		logWarnf("failed to write event: %s", err)
+	}
+}
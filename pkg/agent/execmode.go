@@ -0,0 +1,143 @@
+package agent
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+
+	pprof "github.com/google/pprof/profile"
+)
+
+// Start of the kernel half of the x86-64 and arm64 address spaces.
+const kernelAddressStart = 0xffff800000000000
+
+// An execMode restricts a profile to user or kernel code.
+type execMode int
+
+const (
+	modeAll execMode = iota
+	modeUser
+	modeKernel
+)
+
+func (m execMode) String() string {
+	switch m {
+	case modeUser:
+		return "user"
+	case modeKernel:
+		return "kernel"
+	}
+	return "all"
+}
+
+// perf event modifier that restricts counting to the mode's privilege
+// level.
+func (m execMode) modifier() string {
+	switch m {
+	case modeUser:
+		return "u"
+	case modeKernel:
+		return "k"
+	}
+	return ""
+}
+
+// restrictEvents returns a copy of the perf record arguments args where
+// every event is limited to mode. If no events are given explicitly, the
+// default cycles event is added with the mode's modifier.
+func restrictEvents(args []string, mode execMode) []string {
+	if mode == modeAll {
+		return args
+	}
+	var result []string
+	var events int
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			result = append(result, args[i:]...)
+			i = len(args)
+			continue
+		case (arg == "-e" || arg == "--event") && i+1 < len(args):
+			result = append(result, arg, addModifier(args[i+1], mode.modifier()))
+			i++
+			events++
+			continue
+		case strings.HasPrefix(arg, "--event="):
+			arg = "--event=" + addModifier(strings.TrimPrefix(arg, "--event="), mode.modifier())
+			events++
+		case strings.HasPrefix(arg, "-e") && !strings.HasPrefix(arg, "--"):
+			arg = "-e" + addModifier(strings.TrimPrefix(arg, "-e"), mode.modifier())
+			events++
+		}
+		result = append(result, arg)
+	}
+	if events == 0 {
+		result = append([]string{"-e", "cycles:" + mode.modifier()}, result...)
+	}
+	return result
+}
+
+// addModifier adds the modifier mod to each event in a comma-separated
+// perf event list. Tracepoints and other events whose names contain a
+// colon, but no modifiers, are left alone.
+func addModifier(events, mod string) string {
+	const modifiers = "ukhHGpPISDWe"
+	list := strings.Split(events, ",")
+	for i, ev := range list {
+		colon := strings.LastIndexByte(ev, ':')
+		if colon < 0 {
+			list[i] = ev + ":" + mod
+			continue
+		}
+		if suffix := ev[colon+1:]; suffix != "" && strings.Trim(suffix, modifiers) == "" {
+			list[i] = ev + mod
+		}
+	}
+	return strings.Join(list, ",")
+}
+
+func kernelLocation(loc *pprof.Location) bool {
+	if loc.Mapping != nil {
+		file := loc.Mapping.File
+		base := filepath.Base(file)
+		if strings.HasPrefix(file, "[kernel") || strings.HasPrefix(base, "vmlinux") ||
+			strings.Contains(base, ".ko") {
+			return true
+		}
+	}
+	return loc.Address >= kernelAddressStart
+}
+
+// restrictSamples removes the frames that do not belong to mode from
+// every sample in p. perf records a few samples across the boundary even
+// when events carry a modifier, and custom perf commands may not use
+// modifiers at all. Samples left without any frames are dropped.
+func restrictSamples(p *pprof.Profile, mode execMode) *pprof.Profile {
+	if mode == modeAll {
+		return p
+	}
+	var dropped int
+	samples := p.Sample[:0]
+	for _, s := range p.Sample {
+		locs := s.Location[:0]
+		for _, loc := range s.Location {
+			if kernelLocation(loc) == (mode == modeKernel) {
+				locs = append(locs, loc)
+			}
+		}
+		s.Location = locs
+		if len(locs) == 0 {
+			dropped++
+			continue
+		}
+		samples = append(samples, s)
+	}
+	p.Sample = samples
+	if dropped > 0 {
+		log.Printf("dropped %d samples with no %s frames", dropped, mode)
+		addComment(p, fmt.Sprintf("dropped %d samples with no %s frames", dropped, mode))
+	}
+	return p.Compact()
+}
@@ -0,0 +1,181 @@
+package agent
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/droyo/cloud-profiler-perf/pkg/symbolize"
+)
+
+// perf records samples from processes that start and exit during a
+// recording, but symbolizing them afterwards needs their executables. Those
+// of a CGI script or cron job may be gone by then: deleted, replaced by a
+// newer build, or only reachable through the mount namespace of a
+// container that has since exited. An execTracker listens for exec events
+// from the kernel's process connector and holds each new executable open
+// while the process still exists, so it can be read and preserved after
+// the recording.
+
+// From linux/connector.h and linux/cn_proc.h.
+const (
+	cnIdxProc          = 1
+	cnValProc          = 1
+	procCnMcastListen  = 1
+	procEventExec      = 2
+	cnMsgSize          = 20
+	procEventHeader    = 16
+	maxTrackedBinaries = 256
+)
+
+type fileKey struct {
+	dev, ino uint64
+}
+
+type trackedBinary struct {
+	file *os.File
+	// path as seen by the process
+	path string
+}
+
+type execTracker struct {
+	sock int
+
+	mu      sync.Mutex
+	pending map[fileKey]trackedBinary
+	// binaries already copied, by file identity
+	preserved map[fileKey]string
+}
+
+// track opens the executable of a process that has just called exec.
+func (t *execTracker) track(pid int) {
+	exe := fmt.Sprintf("/proc/%d/exe", pid)
+	file, err := os.Open(exe)
+	if err != nil {
+		// already gone
+		return
+	}
+	path, err := os.Readlink(exe)
+	key, ok := fileIdentity(file)
+	if err != nil || !ok {
+		file.Close()
+		return
+	}
+	path = strings.TrimSuffix(path, " (deleted)")
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.pending[key]; ok {
+		file.Close()
+		return
+	}
+	if _, ok := t.preserved[key]; ok || len(t.pending) >= maxTrackedBinaries {
+		file.Close()
+		return
+	}
+	t.pending[key] = trackedBinary{file: file, path: path}
+}
+
+func fileIdentity(file *os.File) (fileKey, bool) {
+	info, err := file.Stat()
+	if err != nil {
+		return fileKey{}, false
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileKey{}, false
+	}
+	return fileKey{dev: uint64(st.Dev), ino: st.Ino}, true
+}
+
+// reachable reports whether path still refers to the same file in the
+// agent's mount namespace.
+func reachable(path string, key fileKey) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	k, ok := fileIdentity(file)
+	return ok && k == key
+}
+
+// preserve copies the executables of processes started since the last
+// call that can no longer be found where they were run from, and links
+// them into the pprof symbol lookup tree dst. Copies are kept in dir and
+// reused by later recordings.
+func (t *execTracker) preserve(dir, dst string, filter binaryFilter) {
+	t.mu.Lock()
+	pending := t.pending
+	t.pending = make(map[fileKey]trackedBinary)
+	t.mu.Unlock()
+
+	var n int
+	for key, b := range pending {
+		if reachable(b.path, key) || filter.excluded(b.path) {
+			b.file.Close()
+			continue
+		}
+		saved := filepath.Join(dir, fmt.Sprintf("%x-%x", key.dev, key.ino), filepath.Base(b.path))
+		err := copyFile(saved, b.file)
+		b.file.Close()
+		if err != nil {
+			logWarnf("failed to preserve %s: %s", b.path, err)
+			continue
+		}
+		t.mu.Lock()
+		t.preserved[key] = saved
+		t.mu.Unlock()
+		if err := linkSymbols(dst, b.path, saved); err != nil {
+			logWarnf("failed to link symbols for %s: %s", b.path, err)
+			continue
+		}
+		n++
+	}
+	if n > 0 {
+		log.Printf("preserved %d executables of exited processes", n)
+	}
+}
+
+func copyFile(dst string, src *os.File) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+		return err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, src); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// linkSymbols links saved, the preserved copy of the binary at path, into
+// the symbol lookup tree dst, both by build ID and by path, which are the
+// two ways pprof looks for binaries in $PPROF_BINARY_PATH.
+func linkSymbols(dst, path, saved string) error {
+	abs, err := filepath.Abs(saved)
+	if err != nil {
+		return err
+	}
+	links := []string{filepath.Join(dst, path)}
+	if id, err := symbolize.BuildID(saved); err == nil && id != "" {
+		links = append(links, filepath.Join(dst, id, filepath.Base(path)))
+	}
+	for _, link := range links {
+		if err := os.MkdirAll(filepath.Dir(link), 0777); err != nil {
+			return err
+		}
+		if err := os.Symlink(abs, link); err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+	return nil
+}
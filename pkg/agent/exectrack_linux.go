@@ -0,0 +1,77 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Exec events come from the process connector, a netlink socket of
+// Linux's; exectrack_other.go has the stub for other systems.
+
+// newExecTracker subscribes to exec events. It needs CAP_NET_ADMIN.
+func newExecTracker() (*execTracker, error) {
+	sock, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_DGRAM, syscall.NETLINK_CONNECTOR)
+	if err != nil {
+		return nil, fmt.Errorf("process connector: %s", err)
+	}
+	addr := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: cnIdxProc}
+	if err := syscall.Bind(sock, addr); err != nil {
+		syscall.Close(sock)
+		return nil, fmt.Errorf("process connector: %s", err)
+	}
+
+	var msg bytes.Buffer
+	binary.Write(&msg, binary.LittleEndian, syscall.NlMsghdr{
+		Len:  syscall.NLMSG_HDRLEN + cnMsgSize + 4,
+		Type: syscall.NLMSG_DONE,
+		Pid:  uint32(os.Getpid()),
+	})
+	binary.Write(&msg, binary.LittleEndian, [4]uint32{cnIdxProc, cnValProc, 0, 0})
+	binary.Write(&msg, binary.LittleEndian, [2]uint16{4, 0})
+	binary.Write(&msg, binary.LittleEndian, uint32(procCnMcastListen))
+	if err := syscall.Sendto(sock, msg.Bytes(), 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		syscall.Close(sock)
+		return nil, fmt.Errorf("process connector: %s", err)
+	}
+
+	t := &execTracker{
+		sock:      sock,
+		pending:   make(map[fileKey]trackedBinary),
+		preserved: make(map[fileKey]string),
+	}
+	go t.listen()
+	return t, nil
+}
+
+func (t *execTracker) listen() {
+	buf := make([]byte, os.Getpagesize())
+	for {
+		n, _, err := syscall.Recvfrom(t.sock, buf, 0)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			logWarnf("no longer tracking exec events: %s", err)
+			return
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+		for _, m := range msgs {
+			data := m.Data
+			if len(data) < cnMsgSize+procEventHeader+8 {
+				continue
+			}
+			event := data[cnMsgSize:]
+			if binary.LittleEndian.Uint32(event) != procEventExec {
+				continue
+			}
+			tgid := binary.LittleEndian.Uint32(event[procEventHeader+4:])
+			t.track(int(tgid))
+		}
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package agent
+
+import (
+	"errors"
+	"runtime"
+)
+
+// newExecTracker fails, as only Linux has the process connector.
+func newExecTracker() (*execTracker, error) {
+	return nil, errors.New("exec events are not supported on " + runtime.GOOS)
+}
@@ -0,0 +1,225 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// Hosts outside Google Cloud can authenticate with workload identity
+// federation rather than a service account key: a credentials file of
+// type external_account names a token the host already has, from a file
+// or a local URL, which Google's security token service exchanges for
+// an access token, and the service account the exchanged token then
+// impersonates, if any. Such files are accepted wherever a service
+// account key is, with -credentials or GOOGLE_APPLICATION_CREDENTIALS.
+// Tokens from AWS and executables are not supported.
+
+const externalAccountType = "external_account"
+
+const (
+	tokenExchangeGrant = "urn:ietf:params:oauth:grant-type:token-exchange"
+	accessTokenType    = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+// externalAccount is the credentials file of workload identity
+// federation.
+type externalAccount struct {
+	Audience                       string `json:"audience"`
+	SubjectTokenType               string `json:"subject_token_type"`
+	TokenURL                       string `json:"token_url"`
+	ServiceAccountImpersonationURL string `json:"service_account_impersonation_url"`
+	CredentialSource               struct {
+		File    string            `json:"file"`
+		URL     string            `json:"url"`
+		Headers map[string]string `json:"headers"`
+		Format  struct {
+			Type                  string `json:"type"`
+			SubjectTokenFieldName string `json:"subject_token_field_name"`
+		} `json:"format"`
+		EnvironmentID string `json:"environment_id"`
+		Executable    *struct {
+			Command string `json:"command"`
+		} `json:"executable"`
+	} `json:"credential_source"`
+}
+
+type externalAccountTokenSource struct {
+	ctx     context.Context
+	account *externalAccount
+	scopes  []string
+}
+
+// credentialsFromFile returns a token source with scopes for the
+// credentials file named file, which holds a service account key or the
+// credentials of workload identity federation.
+func credentialsFromFile(ctx context.Context, file string, scopes ...string) (oauth2.TokenSource, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var creds struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %s", file, err)
+	}
+	if creds.Type != externalAccountType {
+		key, err := google.CredentialsFromJSON(ctx, data, scopes...)
+		if err != nil {
+			return nil, err
+		}
+		return key.TokenSource, nil
+	}
+	account := new(externalAccount)
+	if err := json.Unmarshal(data, account); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %s", file, err)
+	}
+	src := account.CredentialSource
+	switch {
+	case account.Audience == "" || account.TokenURL == "" || account.SubjectTokenType == "":
+		return nil, fmt.Errorf("%s: audience, token_url and subject_token_type are required", file)
+	case src.EnvironmentID != "" || src.Executable != nil:
+		return nil, fmt.Errorf("%s: only file and url credential sources are supported", file)
+	case (src.File == "") == (src.URL == ""):
+		return nil, fmt.Errorf("%s: credential_source needs one of file or url", file)
+	}
+	ts := &externalAccountTokenSource{ctx: ctx, account: account, scopes: scopes}
+	if account.ServiceAccountImpersonationURL == "" {
+		return oauth2.ReuseTokenSource(nil, ts), nil
+	}
+	// the federated token impersonates the service account, and needs
+	// only the scope to do so
+	federated := &externalAccountTokenSource{ctx: ctx, account: account, scopes: []string{cloudPlatformScope}}
+	impersonationURL := account.ServiceAccountImpersonationURL
+	return oauth2.ReuseTokenSource(nil, &impersonatedTokenSource{
+		ctx:     ctx,
+		client:  oauth2.NewClient(ctx, oauth2.ReuseTokenSource(nil, federated)),
+		url:     impersonationURL,
+		account: strings.TrimSuffix(path.Base(impersonationURL), ":generateAccessToken"),
+		scopes:  scopes,
+	}), nil
+}
+
+// subjectToken reads the token the host already has.
+func (ts *externalAccountTokenSource) subjectToken() (string, error) {
+	src := ts.account.CredentialSource
+	var data []byte
+	var err error
+	if src.File != "" {
+		data, err = ioutil.ReadFile(src.File)
+	} else {
+		data, err = ts.fetchSubjectToken()
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not read subject token: %s", err)
+	}
+	if src.Format.Type != "json" {
+		return string(bytes.TrimSpace(data)), nil
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return "", fmt.Errorf("could not parse subject token: %s", err)
+	}
+	token, ok := fields[src.Format.SubjectTokenFieldName].(string)
+	if !ok {
+		return "", fmt.Errorf("subject token has no string field %q", src.Format.SubjectTokenFieldName)
+	}
+	return token, nil
+}
+
+func (ts *externalAccountTokenSource) fetchSubjectToken() ([]byte, error) {
+	src := ts.account.CredentialSource
+	req, err := http.NewRequest("GET", src.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range src.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ts.ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", src.URL, resp.Status)
+	}
+	return data, nil
+}
+
+// Token exchanges the subject token for an access token with the
+// security token service.
+func (ts *externalAccountTokenSource) Token() (*oauth2.Token, error) {
+	subject, err := ts.subjectToken()
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":           {tokenExchangeGrant},
+		"audience":             {ts.account.Audience},
+		"scope":                {strings.Join(ts.scopes, " ")},
+		"requested_token_type": {accessTokenType},
+		"subject_token":        {subject},
+		"subject_token_type":   {ts.account.SubjectTokenType},
+	}
+	req, err := http.NewRequest("POST", ts.account.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req.WithContext(ts.ctx))
+	if err != nil {
+		return nil, fmt.Errorf("could not exchange token: %s", err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not exchange token: %s: %s", resp.Status, bytes.TrimSpace(data))
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(data, &token); err != nil {
+		return nil, fmt.Errorf("could not parse exchanged token: %s", err)
+	}
+	if token.AccessToken == "" {
+		return nil, errors.New("could not exchange token: no access token returned")
+	}
+	return &oauth2.Token{
+		AccessToken: token.AccessToken,
+		TokenType:   "Bearer",
+		Expiry:      time.Now().Add(time.Duration(token.ExpiresIn) * time.Second),
+	}, nil
+}
+
+// defaultTokenSource returns a token source with scopes for the
+// application default credentials, which may name a credentials file of
+// workload identity federation.
+func defaultTokenSource(ctx context.Context, scopes ...string) (oauth2.TokenSource, error) {
+	if path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); path != "" {
+		return credentialsFromFile(ctx, path, scopes...)
+	}
+	return google.DefaultTokenSource(ctx, scopes...)
+}
@@ -0,0 +1,172 @@
+package agent
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	cloudprofiler "google.golang.org/genproto/googleapis/devtools/cloudprofiler/v2"
+)
+
+// A cheap system-wide profile shows the health of a node, but rarely
+// samples any one service often enough to show its detail. With -focus,
+// key processes are recorded at the same time as the system-wide
+// profile, in the same window of overhead, at -focus-frequency, and each
+// is uploaded to a deployment of its own.
+
+// The label linking a focused profile to the system-wide deployment it
+// was recorded alongside.
+const focusLabel = "system-target"
+
+// A focus selects processes by name and names the deployment their
+// profiles are uploaded to.
+type focus struct {
+	target  string
+	pattern string
+}
+
+// parseFocus parses rules of the form target=pattern, where pattern is a
+// shell glob matched against process names, as in /proc/pid/comm.
+func parseFocus(rules []string) ([]focus, error) {
+	var parsed []focus
+	for _, r := range rules {
+		i := strings.Index(r, "=")
+		if i <= 0 || i == len(r)-1 {
+			return nil, fmt.Errorf("focus rule %q must be of the form target=pattern", r)
+		}
+		f := focus{target: r[:i], pattern: r[i+1:]}
+		if _, err := filepath.Match(f.pattern, ""); err != nil {
+			return nil, fmt.Errorf("focus rule %q: %s", r, err)
+		}
+		parsed = append(parsed, f)
+	}
+	return parsed, nil
+}
+
+// pids returns the processes in snap matching f, sorted.
+func (f focus) pids(snap procSnapshot) []int {
+	var pids []int
+	for pid, st := range snap.procs {
+		if ok, _ := filepath.Match(f.pattern, st.comm); ok {
+			pids = append(pids, pid)
+		}
+	}
+	sort.Ints(pids)
+	return pids
+}
+
+// A focusedRecording is a recording of a focus running alongside the
+// system-wide one.
+type focusedRecording struct {
+	focus
+	data string
+	err  error
+}
+
+// startFocused starts recording the focused processes for the profile
+// requested, in its work directory dir. The returned function waits for
+// the recordings to end, then converts and uploads them; it must be
+// called once the system-wide recording has ended.
+func (a *agent) startFocused(dir string, profile *cloudprofiler.Profile, timeout time.Duration, stop <-chan struct{}) func() {
+	if len(a.focus) == 0 || profile.ProfileType != cloudprofiler.ProfileType_CPU {
+		return func() {}
+	}
+	snap := takeProcSnapshot()
+	var wg sync.WaitGroup
+	var recordings []*focusedRecording
+	for i, f := range a.focus {
+		pids := f.pids(snap)
+		if len(pids) == 0 {
+			log.Printf("no processes match focus %s=%s", f.target, f.pattern)
+			continue
+		}
+		list := make([]string, len(pids))
+		for i, pid := range pids {
+			list[i] = strconv.Itoa(pid)
+		}
+		rec := &focusedRecording{focus: f, data: filepath.Join(dir, fmt.Sprintf("focus%d.data", i))}
+		args := []string{"record", "-g", "-F", strconv.Itoa(a.focusFreq), "-o", rec.data, "-p", strings.Join(list, ",")}
+		args = append(args[:1:1], restrictEvents(args[1:], a.mode)...)
+		cmd := exec.Command("perf", args...)
+		recordings = append(recordings, rec)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, rec.err = runPerfCommand(dir, cmd, timeout, stop)
+		}()
+	}
+	start := time.Now()
+	return func() {
+		wg.Wait()
+		duration := time.Since(start)
+		for _, rec := range recordings {
+			if rec.err != nil {
+				logWarnf("failed to record focus %s: %s", rec.target, rec.err)
+				continue
+			}
+			if err := a.uploadFocused(rec, duration); err != nil {
+				logWarnf("failed to upload focused profile of %s: %s", rec.target, err)
+			}
+			os.Remove(rec.data)
+		}
+	}
+}
+
+func (a *agent) uploadFocused(rec *focusedRecording, duration time.Duration) error {
+	var cycle cycleStats
+	converting := time.Now()
+	p, partial, err := a.convertFile(strings.TrimSuffix(rec.data, ".data")+".pprof", rec.data, &cycle)
+	cycle.converting = time.Since(converting)
+	if err != nil {
+		return err
+	}
+	p, _ = limitStackDepth(p, a.maxDepth)
+	p = a.binaries.strip(p)
+	p = restrictSamples(p, a.mode)
+	rewriteSourcePaths(p, a.sources)
+	if err := a.sampleType.apply(p, a.focusFreq); err != nil {
+		return err
+	}
+	addComment(p, fmt.Sprintf("processes matching %s, recorded alongside a system-wide profile of %s", rec.pattern, a.service))
+	cycle.annotate(p)
+
+	labels := make(map[string]string, len(a.labels)+1)
+	for k, v := range a.labels {
+		labels[k] = v
+	}
+	labels[focusLabel] = a.service
+	profile := &cloudprofiler.Profile{
+		ProfileType: cloudprofiler.ProfileType_CPU,
+		Deployment: &cloudprofiler.Deployment{
+			ProjectId: a.project,
+			Target:    rec.target,
+			Labels:    labels,
+		},
+		Duration: ptypes.DurationProto(duration),
+	}
+	setProfileLabel(profile, "sampling-frequency", strconv.Itoa(a.focusFreq))
+	if partial {
+		setProfileLabel(profile, "partial", "true")
+	}
+	if err := setProfileBytes(profile, p); err != nil {
+		return err
+	}
+	uploaded, err := a.tryCreateOfflineProfile(profile)
+	if err != nil {
+		return err
+	}
+	log.Printf("uploaded focused profile of %s as %s", rec.target, uploaded.Name)
+	profileUploaded(uploaded.ProfileType, uploaded.Name)
+	if err := a.audit.record(uploaded); err != nil {
+		logWarnf("failed to write audit record for %s: %s", uploaded.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Supervisors such as gunicorn, php-fpm and postgres serve from worker
+// processes they fork and replace, so neither a process name nor the
+// supervisor's PID alone selects the service, and its cgroup may hold
+// unrelated helpers. With -follow-children, the agent profiles only the
+// process tree under a root process, given by PID or as the systemd unit
+// whose main process it is. The tree is listed from /proc when each
+// recording starts, and perf follows the processes forked during the
+// recording, so workers started mid-profile are included.
+
+// A processTree is the root of the processes -follow-children profiles.
+type processTree struct {
+	// the root PID, or the unit whose main process is the root
+	pid  int
+	unit string
+}
+
+// parseProcessTree parses the -follow-children argument.
+func parseProcessTree(s string) (*processTree, error) {
+	if pid, err := strconv.Atoi(s); err == nil {
+		if pid <= 1 {
+			return nil, errors.New("-follow-children: the root must not be init, profile system-wide instead")
+		}
+		return &processTree{pid: pid}, nil
+	}
+	if !strings.Contains(s, ".") {
+		return nil, fmt.Errorf("-follow-children %s: not a PID or systemd unit such as gunicorn.service", s)
+	}
+	return &processTree{unit: s}, nil
+}
+
+func (t *processTree) String() string {
+	if t.unit != "" {
+		return t.unit
+	}
+	return strconv.Itoa(t.pid)
+}
+
+// root returns the PID of the root of the tree. A unit's main process is
+// looked up every time, as the unit may have been restarted.
+func (t *processTree) root() (int, error) {
+	if t.unit == "" {
+		return t.pid, nil
+	}
+	out, err := exec.Command("systemctl", "show", "--property", "MainPID", "--value", t.unit).Output()
+	if err != nil {
+		return 0, fmt.Errorf("could not find the main process of %s: %s", t.unit, err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	if err != nil || pid == 0 {
+		return 0, fmt.Errorf("%s is not running", t.unit)
+	}
+	return pid, nil
+}
+
+// pids returns the root of the tree and its descendants in snap, sorted.
+func (t *processTree) pids(snap procSnapshot) ([]int, error) {
+	root, err := t.root()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := snap.procs[root]; !ok {
+		return nil, fmt.Errorf("process %d of -follow-children %s is not running", root, t)
+	}
+	children := make(map[int][]int)
+	for pid, st := range snap.procs {
+		children[st.ppid] = append(children[st.ppid], pid)
+	}
+	pids := []int{root}
+	for i := 0; i < len(pids); i++ {
+		pids = append(pids, children[pids[i]]...)
+	}
+	sort.Ints(pids)
+	return pids, nil
+}
+
+// followArgs returns the perf arguments args recording only the current
+// tree of t.
+func (t *processTree) followArgs(args []string) ([]string, error) {
+	pids, err := t.pids(takeProcSnapshot())
+	if err != nil {
+		return nil, &skipError{kind: "no-process", reason: err.Error()}
+	}
+	list := make([]string, len(pids))
+	for i, pid := range pids {
+		list[i] = strconv.Itoa(pid)
+	}
+	return addPerfOptions(args, "-p", strings.Join(list, ",")), nil
+}
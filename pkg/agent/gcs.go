@@ -0,0 +1,89 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Objects are read and written with the JSON API of Cloud Storage, to
+// avoid depending on its client library.
+const (
+	gcsUploadURL   = "https://storage.googleapis.com/upload/storage/v1/b/%s/o?uploadType=media&name=%s"
+	gcsDownloadURL = "https://storage.googleapis.com/storage/v1/b/%s/o/%s?alt=media"
+	gcsScope       = "https://www.googleapis.com/auth/devstorage.read_write"
+)
+
+// A gcsStore holds objects under a prefix of a Cloud Storage bucket.
+type gcsStore struct {
+	bucket, prefix string
+	client         *http.Client
+}
+
+// parseGCSURL splits a gs://bucket/prefix URL.
+func parseGCSURL(s string) (bucket, prefix string, err error) {
+	if !strings.HasPrefix(s, "gs://") {
+		return "", "", fmt.Errorf("%q is not a gs://bucket/path URL", s)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(s, "gs://"), "/", 2)
+	if parts[0] == "" {
+		return "", "", fmt.Errorf("%q does not name a bucket", s)
+	}
+	if len(parts) == 2 {
+		prefix = strings.Trim(parts[1], "/")
+	}
+	return parts[0], prefix, nil
+}
+
+func (s *gcsStore) object(name string) string {
+	return path.Join(s.prefix, name)
+}
+
+func (s *gcsStore) String() string {
+	return "gs://" + path.Join(s.bucket, s.prefix)
+}
+
+// put writes the object name with the size bytes read from r.
+func (s *gcsStore) put(name string, r io.Reader, size int64) error {
+	u := fmt.Sprintf(gcsUploadURL, url.PathEscape(s.bucket), url.QueryEscape(s.object(name)))
+	req, err := http.NewRequest("POST", u, io.LimitReader(r, size))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return gcsError(resp, s.object(name))
+}
+
+// get copies the contents of the object name to w.
+func (s *gcsStore) get(name string, w io.Writer) error {
+	u := fmt.Sprintf(gcsDownloadURL, url.PathEscape(s.bucket), url.PathEscape(s.object(name)))
+	resp, err := s.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := gcsError(resp, s.object(name)); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+func gcsError(resp *http.Response, object string) error {
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("%s: %s: %s", object, resp.Status, bytes.TrimSpace(body))
+}
@@ -0,0 +1,505 @@
+package agent
+
+import (
+	"context"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	pprof "github.com/google/pprof/profile"
+	cloudprofiler "google.golang.org/genproto/googleapis/devtools/cloudprofiler/v2"
+
+	"github.com/droyo/cloud-profiler-perf/pkg/uploader"
+)
+
+// HEAP profiles of the target, the command launched with run or the
+// processes of -container, are recorded with uprobes on the malloc and
+// free of every library or executable they map that defines both, such
+// as libc, jemalloc or a static binary. BPF programs run on each call,
+// as memleak does: malloc's entry notes the size asked for, its return
+// stores the address it returned with the size and the user stack it
+// was called from, and free forgets the address. When the profile ends,
+// the allocations still outstanding are written out as a perf.data file
+// with one sample per allocation, weighted by its size, and the profile
+// reports them as inuse_objects and inuse_space. Only memory allocated
+// while the profile is recorded is seen, and calloc, realloc and mmap
+// are not traced.
+
+const (
+	// the threads that may be between the entry and return of malloc
+	bpfHeapThreads = 16384
+	// the allocations that may be outstanding
+	bpfHeapAllocs = 1 << 17
+	// the target processes
+	bpfHeapPids = 4096
+	// keys and values of the allocation map: {address, pid} and
+	// {size, user stack id}
+	bpfAllocKeySize   = 16
+	bpfAllocValueSize = 16
+)
+
+// Where the kernel describes the uprobe PMU.
+const uprobePMUDir = "/sys/bus/event_source/devices/uprobe"
+
+// A heapCollector records HEAP profiles of the target with uprobes.
+type heapCollector struct {
+	agent *agent
+}
+
+// newHeapCollector returns the HEAP collector of a, which must have a
+// target.
+func newHeapCollector(a *agent) (uploader.Collector, error) {
+	if a.target == nil && a.container == nil {
+		return nil, errors.New("HEAP profiles need a target: use run or -container")
+	}
+	if _, ok := bpfArchs[runtime.GOARCH]; !ok {
+		return nil, fmt.Errorf("HEAP profiles cannot be recorded on %s", runtime.GOARCH)
+	}
+	if _, _, err := uprobePMU(); err != nil {
+		return nil, fmt.Errorf("HEAP profiles need uprobes attachable with perf_event_open (kernel 4.17): %s", err)
+	}
+	return &heapCollector{agent: a}, nil
+}
+
+func (c *heapCollector) Collect(ctx context.Context, profile *cloudprofiler.Profile) ([]byte, error) {
+	return c.agent.inWorkDir(profile, func(dir string) ([]byte, error) {
+		return c.record(ctx, dir, profile)
+	})
+}
+
+// record records profile in the work directory dir.
+func (c *heapCollector) record(ctx context.Context, dir string, profile *cloudprofiler.Profile) ([]byte, error) {
+	a := c.agent
+	pids := a.leakTargets()
+	if len(pids) == 0 {
+		return nil, &skipError{kind: "no-process", reason: "no target process to trace the allocations of"}
+	}
+	duration, err := ptypes.Duration(profile.Duration)
+	if err != nil || duration <= 0 {
+		duration = defaultProfileDuration
+	}
+	a.markPending(dir, profile)
+	setPhase("recording", duration)
+	rec, err := recordHeap(ctx, pids, duration)
+	if err != nil {
+		return nil, err
+	}
+	if err := rec.writePerfData(filepath.Join(dir, "perf.data")); err != nil {
+		return nil, err
+	}
+	setProfileLabel(profile, "collector", "uprobes")
+	var cycle cycleStats
+	cycle.perf = rec.stats()
+	return a.convertRecording(dir, profile, 0, false, &cycle, nil, nil, nil)
+}
+
+// heapSampleTypes relabels the values of p, converted from a recording
+// of recordHeap, as those of a heap profile: the samples are
+// allocations, and their periods bytes.
+func heapSampleTypes(p *pprof.Profile) {
+	if len(p.SampleType) != 2 {
+		return
+	}
+	p.SampleType = []*pprof.ValueType{
+		{Type: "inuse_objects", Unit: "count"},
+		{Type: "inuse_space", Unit: "bytes"},
+	}
+	p.DefaultSampleType = "inuse_space"
+	p.PeriodType = &pprof.ValueType{Type: "space", Unit: "bytes"}
+	p.Period = 1
+}
+
+// uprobePMU returns the type of the uprobe PMU, and the bit of the
+// config of its events that makes them return probes.
+func uprobePMU() (uint32, uint, error) {
+	data, err := ioutil.ReadFile(uprobePMUDir + "/type")
+	if err != nil {
+		return 0, 0, err
+	}
+	typ, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("malformed %s/type %q", uprobePMUDir, data)
+	}
+	data, err = ioutil.ReadFile(uprobePMUDir + "/format/retprobe")
+	if err != nil {
+		return 0, 0, err
+	}
+	// such as config:0
+	format := strings.TrimSpace(string(data))
+	bit, err := strconv.ParseUint(strings.TrimPrefix(format, "config:"), 10, 6)
+	if err != nil || !strings.HasPrefix(format, "config:") {
+		return 0, 0, fmt.Errorf("malformed %s/format/retprobe %q", uprobePMUDir, data)
+	}
+	return uint32(typ), uint(bit), nil
+}
+
+// A mallocLib is a file defining malloc and free, and the offsets of
+// their code in it.
+type mallocLib struct {
+	path         string
+	malloc, free uint64
+}
+
+// mallocLibs returns the files mapped by pids that define malloc and
+// free, each once, by paths through the processes' roots.
+func mallocLibs(pids []int) []mallocLib {
+	var libs []mallocLib
+	seen := make(map[string]bool)
+	ids := make(map[string]string)
+	for _, pid := range pids {
+		for _, m := range readProcMaps(uint32(pid), ids) {
+			if !strings.HasPrefix(m.file, "/") {
+				continue
+			}
+			path := fmt.Sprintf("/proc/%d/root%s", pid, m.file)
+			var st syscall.Stat_t
+			if err := syscall.Stat(path, &st); err != nil {
+				continue
+			}
+			// uprobes are placed on inodes
+			key := fmt.Sprintf("%d:%d", st.Dev, st.Ino)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			f, err := elf.Open(path)
+			if err != nil {
+				continue
+			}
+			malloc, okMalloc := elfFuncOffset(f, "malloc")
+			free, okFree := elfFuncOffset(f, "free")
+			f.Close()
+			if okMalloc && okFree {
+				libs = append(libs, mallocLib{path: path, malloc: malloc, free: free})
+			}
+		}
+	}
+	return libs
+}
+
+// elfFuncOffset returns the offset in f of the code of the function
+// name, if f defines it.
+func elfFuncOffset(f *elf.File, name string) (uint64, bool) {
+	dynamic, _ := f.DynamicSymbols()
+	static, _ := f.Symbols()
+	for _, sym := range append(dynamic, static...) {
+		if sym.Name != name || elf.ST_TYPE(sym.Info) != elf.STT_FUNC || sym.Section == elf.SHN_UNDEF || sym.Value == 0 {
+			continue
+		}
+		for _, prog := range f.Progs {
+			if prog.Type == elf.PT_LOAD && prog.Flags&elf.PF_X != 0 && sym.Value >= prog.Vaddr && sym.Value < prog.Vaddr+prog.Memsz {
+				return sym.Value - prog.Vaddr + prog.Off, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// bpfExit0 returns 0 from a program.
+var bpfExit0 = []bpfInsn{{code: bpfMov64Imm, dst: r0}, {code: bpfExit}}
+
+// bpfMallocEntry assembles the program run on entry to malloc. It notes
+// the size the calling thread asked for, if its process is a target:
+//
+//	pid = bpf_get_current_pid_tgid() >> 32;
+//	if (!bpf_map_lookup_elem(pids, &pid))
+//		return 0;
+//	tid = bpf_get_current_pid_tgid();
+//	size = PT_REGS_PARM1(ctx);
+//	bpf_map_update_elem(sizes, &tid, &size, BPF_ANY);
+//	return 0;
+func bpfMallocEntry(pids, sizes *bpfMap, arch bpfArch) []bpfInsn {
+	var p []bpfInsn
+	add := func(insns ...bpfInsn) { p = append(p, insns...) }
+	add(bpfInsn{code: bpfMov64Reg, dst: r6, src: r1})
+	add(bpfInsn{code: bpfCall, imm: bpfFuncGetCurrentPidTgid})
+	add(bpfInsn{code: bpfMov64Reg, dst: r7, src: r0})
+	add(bpfInsn{code: bpfRsh64Imm, dst: r0, imm: 32})
+	add(bpfInsn{code: bpfStxMemW, dst: r10, src: r0, off: -4})
+	add(ldMapFD(r1, pids.fd)...)
+	add(bpfInsn{code: bpfMov64Reg, dst: r2, src: r10})
+	add(bpfInsn{code: bpfAdd64Imm, dst: r2, imm: -4})
+	add(bpfInsn{code: bpfCall, imm: bpfFuncMapLookupElem})
+	var target []bpfInsn
+	target = append(target,
+		bpfInsn{code: bpfLdxMemDW, dst: r1, src: r6, off: arch.arg0},
+		bpfInsn{code: bpfStxMemDW, dst: r10, src: r1, off: -16},
+		bpfInsn{code: bpfStxMemDW, dst: r10, src: r7, off: -24})
+	target = append(target, ldMapFD(r1, sizes.fd)...)
+	target = append(target,
+		bpfInsn{code: bpfMov64Reg, dst: r2, src: r10},
+		bpfInsn{code: bpfAdd64Imm, dst: r2, imm: -24},
+		bpfInsn{code: bpfMov64Reg, dst: r3, src: r10},
+		bpfInsn{code: bpfAdd64Imm, dst: r3, imm: -16},
+		bpfInsn{code: bpfMov64Imm, dst: r4, imm: bpfAny},
+		bpfInsn{code: bpfCall, imm: bpfFuncMapUpdateElem})
+	add(bpfInsn{code: bpfJeqImm, dst: r0, off: int16(len(target))})
+	add(target...)
+	add(bpfExit0...)
+	return p
+}
+
+// bpfMallocReturn assembles the program run on return from malloc. It
+// stores the allocation under its address, with the size noted on entry
+// and the stack of the caller:
+//
+//	tid = bpf_get_current_pid_tgid();
+//	if (!(size = bpf_map_lookup_elem(sizes, &tid)))
+//		return 0;
+//	value.size = *size;
+//	bpf_map_delete_elem(sizes, &tid);
+//	if (!(key.addr = PT_REGS_RC(ctx)))
+//		return 0;
+//	value.stack = bpf_get_stackid(ctx, stacks, BPF_F_USER_STACK);
+//	key.pid = tid >> 32;
+//	bpf_map_update_elem(allocs, &key, &value, BPF_ANY);
+//	return 0;
+func bpfMallocReturn(sizes, allocs, stacks *bpfMap, arch bpfArch) []bpfInsn {
+	var p []bpfInsn
+	add := func(insns ...bpfInsn) { p = append(p, insns...) }
+	add(bpfInsn{code: bpfMov64Reg, dst: r6, src: r1})
+	add(bpfInsn{code: bpfCall, imm: bpfFuncGetCurrentPidTgid})
+	add(bpfInsn{code: bpfStxMemDW, dst: r10, src: r0, off: -8})
+	add(ldMapFD(r1, sizes.fd)...)
+	add(bpfInsn{code: bpfMov64Reg, dst: r2, src: r10})
+	add(bpfInsn{code: bpfAdd64Imm, dst: r2, imm: -8})
+	add(bpfInsn{code: bpfCall, imm: bpfFuncMapLookupElem})
+
+	var allocated []bpfInsn
+	allocated = append(allocated,
+		bpfInsn{code: bpfMov64Reg, dst: r1, src: r6})
+	allocated = append(allocated, ldMapFD(r2, stacks.fd)...)
+	allocated = append(allocated,
+		bpfInsn{code: bpfMov64Imm, dst: r3, imm: bpfFUserStack},
+		bpfInsn{code: bpfCall, imm: bpfFuncGetStackID},
+		bpfInsn{code: bpfStxMemDW, dst: r10, src: r7, off: -32},
+		bpfInsn{code: bpfStxMemW, dst: r10, src: r0, off: -24},
+		bpfInsn{code: bpfStMemW, dst: r10, off: -20},
+		bpfInsn{code: bpfStxMemDW, dst: r10, src: r8, off: -48},
+		bpfInsn{code: bpfLdxMemDW, dst: r1, src: r10, off: -8},
+		bpfInsn{code: bpfRsh64Imm, dst: r1, imm: 32},
+		bpfInsn{code: bpfStxMemW, dst: r10, src: r1, off: -40},
+		bpfInsn{code: bpfStMemW, dst: r10, off: -36})
+	allocated = append(allocated, ldMapFD(r1, allocs.fd)...)
+	allocated = append(allocated,
+		bpfInsn{code: bpfMov64Reg, dst: r2, src: r10},
+		bpfInsn{code: bpfAdd64Imm, dst: r2, imm: -48},
+		bpfInsn{code: bpfMov64Reg, dst: r3, src: r10},
+		bpfInsn{code: bpfAdd64Imm, dst: r3, imm: -32},
+		bpfInsn{code: bpfMov64Imm, dst: r4, imm: bpfAny},
+		bpfInsn{code: bpfCall, imm: bpfFuncMapUpdateElem})
+
+	var noted []bpfInsn
+	noted = append(noted,
+		bpfInsn{code: bpfLdxMemDW, dst: r7, src: r0})
+	noted = append(noted, ldMapFD(r1, sizes.fd)...)
+	noted = append(noted,
+		bpfInsn{code: bpfMov64Reg, dst: r2, src: r10},
+		bpfInsn{code: bpfAdd64Imm, dst: r2, imm: -8},
+		bpfInsn{code: bpfCall, imm: bpfFuncMapDeleteElem},
+		bpfInsn{code: bpfLdxMemDW, dst: r8, src: r6, off: arch.ret},
+		bpfInsn{code: bpfJeqImm, dst: r8, off: int16(len(allocated))})
+	noted = append(noted, allocated...)
+
+	add(bpfInsn{code: bpfJeqImm, dst: r0, off: int16(len(noted))})
+	add(noted...)
+	add(bpfExit0...)
+	return p
+}
+
+// bpfFreeEntry assembles the program run on entry to free. It forgets
+// the allocation freed:
+//
+//	if (!(key.addr = PT_REGS_PARM1(ctx)))
+//		return 0;
+//	key.pid = bpf_get_current_pid_tgid() >> 32;
+//	bpf_map_delete_elem(allocs, &key);
+//	return 0;
+func bpfFreeEntry(allocs *bpfMap, arch bpfArch) []bpfInsn {
+	var p []bpfInsn
+	add := func(insns ...bpfInsn) { p = append(p, insns...) }
+	add(bpfInsn{code: bpfLdxMemDW, dst: r7, src: r1, off: arch.arg0})
+	var freed []bpfInsn
+	freed = append(freed,
+		bpfInsn{code: bpfCall, imm: bpfFuncGetCurrentPidTgid},
+		bpfInsn{code: bpfRsh64Imm, dst: r0, imm: 32},
+		bpfInsn{code: bpfStxMemW, dst: r10, src: r0, off: -8},
+		bpfInsn{code: bpfStMemW, dst: r10, off: -4},
+		bpfInsn{code: bpfStxMemDW, dst: r10, src: r7, off: -16})
+	freed = append(freed, ldMapFD(r1, allocs.fd)...)
+	freed = append(freed,
+		bpfInsn{code: bpfMov64Reg, dst: r2, src: r10},
+		bpfInsn{code: bpfAdd64Imm, dst: r2, imm: -16},
+		bpfInsn{code: bpfCall, imm: bpfFuncMapDeleteElem})
+	add(bpfInsn{code: bpfJeqImm, dst: r7, off: int16(len(freed))})
+	add(freed...)
+	add(bpfExit0...)
+	return p
+}
+
+// recordHeap traces the allocations of pids for duration, or until ctx
+// is done, and returns those still outstanding at the end as samples of
+// one allocation each, with their sizes for periods.
+func recordHeap(ctx context.Context, pids []int, duration time.Duration) (*bpfRecording, error) {
+	arch, ok := bpfArchs[runtime.GOARCH]
+	if !ok {
+		return nil, fmt.Errorf("BPF is not supported on %s", runtime.GOARCH)
+	}
+	pmu, retBit, err := uprobePMU()
+	if err != nil {
+		return nil, err
+	}
+	libs := mallocLibs(pids)
+	if len(libs) == 0 {
+		return nil, &skipError{kind: "no-process", reason: "no target process maps a file defining malloc and free"}
+	}
+	raiseMemlockLimit()
+	stacks, err := newBPFMap(bpfMapTypeStackTrace, 4, bpfMaxStackDepth*8, bpfStackEntries)
+	if err != nil {
+		return nil, err
+	}
+	defer stacks.close()
+	targets, err := newBPFMap(bpfMapTypeHash, 4, 4, bpfHeapPids)
+	if err != nil {
+		return nil, err
+	}
+	defer targets.close()
+	sizes, err := newBPFMap(bpfMapTypeHash, 8, 8, bpfHeapThreads)
+	if err != nil {
+		return nil, err
+	}
+	defer sizes.close()
+	allocs, err := newBPFMap(bpfMapTypeHash, bpfAllocKeySize, bpfAllocValueSize, bpfHeapAllocs)
+	if err != nil {
+		return nil, err
+	}
+	defer allocs.close()
+	for i, pid := range pids {
+		if i == bpfHeapPids {
+			log.Printf("tracing the allocations of only %d of %d target processes", bpfHeapPids, len(pids))
+			break
+		}
+		key := make([]byte, 4)
+		binary.LittleEndian.PutUint32(key, uint32(pid))
+		if err := targets.update(key, []byte{1, 0, 0, 0}); err != nil {
+			return nil, fmt.Errorf("could not add process %d to BPF map: %s", pid, err)
+		}
+	}
+
+	type probe struct {
+		prog   []bpfInsn
+		config uint64
+		offset func(mallocLib) uint64
+	}
+	probes := []probe{
+		{bpfMallocEntry(targets, sizes, arch), 0, func(l mallocLib) uint64 { return l.malloc }},
+		{bpfMallocReturn(sizes, allocs, stacks, arch), 1 << retBit, func(l mallocLib) uint64 { return l.malloc }},
+		{bpfFreeEntry(allocs, arch), 0, func(l mallocLib) uint64 { return l.free }},
+	}
+	cpus, err := onlineCPUs()
+	if err != nil {
+		return nil, err
+	}
+	var events []int
+	defer func() {
+		for _, fd := range events {
+			syscall.Close(fd)
+		}
+	}()
+	for _, pr := range probes {
+		prog, err := loadBPFProgram(bpfProgTypeKprobe, pr.prog)
+		if err != nil {
+			return nil, err
+		}
+		defer syscall.Close(prog)
+		for _, lib := range libs {
+			for _, cpu := range cpus {
+				fd, err := openUprobe(pmu, pr.config, lib.path, pr.offset(lib), cpu)
+				if err != nil {
+					return nil, err
+				}
+				events = append(events, fd)
+				if err := ioctl(fd, perfEventIOCSetBPF, uintptr(prog)); err != nil {
+					return nil, fmt.Errorf("could not attach BPF program to uprobe on %s: %s", lib.path, err)
+				}
+			}
+		}
+	}
+
+	rec := &bpfRecording{freq: 1, mode: modeUser, start: time.Now()}
+	log.Printf("tracing the allocations of %d processes in %d files with BPF for %v", len(pids), len(libs), duration)
+	for _, fd := range events {
+		ioctl(fd, perfEventIOCEnable, 0)
+	}
+	t := time.NewTimer(duration)
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+		t.Stop()
+	}
+	for _, fd := range events {
+		ioctl(fd, perfEventIOCDisable, 0)
+	}
+	rec.end = time.Now()
+	return rec, rec.readAllocs(stacks, allocs)
+}
+
+// readAllocs adds the allocations in allocs to rec, one sample of each
+// process and stack.
+func (rec *bpfRecording) readAllocs(stacks, allocs *bpfMap) error {
+	trace := stackReader(stacks)
+	type site struct {
+		pid   uint32
+		stack int32
+	}
+	sites := make(map[site]int)
+	var n int
+	var err error
+	iterErr := allocs.each(func(key []byte) {
+		value, lookupErr := allocs.lookup(key)
+		if lookupErr == syscall.ENOENT {
+			return
+		} else if lookupErr != nil {
+			err = lookupErr
+			return
+		}
+		n++
+		at := site{pid: le32(key[8:]), stack: int32(le32(value[8:]))}
+		user, ok := trace(at.stack)
+		if !ok {
+			rec.lost++
+			return
+		}
+		if len(user) == 0 {
+			return
+		}
+		i, ok := sites[at]
+		if !ok {
+			i = len(rec.samples)
+			sites[at] = i
+			rec.samples = append(rec.samples, bpfSample{pid: at.pid, user: user})
+		}
+		rec.samples[i].count++
+		rec.samples[i].period += le64(value)
+	})
+	if iterErr != nil {
+		return fmt.Errorf("could not read BPF allocations: %s", iterErr)
+	}
+	if err != nil {
+		return fmt.Errorf("could not read BPF allocations: %s", err)
+	}
+	if n >= bpfHeapAllocs {
+		logWarnf("more than %d allocations were outstanding; the HEAP profile is missing some", bpfHeapAllocs)
+	}
+	return nil
+}
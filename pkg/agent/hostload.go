@@ -0,0 +1,106 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long CPU usage is measured for before a profile.
+const idleSampleInterval = time.Second
+
+// A loadGate defers collection while the host is saturated. perf's own
+// overhead, and that of converting and symbolizing its output, is small
+// on a healthy machine but can tip an overloaded one over the edge.
+type loadGate struct {
+	// maximum 1-minute load average per CPU; zero disables the check
+	maxLoad float64
+	// minimum percentage of idle CPU time; zero disables the check
+	minIdle float64
+}
+
+// loadAverage returns the 1-minute load average.
+func loadAverage() (float64, error) {
+	data, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, errors.New("empty /proc/loadavg")
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
+
+// cpuTimes returns the idle (including iowait) and total CPU time of the
+// host in clock ticks, from the first line of /proc/stat.
+func cpuTimes() (idle, total uint64, err error) {
+	data, err := ioutil.ReadFile("/proc/stat")
+	if err != nil {
+		return 0, 0, err
+	}
+	line := strings.SplitN(string(data), "\n", 2)[0]
+	fields := strings.Fields(line)
+	if len(fields) < 6 || fields[0] != "cpu" {
+		return 0, 0, errors.New("malformed /proc/stat")
+	}
+	// user nice system idle iowait irq softirq steal ...
+	for i, f := range fields[1:] {
+		v, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+		total += v
+		if i == 3 || i == 4 {
+			idle += v
+		}
+	}
+	return idle, total, nil
+}
+
+// idlePercent measures the percentage of CPU time the host spends idle
+// over interval.
+func idlePercent(interval time.Duration) (float64, error) {
+	idle0, total0, err := cpuTimes()
+	if err != nil {
+		return 0, err
+	}
+	time.Sleep(interval)
+	idle1, total1, err := cpuTimes()
+	if err != nil {
+		return 0, err
+	}
+	if total1 == total0 {
+		return 100, nil
+	}
+	return 100 * float64(idle1-idle0) / float64(total1-total0), nil
+}
+
+// check returns a *skipError if the host is too busy to be profiled.
+// Checks whose inputs cannot be read are passed.
+func (g loadGate) check() error {
+	if g.maxLoad > 0 {
+		if load, err := loadAverage(); err == nil {
+			cpus := runtime.NumCPU()
+			if load/float64(cpus) > g.maxLoad {
+				return &skipError{
+					kind:   "host-load",
+					reason: fmt.Sprintf("host overloaded: load average %.2f on %d CPUs", load, cpus),
+				}
+			}
+		}
+	}
+	if g.minIdle > 0 {
+		if idle, err := idlePercent(idleSampleInterval); err == nil && idle < g.minIdle {
+			return &skipError{
+				kind:   "host-load",
+				reason: fmt.Sprintf("host overloaded: %.1f%% CPU idle", idle),
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// agentVersion is the version of this agent, set at build time with
+//
+//	-ldflags "-X main.agentVersion=1.2.3"
+var agentVersion = "dev"
+
+// Deployment labels identifying the agent that uploaded a profile.
+const (
+	instanceLabel     = "agent-instance"
+	agentVersionLabel = "agent-version"
+)
+
+// The longest deployment label value the API accepts.
+const maxDeploymentLabelValue = 63
+
+// instanceID returns an ID for this agent that stays the same across
+// restarts: a hash of the host's machine ID, or its hostname if it has
+// none, and the -agent-id given, which tells apart agents sharing a host.
+func instanceID(agentID string) (string, error) {
+	machine, err := ioutil.ReadFile("/etc/machine-id")
+	if err != nil || len(bytes.TrimSpace(machine)) == 0 {
+		host, err := os.Hostname()
+		if err != nil {
+			return "", fmt.Errorf("no machine ID or hostname: %s", err)
+		}
+		machine = []byte(host)
+	}
+	sum := sha256.Sum256([]byte(strings.TrimSpace(string(machine)) + "\x00" + agentID))
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+// identityLabels returns the deployment labels identifying this agent.
+func identityLabels(instance string) map[string]string {
+	version := agentVersion
+	if len(version) > maxDeploymentLabelValue {
+		version = version[:maxDeploymentLabelValue]
+	}
+	return map[string]string{
+		instanceLabel:     instance,
+		agentVersionLabel: version,
+	}
+}
+
+// A heartbeat is the row an agent reports to the -heartbeat-url endpoint,
+// listing what it runs on and what it profiles.
+type heartbeat struct {
+	Instance string    `json:"instance"`
+	Version  string    `json:"version"`
+	Hostname string    `json:"hostname"`
+	Project  string    `json:"project"`
+	Service  string    `json:"service"`
+	Kernel   string    `json:"kernel"`
+	Perf     string    `json:"perf"`
+	Uploaded int64     `json:"uploaded"`
+	Time     time.Time `json:"time"`
+}
+
+// heartbeatLoop posts a heartbeat for a to url every interval. Failures
+// are logged and otherwise ignored; the inventory is not worth stopping
+// profiling for.
+func (a *agent) heartbeatLoop(url, instance string, interval time.Duration) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	host, _ := os.Hostname()
+	for {
+		hb := heartbeat{
+			Instance: instance,
+			Version:  agentVersion,
+			Hostname: host,
+			Project:  a.project,
+			Service:  a.service,
+			Kernel:   a.caps.kernel.String(),
+			Perf:     a.caps.perf.String(),
+			Uploaded: uploadCount.Value(),
+			Time:     time.Now().UTC(),
+		}
+		if err := postHeartbeat(client, url, hb); err != nil {
+			logWarnf("failed to report heartbeat: %s", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func postHeartbeat(client *http.Client, url string, hb heartbeat) error {
+	body, err := json.Marshal(hb)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package agent
+
+import (
+	"fmt"
+	"log"
+
+	pprof "github.com/google/pprof/profile"
+)
+
+// What to do with samples of the kernel's idle loop, which the swapper
+// tasks run whenever a CPU has nothing else to do. They dominate
+// system-wide profiles of lightly loaded hosts.
+type idleMode int
+
+const (
+	idleKeep idleMode = iota
+	idleDrop
+	// replace each idle stack with a single [idle] frame, keeping the
+	// amount of idle time visible but not its many variants
+	idleCollapse
+)
+
+func parseIdleMode(s string) (idleMode, error) {
+	switch s {
+	case "", "keep":
+		return idleKeep, nil
+	case "drop":
+		return idleDrop, nil
+	case "collapse":
+		return idleCollapse, nil
+	}
+	return 0, fmt.Errorf("unknown idle stack mode %q, must be keep, drop or collapse", s)
+}
+
+const idleFrame = "[idle]"
+
+// Functions of the kernel's idle loop and of the cpuidle drivers it
+// calls into. A sample with any of them on its stack was taken while the
+// CPU was idle, or entering or leaving idle.
+var idleFunctions = map[string]bool{
+	"do_idle":             true,
+	"cpu_idle":            true,
+	"cpu_idle_loop":       true,
+	"cpu_startup_entry":   true,
+	"default_idle":        true,
+	"default_idle_call":   true,
+	"arch_cpu_idle":       true,
+	"cpuidle_enter":       true,
+	"cpuidle_enter_state": true,
+	"cpuidle_idle_call":   true,
+	"poll_idle":           true,
+	"intel_idle":          true,
+	"acpi_idle_enter":     true,
+	"acpi_idle_do_entry":  true,
+	"mwait_idle":          true,
+	"native_safe_halt":    true,
+	"pv_native_safe_halt": true,
+}
+
+func idleSample(s *pprof.Sample) bool {
+	for _, loc := range s.Location {
+		for _, line := range loc.Line {
+			if line.Function != nil && idleFunctions[line.Function.Name] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// stripIdle drops or collapses the idle samples of p according to mode.
+// It returns the fraction of the first sample value that was idle, or -1
+// if mode is idleKeep.
+func stripIdle(p *pprof.Profile, mode idleMode) (*pprof.Profile, float64) {
+	if mode == idleKeep {
+		return p, -1
+	}
+	var idle, total int64
+	var frame *pprof.Location
+	samples := p.Sample[:0]
+	for _, s := range p.Sample {
+		var v int64
+		if len(s.Value) > 0 {
+			v = s.Value[0]
+		}
+		total += v
+		if !idleSample(s) {
+			samples = append(samples, s)
+			continue
+		}
+		idle += v
+		if mode == idleCollapse {
+			if frame == nil {
+				frame = addPseudoFrame(p, idleFrame)
+			}
+			s.Location = []*pprof.Location{frame}
+			samples = append(samples, s)
+		}
+	}
+	p.Sample = samples
+	if idle == 0 {
+		return p, 0
+	}
+	fraction := float64(idle) / float64(total)
+	verb := "dropped"
+	if mode == idleCollapse {
+		verb = "collapsed"
+	}
+	log.Printf("%s idle samples, %.1f%% of the profile", verb, 100*fraction)
+	addComment(p, fmt.Sprintf("%s idle samples, %.1f%% of the profile", verb, 100*fraction))
+	// Compact also merges the collapsed samples, which now share a
+	// stack.
+	return p.Compact(), fraction
+}
+
+// addPseudoFrame adds a location for a pseudo-function such as [idle]
+// to p.
+func addPseudoFrame(p *pprof.Profile, name string) *pprof.Location {
+	var fid, lid uint64
+	for _, f := range p.Function {
+		if f.ID > fid {
+			fid = f.ID
+		}
+	}
+	for _, l := range p.Location {
+		if l.ID > lid {
+			lid = l.ID
+		}
+	}
+	fn := &pprof.Function{ID: fid + 1, Name: name, SystemName: name}
+	loc := &pprof.Location{ID: lid + 1, Line: []pprof.Line{{Function: fn}}}
+	p.Function = append(p.Function, fn)
+	p.Location = append(p.Location, loc)
+	return loc
+}
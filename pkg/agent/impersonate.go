@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// Profiles of one team's workloads may need to be uploaded under that
+// team's service account, even when the agent's own credentials belong
+// to the host. With -impersonate, the agent's credentials are used only
+// to mint short-lived tokens for the named service account, which needs
+// to grant the agent's identity roles/iam.serviceAccountTokenCreator.
+
+const generateAccessTokenURL = "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/%s:generateAccessToken"
+
+// How long impersonated tokens are requested for.
+const impersonatedTokenLifetime = time.Hour
+
+// The scope the agent's own credentials need to impersonate.
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+type impersonatedTokenSource struct {
+	ctx     context.Context
+	client  *http.Client
+	url     string
+	account string
+	scopes  []string
+}
+
+// impersonate returns a token source for account with scopes, using the
+// credentials file keyFile, or application default credentials if it is
+// empty, to authorize the exchange.
+func impersonate(ctx context.Context, keyFile, account string, scopes []string) (oauth2.TokenSource, error) {
+	var source oauth2.TokenSource
+	var err error
+	if keyFile != "" {
+		source, err = credentialsFromFile(ctx, keyFile, cloudPlatformScope)
+	} else {
+		source, err = defaultTokenSource(ctx, cloudPlatformScope)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ts := &impersonatedTokenSource{
+		ctx:     ctx,
+		client:  oauth2.NewClient(ctx, source),
+		url:     fmt.Sprintf(generateAccessTokenURL, account),
+		account: account,
+		scopes:  scopes,
+	}
+	return oauth2.ReuseTokenSource(nil, ts), nil
+}
+
+func (ts *impersonatedTokenSource) Token() (*oauth2.Token, error) {
+	body, err := json.Marshal(struct {
+		Scope    []string `json:"scope"`
+		Lifetime string   `json:"lifetime"`
+	}{ts.scopes, fmt.Sprintf("%ds", int(impersonatedTokenLifetime.Seconds()))})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", ts.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := ts.client.Do(req.WithContext(ts.ctx))
+	if err != nil {
+		return nil, fmt.Errorf("could not impersonate %s: %s", ts.account, err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not impersonate %s: %s: %s", ts.account, resp.Status, bytes.TrimSpace(data))
+	}
+	var token struct {
+		AccessToken string    `json:"accessToken"`
+		ExpireTime  time.Time `json:"expireTime"`
+	}
+	if err := json.Unmarshal(data, &token); err != nil {
+		return nil, fmt.Errorf("could not parse token for %s: %s", ts.account, err)
+	}
+	return &oauth2.Token{
+		AccessToken: token.AccessToken,
+		TokenType:   "Bearer",
+		Expiry:      token.ExpireTime,
+	}, nil
+}
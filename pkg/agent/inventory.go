@@ -0,0 +1,144 @@
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	cloudprofiler "google.golang.org/genproto/googleapis/devtools/cloudprofiler/v2"
+
+	pprof "github.com/google/pprof/profile"
+)
+
+// USER_HZ, the unit of the CPU times in /proc/<pid>/stat. It is 100 on
+// every Linux architecture we care about.
+const clockTicks = 100
+
+type procStat struct {
+	comm  string
+	ppid  int
+	ticks uint64 // utime + stime
+}
+
+// A procSnapshot records the cumulative CPU time of every process on
+// the host at a point in time.
+type procSnapshot struct {
+	time  time.Time
+	procs map[int]procStat
+}
+
+func takeProcSnapshot() procSnapshot {
+	snap := procSnapshot{
+		time:  time.Now(),
+		procs: make(map[int]procStat),
+	}
+	paths, _ := filepath.Glob("/proc/[0-9]*/stat")
+	for _, path := range paths {
+		pid, err := strconv.Atoi(filepath.Base(filepath.Dir(path)))
+		if err != nil {
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			// the process exited
+			continue
+		}
+		if stat, ok := parseProcStat(string(data)); ok {
+			snap.procs[pid] = stat
+		}
+	}
+	return snap
+}
+
+// see proc(5). The command name is in parentheses and may itself contain
+// spaces or parentheses, so fields are counted from the last ')'.
+func parseProcStat(line string) (procStat, bool) {
+	open := strings.IndexByte(line, '(')
+	close := strings.LastIndexByte(line, ')')
+	if open < 0 || close < open {
+		return procStat{}, false
+	}
+	fields := strings.Fields(line[close+1:])
+	if len(fields) < 13 {
+		return procStat{}, false
+	}
+	ppid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return procStat{}, false
+	}
+	utime, err1 := strconv.ParseUint(fields[11], 10, 64)
+	stime, err2 := strconv.ParseUint(fields[12], 10, 64)
+	if err1 != nil || err2 != nil {
+		return procStat{}, false
+	}
+	return procStat{comm: line[open+1 : close], ppid: ppid, ticks: utime + stime}, true
+}
+
+// procUsage is the CPU consumed by all processes sharing a command name
+// over an interval, as a percentage of one CPU.
+type procUsage struct {
+	comm    string
+	procs   int
+	percent float64
+}
+
+// topProcesses returns the n command names that used the most CPU
+// between the two snapshots.
+func topProcesses(before, after procSnapshot, n int) []procUsage {
+	elapsed := after.time.Sub(before.time).Seconds()
+	if elapsed <= 0 {
+		return nil
+	}
+	byComm := make(map[string]*procUsage)
+	for pid, stat := range after.procs {
+		ticks := stat.ticks
+		// Processes that started during the window have no prior
+		// sample. A matching pid with a different name was reused.
+		if prev, ok := before.procs[pid]; ok && prev.comm == stat.comm && prev.ticks <= ticks {
+			ticks -= prev.ticks
+		}
+		if ticks == 0 {
+			continue
+		}
+		u := byComm[stat.comm]
+		if u == nil {
+			u = &procUsage{comm: stat.comm}
+			byComm[stat.comm] = u
+		}
+		u.procs++
+		u.percent += float64(ticks) / clockTicks / elapsed * 100
+	}
+	usage := make([]procUsage, 0, len(byComm))
+	for _, u := range byComm {
+		usage = append(usage, *u)
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		if usage[i].percent != usage[j].percent {
+			return usage[i].percent > usage[j].percent
+		}
+		return usage[i].comm < usage[j].comm
+	})
+	if len(usage) > n {
+		usage = usage[:n]
+	}
+	return usage
+}
+
+// annotateInventory records the busiest processes on the host in the
+// profile, both as a compact label and as a more detailed pprof comment.
+func annotateInventory(profile *cloudprofiler.Profile, p *pprof.Profile, top []procUsage) {
+	if len(top) == 0 {
+		return
+	}
+	var label, comment []string
+	for _, u := range top {
+		label = append(label, fmt.Sprintf("%s=%.0f%%", u.comm, u.percent))
+		comment = append(comment, fmt.Sprintf("%s %.1f%% (%d processes)", u.comm, u.percent, u.procs))
+	}
+	setProfileLabel(profile, "top-processes", strings.Join(label, ","))
+	addComment(p, "top processes by CPU: "+strings.Join(comment, ", "))
+}
@@ -0,0 +1,114 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/droyo/cloud-profiler-perf/pkg/perf"
+)
+
+// Runtimes that compile code at run time, such as the JVM with
+// libperf-jvmti, Node with --perf-prof or .NET with DOTNET_PerfMapEnabled,
+// can describe the code they compile in a jitdump file, which they map
+// so that perf records where it is. With -jit, perf records with the
+// monotonic clock the jitdump files are stamped with, and a recording
+// mapping any jitdump file is passed through perf inject --jit before it
+// is symbolized. perf inject writes the code of each compiled function
+// out as a small ELF file next to the jitdump file, and maps it in the
+// recording in place of the anonymous memory the code was run from, so
+// that the functions are symbolized like any other. The ELF files are
+// removed once the recording has been converted. The jitdump files must
+// be readable at the paths the processes mapped them from, which rules
+// out processes in containers that keep them in a /tmp of their own.
+
+var (
+	jitdumpRegexp = regexp.MustCompile(`^jit-\d+\.dump$`)
+	jittedRegexp  = regexp.MustCompile(`^jitted-\d+-\d+\.so$`)
+)
+
+// jitClockArgs returns perf record arguments args recording with the
+// monotonic clock, unless they already choose a clock.
+func jitClockArgs(args []string) []string {
+	if hasPerfOption(args, "-k") || hasPerfOption(args, "--clockid") {
+		return args
+	}
+	return addPerfOptions(args, "-k", "mono")
+}
+
+// jitdumps returns the jitdump files mapped in the perf.data file at
+// path.
+func jitdumps(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	maps, err := perf.Mappings(f)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var dumps []string
+	for _, pm := range maps {
+		for _, m := range pm {
+			if jitdumpRegexp.MatchString(filepath.Base(m.File)) && !seen[m.File] {
+				seen[m.File] = true
+				dumps = append(dumps, m.File)
+			}
+		}
+	}
+	return dumps, nil
+}
+
+// injectJIT runs perf inject --jit on the perf.data file at path, if it
+// maps any jitdump files, replacing it with the result. It returns the
+// ELF files perf inject wrote, for removeJitted.
+func injectJIT(path string) ([]string, error) {
+	dumps, err := jitdumps(path)
+	if err != nil || len(dumps) == 0 {
+		return nil, err
+	}
+	out := path + ".jit"
+	cmd := exec.Command("perf", "inject", "--jit", "-b", "-i", path, "-o", out)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	logDebugf("running %q", cmd.Args)
+	if err := cmd.Run(); err != nil {
+		os.Remove(out)
+		return nil, fmt.Errorf("perf inject --jit failed: %s; %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	if err := os.Rename(out, path); err != nil {
+		return nil, err
+	}
+	ids, err := perf.BuildIDs(path)
+	if err != nil {
+		return nil, err
+	}
+	var jitted []string
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		fields := strings.Fields(id)
+		if len(fields) != 2 {
+			continue
+		}
+		if file := fields[1]; jittedRegexp.MatchString(filepath.Base(file)) && !seen[file] {
+			seen[file] = true
+			jitted = append(jitted, file)
+		}
+	}
+	log.Printf("injected %d JIT-compiled functions from %d jitdump files into %s", len(jitted), len(dumps), path)
+	return jitted, nil
+}
+
+// removeJitted removes the ELF files perf inject wrote.
+func removeJitted(files []string) {
+	for _, file := range files {
+		os.Remove(file)
+	}
+}
@@ -0,0 +1,188 @@
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A version is a kernel or perf tool version.
+type version struct {
+	major, minor int
+}
+
+func (v version) String() string { return fmt.Sprintf("%d.%d", v.major, v.minor) }
+
+func (v version) atLeast(w version) bool {
+	return v.major > w.major || (v.major == w.major && v.minor >= w.minor)
+}
+
+var versionRegexp = regexp.MustCompile(`(\d+)\.(\d+)`)
+
+// parseVersion extracts the leading major.minor version from strings
+// such as "5.10.0-23-cloud-amd64" or "perf version 6.1.76".
+func parseVersion(s string) (version, error) {
+	m := versionRegexp.FindStringSubmatch(s)
+	if m == nil {
+		return version{}, fmt.Errorf("no version in %q", s)
+	}
+	major, _ := strconv.Atoi(m[1])
+	minor, _ := strconv.Atoi(m[2])
+	return version{major, minor}, nil
+}
+
+// A kernelFeature is a profiling capability that depends on both the
+// running kernel and the perf tool, which may be packaged separately
+// and lag behind or run ahead of the kernel.
+type kernelFeature struct {
+	name        string
+	kernel      version
+	perf        version
+	description string
+	// perf record options that need the feature
+	options []string
+	// If true, a perf command using options cannot be run without
+	// the feature, because dropping them would change what is
+	// profiled.
+	required bool
+}
+
+var kernelFeatures = []kernelFeature{
+	{
+		// Only checked on hosts using the unified cgroup hierarchy;
+		// the v1 perf_event controller is much older.
+		name:        "cgroup2",
+		kernel:      version{4, 11},
+		perf:        version{4, 11},
+		description: "perf_event controller in the cgroup v2 hierarchy",
+		options:     []string{"-G", "--cgroup"},
+		required:    true,
+	},
+	{
+		name:        "bpf-perf-event",
+		kernel:      version{4, 9},
+		description: "BPF programs attached to perf events",
+	},
+	{
+		name:        "btf",
+		kernel:      version{5, 4},
+		description: "kernel type information in /sys/kernel/btf/vmlinux",
+	},
+	{
+		name:        "zstd",
+		kernel:      version{5, 1},
+		perf:        version{5, 1},
+		description: "zstd compressed perf.data",
+		options:     []string{"-z", "--compression-level"},
+	},
+	{
+		name:        "cgroup-sampling",
+		kernel:      version{5, 7},
+		perf:        version{5, 7},
+		description: "cgroup id recorded in each sample",
+		options:     []string{"--all-cgroups"},
+	},
+	{
+		name:        "buildid-mmap",
+		kernel:      version{5, 12},
+		perf:        version{5, 12},
+		description: "build ids recorded in mmap events",
+		options:     []string{"--buildid-mmap"},
+	},
+	{
+		name:        "off-cpu",
+		kernel:      version{5, 19},
+		perf:        version{6, 0},
+		description: "off-CPU profiling with BPF",
+		options:     []string{"--off-cpu"},
+	},
+}
+
+// capabilities is the set of kernelFeatures available on this host.
+type capabilities struct {
+	kernel, perf version
+	features     map[string]bool
+}
+
+func (c capabilities) has(name string) bool { return c.features[name] }
+
+func (c capabilities) String() string {
+	var names []string
+	for _, f := range kernelFeatures {
+		if c.features[f.name] {
+			names = append(names, f.name)
+		}
+	}
+	return fmt.Sprintf("kernel %s, perf %s: %s", c.kernel, c.perf, strings.Join(names, " "))
+}
+
+func hostKernelVersion() (version, error) {
+	release, err := ioutil.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return version{}, err
+	}
+	return parseVersion(string(release))
+}
+
+func perfVersion() (version, error) {
+	out, err := exec.Command("perf", "version").Output()
+	if err != nil {
+		return version{}, fmt.Errorf("perf version: %s", err)
+	}
+	return parseVersion(string(out))
+}
+
+// probeCapabilities determines which kernelFeatures this host has. A
+// version that cannot be determined is treated as too old for any
+// feature that needs it.
+func probeCapabilities() capabilities {
+	c := capabilities{features: make(map[string]bool)}
+	var err error
+	if c.kernel, err = hostKernelVersion(); err != nil {
+		logWarnf("could not determine kernel version: %s", err)
+	}
+	if c.perf, err = perfVersion(); err != nil {
+		logWarnf("could not determine perf version: %s", err)
+	}
+	for _, f := range kernelFeatures {
+		c.features[f.name] = c.kernel.atLeast(f.kernel) && c.perf.atLeast(f.perf)
+	}
+	if !unifiedCgroups() {
+		c.features["cgroup2"] = true
+	}
+	return c
+}
+
+// unifiedCgroups reports whether the host uses the cgroup v2 hierarchy
+// exclusively.
+func unifiedCgroups() bool {
+	_, err := ioutil.ReadFile("/sys/fs/cgroup/cgroup.controllers")
+	return err == nil
+}
+
+// adaptPerfArgs removes options from the perf record arguments args that
+// need features this host lacks, so that one perf command can be used
+// across a fleet with several kernel generations. It returns an error if
+// an option cannot be removed without changing what is profiled.
+func adaptPerfArgs(args []string, caps capabilities) ([]string, error) {
+	for _, f := range kernelFeatures {
+		if len(f.options) == 0 || caps.has(f.name) {
+			continue
+		}
+		for _, opt := range f.options {
+			if !hasPerfOption(args, opt) {
+				continue
+			}
+			if f.required {
+				return nil, fmt.Errorf("perf option %s needs %s (kernel %s, perf %s), but this host has %s",
+					opt, f.description, f.kernel, f.perf, caps)
+			}
+			logWarnf("dropping perf option %s: needs %s (kernel %s, perf %s)", opt, f.description, f.kernel, f.perf)
+			args = removePerfOption(args, opt)
+		}
+	}
+	return args, nil
+}
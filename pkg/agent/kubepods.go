@@ -0,0 +1,184 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	cloudprofiler "google.golang.org/genproto/googleapis/devtools/cloudprofiler/v2"
+
+	pprof "github.com/google/pprof/profile"
+)
+
+// An agent run as a DaemonSet profiles its whole node, and the workloads
+// of every pod on it end up in one deployment. With -kubernetes, the
+// samples of each system-wide profile are also split by the container
+// their process ran in, and each pod container's share is uploaded as a
+// profile of its own, labeled with its namespace, pod and container. The
+// containers are matched to pods by listing the pods of the node from
+// the API server, again whenever a container not seen before turns up,
+// so the agent's service account needs to list pods. Samples of
+// processes outside pods, or that exited before the recording was
+// converted, are only in the node's profile.
+
+// A podContainer names a container of a pod.
+type podContainer struct {
+	namespace, pod, name string
+}
+
+// A podIndex finds the pod containers of the node the agent runs on.
+type podIndex struct {
+	k    *kubeClient
+	node string
+	// by container ID
+	containers map[string]podContainer
+}
+
+// newPodIndex returns the index of the pods of the agent's node, named
+// by $NODE_NAME or found from the agent's own pod.
+func newPodIndex() (*podIndex, error) {
+	k, err := inClusterClient()
+	if err != nil {
+		return nil, err
+	}
+	x := &podIndex{k: k, node: os.Getenv("NODE_NAME")}
+	if x.node == "" {
+		pod, err := k.findPod("", "")
+		if err != nil {
+			return nil, fmt.Errorf("could not find the agent's node: set $NODE_NAME, or %s", err)
+		}
+		x.node = pod.Spec.NodeName
+	}
+	if x.node == "" {
+		return nil, errors.New("could not find the agent's node: set $NODE_NAME")
+	}
+	if err := x.refresh(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// refresh lists the pods of the node again.
+func (x *podIndex) refresh() error {
+	pods, err := x.k.nodePods(x.node)
+	if err != nil {
+		return fmt.Errorf("could not list the pods of node %s: %s", x.node, err)
+	}
+	containers := make(map[string]podContainer)
+	for _, pod := range pods {
+		for _, st := range pod.Status.ContainerStatuses {
+			id := st.ContainerID
+			if i := strings.Index(id, "://"); i >= 0 {
+				id = id[i+3:]
+			}
+			if id == "" {
+				continue
+			}
+			containers[id] = podContainer{
+				namespace: pod.Metadata.Namespace,
+				pod:       pod.Metadata.Name,
+				name:      st.Name,
+			}
+		}
+	}
+	x.containers = containers
+	return nil
+}
+
+// podSamples groups the samples of p by the pod container of their
+// process, by index.
+func (x *podIndex) podSamples(p *pprof.Profile) map[podContainer][]int {
+	groups := make(map[podContainer][]int)
+	byPid := make(map[int64]*podContainer)
+	var refreshed bool
+	for i, s := range p.Sample {
+		pids := s.NumLabel["pid"]
+		if len(pids) != 1 {
+			continue
+		}
+		pc, ok := byPid[pids[0]]
+		if !ok {
+			if c, ok := processContainer(int(pids[0])); ok {
+				found, ok := x.containers[c.id]
+				if !ok && !refreshed {
+					// a pod started since the last listing
+					refreshed = true
+					if err := x.refresh(); err != nil {
+						logWarnf("%s", err)
+					}
+					found, ok = x.containers[c.id]
+				}
+				if ok {
+					pc = &found
+				}
+			}
+			byPid[pids[0]] = pc
+		}
+		if pc != nil {
+			groups[*pc] = append(groups[*pc], i)
+		}
+	}
+	return groups
+}
+
+// uploadPods uploads the share of each pod container in p, the
+// converted profile, lasting duration, of the system-wide recording for
+// profile.
+func (a *agent) uploadPods(profile *cloudprofiler.Profile, p *pprof.Profile, duration time.Duration) {
+	for pc, samples := range a.pods.podSamples(p) {
+		q := p.Copy()
+		all := q.Sample
+		q.Sample = make([]*pprof.Sample, 0, len(samples))
+		for _, i := range samples {
+			q.Sample = append(q.Sample, all[i])
+		}
+		if err := a.uploadPod(profile, pc, q.Compact(), duration); err != nil {
+			logWarnf("failed to upload profile of pod %s/%s container %s: %s", pc.namespace, pc.pod, pc.name, err)
+		}
+	}
+}
+
+func (a *agent) uploadPod(profile *cloudprofiler.Profile, pc podContainer, p *pprof.Profile, duration time.Duration) error {
+	labels := make(map[string]string, len(a.labels)+3)
+	for k, v := range a.labels {
+		labels[k] = v
+	}
+	for k, v := range map[string]string{"namespace": pc.namespace, "pod": pc.pod, "container": pc.name} {
+		if len(v) > maxDeploymentLabelValue {
+			v = v[:maxDeploymentLabelValue]
+		}
+		labels[k] = v
+	}
+	podProfile := &cloudprofiler.Profile{
+		ProfileType: profile.ProfileType,
+		Deployment: &cloudprofiler.Deployment{
+			ProjectId: a.project,
+			Target:    a.service,
+			Labels:    labels,
+		},
+		Duration: ptypes.DurationProto(duration),
+	}
+	for k, v := range profile.Labels {
+		setProfileLabel(podProfile, k, v)
+	}
+	setProfileLabel(podProfile, "node", a.pods.node)
+	addComment(p, fmt.Sprintf("samples of pod %s/%s container %s, split from a profile of node %s", pc.namespace, pc.pod, pc.name, a.pods.node))
+	if err := setProfileBytes(podProfile, p); err != nil {
+		return err
+	}
+	uploaded, err := a.tryCreateOfflineProfile(podProfile)
+	if err != nil {
+		return err
+	}
+	fields := profileFields(podProfile)
+	fields["profile"] = uploaded.Name
+	logAt(levelInfo, fields, "uploaded profile of pod %s/%s container %s as %s", pc.namespace, pc.pod, pc.name, uploaded.Name)
+	profileUploaded(uploaded.ProfileType, uploaded.Name)
+	if err := a.audit.record(uploaded); err != nil {
+		logWarnf("failed to write audit record for %s: %s", uploaded.Name, err)
+	}
+	return nil
+}
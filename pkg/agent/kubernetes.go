@@ -0,0 +1,230 @@
+package agent
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// When the agent runs in a Kubernetes cluster, -k8s-labels copies labels
+// of the node and of the profiled pod onto the deployment, so the
+// cluster's metadata conventions carry over to the profiler. The agent
+// reads them from the API server with its pod's service account, which
+// needs to get nodes and list pods.
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubernetesAPIAddr returns the host:port of the API server, or "" if the
+// agent does not run in a Kubernetes pod.
+func kubernetesAPIAddr() string {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return ""
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// A kubeClient makes requests to the Kubernetes API server the agent's
+// pod can reach.
+type kubeClient struct {
+	base   string
+	token  string
+	client *http.Client
+}
+
+// inClusterClient returns a client authenticated with the service account
+// of the agent's pod.
+func inClusterClient() (*kubeClient, error) {
+	addr := kubernetesAPIAddr()
+	if addr == "" {
+		return nil, errors.New("not running in a Kubernetes pod")
+	}
+	token, err := ioutil.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, err
+	}
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no certificates in " + serviceAccountDir + "/ca.crt")
+	}
+	return &kubeClient{
+		base:  "https://" + addr,
+		token: strings.TrimSpace(string(token)),
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				DialContext:     dialContext,
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		},
+	}, nil
+}
+
+func (k *kubeClient) get(path string, v interface{}) error {
+	req, err := http.NewRequest("GET", k.base+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+k.token)
+	req.Header.Set("Accept", "application/json")
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+	return json.Unmarshal(body, v)
+}
+
+type kubeObject struct {
+	Metadata struct {
+		Name      string            `json:"name"`
+		Namespace string            `json:"namespace"`
+		UID       string            `json:"uid"`
+		Labels    map[string]string `json:"labels"`
+	} `json:"metadata"`
+	Spec struct {
+		NodeName string `json:"nodeName"`
+	} `json:"spec"`
+	Status struct {
+		ContainerStatuses []struct {
+			Name string `json:"name"`
+			// runtime://id
+			ContainerID string `json:"containerID"`
+		} `json:"containerStatuses"`
+	} `json:"status"`
+}
+
+// findPod returns the pod with uid on node, or if uid is empty, the pod
+// named by $POD_NAMESPACE and $POD_NAME, as set from the downward API.
+func (k *kubeClient) findPod(uid, node string) (*kubeObject, error) {
+	if uid == "" {
+		ns, name := os.Getenv("POD_NAMESPACE"), os.Getenv("POD_NAME")
+		if ns == "" || name == "" {
+			return nil, errors.New("$POD_NAMESPACE and $POD_NAME are not set")
+		}
+		var pod kubeObject
+		err := k.get("/api/v1/namespaces/"+url.PathEscape(ns)+"/pods/"+url.PathEscape(name), &pod)
+		return &pod, err
+	}
+	pods, err := k.nodePods(node)
+	if err != nil {
+		return nil, err
+	}
+	for i := range pods {
+		if pods[i].Metadata.UID == uid {
+			return &pods[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no pod with UID %s", uid)
+}
+
+// nodePods returns the pods on node, or in the cluster if node is empty.
+func (k *kubeClient) nodePods(node string) ([]kubeObject, error) {
+	path := "/api/v1/pods"
+	if node != "" {
+		path += "?fieldSelector=" + url.QueryEscape("spec.nodeName="+node)
+	}
+	var pods struct {
+		Items []kubeObject `json:"items"`
+	}
+	if err := k.get(path, &pods); err != nil {
+		return nil, err
+	}
+	return pods.Items, nil
+}
+
+// A kubeLabel maps the Kubernetes label key to the deployment label name.
+type kubeLabel struct {
+	key, name string
+}
+
+var invalidLabelChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// parseKubeLabels parses a list of Kubernetes label keys, each optionally
+// followed by =name to choose its deployment label. By default the label
+// is named after the last part of the key, so topology.kubernetes.io/zone
+// becomes zone.
+func parseKubeLabels(s string) ([]kubeLabel, error) {
+	var labels []kubeLabel
+	for _, field := range strings.Split(s, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		l := kubeLabel{key: field}
+		if i := strings.Index(field, "="); i >= 0 {
+			l.key, l.name = field[:i], field[i+1:]
+		} else {
+			name := l.key[strings.LastIndex(l.key, "/")+1:]
+			l.name = strings.Trim(invalidLabelChars.ReplaceAllString(strings.ToLower(name), "-"), "-")
+		}
+		if !labelNameRegexp.MatchString(l.name) {
+			return nil, fmt.Errorf("%q is not a valid deployment label name for %s; choose one with %s=name", l.name, l.key, l.key)
+		}
+		labels = append(labels, l)
+	}
+	return labels, nil
+}
+
+// kubeDeploymentLabels returns the deployment labels for wanted, taken
+// from the pod with uid, or the agent's own pod if uid is empty, and the
+// node it runs on. Pod labels take precedence over node labels.
+func kubeDeploymentLabels(wanted []kubeLabel, uid string) (map[string]string, error) {
+	k, err := inClusterClient()
+	if err != nil {
+		return nil, err
+	}
+	node := os.Getenv("NODE_NAME")
+	pod, err := k.findPod(uid, node)
+	if err != nil {
+		return nil, fmt.Errorf("could not find pod: %s", err)
+	}
+	if node == "" {
+		node = pod.Spec.NodeName
+	}
+	var nodeLabels map[string]string
+	if node != "" {
+		var n kubeObject
+		if err := k.get("/api/v1/nodes/"+url.PathEscape(node), &n); err != nil {
+			return nil, fmt.Errorf("could not get node %s: %s", node, err)
+		}
+		nodeLabels = n.Metadata.Labels
+	}
+	labels := make(map[string]string)
+	for _, l := range wanted {
+		v, ok := pod.Metadata.Labels[l.key]
+		if !ok {
+			v, ok = nodeLabels[l.key]
+		}
+		if !ok {
+			log.Printf("neither pod %s nor node %s has label %s", pod.Metadata.Name, node, l.key)
+			continue
+		}
+		if len(v) > maxDeploymentLabelValue {
+			v = v[:maxDeploymentLabelValue]
+		}
+		labels[l.name] = v
+	}
+	return labels, nil
+}
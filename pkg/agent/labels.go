@@ -0,0 +1,208 @@
+package agent
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	cloudprofiler "google.golang.org/genproto/googleapis/devtools/cloudprofiler/v2"
+
+	pprof "github.com/google/pprof/profile"
+)
+
+// Limits the profiler API places on labels. A profile whose labels exceed
+// them is rejected with InvalidArgument, losing the whole upload.
+const (
+	maxLabelValue = 512
+	// all label names and values of a profile, including those of its
+	// deployment
+	maxLabelBytes = 1024
+)
+
+// Limits on the comments added to profiles. Comments are not limited by
+// the API, but they are stored with every profile.
+const (
+	maxComments      = 32
+	maxCommentLength = 1024
+)
+
+var labelNameRegexp = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// Labels that are kept first when a profile has more than fit. Other
+// labels are kept in order of their names.
+var labelPriority = []string{
+	"partial",
+	"recovered",
+	symbolsLabel,
+	mismatchLabel,
+	"container",
+	"pod-uid",
+	"exit-status",
+	leakLabel,
+	"perf-defaults",
+	"sampling-frequency",
+	"sampling-adjustment",
+	"idle-fraction",
+	"elided-frames",
+	"command",
+	"top-processes",
+}
+
+// Profiles some of whose binaries had been replaced by another build
+// since they were mapped carry this label, whose value is their number.
+const mismatchLabel = "build-id-mismatch"
+
+// Deployment labels the Profiler UI groups and filters profiles by.
+const (
+	zoneLabel    = "zone"
+	versionLabel = "version"
+)
+
+// parseDeploymentLabels parses the key=value deployment labels of -label.
+func parseDeploymentLabels(flags []string) (map[string]string, error) {
+	labels := make(map[string]string, len(flags))
+	for _, f := range flags {
+		i := strings.Index(f, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("-label %s: expected key=value", f)
+		}
+		k, v := f[:i], f[i+1:]
+		switch {
+		case !labelNameRegexp.MatchString(k):
+			return nil, fmt.Errorf("-label %s: %q is not a valid label name", f, k)
+		case len(v) > maxDeploymentLabelValue:
+			return nil, fmt.Errorf("-label %s: values of deployment labels are limited to %d bytes", f, maxDeploymentLabelValue)
+		}
+		labels[k] = v
+	}
+	return labels, nil
+}
+
+// addDeploymentLabels adds the zone of the instance, unless a label
+// names it already, then the -service-version and the -label labels,
+// which take precedence over labels from elsewhere.
+func (a *agent) addDeploymentLabels() error {
+	labels, err := parseDeploymentLabels(deployLabels)
+	if err != nil {
+		return err
+	}
+	if *serviceVer != "" {
+		if len(*serviceVer) > maxDeploymentLabelValue {
+			return fmt.Errorf("-service-version is limited to %d bytes", maxDeploymentLabelValue)
+		}
+		if _, ok := labels[versionLabel]; !ok {
+			labels[versionLabel] = *serviceVer
+		}
+	}
+	if a.labels == nil {
+		a.labels = make(map[string]string)
+	}
+	if _, ok := labels[zoneLabel]; !ok && a.labels[zoneLabel] == "" {
+		if zone, err := instanceZone(); err == nil && zone != "" {
+			labels[zoneLabel] = zone
+		}
+	}
+	for k, v := range labels {
+		log.Printf("labeling deployment %s=%s", k, v)
+		a.labels[k] = v
+	}
+	return nil
+}
+
+// setProfileLabel attaches a label to a single uploaded profile. The
+// server merges these with the deployment labels. Labels the API would
+// reject are dropped, and values that are too long are truncated.
+func setProfileLabel(profile *cloudprofiler.Profile, key, value string) {
+	if !labelNameRegexp.MatchString(key) {
+		logWarnf("not setting label %q: invalid label name", key)
+		return
+	}
+	if len(value) > maxLabelValue {
+		log.Printf("truncating %d byte value of label %s", len(value), key)
+		value = truncateLabel(value)
+	}
+	if profile.Labels == nil {
+		profile.Labels = make(map[string]string)
+	}
+	profile.Labels[key] = value
+}
+
+// truncateLabel shortens s to the longest label value the API accepts,
+// without splitting a UTF-8 sequence.
+func truncateLabel(s string) string {
+	if len(s) <= maxLabelValue {
+		return s
+	}
+	n := maxLabelValue
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+func labelOrder(labels map[string]string) []string {
+	rank := make(map[string]int, len(labelPriority))
+	for i, k := range labelPriority {
+		rank[k] = i + 1
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		ri, rj := rank[keys[i]], rank[keys[j]]
+		switch {
+		case ri != 0 && rj != 0:
+			return ri < rj
+		case ri != 0 || rj != 0:
+			return ri != 0
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+// fitLabels drops labels of profile until they fit in the API's budget
+// alongside those of its deployment. Which labels are dropped depends
+// only on the labels, not on the order they were set in.
+func fitLabels(profile *cloudprofiler.Profile) {
+	var used int
+	if d := profile.Deployment; d != nil {
+		for k, v := range d.Labels {
+			used += len(k) + len(v)
+		}
+	}
+	var dropped []string
+	for _, k := range labelOrder(profile.Labels) {
+		n := len(k) + len(profile.Labels[k])
+		if used+n > maxLabelBytes {
+			dropped = append(dropped, k)
+			delete(profile.Labels, k)
+			continue
+		}
+		used += n
+	}
+	if len(dropped) > 0 {
+		logWarnf("dropped labels %s from profile to stay within %d bytes", strings.Join(dropped, ", "), maxLabelBytes)
+	}
+}
+
+// addComment adds a comment to p, truncated to maxCommentLength. Once p
+// has maxComments comments, further ones are dropped.
+func addComment(p *pprof.Profile, comment string) {
+	if len(p.Comments) >= maxComments {
+		logWarnf("dropped profile comment: %.80s", comment)
+		return
+	}
+	if len(comment) > maxCommentLength {
+		n := maxCommentLength
+		for n > 0 && !utf8.RuneStart(comment[n]) {
+			n--
+		}
+		comment = comment[:n]
+	}
+	p.Comments = append(p.Comments, comment)
+}
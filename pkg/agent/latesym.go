@@ -0,0 +1,261 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"golang.org/x/oauth2"
+	cloudprofiler "google.golang.org/genproto/googleapis/devtools/cloudprofiler/v2"
+
+	"github.com/droyo/cloud-profiler-perf/pkg/perf"
+)
+
+// Symbolizing a profile can take more CPU and memory than a small host
+// can spare. With -late-symbols, the agent uploads profiles with
+// addresses only, labeled symbols=pending, and copies each recording
+// with the build IDs of its binaries to Cloud Storage. The symbolize
+// subcommand, run wherever the binaries are available, symbolizes them
+// and uploads the results with CreateOfflineProfile, labeled
+// symbols=late.
+const symbolizeCommand = "symbolize"
+
+// Profiles uploaded with addresses only, and those symbolized from their
+// recordings, carry this label.
+const symbolsLabel = "symbols"
+
+// Objects of each recording in the late symbols store.
+const (
+	lateRecordingObject = "recording.json"
+	latePerfDataObject  = "perf.data"
+)
+
+// A lateRecording describes a recording waiting to be symbolized.
+type lateRecording struct {
+	// name of the address-only profile
+	Name        string
+	ProfileType cloudprofiler.ProfileType
+	Project     string
+	Target      string
+	// deployment labels
+	Deployment map[string]string
+	Labels     map[string]string
+	Duration   time.Duration
+	// "build-id path" pairs, as listed by perf buildid-list
+	BuildIDs []string
+	Time     time.Time
+}
+
+// newLateStore returns the store of recordings at the gs:// URL u.
+func newLateStore(u string, ts oauth2.TokenSource) (*gcsStore, error) {
+	bucket, prefix, err := parseGCSURL(u)
+	if err != nil {
+		return nil, err
+	}
+	return &gcsStore{bucket: bucket, prefix: prefix, client: oauth2.NewClient(context.Background(), ts)}, nil
+}
+
+// recordingKey names the objects of the recording of profile.
+func recordingKey(profile *cloudprofiler.Profile) string {
+	if profile.Name != "" {
+		return path.Base(profile.Name)
+	}
+	return fmt.Sprintf("%s-%d", time.Now().UTC().Format("20060102T150405.000Z"), os.Getpid())
+}
+
+// pushLateSymbols copies perfData, the recording of profile, to the late
+// symbols store.
+func (a *agent) pushLateSymbols(profile *cloudprofiler.Profile, perfData string) error {
+	ids, err := perf.BuildIDs(perfData)
+	if err != nil {
+		return err
+	}
+	duration, _ := ptypes.Duration(profile.Duration)
+	rec := lateRecording{
+		Name:        profile.Name,
+		ProfileType: profile.ProfileType,
+		Project:     a.project,
+		Target:      a.service,
+		Deployment:  a.labels,
+		Labels:      profile.Labels,
+		Duration:    duration,
+		BuildIDs:    ids,
+		Time:        time.Now().UTC(),
+	}
+	meta, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	key := recordingKey(profile)
+	f, err := os.Open(perfData)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := a.late.put(path.Join(key, latePerfDataObject), f, info.Size()); err != nil {
+		return err
+	}
+	// written last, as the symbolize pipeline looks for it
+	if err := a.late.put(path.Join(key, lateRecordingObject), bytes.NewReader(meta), int64(len(meta))); err != nil {
+		return err
+	}
+	log.Printf("copied recording of %s to %s/%s", profile.ProfileType, a.late, key)
+	return nil
+}
+
+// runSymbolize runs the symbolize subcommand with its arguments args: a
+// -symbols directory of binaries, which may be in any layout pprof
+// searches with $PPROF_BINARY_PATH, such as <dir>/<build-id>/<name>,
+// followed by the gs:// URLs of the recordings to symbolize.
+func runSymbolize(args []string) error {
+	fs := flag.NewFlagSet(symbolizeCommand, flag.ContinueOnError)
+	symbols := fs.String("symbols", "", "`directory` of binaries to symbolize recordings with")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *symbols == "" || fs.NArg() == 0 {
+		return errors.New("usage: symbolize -symbols dir gs://bucket/path/recording ...")
+	}
+	dir, err := filepath.Abs(*symbols)
+	if err != nil {
+		return err
+	}
+
+	var a agent
+	a.ctx = context.Background()
+	a.convert = newConverterPool(a.ctx, *conversions)
+	if a.sources, err = parseSourceRules(sourcePaths); err != nil {
+		return err
+	}
+	if *auditPath != "" {
+		if a.audit, err = openAuditLog(*auditPath); err != nil {
+			return fmt.Errorf("failed to open audit log: %s", err)
+		}
+	}
+	ts, err := a.tokenSource(gcsScope)
+	if err != nil {
+		return fmt.Errorf("failed to load credentials for Cloud Storage: %s", err)
+	}
+	if err := a.useCredentials(); err != nil {
+		return err
+	}
+	if a.backoff, err = backoffPolicy(); err != nil {
+		return err
+	}
+	if a.endpoints, err = newEndpointSet(*serverAddr); err != nil {
+		return err
+	}
+	if err := a.connect(false); err != nil {
+		return err
+	}
+	defer a.endpoints.conn.Close()
+
+	if a.tmpdir, err = ioutil.TempDir("", filepath.Base(os.Args[0])); err != nil {
+		return fmt.Errorf("failed to create temp directory: %s", err)
+	}
+	defer os.RemoveAll(a.tmpdir)
+
+	var failed int
+	for _, u := range fs.Args() {
+		store, err := newLateStore(u, ts)
+		if err == nil {
+			err = a.symbolizeRecording(store, dir)
+		}
+		if err != nil {
+			logErrorf("could not symbolize %s: %s", u, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d recordings could not be symbolized", failed, fs.NArg())
+	}
+	return nil
+}
+
+// symbolizeRecording symbolizes the recording in store with the binaries
+// in symbols, and uploads the result.
+func (a *agent) symbolizeRecording(store *gcsStore, symbols string) error {
+	var meta bytes.Buffer
+	if err := store.get(lateRecordingObject, &meta); err != nil {
+		return err
+	}
+	var rec lateRecording
+	if err := json.Unmarshal(meta.Bytes(), &rec); err != nil {
+		return fmt.Errorf("malformed %s: %s", lateRecordingObject, err)
+	}
+	dir, err := a.newWorkDir(rec.ProfileType)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	f, err := os.Create(filepath.Join(dir, "perf.data"))
+	if err != nil {
+		return err
+	}
+	err = store.get(latePerfDataObject, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	job := &conversion{
+		dst:      filepath.Join(dir, "perf.pprof"),
+		src:      filepath.Join(dir, "perf.data"),
+		symbols:  symbols,
+		prebuilt: true,
+	}
+	if err := a.convert.convert(a.ctx, job); err != nil {
+		return err
+	}
+	p, err := readPprof(job.dst)
+	if err != nil {
+		return fmt.Errorf("could not parse converted profile: %s", err)
+	}
+	if rec.Name != "" {
+		addComment(p, "symbolized late; the address-only profile is "+rec.Name)
+	}
+	rewriteSourcePaths(p, a.sources)
+
+	a.project = rec.Project
+	a.service = rec.Target
+	a.labels = rec.Deployment
+	profile := &cloudprofiler.Profile{
+		ProfileType: rec.ProfileType,
+		Deployment:  a.deployment(),
+		Duration:    ptypes.DurationProto(rec.Duration),
+	}
+	for k, v := range rec.Labels {
+		setProfileLabel(profile, k, v)
+	}
+	setProfileLabel(profile, symbolsLabel, "late")
+	if job.partial {
+		setProfileLabel(profile, "partial", "true")
+	}
+	if err := setProfileBytes(profile, p); err != nil {
+		return err
+	}
+	uploaded, err := a.tryCreateOfflineProfile(profile)
+	if err != nil {
+		return err
+	}
+	log.Printf("uploaded symbolized %s profile %s from %s", uploaded.ProfileType, uploaded.Name, store)
+	if err := a.audit.record(uploaded); err != nil {
+		logWarnf("failed to write audit record for %s: %s", uploaded.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	cloudprofiler "google.golang.org/genproto/googleapis/devtools/cloudprofiler/v2"
+)
+
+// In run mode the agent starts the command to profile itself, rather than
+// waiting for the profiler API to ask for profiles of the whole host. This
+// suits batch and CI jobs, which may be over before the API would ask.
+const runModeCommand = "run"
+
+// The perf command used in run mode. The pid is that of the launched
+// command.
+var runModePerf = []string{"record", "-g", "-F", "99", "-p", "{{ .Pid }}"}
+
+// perf attaches to the launched command only once it is running, so the
+// command is started stopped, by a shell that stops itself before it
+// execs the command in its place, and continued once perf has attached.
+// Its startup is then recorded, as are commands that would have exited
+// before perf was ready. If perf has not attached within attachTimeout,
+// as when the first profile is skipped, the command is continued anyway.
+const (
+	stopAndExec   = `kill -STOP $$ && exec "$@"`
+	attachTimeout = 10 * time.Second
+)
+
+// Environment variables naming the service and version of a job, in the
+// order they are looked for. Besides the generic names, these are the
+// conventions of Cloud Run and App Engine.
+var (
+	serviceEnv = []string{"SERVICE", "K_SERVICE", "GAE_SERVICE"}
+	versionEnv = []string{"VERSION", "K_REVISION", "GAE_VERSION"}
+)
+
+// A launched command is a child process started in run mode.
+type launched struct {
+	// the command as given; cmd may run it through a shell
+	args []string
+	cmd  *exec.Cmd
+	done chan struct{}
+	err  error
+}
+
+// runModeArgs returns the command to launch if args are those of run
+// mode, and nil otherwise.
+func runModeArgs(args []string) ([]string, bool) {
+	if len(args) == 0 || args[0] != runModeCommand {
+		return nil, false
+	}
+	args = args[1:]
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	return args, true
+}
+
+// newLaunched prepares args to be run in dir, with the agent's standard
+// input and output.
+func newLaunched(args []string, dir string) *launched {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = dir
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return &launched{args: args, cmd: cmd, done: make(chan struct{})}
+}
+
+// start starts the command, held stopped until perf attaches to it if
+// hold is true. Interrupt and termination signals sent to the agent are
+// passed on to it, so that the agent outlives it long enough to upload
+// what was recorded.
+func (l *launched) start(hold bool) error {
+	if hold {
+		l.cmd.Path = "/bin/sh"
+		l.cmd.Args = append([]string{"sh", "-c", stopAndExec, "sh"}, l.args...)
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	if err := l.cmd.Start(); err != nil {
+		signal.Stop(sig)
+		return fmt.Errorf("failed to start %q: %s", l.args, err)
+	}
+	log.Printf("started %q as process %d", l.args, l.cmd.Process.Pid)
+	if hold {
+		l.waitStopped()
+		go l.resumeWhenAttached()
+	}
+	go func() {
+		for {
+			select {
+			case s := <-sig:
+				l.cmd.Process.Signal(s)
+			case <-l.done:
+				signal.Stop(sig)
+				return
+			}
+		}
+	}()
+	go func() {
+		l.err = l.cmd.Wait()
+		log.Printf("process %d exited: %s", l.cmd.Process.Pid, l.cmd.ProcessState)
+		close(l.done)
+	}()
+	return nil
+}
+
+func (l *launched) pid() int { return l.cmd.Process.Pid }
+
+// waitStopped waits until the shell starting the command has stopped
+// itself, or exited, for at most attachTimeout.
+func (l *launched) waitStopped() {
+	stat := fmt.Sprintf("/proc/%d/stat", l.pid())
+	for deadline := time.Now().Add(attachTimeout); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		data, err := ioutil.ReadFile(stat)
+		if err != nil {
+			return
+		}
+		// pid (comm) state ..., where the state is T once
+		// stopped, and Z or X once exited
+		if i := bytes.LastIndexByte(data, ')'); i >= 0 && i+2 < len(data) && strings.IndexByte("TtZX", data[i+2]) >= 0 {
+			return
+		}
+	}
+}
+
+// resumeWhenAttached continues the stopped command once perf has
+// attached to it.
+func (l *launched) resumeWhenAttached() {
+	deadline := time.Now().Add(attachTimeout)
+	for !perfAttached() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !perfAttached() {
+		logWarnf("perf has not attached to process %d after %v, continuing it", l.pid(), attachTimeout)
+	}
+	l.cmd.Process.Signal(syscall.SIGCONT)
+}
+
+// getenv returns the first of names set in the command's environment.
+func (l *launched) getenv(names []string) string {
+	env := l.cmd.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	for _, name := range names {
+		for _, kv := range env {
+			if strings.HasPrefix(kv, name+"=") && len(kv) > len(name)+1 {
+				return kv[len(name)+1:]
+			}
+		}
+	}
+	return ""
+}
+
+// labels returns the labels that identify profiles of the run: its
+// command line and, once it has exited, its exit status.
+func (l *launched) labels() map[string]string {
+	labels := map[string]string{
+		"command": strings.Join(l.args, " "),
+	}
+	if l.exited() {
+		labels["exit-status"] = fmt.Sprint(l.exitCode())
+	}
+	return labels
+}
+
+func (l *launched) exited() bool {
+	select {
+	case <-l.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// exitCode returns the exit status of the command the way a shell would
+// report it. It must not be called before the command exits.
+func (l *launched) exitCode() int {
+	if l.err == nil {
+		return 0
+	}
+	exit, ok := l.err.(*exec.ExitError)
+	if !ok {
+		return 1
+	}
+	if ws, ok := exit.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return exit.ExitCode()
+}
+
+// A childExit is returned by the agent in run mode once the launched
+// command has exited and its profiles have been uploaded.
+type childExit struct {
+	code int
+}
+
+func (e *childExit) Error() string { return fmt.Sprintf("command exited with status %d", e.code) }
+
+// runLaunched starts the launched command and profiles it until it exits.
+// If window is zero, it is recorded in a single profile covering its whole
+// lifetime. Otherwise a profile is uploaded every window, and the last
+// one covers whatever remains.
+func (a *agent) runLaunched(window time.Duration) error {
+	if err := a.target.start(true); err != nil {
+		return err
+	}
+	for !a.target.exited() {
+		profile := &cloudprofiler.Profile{
+			ProfileType: cloudprofiler.ProfileType_CPU,
+			Deployment:  a.deployment(),
+		}
+		if window > 0 {
+			profile.Duration = ptypes.DurationProto(window)
+		}
+		start := time.Now()
+		if err := a.retrieveProfile(profile); err != nil {
+			if skip, ok := err.(*skipError); ok {
+				logAt(levelInfo, profileFields(profile), "not uploading profile: %s", skip.reason)
+				cycleSkipped(profile.ProfileType, skip)
+				a.waitAfterSkip(window)
+				continue
+			}
+			logAt(levelWarn, profileFields(profile), "could not collect perf profile: %s", err)
+			cycleAborted(profile.ProfileType, errCollect, err)
+			break
+		}
+		profile.Duration = ptypes.DurationProto(time.Since(start))
+		if window == 0 {
+			// perf stops when the command does, but we may not have
+			// reaped it yet
+			<-a.target.done
+		}
+		for k, v := range a.target.labels() {
+			setProfileLabel(profile, k, v)
+		}
+		if !a.uploadOffline(profile) {
+			continue
+		}
+		markReady()
+		a.afterCycle()
+	}
+	<-a.target.done
+	return &childExit{code: a.target.exitCode()}
+}
+
+// waitAfterSkip waits before trying to record the launched command
+// again after a skipped profile, unless the command exits first. Skips
+// may be due to host load, which will not have gone away immediately.
+func (a *agent) waitAfterSkip(window time.Duration) {
+	if window <= 0 {
+		window = defaultProfileDuration
+	}
+	select {
+	case <-a.target.done:
+	case <-time.After(window):
+	}
+}
+
+func (a *agent) tryCreateOfflineProfile(profile *cloudprofiler.Profile) (*cloudprofiler.Profile, error) {
+	req := &cloudprofiler.CreateOfflineProfileRequest{
+		Parent:  "projects/" + a.project,
+		Profile: profile,
+	}
+	if err := normalizeProfile(profile); err != nil {
+		return nil, err
+	}
+	a.fitSize(profile)
+	fitLabels(profile)
+	client, _ := a.api()
+	uploaded, err := client.CreateOfflineProfile(a.ctx, req)
+	if err != nil && a.refreshCredentials(err) {
+		uploaded, err = client.CreateOfflineProfile(a.ctx, req)
+	}
+	a.endpointError(err)
+	return uploaded, err
+}
@@ -0,0 +1,196 @@
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	cloudprofiler "google.golang.org/genproto/googleapis/devtools/cloudprofiler/v2"
+)
+
+// How long to record allocations for once a leak is suspected.
+const leakProfileDuration = 30 * time.Second
+
+// Label names may not contain underscores, so this is the API's
+// spelling of suspected_leak.
+const leakLabel = "suspected-leak"
+
+// A leakDetector watches the resident memory of a target across profile
+// cycles. Memory that grows in every one of several consecutive cycles is
+// more likely a leak than a cache warming up or a burst of work.
+type leakDetector struct {
+	// consecutive cycles of growth needed; zero disables detection
+	cycles int
+	rss    []int64
+	// set while an allocation profile is being recorded
+	recording uint32
+}
+
+// observe records the resident set size of the target in bytes after a
+// cycle, and reports whether it has grown through each of the last
+// d.cycles cycles. Once growth is reported, as many cycles of growth are
+// needed again before it is reported next.
+func (d *leakDetector) observe(rss int64) bool {
+	if d.cycles <= 0 {
+		return false
+	}
+	if n := len(d.rss); n > 0 && rss <= d.rss[n-1] {
+		d.rss = d.rss[:0]
+	}
+	d.rss = append(d.rss, rss)
+	if len(d.rss) <= d.cycles {
+		return false
+	}
+	d.rss = d.rss[:0]
+	return true
+}
+
+// processRSS returns the resident set size of pid in bytes.
+func processRSS(pid int) (int64, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/statm", pid))
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("malformed /proc/%d/statm", pid)
+	}
+	pages, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return pages * int64(os.Getpagesize()), nil
+}
+
+// leakTargets returns the processes watched for leaks: the launched
+// command in run mode, or the processes in the profiled container.
+func (a *agent) leakTargets() []int {
+	switch {
+	case a.target != nil:
+		if !a.target.exited() {
+			return []int{a.target.pid()}
+		}
+	case a.container != nil:
+		var pids []int
+		paths, _ := filepath.Glob("/proc/[0-9]*/cgroup")
+		for _, path := range paths {
+			pid, err := strconv.Atoi(filepath.Base(filepath.Dir(path)))
+			if err != nil {
+				continue
+			}
+			if c, ok := processContainer(pid); ok && c.id == a.container.id {
+				pids = append(pids, pid)
+			}
+		}
+		return pids
+	}
+	return nil
+}
+
+// checkLeak is called after every profile cycle. If the memory of the
+// targets has kept growing, it starts recording where they are faulting
+// in new memory, to upload as an allocation profile, and returns without
+// waiting for it, so the server's next request is not kept waiting for
+// leakProfileDuration. A growth seen while one is still being recorded
+// is only logged.
+func (a *agent) checkLeak() {
+	if a.leaks.cycles <= 0 {
+		return
+	}
+	pids := a.leakTargets()
+	var total int64
+	for _, pid := range pids {
+		if rss, err := processRSS(pid); err == nil {
+			total += rss
+		}
+	}
+	if len(pids) == 0 || !a.leaks.observe(total) {
+		return
+	}
+	if !atomic.CompareAndSwapUint32(&a.leaks.recording, 0, 1) {
+		log.Printf("resident memory grew for %d cycles to %d bytes, still recording allocations", a.leaks.cycles, total)
+		return
+	}
+	log.Printf("resident memory grew for %d cycles to %d bytes, recording allocations", a.leaks.cycles, total)
+	go func() {
+		defer atomic.StoreUint32(&a.leaks.recording, 0)
+		a.uploadAllocations(pids, total)
+	}()
+}
+
+// uploadAllocations records the allocations of pids, whose resident
+// memory has grown to total bytes, and uploads them. It waits for any
+// profile being collected, as perf records one at a time.
+func (a *agent) uploadAllocations(pids []int, total int64) {
+	a.collecting.Lock()
+	profile, err := a.recordAllocations(pids)
+	a.collecting.Unlock()
+	if err != nil {
+		logErrorf("failed to record allocation profile: %s", err)
+		return
+	}
+	setProfileLabel(profile, leakLabel, "true")
+	setProfileLabel(profile, "rss-bytes", strconv.FormatInt(total, 10))
+	uploaded, err := a.tryCreateOfflineProfile(profile)
+	if err != nil {
+		logAt(levelError, profileFields(profile), "failed to upload allocation profile: %s", err)
+		return
+	}
+	log.Printf("uploaded %s profile %s", uploaded.ProfileType, uploaded.Name)
+	if err := a.audit.record(uploaded); err != nil {
+		logWarnf("failed to write audit record for %s: %s", uploaded.Name, err)
+	}
+}
+
+// recordAllocations samples the page faults of pids. The kernel takes one
+// the first time a process touches each page of new memory, so their call
+// graphs show where memory is being allocated, whatever the allocator.
+func (a *agent) recordAllocations(pids []int) (*cloudprofiler.Profile, error) {
+	list := make([]string, len(pids))
+	for i, pid := range pids {
+		list[i] = strconv.Itoa(pid)
+	}
+	dir, err := a.newWorkDir(cloudprofiler.ProfileType_HEAP_ALLOC)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	cmd := exec.Command("perf", "record", "-g", "-e", "page-faults", "-c", "1",
+		"-o", "alloc.data", "-p", strings.Join(list, ","))
+	var stop <-chan struct{}
+	if a.target != nil {
+		stop = a.target.done
+	}
+	start := time.Now()
+	setPhase("recording allocations", leakProfileDuration)
+	stderr, err := runPerfCommand(dir, cmd, leakProfileDuration, stop)
+	if err != nil {
+		return nil, err
+	}
+	cycle := cycleStats{perf: parsePerfStats(stderr)}
+	converting := time.Now()
+	p, _, err := a.convertFile(filepath.Join(dir, "alloc.pprof"), filepath.Join(dir, "alloc.data"), &cycle)
+	cycle.converting = time.Since(converting)
+	if err != nil {
+		return nil, err
+	}
+	p = a.binaries.strip(p)
+	p = restrictSamples(p, a.mode)
+	rewriteSourcePaths(p, a.sources)
+	cycle.annotate(p)
+
+	profile := &cloudprofiler.Profile{
+		ProfileType: cloudprofiler.ProfileType_HEAP_ALLOC,
+		Deployment:  a.deployment(),
+		Duration:    ptypes.DurationProto(time.Since(start)),
+	}
+	return profile, setProfileBytes(profile, p)
+}
@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	cloudprofiler "google.golang.org/genproto/googleapis/devtools/cloudprofiler/v2"
+)
+
+// Trying out perf commands, sampling settings or symbolization should not
+// need a Google Cloud project, and some hosts cannot reach the API at
+// all. With -output-dir, the agent does not talk to the API: every
+// -output-interval it records a profile of the next of its enabled
+// types in turn, for -output-duration, and writes it to the directory
+// as a pprof file named by its type and the time it was recorded, such
+// as cpu-20190801T120000Z.pb.gz, which `go tool pprof` reads as it is.
+
+// writeLocal records a profile every interval, of each of the agent's
+// types in turn and lasting duration, and writes them to dir, until the
+// agent is stopped. Profiles that cannot be recorded are logged and
+// skipped.
+func (a *agent) writeLocal(dir string, interval, duration time.Duration) error {
+	types := a.profileTypes()
+	log.Printf("writing %v profiles of types %v to %s every %v", duration, types, dir, interval)
+	for i := 0; ; i++ {
+		start := time.Now()
+		a.beforeCycle()
+		t := types[i%len(types)]
+		profile := &cloudprofiler.Profile{
+			ProfileType: t,
+			Deployment:  a.deployment(),
+			Duration:    ptypes.DurationProto(duration),
+		}
+		if err := a.retrieveProfile(profile); err != nil {
+			if diskFull(err) {
+				err = a.diskFilled(profile, err)
+			}
+			if skip, ok := err.(*skipError); ok {
+				logAt(levelInfo, profileFields(profile), "not writing %s profile: %s", t, skip.reason)
+				cycleSkipped(t, skip)
+			} else {
+				logAt(levelWarn, profileFields(profile), "could not collect %s profile: %s", t, err)
+				cycleAborted(t, errCollect, err)
+			}
+		} else {
+			path := filepath.Join(dir, localProfileName(t, start))
+			if err := ioutil.WriteFile(path, profile.ProfileBytes, 0644); err != nil {
+				return fmt.Errorf("could not write profile: %s", err)
+			}
+			fields := profileFields(profile)
+			fields["path"] = path
+			logAt(levelInfo, fields, "wrote %s profile to %s", t, path)
+			cycleDone("wrote " + path)
+			markReady()
+		}
+		if rest := interval - time.Since(start); rest > 0 {
+			setPhase("waiting for the next profile", rest)
+			time.Sleep(rest)
+		}
+	}
+}
+
+// localProfileName returns the name of the file a profile of type t,
+// recorded at start, is written to.
+func localProfileName(t cloudprofiler.ProfileType, start time.Time) string {
+	return fmt.Sprintf("%s-%s.pb.gz", strings.ToLower(t.String()), start.UTC().Format("20060102T150405Z"))
+}
@@ -0,0 +1,188 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	cloudprofiler "google.golang.org/genproto/googleapis/devtools/cloudprofiler/v2"
+
+	"github.com/droyo/cloud-profiler-perf/pkg/perf"
+	"github.com/droyo/cloud-profiler-perf/pkg/symbolize"
+)
+
+// The agent logs in the standard log package's format by default, for
+// people reading a terminal or the journal. With -log-format json, each
+// line is a JSON object with the severity, time and message fields Cloud
+// Logging and other collectors parse, and the messages about collecting
+// and uploading a profile carry its name, type, duration and size as
+// fields of their own. -log-level drops messages below debug, info,
+// warn or error; log calls that do not give a level are at info.
+// Failures are logged at warn, or at error when they stop what was being
+// done, so that -log-level warn keeps every one of them.
+
+// Levels of log messages.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+// The names Cloud Logging gives the levels.
+var logSeverities = []string{"DEBUG", "INFO", "WARNING", "ERROR"}
+
+// Fields of a log message besides its text.
+type logFields map[string]interface{}
+
+// A logSink is where the standard logger writes. It filters messages by
+// level, and formats them.
+type logSink struct {
+	mu   sync.Mutex
+	out  io.Writer
+	json bool
+	min  logLevel
+}
+
+var logs = &logSink{out: os.Stderr, min: levelInfo}
+
+// setupLogging makes the standard logger write in format, text or json,
+// the messages of level and above.
+func setupLogging(format, level string) error {
+	switch format {
+	case "text":
+	case "json":
+		logs.json = true
+		// the time is a field of its own
+		log.SetFlags(0)
+	default:
+		return fmt.Errorf("-log-format %s: want text or json", format)
+	}
+	found := false
+	for i, name := range logLevelNames {
+		if name == level {
+			logs.min, found = logLevel(i), true
+		}
+	}
+	if !found {
+		return fmt.Errorf("-log-level %s: want one of %s", level, strings.Join(logLevelNames, ", "))
+	}
+	log.SetOutput(logs)
+	return nil
+}
+
+// setLogOutput sends the log to w.
+func setLogOutput(w io.Writer) {
+	logs.mu.Lock()
+	defer logs.mu.Unlock()
+	logs.out = w
+}
+
+// Write logs p, a line of the standard logger, at the info level.
+func (s *logSink) Write(p []byte) (int, error) {
+	if s.min > levelInfo {
+		return len(p), nil
+	}
+	if !s.json {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.out.Write(p)
+	}
+	return len(p), s.writeJSON(levelInfo, strings.TrimSuffix(string(p), "\n"), nil)
+}
+
+func (s *logSink) writeJSON(level logLevel, msg string, fields logFields) error {
+	rec := make(map[string]interface{}, len(fields)+3)
+	for k, v := range fields {
+		rec[k] = v
+	}
+	rec["severity"] = logSeverities[level]
+	rec["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	rec["message"] = msg
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.out.Write(append(line, '\n'))
+	return err
+}
+
+// logAt logs a message at level, formatted as by fmt.Sprintf, with
+// fields. In text, the fields follow the message as key=value, and
+// levels other than info precede it.
+func logAt(level logLevel, fields logFields, format string, v ...interface{}) {
+	if level < logs.min {
+		return
+	}
+	msg := fmt.Sprintf(format, v...)
+	if logs.json {
+		logs.writeJSON(level, log.Prefix()+msg, fields)
+		return
+	}
+	var b strings.Builder
+	// as the standard logger would
+	b.WriteString(log.Prefix() + time.Now().Format("2006/01/02 15:04:05 "))
+	if level != levelInfo {
+		b.WriteString(logSeverities[level] + ": ")
+	}
+	b.WriteString(msg)
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s=%v", k, fields[k])
+	}
+	b.WriteByte('\n')
+	logs.mu.Lock()
+	defer logs.mu.Unlock()
+	io.WriteString(logs.out, b.String())
+}
+
+func logDebugf(format string, v ...interface{}) { logAt(levelDebug, nil, format, v...) }
+func logWarnf(format string, v ...interface{})  { logAt(levelWarn, nil, format, v...) }
+func logErrorf(format string, v ...interface{}) { logAt(levelError, nil, format, v...) }
+
+// The packages converting and symbolizing recordings log at the agent's
+// levels.
+func init() {
+	perf.Debugf, perf.Warnf = logDebugf, logWarnf
+	symbolize.Warnf = logWarnf
+}
+
+// fatal logs err at the error level, and exits.
+func fatal(err error) {
+	logAt(levelError, nil, "%s", err)
+	os.Exit(1)
+}
+
+// profileFields returns the fields logged with messages about profile:
+// its name, once the API has given it one, type, duration in seconds,
+// and size in bytes once it has been collected.
+func profileFields(profile *cloudprofiler.Profile) logFields {
+	fields := logFields{"type": profile.ProfileType.String()}
+	if profile.Name != "" {
+		fields["profile"] = profile.Name
+	}
+	if d, err := ptypes.Duration(profile.Duration); err == nil {
+		fields["duration"] = d.Seconds()
+	}
+	if len(profile.ProfileBytes) > 0 {
+		fields["size"] = len(profile.ProfileBytes)
+	}
+	return fields
+}
@@ -0,0 +1,1644 @@
+// Package agent runs configurable perf profiles and uploads them to the
+// StackDriver Profiler API in Google Cloud. It is the whole of the
+// sd-perf-profiler command, run by Main.
+package agent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/template"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/golang/protobuf/ptypes"
+
+	cloudprofiler "google.golang.org/genproto/googleapis/devtools/cloudprofiler/v2"
+
+	pprof "github.com/google/pprof/profile"
+
+	"github.com/droyo/cloud-profiler-perf/pkg/perf"
+	"github.com/droyo/cloud-profiler-perf/pkg/uploader"
+)
+
+// commandLine holds the agent's flags, apart from those of a program
+// embedding it.
+var commandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+
+var (
+	serverAddr   = commandLine.String("api", "cloudprofiler.googleapis.com:443", "comma-separated host:port addresses of cloud profiler API front ends")
+	credsJSON    = commandLine.String("credentials", "", "service account key or workload identity federation credentials JSON `file`")
+	impersonated = commandLine.String("impersonate", "", "upload profiles as the service account `email`, using the agent's credentials to impersonate it")
+	cloudProject = commandLine.String("project", "", "Google Cloud project ID")
+	service      = commandLine.String("service", "", "Service name")
+	serviceVer   = commandLine.String("service-version", "", "label the deployment with the `version` of the service")
+	conversions  = commandLine.Int("max-conversions", 1, "maximum number of profiles to convert concurrently")
+	inventory    = commandLine.Int("inventory", 5, "annotate system-wide profiles with the `n` busiest processes")
+	noKernel     = commandLine.Bool("exclude-kernel", false, "only profile user-space code")
+	noUser       = commandLine.Bool("exclude-user", false, "only profile kernel code")
+	maxLoad      = commandLine.Float64("max-load", 0, "skip profiles while the 1-minute load average per CPU exceeds `load`")
+	minIdle      = commandLine.Float64("min-cpu-idle", 0, "skip profiles while less than `percent` of CPU time is idle")
+	lateSymbols  = commandLine.String("late-symbols", "", "upload profiles unsymbolized, copying recordings to `gs://bucket/path` for the symbolize subcommand")
+	stackDepth   = commandLine.Int("max-stack-depth", 0, "truncate stacks deeper than `n` frames, replacing the frames nearest the root with [truncated]")
+	maxProfSize  = commandLine.Int("max-profile-bytes", 0, "downsample profiles larger than `bytes` before uploading them; 0 uploads them whole")
+	smallDefault = commandLine.Bool("small-vm-defaults", true, "on 1 vCPU and shared-core instances, default to profiling user code at 49 Hz")
+	idleStacks   = commandLine.String("idle-stacks", "keep", "what to do with samples of the kernel's idle loop: `keep`, drop or collapse")
+	maxLost      = commandLine.Float64("max-lost-samples", 1, "reduce sampling when more than `percent` of samples are lost")
+	streamSegs   = commandLine.Duration("stream-segments", 0, "record profiles longer than `interval` in segments of that length, converting each as soon as perf writes it")
+	timeSlice    = commandLine.Duration("time-slice", 0, "label samples with the `interval` of the profile they were recorded in")
+	idleSamples  = commandLine.Int64("dedup-idle-samples", 0, "skip uploading profiles with at most `n` samples that are identical to the previous one")
+	containerID  = commandLine.String("container", "", "only profile the container with this `ID` or ID prefix")
+	cgroupPath   = commandLine.String("cgroup", "", "only profile processes in this cgroup `path`")
+	followTree   = commandLine.String("follow-children", "", "only profile the process tree under `root`, a PID or the systemd unit whose main process it is")
+	kubeMode     = commandLine.Bool("kubernetes", false, "also split system-wide profiles by pod container, and upload each with namespace, pod and container labels")
+	k8sLabels    = commandLine.String("k8s-labels", "", "comma-separated Kubernetes node and pod label `keys`, each optionally =name, to copy onto the deployment")
+	runWindow    = commandLine.Duration("run-window", 0, "in run mode, upload a profile every `interval` rather than one for the whole run")
+	profileTypes = commandLine.String("profile-types", "cpu=on", "comma-separated `type=on|off` settings of the profile types to collect, such as cpu=on,wall=off")
+	sampleTypes  = commandLine.String("sample-type", "", "report samples as `type/unit`, such as cpu/nanoseconds, instead of the converter's sample counts")
+	shortLived   = commandLine.Bool("short-lived", false, "preserve the executables of processes that exit during a profile for symbolization")
+	leakCycles   = commandLine.Int("leak-cycles", 0, "record allocations when the target's memory grows for `n` consecutive profiles")
+	shardAgents  = commandLine.String("shard-agents", "", "comma-separated `IDs` of the agents sharing deployments; each deployment is profiled by one of them")
+	logFormat    = commandLine.String("log-format", "text", "log as `text` or as json, one object per line")
+	logVerbosity = commandLine.String("log-level", "info", "log messages of `level` debug, info, warn or error and above")
+	tuiMode      = commandLine.Bool("tui", false, "show a live dashboard of the agent's state on the terminal")
+	statusPath   = commandLine.String("status-file", "", "periodically write the agent's status as JSON to `file`")
+	readyUpload  = commandLine.Bool("ready-after-upload", false, "report ready to systemd and in the status only once a profile has been uploaded")
+	agentID      = commandLine.String("agent-id", "", "this agent's `ID` among -shard-agents (default hostname), also distinguishing agents on one host")
+	noEgress     = commandLine.Bool("restrict-egress", false, "refuse to connect anywhere but the endpoints the agent's configuration needs")
+	allowEgress  = commandLine.String("allow-egress", "", "comma-separated `host:port` addresses -restrict-egress also allows")
+	googleVIP    = commandLine.String("google-apis-vip", "", "connect to Google APIs through the `private` or restricted googleapis.com VIP")
+	quotaProject = commandLine.String("quota-project", "", "bill API calls to the quota of `project` rather than that of the credentials (default $GOOGLE_CLOUD_QUOTA_PROJECT)")
+	eventsPath   = commandLine.String("events-file", "", "append a JSON record of every skipped, aborted or deferred profile to `file`")
+	auditPath    = commandLine.String("audit-log", "", "append a JSON record of every uploaded profile to `file`")
+	spoolDir     = commandLine.String("spool", "", "keep profiles that could not be uploaded in `directory`, and retry them")
+	spoolOrder   = commandLine.String("spool-order", "newest", "retry spooled profiles `newest` or oldest first")
+	spoolMaxAge  = commandLine.Duration("spool-max-age", 24*time.Hour, "drop spooled profiles older than `duration`")
+	spoolKey     = commandLine.String("spool-key", "", "encrypt spooled profiles with the 32-byte key, raw or base64, in `file`")
+	spoolKMSKey  = commandLine.String("spool-kms-key", "", "encrypt spooled profiles with a data key wrapped by the Cloud KMS key `name`")
+	spoolMaxSize = commandLine.Int64("spool-max-bytes", 100<<20, "drop the oldest spooled profiles when the spool exceeds `bytes`")
+	identity     = commandLine.Bool("identity-labels", false, "label the deployment with this agent's instance ID and version")
+	heartbeatURL = commandLine.String("heartbeat-url", "", "periodically POST a JSON row describing this agent to `url`")
+	heartbeatInt = commandLine.Duration("heartbeat-interval", 5*time.Minute, "how often to report to -heartbeat-url")
+	webhookEvts  = commandLine.String("webhook-events", "started,stopped,upload-failed,errors", "comma-separated `events` to post to -webhook: started, stopped, uploaded, upload-failed and errors")
+	webhookTmpl  = commandLine.String("webhook-template", "", "format webhook payloads with the Go text/template in `file`, which must produce JSON")
+	webhookErrs  = commandLine.Int("webhook-errors", 3, "post an errors event to -webhook when `n` cycles in a row have failed")
+	recoverAge   = commandLine.Duration("recover-max-age", time.Hour, "on startup, upload profiles left by a crashed agent if recorded within this `duration`; 0 disables")
+	focusFreq    = commandLine.Int("focus-frequency", 499, "sampling frequency in `Hz` of the -focus processes")
+	limitsFlag   = commandLine.String("profile-limits", "", "comma-separated `type=duration@Hz` caps on the duration, and sampling frequencies, of profile types, such as cpu=10s@99,wall=30s")
+	debugServers = commandLine.String("debuginfod", "", "fetch debug symbols missing on this host from the debuginfod servers at `URLs`, separated by spaces or commas, besides those of $DEBUGINFOD_URLS")
+	symbolServer = commandLine.String("symbolizer", "", "send recordings to the symbolization service at `host:port` rather than symbolizing them on this host")
+	collectWith  = commandLine.String("collector", collectorPerf, "record CPU profiles with `backend` perf, running perf record, or ebpf, sampling stacks with a BPF program")
+	configPath   = commandLine.String("config", "", "load settings, labels and the perf commands of profile types from the YAML `file`")
+	jobName      = commandLine.String("job", "", "profile only the job `name` of the -config file")
+	pushMode     = commandLine.Bool("push", false, "record a profile of each enabled type at once, upload them with CreateOfflineProfile, and exit")
+	lateConvert  = commandLine.String("late-conversion", lateUnsymbolized, "when symbolizing a profile would delay the next one, convert it `unsymbolized`, skip it, or wait")
+	outputDir    = commandLine.String("output-dir", "", "write profiles to `directory` as pprof files rather than uploading them, without using the profiler API")
+	outputEvery  = commandLine.Duration("output-interval", time.Minute, "with -output-dir, record a profile every `interval`")
+	outputLength = commandLine.Duration("output-duration", 10*time.Second, "the `duration` of the profiles written to -output-dir")
+	pushDuration = commandLine.Duration("push-duration", 10*time.Second, "the `duration` of the profiles recorded with -push")
+	pushMerge    = commandLine.Duration("push-merge-window", 0, "with -push, keep recording, and upload one profile of each type merging those recorded every `interval`")
+	triggerAddr  = commandLine.String("trigger-listen", "", "serve POST /profile on `address`, recording and uploading a profile on demand")
+	triggerToken = commandLine.String("trigger-token-file", "", "the bearer token in `file` that -trigger-listen requests must present")
+	quotaShare   = commandLine.Float64("quota-share", 80, "keep profiling within `percent` of the CPU quota of the agent's cgroup, if it has one; 0 disables")
+	startSplay   = commandLine.Duration("start-splay", 0, "delay the first profile request by up to `duration`, by a fixed fraction for each host")
+	commentTmpl  = commandLine.String("comment-template", "", "add each line the Go text/template in `file` outputs as a comment to every profile")
+	deployFlag   = commandLine.String("deploy-flag", "", "skip profiles while `file`, naming the version being deployed, exists")
+	minFreeBytes = commandLine.Int64("min-free-bytes", 64<<20, "do not profile while the filesystem of the temporary directory has less than `bytes` free")
+	minFreeInode = commandLine.Int64("min-free-inodes", 1000, "do not profile while the filesystem of the temporary directory has fewer than `n` inodes free")
+	pollTimeout  = commandLine.Duration("create-profile-timeout", uploader.DefaultTimeout, "ask for a profile again when the API has not asked for one within `duration`")
+	keepalive    = commandLine.Duration("keepalive", 5*time.Minute, "ping the API every `interval` while waiting for it to ask for a profile; 0 disables")
+	jitInject    = commandLine.Bool("jit", false, "symbolize the code of runtimes writing jitdump files, running perf inject --jit on recordings")
+	backoffBase  = commandLine.Duration("backoff-base", uploader.DefaultBackoff.Base, "retry failed API calls after a random delay of up to `duration`, doubled with every failure")
+	backoffMax   = commandLine.Duration("backoff-max", uploader.DefaultBackoff.Max, "the longest `duration` -backoff-base grows to")
+	pipelineLen  = commandLine.Int("pipeline", 0, "keep asking for profiles while collecting and uploading one, up to `n` ahead; 0 asks only between profiles")
+	caCert       = commandLine.String("ca-cert", "", "also trust the CA certificates in PEM `file` when connecting to -api")
+	mtlsCert     = commandLine.String("mtls-cert", "", "present the client certificate in PEM `file` when connecting to -api")
+	mtlsKey      = commandLine.String("mtls-key", "", "private key PEM `file` of -mtls-cert (default: the -mtls-cert file)")
+	fallbackDir  = commandLine.String("fallback-dir", "", "when the filesystem of the temporary directory fills up, move it to `directory`, such as a tmpfs")
+
+	allowBinaries listFlag
+	denyBinaries  listFlag
+	sourcePaths   listFlag
+	focusRules    listFlag
+	chrootDirs    listFlag
+	deployLabels  listFlag
+	webhookURLs   listFlag
+)
+
+func init() {
+	commandLine.Var(&allowBinaries, "allow-binary", "only symbolize and upload samples from binaries matching `pattern` (repeatable)")
+	commandLine.Var(&denyBinaries, "deny-binary", "do not symbolize or upload samples from binaries matching `pattern` (repeatable)")
+	commandLine.Var(&sourcePaths, "source-path", "rewrite source file names starting with `prefix=replacement` (repeatable)")
+	commandLine.Var(&focusRules, "focus", "also profile processes named like `target=pattern` in the deployment target (repeatable)")
+	commandLine.Var(&deployLabels, "label", "label the deployment `key=value` (repeatable)")
+	commandLine.Var(&chrootDirs, "chroot", "also look for the binaries of profiled processes under the chroot `directory` (repeatable)")
+	commandLine.Var(&webhookURLs, "webhook", "POST a JSON payload to `url` on the -webhook-events (repeatable)")
+	commandLine.StringVar(impersonated, "impersonate-service-account", "", "same as -impersonate")
+}
+
+// listFlag is a flag that may be given more than once.
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+var (
+	requiredScopes = []string{
+		"https://www.googleapis.com/auth/monitoring.write",
+	}
+)
+
+const (
+	defaultProfileDuration = time.Second * 5
+	maxRequestAttempts     = uploader.DefaultMaxAttempts
+)
+
+const (
+	// how long one UpdateProfile call may take
+	uploadTimeout = uploader.DefaultUploadTimeout
+)
+
+const (
+	// how much longer than the profile duration a perf command running
+	// its own workload is given to finish
+	workloadGrace = 5 * time.Second
+	// how long perf may take to write out its data once interrupted
+	perfExitTimeout = time.Minute
+)
+
+// Currently the best documentation for the agent <-> profiler API protocol
+// is in the protobuf service definition, which can be viewed on github here:
+//
+// https://github.com/googleapis/googleapis/blob/master/google/devtools/cloudprofiler/v2/profiler.proto
+
+type agent struct {
+	cloudprofiler.ProfilerServiceClient
+	addr    string
+	tmpdir  string
+	ctx     context.Context
+	perf    *exec.Cmd
+	convert *converterPool
+	service string
+	project string
+	labels  map[string]string
+
+	// number of processes listed in the inventory of system-wide
+	// profiles
+	inventory int
+	binaries  binaryFilter
+	mode      execMode
+	sampler   *sampler
+	timeSlice time.Duration
+	dedup     deduplicator
+	caps      capabilities
+	container *container
+	creds     *reloadableCredentials
+	// if set, replaces TLS and creds on connections to the API, as
+	// tests do to reach their in-memory server
+	transport grpc.DialOption
+	audit     *auditLog
+	// the command started in run mode
+	target *launched
+	leaks  leakDetector
+	execs  *execTracker
+	// overrides the converter's sample type, if set
+	sampleType sampleType
+	// collectors of each enabled profile type, and the backend that
+	// made them
+	collectors map[cloudprofiler.ProfileType]uploader.Collector
+	backend    collectorBackend
+	endpoints  *endpointSet
+	clock      requestClock
+	load       loadGate
+	limits     map[cloudprofiler.ProfileType]profileLimit
+	deploy     *deployGate
+	idle       idleMode
+	spool      *spool
+	// where recordings are copied to be symbolized elsewhere, if set
+	late *gcsStore
+	// the symbolization service, if any
+	remote *symbolService
+	// CPU profiles are recorded by a BPF program rather than perf
+	ebpf bool
+	// perf commands -config gives profile types other than CPU
+	typePerf map[cloudprofiler.ProfileType]*exec.Cmd
+	// why the cheaper default perf command for small instances was
+	// chosen, if it was
+	small string
+	// maximum frames per sample; zero for no limit
+	maxDepth int
+	sources  []sourceRule
+	// key processes recorded alongside system-wide profiles
+	focus     []focus
+	focusFreq int
+	// WALL profiles trace sched_switch, rather than using --off-cpu
+	traceOffCPU bool
+	// profiles longer than this are recorded in segments of this
+	// length, each converted as it is written
+	streamSegment time.Duration
+	// the CPU quota of the agent's cgroup, if it has one
+	quota *cpuQuota
+	// the only processes profiled, if set
+	follow *processTree
+	// the pods profiles are split by, with -kubernetes
+	pods *podIndex
+	disk diskGuard
+	// the -comment-template, if any
+	comments *commentTemplate
+	// what conversions do when they would delay the next profile
+	lateConversion string
+	// how long a CreateProfile call may wait, and how often the
+	// connection is pinged meanwhile
+	pollTimeout time.Duration
+	keepalive   time.Duration
+	// run perf inject --jit on recordings
+	jit bool
+	// the wait between failed API calls
+	backoff uploader.BackoffPolicy
+	// how many profiles may be asked for ahead of their collection
+	pipeline int
+	// profiles larger than this are downsampled; zero for no limit
+	maxBytes int
+	// held while a profile is collected, as profiles triggered over
+	// -trigger-listen are collected outside the agent's loop
+	collecting sync.Mutex
+}
+
+// Main runs the agent as configured by the command line. It exits the
+// process if the agent fails.
+func Main() {
+	commandLine.Parse(os.Args[1:])
+	jobs, err := configure()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := setupLogging(*logFormat, *logVerbosity); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkGoogleVIP(*googleVIP); err != nil {
+		fatal(err)
+	}
+	if servers := debuginfodServers(*debugServers); len(servers) > 0 {
+		debuginfod = newDebuginfodClient(servers, debuginfodDir)
+	}
+	if *noEgress {
+		restrictEgress(strings.Split(*allowEgress, ","))
+	}
+	switch commandLine.Arg(0) {
+	case benchCommand:
+		if err := runBench(commandLine.Args()[1:]); err != nil {
+			fatal(err)
+		}
+		return
+	case symbolizeCommand:
+		if err := runSymbolize(commandLine.Args()[1:]); err != nil {
+			fatal(err)
+		}
+		return
+	case symbolizeServerCommand:
+		if err := runSymbolizeServer(commandLine.Args()[1:]); err != nil {
+			fatal(err)
+		}
+		return
+	case uploadCommand:
+		if err := runUpload(commandLine.Args()[1:]); err != nil {
+			fatal(err)
+		}
+		return
+	}
+	if jobs != nil {
+		if err := runJobs(jobs); err != nil {
+			fatal(err)
+		}
+		return
+	}
+	err = cloudPerfProfiler()
+	stopTUI()
+	logSummary()
+	if err == nil {
+		webhooks.stop("exited")
+	} else {
+		webhooks.stop(err.Error())
+	}
+	if err == nil {
+		return
+	}
+	if exit, ok := err.(*childExit); ok {
+		os.Exit(exit.code)
+	}
+	fatal(err)
+}
+
+func cloudPerfProfiler() error {
+	var err error
+	var agent agent
+
+	agent.ctx = context.Background()
+	agent.convert = newConverterPool(agent.ctx, *conversions)
+	agent.inventory = *inventory
+	agent.binaries = binaryFilter{allow: allowBinaries, deny: denyBinaries}
+
+	perfArgs, checking := checkModeArgs(commandLine.Args())
+	if args, ok := runModeArgs(perfArgs); ok {
+		if len(args) == 0 {
+			return errors.New("run: no command given")
+		}
+		if *containerID != "" || *cgroupPath != "" {
+			return errors.New("run cannot be combined with -container or -cgroup")
+		}
+		if conf.hasPerf() {
+			return errors.New("run cannot be combined with perf commands in -config")
+		}
+		wd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		agent.target = newLaunched(args, wd)
+		if *service == "" {
+			*service = agent.target.getenv(serviceEnv)
+		}
+		if v := agent.target.getenv(versionEnv); v != "" {
+			agent.labels = map[string]string{"version": v}
+		}
+		agent.perf = exec.Command("perf", runModePerf...)
+	} else if len(perfArgs) > 0 {
+		agent.perf = exec.Command("perf", append([]string{"record"}, perfArgs...)...)
+	} else if args := conf.perf(cloudprofiler.ProfileType_CPU); len(args) > 0 {
+		agent.perf = exec.Command("perf", append([]string{"record"}, args...)...)
+	} else {
+		agent.perf = exec.Command("perf", "record", "-ag", "-F", "99")
+		if *smallDefault {
+			if why := smallInstance(); why != "" {
+				log.Printf("%s instance: sampling at %s Hz", why, smallVMFrequency)
+				agent.perf = exec.Command("perf", "record", "-ag", "-F", smallVMFrequency)
+				agent.small = why
+			}
+		}
+	}
+	for t, p := range conf.profiles {
+		if t != cloudprofiler.ProfileType_CPU && len(p.perf) > 0 {
+			if agent.typePerf == nil {
+				agent.typePerf = make(map[cloudprofiler.ProfileType]*exec.Cmd)
+			}
+			agent.typePerf[t] = exec.Command("perf", append([]string{"record"}, p.perf...)...)
+		}
+	}
+	if err := checkPerfTemplates(agent.perf, cloudprofiler.ProfileType_CPU); err != nil {
+		return err
+	}
+	for t, cmd := range agent.typePerf {
+		if err := checkPerfTemplates(cmd, t); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case *noKernel && *noUser:
+		return errors.New("-exclude-kernel and -exclude-user are mutually exclusive")
+	case *noKernel:
+		agent.mode = modeUser
+	case *noUser:
+		agent.mode = modeKernel
+	case agent.small != "":
+		log.Printf("%s instance: profiling only user code", agent.small)
+		agent.mode = modeUser
+	}
+	privs := readPrivileges()
+	log.Printf("running as %s", privs)
+	agent.adaptToPrivileges(privs)
+	for _, cmd := range agent.perfCommands() {
+		cmd.Args = append(cmd.Args[:2:2], restrictEvents(cmd.Args[2:], agent.mode)...)
+	}
+
+	if *containerID != "" && *cgroupPath != "" {
+		return errors.New("-container and -cgroup are mutually exclusive")
+	}
+	if *containerID != "" {
+		c, err := findContainer(*containerID)
+		if err != nil {
+			return err
+		}
+		log.Printf("profiling container %s in cgroup %s", c.shortID(), c.cgroup)
+		agent.container = &c
+		*cgroupPath = c.cgroup
+	}
+	if *cgroupPath != "" {
+		for _, cmd := range agent.perfCommands() {
+			opts := cgroupOptions(cmd.Args[2:], *cgroupPath)
+			cmd.Args = append(cmd.Args[:2:2], addPerfOptions(cmd.Args[2:], opts...)...)
+		}
+	}
+	if *followTree != "" {
+		switch {
+		case agent.target != nil:
+			return errors.New("-follow-children cannot be combined with run mode, which follows the command's children")
+		case *cgroupPath != "":
+			return errors.New("-follow-children cannot be combined with -container or -cgroup")
+		}
+		if agent.follow, err = parseProcessTree(*followTree); err != nil {
+			return err
+		}
+		for _, cmd := range agent.perfCommands() {
+			if perfWorkload(cmd.Args[2:]) {
+				return errors.New("-follow-children cannot be combined with a perf command running a workload")
+			}
+			cmd.Args = append(cmd.Args[:2:2], removeSystemWide(cmd.Args[2:])...)
+		}
+		log.Printf("profiling only the process tree of %s", agent.follow)
+	}
+
+	switch *collectWith {
+	case collectorPerf:
+	case collectorEBPF:
+		switch {
+		case len(perfArgs) > 0 || conf.hasPerf():
+			return errors.New("-collector=ebpf samples every CPU, and cannot be combined with run or a perf command")
+		case *cgroupPath != "" || *followTree != "":
+			return errors.New("-collector=ebpf cannot be combined with -container, -cgroup or -follow-children")
+		case *timeSlice > 0:
+			return errors.New("-collector=ebpf cannot be combined with -time-slice")
+		case len(focusRules) > 0:
+			return errors.New("-collector=ebpf cannot be combined with -focus")
+		}
+		agent.ebpf = true
+	default:
+		return fmt.Errorf("unknown -collector %q: use perf or ebpf", *collectWith)
+	}
+
+	for k, v := range conf.labels {
+		if agent.labels == nil {
+			agent.labels = make(map[string]string)
+		}
+		agent.labels[k] = v
+	}
+	var localDir string
+	if *outputDir != "" {
+		switch {
+		case agent.target != nil || *pushMode:
+			return errors.New("-output-dir cannot be combined with run mode or -push")
+		case *kubeMode || len(focusRules) > 0:
+			return errors.New("-output-dir cannot be combined with -kubernetes or -focus, which upload profiles of their own")
+		case *spoolDir != "" || *lateSymbols != "":
+			return errors.New("-output-dir cannot be combined with -spool or -late-symbols")
+		case *outputEvery <= 0 || *outputLength <= 0:
+			return errors.New("-output-interval and -output-duration must be positive")
+		}
+		// made absolute before changing directory
+		if localDir, err = filepath.Abs(*outputDir); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(localDir, 0755); err != nil {
+			return err
+		}
+	}
+	if *kubeMode {
+		switch {
+		case agent.target != nil:
+			return errors.New("-kubernetes cannot be combined with run mode")
+		case *cgroupPath != "" || *followTree != "":
+			return errors.New("-kubernetes splits system-wide profiles, and cannot be combined with -container, -cgroup or -follow-children")
+		}
+		if agent.pods, err = newPodIndex(); err != nil {
+			return fmt.Errorf("-kubernetes: %s", err)
+		}
+		log.Printf("splitting profiles by the pods of node %s", agent.pods.node)
+	}
+	if *k8sLabels != "" {
+		wanted, err := parseKubeLabels(*k8sLabels)
+		if err != nil {
+			return err
+		}
+		var uid string
+		if agent.container != nil {
+			uid = agent.container.podUID
+		}
+		labels, err := kubeDeploymentLabels(wanted, uid)
+		if err != nil {
+			return fmt.Errorf("could not read Kubernetes labels: %s", err)
+		}
+		if agent.labels == nil {
+			agent.labels = make(map[string]string)
+		}
+		for k, v := range labels {
+			log.Printf("labeling deployment %s=%s", k, v)
+			agent.labels[k] = v
+		}
+	}
+	if err := agent.addDeploymentLabels(); err != nil {
+		return err
+	}
+
+	if *leakCycles > 0 {
+		if agent.target == nil && agent.container == nil {
+			return errors.New("-leak-cycles needs a target: use run or -container")
+		}
+		agent.leaks.cycles = *leakCycles
+	}
+
+	if *service != "" {
+		agent.service = *service
+	} else {
+		if service, err := inferService(); err != nil {
+			return fmt.Errorf("could not determine service: %s", err)
+		} else {
+			log.Println("inferring service as", service)
+			agent.service = service
+		}
+	}
+
+	if *shardAgents != "" {
+		agents := strings.Split(*shardAgents, ",")
+		id := *agentID
+		if id == "" {
+			if id, err = os.Hostname(); err != nil {
+				return err
+			}
+		}
+		if err := checkShard(id, agents); err != nil {
+			return err
+		}
+		if owner := shardOwner(agent.deploymentKey(), agents); owner != id {
+			return agent.standBy(owner)
+		}
+	}
+
+	var instance string
+	if *identity || *heartbeatURL != "" || len(webhookURLs) > 0 || *commentTmpl != "" {
+		if instance, err = instanceID(*agentID); err != nil {
+			return err
+		}
+		log.Printf("agent instance %s, version %s", instance, agentVersion)
+	}
+	// added after sharding, which must reach the same decision in
+	// every agent
+	if *identity {
+		if agent.labels == nil {
+			agent.labels = make(map[string]string)
+		}
+		for k, v := range identityLabels(instance) {
+			agent.labels[k] = v
+		}
+	}
+
+	if *commentTmpl != "" {
+		if agent.comments, err = loadCommentTemplate(*commentTmpl, instance); err != nil {
+			return err
+		}
+	}
+
+	if err := agent.checkDependencies(); err != nil && !checking {
+		return err
+	}
+
+	agent.caps = probeCapabilities()
+	log.Printf("host capabilities: %s", agent.caps)
+	for _, cmd := range agent.perfCommands() {
+		if args, err := adaptPerfArgs(cmd.Args[2:], agent.caps); err != nil {
+			return err
+		} else {
+			cmd.Args = append(cmd.Args[:2:2], args...)
+		}
+	}
+	if *shortLived {
+		if agent.execs, err = newExecTracker(); err != nil {
+			return fmt.Errorf("cannot track short-lived processes: %s", err)
+		}
+		// build IDs of binaries mapped by processes that
+		// have exited by the end of the recording
+		for _, cmd := range agent.perfCommands() {
+			args := cmd.Args[2:]
+			if agent.caps.has("buildid-mmap") && !hasPerfOption(args, "--buildid-mmap") {
+				cmd.Args = append(cmd.Args[:2:2], addPerfOptions(args, "--buildid-mmap")...)
+			}
+		}
+	}
+	if *jitInject {
+		if *collectWith != collectorPerf {
+			return fmt.Errorf("-jit cannot be combined with -collector=%s", *collectWith)
+		}
+		// jitdump files are stamped with the monotonic clock
+		for _, cmd := range agent.perfCommands() {
+			cmd.Args = append(cmd.Args[:2:2], jitClockArgs(cmd.Args[2:])...)
+		}
+		agent.jit = true
+	}
+	agent.sampler = newSampler(agent.perf.Args[2:], *maxLost)
+	switch {
+	case *quotaShare < 0 || *quotaShare > 100:
+		return errors.New("-quota-share must be a percentage")
+	case *quotaShare > 0:
+		if agent.quota, err = findCPUQuota(*quotaShare / 100); err != nil {
+			logWarnf("not keeping within a CPU quota: %s", err)
+		} else if agent.quota != nil {
+			log.Printf("keeping within %.0f%% of the agent's CPU quota of %s", *quotaShare, agent.quota)
+		}
+	}
+	if *sampleTypes != "" {
+		if agent.sampleType, err = parseSampleType(*sampleTypes); err != nil {
+			return err
+		}
+		if agent.sampleType.timed() && agent.sampler.frequency == 0 {
+			return fmt.Errorf("-sample-type %s needs a perf command sampling at a frequency (-F)", *sampleTypes)
+		}
+	}
+	if enabled, err := parseProfileTypes(*profileTypes); err != nil {
+		return err
+	} else if agent.collectors, err = newCollectors(&agent, *collectWith, enabled, agent.caps); err != nil {
+		return err
+	}
+	log.Printf("offering profile types %v", agent.profileTypes())
+	if agent.limits, err = parseProfileLimits(*limitsFlag); err != nil {
+		return err
+	}
+	for t, p := range conf.profiles {
+		// -profile-limits takes precedence
+		lim, ok := agent.limits[t]
+		if !ok {
+			lim = p.limit
+		}
+		if !lim.hasDuration && p.limit.hasDuration {
+			lim.duration, lim.hasDuration = p.limit.duration, true
+		}
+		if lim.freq == 0 {
+			lim.freq = p.limit.freq
+		}
+		if lim != (profileLimit{}) {
+			agent.limits[t] = lim
+		}
+	}
+	for t, lim := range agent.limits {
+		if _, ok := agent.collectors[t]; !ok {
+			continue
+		}
+		if lim.hasDuration && lim.duration == 0 {
+			return fmt.Errorf("-profile-limits: %s profiles are recorded for a duration, which must be positive", t)
+		}
+		if lim.freq > 0 && agent.sampler.frequency == 0 {
+			return fmt.Errorf("-profile-limits: setting the frequency of %s profiles needs a perf command sampling at a frequency (-F)", t)
+		}
+	}
+	if _, ok := agent.collectors[cloudprofiler.ProfileType_WALL]; ok && !agent.caps.has("off-cpu") {
+		if agent.sampler.frequency == 0 {
+			return errors.New("WALL profiles traced with sched:sched_switch need a perf command sampling at a frequency (-F)")
+		}
+		log.Printf("WALL profiles will trace sched:sched_switch for off-CPU time")
+		agent.traceOffCPU = true
+	}
+	if agent.idle, err = parseIdleMode(*idleStacks); err != nil {
+		return err
+	}
+	if *stackDepth < 0 {
+		return errors.New("-max-stack-depth must not be negative")
+	}
+	agent.maxDepth = *stackDepth
+	if *maxProfSize < 0 {
+		return errors.New("-max-profile-bytes must not be negative")
+	}
+	agent.maxBytes = *maxProfSize
+	if agent.sources, err = parseSourceRules(sourcePaths); err != nil {
+		return err
+	}
+	if err := checkChroots(chrootDirs); err != nil {
+		return err
+	}
+	if agent.focus, err = parseFocus(focusRules); err != nil {
+		return err
+	}
+	if len(agent.focus) > 0 {
+		switch {
+		case agent.target != nil:
+			return errors.New("-focus cannot be combined with run mode")
+		case *lateSymbols != "":
+			return errors.New("-focus cannot be combined with -late-symbols")
+		case *focusFreq <= 0:
+			return errors.New("-focus-frequency must be positive")
+		}
+	}
+	agent.focusFreq = *focusFreq
+	if agent.lateConversion, err = parseLateConversion(*lateConvert); err != nil {
+		return err
+	}
+	agent.load = loadGate{maxLoad: *maxLoad, minIdle: *minIdle}
+	agent.disk = diskGuard{minBytes: *minFreeBytes, minInodes: *minFreeInode}
+	if *fallbackDir != "" {
+		// made absolute before changing directory
+		if agent.disk.fallback, err = filepath.Abs(*fallbackDir); err != nil {
+			return err
+		}
+	}
+	if *deployFlag != "" {
+		// made absolute before changing directory
+		path, err := filepath.Abs(*deployFlag)
+		if err != nil {
+			return err
+		}
+		agent.deploy = &deployGate{path: path}
+	}
+	agent.timeSlice = *timeSlice
+	switch {
+	case *timeSlice < 0 || *timeSlice%time.Second != 0:
+		// perf rotates its output every whole number of seconds
+		return errors.New("-time-slice must be a whole number of seconds")
+	case *lateSymbols != "" && agent.timeSlice > 0:
+		return errors.New("-late-symbols cannot be combined with -time-slice")
+	}
+	switch {
+	case *streamSegs < 0 || *streamSegs%time.Second != 0:
+		return errors.New("-stream-segments must be a whole number of seconds")
+	case *streamSegs > 0 && agent.timeSlice > 0:
+		return errors.New("-stream-segments cannot be combined with -time-slice, which converts segments itself")
+	case *streamSegs > 0 && *lateSymbols != "":
+		return errors.New("-stream-segments cannot be combined with -late-symbols, which needs the whole recording")
+	}
+	agent.streamSegment = *streamSegs
+	if _, ok := agent.collectors[cloudprofiler.ProfileType_CONTENTION].(*perfCollector); ok {
+		switch {
+		case agent.timeSlice > 0:
+			return errors.New("CONTENTION profiles cannot be combined with -time-slice")
+		case agent.streamSegment > 0:
+			return errors.New("CONTENTION profiles cannot be combined with -stream-segments")
+		case *lateSymbols != "":
+			return errors.New("CONTENTION profiles cannot be combined with -late-symbols, as perf script symbolizes them")
+		}
+	}
+	agent.dedup.idleSamples = *idleSamples
+	if *pushMode {
+		switch {
+		case agent.target != nil:
+			return errors.New("-push cannot be combined with run mode, which uploads its profiles itself")
+		case *pushDuration <= 0:
+			return errors.New("-push-duration must be positive")
+		case *pushMerge < 0:
+			return errors.New("-push-merge-window must not be negative")
+		case *pushMerge > 0 && *pushMerge < *pushDuration:
+			return errors.New("-push-merge-window must be at least -push-duration")
+		}
+	} else if *pushMerge != 0 {
+		return errors.New("-push-merge-window needs -push")
+	}
+	switch {
+	case *triggerAddr == "":
+	case *triggerToken == "":
+		return errors.New("-trigger-listen needs -trigger-token-file")
+	case agent.target != nil:
+		return errors.New("-trigger-listen cannot be combined with run mode")
+	case *pushMode && *pushMerge == 0:
+		return errors.New("-trigger-listen cannot be combined with -push, which exits once it has pushed, unless -push-merge-window is set")
+	}
+	var splay time.Duration
+	switch {
+	case *startSplay < 0:
+		return errors.New("-start-splay must not be negative")
+	case *startSplay > 0 && agent.target != nil:
+		return errors.New("-start-splay cannot be combined with run mode")
+	case *startSplay > 0:
+		if splay, err = startDelay(*startSplay); err != nil {
+			return err
+		}
+	}
+
+	// opened before changing directory, as the path may be relative
+	if *auditPath != "" {
+		if agent.audit, err = openAuditLog(*auditPath); err != nil {
+			return fmt.Errorf("failed to open audit log: %s", err)
+		}
+	}
+	if *eventsPath != "" {
+		if events, err = openEventLog(*eventsPath); err != nil {
+			return fmt.Errorf("failed to open events file: %s", err)
+		}
+	}
+	if len(webhookURLs) > 0 {
+		if webhooks, err = newWebhookSender(webhookURLs, *webhookEvts, *webhookTmpl, *webhookErrs); err != nil {
+			return err
+		}
+	}
+	if *spoolDir != "" {
+		newestFirst, err := parseSpoolOrder(*spoolOrder)
+		if err != nil {
+			return err
+		}
+		dir, err := filepath.Abs(*spoolDir)
+		if err != nil {
+			return err
+		}
+		if agent.spool, err = newSpool(dir, newestFirst, *spoolMaxAge, *spoolMaxSize); err != nil {
+			return fmt.Errorf("failed to create spool: %s", err)
+		}
+		switch {
+		case *spoolKey != "" && *spoolKMSKey != "":
+			return errors.New("-spool-key and -spool-kms-key are mutually exclusive")
+		case *spoolKey != "":
+			if agent.spool.cipher, err = localSpoolCipher(*spoolKey); err != nil {
+				return err
+			}
+		}
+	}
+	if *statusPath != "" {
+		path, err := filepath.Abs(*statusPath)
+		if err != nil {
+			return err
+		}
+		if err := writeStatus(path); err != nil {
+			return fmt.Errorf("failed to write status file: %s", err)
+		}
+		go writeStatusLoop(path)
+	}
+
+	if tmpdir, err := ioutil.TempDir("", filepath.Base(os.Args[0])); err != nil {
+		return fmt.Errorf("failed to create temp directory: %s", err)
+	} else {
+		log.Println("using temporary directory", tmpdir)
+		agent.tmpdir = tmpdir
+		if err := lockTmpDir(tmpdir); err != nil {
+			return fmt.Errorf("failed to lock temporary directory: %s", err)
+		}
+		if debuginfod != nil {
+			debuginfod.cache = filepath.Join(tmpdir, debuginfodDir)
+		}
+		// the agent may have moved to -fallback-dir since
+		defer func() { os.RemoveAll(agent.tmpdir) }()
+	}
+
+	if checking {
+		if localDir != "" {
+			return errors.New("check cannot be combined with -output-dir, which does not use the API")
+		}
+		return agent.selfCheck()
+	}
+	if localDir != "" {
+		exitOnSignal(&agent)
+		if *tuiMode {
+			if err := startTUI(&agent); err != nil {
+				return err
+			}
+		}
+		if !*readyUpload {
+			markReady()
+		}
+		return agent.writeLocal(localDir, *outputEvery, *outputLength)
+	}
+
+	if err := agent.useCredentials(); err != nil {
+		return err
+	}
+	if agent.spool != nil && *spoolKMSKey != "" {
+		ts, err := agent.tokenSource(kmsScope)
+		if err != nil {
+			return fmt.Errorf("failed to load credentials for Cloud KMS: %s", err)
+		}
+		if agent.spool.cipher, err = kmsSpoolCipher(agent.ctx, *spoolKMSKey, ts); err != nil {
+			return err
+		}
+	}
+	if *lateSymbols != "" {
+		ts, err := agent.tokenSource(gcsScope)
+		if err != nil {
+			return fmt.Errorf("failed to load credentials for Cloud Storage: %s", err)
+		}
+		if agent.late, err = newLateStore(*lateSymbols, ts); err != nil {
+			return err
+		}
+	}
+	if *symbolServer != "" {
+		if *lateSymbols != "" {
+			return errors.New("-symbolizer cannot be combined with -late-symbols")
+		}
+		if agent.remote, err = newSymbolService(*symbolServer); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case *pollTimeout <= 0:
+		return errors.New("-create-profile-timeout must be positive")
+	case *keepalive < 0:
+		return errors.New("-keepalive must not be negative")
+	case *keepalive > 0 && *keepalive < 10*time.Second:
+		// gRPC would ping every 10s anyway
+		return errors.New("-keepalive must be at least 10s")
+	}
+	agent.pollTimeout, agent.keepalive = *pollTimeout, *keepalive
+	if *pipelineLen < 0 {
+		return errors.New("-pipeline must not be negative")
+	}
+	agent.pipeline = *pipelineLen
+	if agent.backoff, err = backoffPolicy(); err != nil {
+		return err
+	}
+	if err := checkAPITLS(); err != nil {
+		return err
+	}
+	if agent.endpoints, err = newEndpointSet(*serverAddr); err != nil {
+		return err
+	}
+	if err := agent.connect(false); err != nil {
+		return err
+	}
+	defer agent.endpoints.conn.Close()
+
+	if *cloudProject != "" {
+		agent.project = *cloudProject
+	} else {
+		if project, err := inferCloudProject(); err != nil {
+			return fmt.Errorf("could not determine project: %s", err)
+		} else {
+			log.Println("inferred project is", project)
+			agent.project = project
+		}
+	}
+
+	if *recoverAge > 0 {
+		agent.recoverProfiles(*recoverAge)
+	}
+	if agent.spool != nil {
+		go agent.drainSpool()
+	}
+	if *heartbeatURL != "" {
+		go agent.heartbeatLoop(*heartbeatURL, instance, *heartbeatInt)
+	}
+	webhooks.identify(&agent, instance)
+	webhooks.post(webhookStarted, cloudprofiler.ProfileType_PROFILE_TYPE_UNSPECIFIED, "agent "+agentVersion+" started")
+	if agent.target == nil {
+		// in run mode, signals are passed to the command instead
+		exitOnSignal(&agent)
+	}
+	if *tuiMode {
+		if err := startTUI(&agent); err != nil {
+			return err
+		}
+	}
+	if !*readyUpload {
+		markReady()
+	}
+	if agent.target != nil {
+		return agent.runLaunched(*runWindow)
+	}
+	if *triggerAddr != "" {
+		if err := agent.serveTrigger(*triggerAddr, *triggerToken); err != nil {
+			return err
+		}
+	}
+	if *pushMode && *pushMerge > 0 {
+		return agent.pushMerged(*pushDuration, *pushMerge)
+	}
+	if *pushMode {
+		return agent.push(*pushDuration)
+	}
+	waitSplay(splay)
+	return agent.run()
+}
+
+func inferService() (string, error) {
+	return os.Hostname()
+}
+
+func (a *agent) run() error {
+	next := a.tryCreateProfile
+	if a.pipeline > 0 {
+		next = a.pollAhead(a.pipeline)
+	}
+	for {
+		if a.quota != nil {
+			a.quota.startCycle()
+		}
+		a.beforeCycle()
+		setPhase("waiting for profile request", 0)
+		profile, err := next()
+		if err != nil {
+			return fmt.Errorf("CreateProfile failed: %s", err)
+		}
+		logAt(levelInfo, profileFields(profile), "%s profile requested", profile.ProfileType)
+		a.clock.requested()
+		if err := a.retrieveProfile(profile); err != nil {
+			if diskFull(err) {
+				err = a.diskFilled(profile, err)
+			}
+			if skip, ok := err.(*skipError); ok {
+				logAt(levelInfo, profileFields(profile), "not uploading %s profile %s: %s", profile.ProfileType, profile.Name, skip.reason)
+				cycleSkipped(profile.ProfileType, skip)
+				a.restWithinQuota()
+				continue
+			}
+			cycleAborted(profile.ProfileType, errCollect, err)
+			return fmt.Errorf("could not collect perf profile: %s", err)
+		}
+		setPhase("uploading", 0)
+		if err := a.tryUpdateProfile(profile); err != nil {
+			logAt(levelWarn, profileFields(profile), "failed to update profile %s: %s", profile.Name, err)
+			cycleAborted(profile.ProfileType, errUpload, err)
+			a.spoolProfile(profile)
+		} else {
+			logAt(levelInfo, profileFields(profile), "uploaded %s profile %s", profile.ProfileType, profile.Name)
+			profileUploaded(profile.ProfileType, profile.Name)
+			cycleDone("uploaded " + profile.Name)
+			markReady()
+			if err := a.audit.record(profile); err != nil {
+				logWarnf("failed to write audit record for %s: %s", profile.Name, err)
+			}
+		}
+		a.afterCycle()
+		a.restWithinQuota()
+	}
+}
+
+// spoolProfile keeps profile, which could not be uploaded, in the spool
+// if there is one.
+func (a *agent) spoolProfile(profile *cloudprofiler.Profile) {
+	if a.spool == nil {
+		return
+	}
+	if err := a.spool.add(profile); err != nil {
+		logWarnf("failed to spool profile: %s", err)
+		return
+	}
+	log.Printf("spooled %s profile for a later upload", profile.ProfileType)
+}
+
+func (a *agent) deployment() *cloudprofiler.Deployment {
+	return &cloudprofiler.Deployment{
+		ProjectId: a.project,
+		Target:    a.service,
+		Labels:    a.labels,
+	}
+}
+
+func (a *agent) tryCreateProfile() (*cloudprofiler.Profile, error) {
+	req := &cloudprofiler.CreateProfileRequest{
+		Parent:      "projects/" + a.project,
+		Deployment:  a.deployment(),
+		ProfileType: a.profileTypes(),
+	}
+	md := metadata.New(map[string]string{})
+
+	client, addr := a.api()
+	log.Printf("waiting for profile request from %s", addr)
+
+	var (
+		attempt   int
+		backoff   time.Duration
+		profile   *cloudprofiler.Profile
+		err       error
+		refreshed bool
+	)
+
+	for attempt < maxRequestAttempts {
+		client, _ = a.api()
+		call, cancel := context.WithTimeout(a.ctx, a.pollTimeout)
+		profile, err = client.CreateProfile(call, req, grpc.Trailer(&md))
+		expired := uploader.Expired(a.ctx, call)
+		cancel()
+		if err != nil && expired {
+			// the API had no profile for us; not an error
+			log.Printf("no profile requested in %v, asking again", a.pollTimeout)
+			continue
+		}
+		a.endpointError(err)
+
+		if err == nil {
+			return profile, nil
+		}
+		errorCounts.Add(errCreateProfile, 1)
+		attempt++
+		// Retry once with fresh credentials; if they are rejected
+		// too, reloading again will not help.
+		if !refreshed && a.refreshCredentials(err) {
+			refreshed = true
+			continue
+		}
+		if uploader.Temporary(err) {
+			if d, ok := uploader.RetryDelay(err, md); ok {
+				backoff = d
+				logWarnf("CreateProfile failed: %s, retrying using server-advised delay of %v", err, d)
+			} else {
+				backoff = a.backoff.Delay(attempt)
+				logWarnf("CreateProfile failed: %s, retrying in %v", err, backoff)
+			}
+			time.Sleep(backoff)
+		} else {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("CreateProfile max retries(%d) exceeded; last error: %s",
+		maxRequestAttempts, err)
+}
+
+// retrieveProfile collects the profile the server asked for with the
+// collector of its type, unless the host is too busy or being deployed
+// to.
+func (a *agent) retrieveProfile(profile *cloudprofiler.Profile) error {
+	a.collecting.Lock()
+	defer a.collecting.Unlock()
+	collector, ok := a.collectors[profile.ProfileType]
+	if !ok {
+		// only the types of a.collectors are asked for, but the
+		// server is not worth stopping the agent over
+		return &skipError{
+			kind:   "unsupported-type",
+			reason: fmt.Sprintf("server asked for unsupported profile type %s", profile.ProfileType),
+		}
+	}
+	if err := a.load.check(); err != nil {
+		return err
+	}
+	if err := a.checkDeploy(profile); err != nil {
+		return err
+	}
+	a.clampDuration(profile)
+	data, err := collector.Collect(a.ctx, profile)
+	if err != nil {
+		return err
+	}
+	if err := a.deployStarted(); err != nil {
+		return err
+	}
+	profile.ProfileBytes = data
+	return normalizeProfile(profile)
+}
+
+// A perfCollector collects profiles by running a perf command, and
+// converting its recording.
+type perfCollector struct {
+	agent *agent
+	cmd   *exec.Cmd
+}
+
+// Collect records profile with c's perf command and returns it converted
+// to pprof format.
+func (c *perfCollector) Collect(ctx context.Context, profile *cloudprofiler.Profile) ([]byte, error) {
+	return c.agent.inWorkDir(profile, func(dir string) ([]byte, error) {
+		return c.record(dir, profile)
+	})
+}
+
+// record records profile in the work directory dir.
+func (c *perfCollector) record(dir string, profile *cloudprofiler.Profile) ([]byte, error) {
+	a := c.agent
+	var pid int
+	var stop <-chan struct{}
+	if a.target != nil {
+		pid, stop = a.target.pid(), a.target.done
+	}
+	cmd := preparePerfCommand(c.cmd, profile, pid)
+	cmd.Args = append(cmd.Args[:2:2], a.sampler.args(cmd.Args[2:])...)
+	if profile.ProfileType == cloudprofiler.ProfileType_HEAP_ALLOC && recordsPageFaults(cmd.Args[2:]) {
+		// not allocations, but where memory is first touched
+		setProfileLabel(profile, "heap-alloc", "page-faults")
+	}
+	if a.follow != nil {
+		args, err := a.follow.followArgs(cmd.Args[2:])
+		if err != nil {
+			return nil, err
+		}
+		cmd.Args = append(cmd.Args[:2:2], args...)
+	}
+	freq := a.frequency(profile.ProfileType)
+	if freq != a.sampler.freq {
+		cmd.Args = append(cmd.Args[:2:2], setPerfOption(cmd.Args[2:], "-F", "--freq", strconv.Itoa(freq))...)
+	}
+	if a.timeSlice > 0 {
+		cmd.Args = append(cmd.Args[:2:2], addPerfOptions(cmd.Args[2:], sliceOptions(a.timeSlice)...)...)
+	}
+	if a.small != "" {
+		setProfileLabel(profile, "perf-defaults", "small-vm")
+	}
+	if freq != a.sampler.frequency {
+		setProfileLabel(profile, "sampling-frequency", strconv.Itoa(freq))
+	}
+	timeout, err := ptypes.Duration(profile.Duration)
+	if err != nil {
+		timeout = defaultProfileDuration
+	}
+	if a.target != nil && profile.Duration == nil {
+		// until the launched command exits
+		timeout = 0
+	}
+	var stream *segmentStream
+	streamed := a.streamSegment > 0 && a.timeSlice == 0 && (timeout == 0 || timeout > a.streamSegment)
+	if streamed {
+		cmd.Args = append(cmd.Args[:2:2], addPerfOptions(cmd.Args[2:], sliceOptions(a.streamSegment)...)...)
+	}
+
+	var cycle cycleStats
+	var before procSnapshot
+	if a.inventory > 0 && systemWide(cmd.Args[2:]) {
+		before = takeProcSnapshot()
+	}
+	if streamed {
+		stream = a.startStream(filepath.Join(dir, "perf.data"), freq, &cycle)
+		defer stream.close()
+	} else if a.timeSlice == 0 {
+		// time-sliced and streamed recordings are not recovered
+		a.markPending(dir, profile)
+	}
+	finishFocused := a.startFocused(dir, profile, timeout, stop)
+	defer finishFocused()
+	var offCPU *offCPUTrace
+	if profile.ProfileType == cloudprofiler.ProfileType_WALL && a.traceOffCPU {
+		offCPU = startOffCPUTrace(dir, cmd.Args[2:], timeout, stop)
+		defer offCPU.wait()
+	}
+	setPhase("recording", timeout)
+	stderr, err := runPerfCommand(dir, cmd, timeout, stop)
+	var partial bool
+	if err != nil {
+		switch {
+		case diskFull(err):
+			// what perf wrote before is not worth filling the
+			// filesystem further to convert
+			return nil, err
+		case stream != nil:
+			if stream.stop(); !stream.any() {
+				return nil, err
+			}
+			logWarnf("%s; uploading the segments converted so far", err)
+		case a.timeSlice > 0:
+			return nil, err
+		default:
+			if _, statErr := os.Stat(filepath.Join(dir, "perf.data")); statErr != nil {
+				return nil, err
+			}
+			logWarnf("%s; converting what was recorded", err)
+		}
+		partial = true
+	}
+	cycle.perf = parsePerfStats(stderr)
+	if change := a.sampler.adjust(cycle.perf); change != "" {
+		log.Printf("perf sampling adjusted: %s", change)
+		setProfileLabel(profile, "sampling-adjustment", change)
+	}
+	var top []procUsage
+	if !before.time.IsZero() {
+		top = topProcesses(before, takeProcSnapshot(), a.inventory)
+	}
+	return a.convertRecording(dir, profile, freq, partial, &cycle, top, offCPU, stream)
+}
+
+// convertRecording converts perf.data in the work directory dir, the
+// recording of profile sampled at freq Hz, and returns it in pprof
+// format, filtered and annotated.
+// The recording is partial if it was cut short, and top lists the
+// processes that used the most CPU while it was made. If stream is not
+// nil, it has been converting the recording's segments all along.
+func (a *agent) convertRecording(dir string, profile *cloudprofiler.Profile, freq int, partial bool, cycle *cycleStats, top []procUsage, offCPU *offCPUTrace, stream *segmentStream) ([]byte, error) {
+	setPhase("converting", 0)
+	if a.execs != nil {
+		a.execs.preserve(filepath.Join(a.tmpdir, "executables"), filepath.Join(dir, "binaries"), a.binaries)
+	}
+	var p *pprof.Profile
+	var damaged bool
+	var err error
+	perfData := filepath.Join(dir, "perf.data")
+	converting := time.Now()
+	switch {
+	case stream != nil:
+		p, damaged, err = stream.finish()
+	case a.timeSlice > 0:
+		p, damaged, err = a.convertSlices(perfData, a.timeSlice, freq, cycle)
+	case profile.ProfileType == cloudprofiler.ProfileType_CONTENTION:
+		p, err = futexContention(perfData)
+	default:
+		cycle.deadline = a.conversionDeadline()
+		p, damaged, err = a.convertFile(filepath.Join(dir, "perf.pprof"), perfData, cycle)
+	}
+	cycle.converting = time.Since(converting)
+	if stream != nil {
+		cycle.converting = stream.converting
+	}
+	if err != nil {
+		return nil, err
+	}
+	if partial || damaged {
+		setProfileLabel(profile, "partial", "true")
+	}
+	if n := len(cycle.mismatches()); n > 0 {
+		setProfileLabel(profile, mismatchLabel, strconv.Itoa(n))
+	}
+	if cycle.hurried > 0 {
+		setProfileLabel(profile, symbolsLabel, symbolsSkipped)
+	}
+	if offCPU != nil {
+		if err := offCPU.addTo(p, freq); err != nil {
+			return nil, err
+		}
+		setProfileLabel(profile, "off-cpu", "sched-switch")
+	}
+	if a.late != nil {
+		setProfileLabel(profile, symbolsLabel, "pending")
+		if err := a.pushLateSymbols(profile, perfData); err != nil {
+			logAt(levelWarn, profileFields(profile), "could not copy recording for late symbolization: %s", err)
+			errorCounts.Add(errLateSymbols, 1)
+		}
+	}
+	var elided int
+	if p, elided = limitStackDepth(p, a.maxDepth); elided > 0 {
+		setProfileLabel(profile, "elided-frames", strconv.Itoa(elided))
+	}
+	if c := a.container; c != nil {
+		setProfileLabel(profile, "container", c.shortID())
+		if c.podUID != "" {
+			setProfileLabel(profile, "pod-uid", c.podUID)
+		}
+	}
+	p = a.binaries.strip(p)
+	p = restrictSamples(p, a.mode)
+	rewriteSourcePaths(p, a.sources)
+	var idle float64
+	if p, idle = stripIdle(p, a.idle); idle >= 0 {
+		setProfileLabel(profile, "idle-fraction", strconv.FormatFloat(idle, 'f', 3, 64))
+	}
+	switch profile.ProfileType {
+	case cloudprofiler.ProfileType_CPU:
+		if err := a.sampleType.apply(p, freq); err != nil {
+			return nil, err
+		}
+	case cloudprofiler.ProfileType_HEAP:
+		heapSampleTypes(p)
+	}
+	annotateInventory(profile, p, top)
+	cycle.annotate(p)
+	a.addTemplateComments(profile, p)
+	if err := a.dedup.check(p); err != nil {
+		return nil, err
+	}
+	if a.pods != nil {
+		duration, err := ptypes.Duration(profile.Duration)
+		if err != nil {
+			duration = time.Duration(p.DurationNanos)
+		}
+		a.uploadPods(profile, p, duration)
+	}
+	var buf bytes.Buffer
+	if err := p.Write(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// backoffPolicy returns the backoff between failed API calls that
+// -backoff-base and -backoff-max set.
+func backoffPolicy() (uploader.BackoffPolicy, error) {
+	switch {
+	case *backoffBase <= 0:
+		return uploader.BackoffPolicy{}, errors.New("-backoff-base must be positive")
+	case *backoffMax < *backoffBase:
+		return uploader.BackoffPolicy{}, errors.New("-backoff-max must be at least -backoff-base")
+	}
+	return uploader.BackoffPolicy{Base: *backoffBase, Max: *backoffMax}, nil
+}
+
+// tryUpdateProfile uploads profile with uploader.UpdateProfile, which
+// retries calls that fail with a temporary error, or take longer than
+// uploadTimeout, with the same backoff as CreateProfile. Errors such as
+// NotFound, for a profile the API no longer expects, or InvalidArgument
+// are returned at once.
+func (a *agent) tryUpdateProfile(profile *cloudprofiler.Profile) error {
+	a.fitSize(profile)
+	fitLabels(profile)
+	u := &uploader.Uploader{
+		Client:  apiClient{a},
+		Backoff: a.backoff,
+		Logf:    logWarnf,
+		Retried: func(*cloudprofiler.Profile, error) { uploadRetries.Add(1) },
+	}
+	return u.UpdateProfile(a.ctx, profile, profile.ProfileBytes)
+}
+
+// The parameters the arguments of a perf command are templates of.
+type perfParams struct {
+	*cloudprofiler.Profile
+	// Shadow duration with its time.Duration equivalent
+	Duration time.Duration
+	Pid      int
+}
+
+// checkPerfTemplates returns an error if an argument of cmd, the perf
+// command of profile type t, is not a template preparePerfCommand can
+// substitute, so that a typo in a profile type's command is reported
+// at startup rather than passed to perf when the type is asked for.
+func checkPerfTemplates(cmd *exec.Cmd, t cloudprofiler.ProfileType) error {
+	params := perfParams{
+		Profile:  &cloudprofiler.Profile{ProfileType: t},
+		Duration: defaultProfileDuration,
+	}
+	for _, arg := range cmd.Args {
+		tmpl, err := template.New("arg").Parse(arg)
+		if err == nil {
+			err = tmpl.Execute(ioutil.Discard, params)
+		}
+		if err != nil {
+			return fmt.Errorf("perf command of %s profiles: argument %q: %s", t, arg, err)
+		}
+	}
+	return nil
+}
+
+// Returns copy of cmd with template variables replaced from profile, and the
+// pid of the launched command in run mode. Cannot be called after cmd is
+// running.
+func preparePerfCommand(cmd *exec.Cmd, profile *cloudprofiler.Profile, pid int) *exec.Cmd {
+	var err error
+	var params perfParams
+	params.Profile = profile
+	params.Pid = pid
+	// In run mode without a window there is no duration; perf records
+	// until the command exits.
+	if profile.Duration != nil || pid == 0 {
+		params.Duration, err = ptypes.Duration(profile.Duration)
+		if err != nil {
+			logWarnf("could not parse duration from profile: %s, using default %v", err, defaultProfileDuration)
+			params.Duration = defaultProfileDuration
+		}
+	}
+
+	newCmd := new(exec.Cmd)
+	*newCmd = *cmd
+	newCmd.Args = append([]string{}, cmd.Args...)
+
+	if len(newCmd.Args) == 0 {
+		return newCmd
+	}
+
+	var buf bytes.Buffer
+	for i, arg := range newCmd.Args {
+		t, err := template.New("arg").Parse(arg)
+		if err != nil {
+			logWarnf("failed to parse arg %q as template: %s", arg, err)
+			continue
+		}
+		buf.Reset()
+		if err := t.Execute(&buf, params); err != nil {
+			logWarnf("substitute %q failed: %s", arg, err)
+			continue
+		}
+		newCmd.Args[i] = buf.String()
+	}
+	return newCmd
+}
+
+// Runs perf in the directory dir with a timeout, after which perf is
+// interrupted, ending the recording. perf is also stopped early if stop
+// is closed; a zero timeout waits for that alone. If the perf command
+// runs a workload, such as sleep, that is expected to end the recording,
+// the timeout is extended by workloadGrace so the two do not race. perf
+// runs in a process group of its own, which is interrupted, and killed
+// if perf does not exit within perfExitTimeout of that. Returns the
+// standard error output of perf, which contains statistics about the
+// recording.
+func runPerfCommand(dir string, cmd *exec.Cmd, timeout time.Duration, stop <-chan struct{}) (string, error) {
+	var stderr bytes.Buffer
+	cmd.Dir = dir
+	cmd.Stderr = &stderr
+	if timeout > 0 && perfWorkload(cmd.Args) {
+		timeout += workloadGrace
+	}
+
+	logDebugf("running %q", cmd.Args)
+	if err := startPerfGroup(cmd); err != nil {
+		return "", fmt.Errorf("Command %q failed: %s", cmd.Args, err)
+	}
+	defer endPerfGroup(cmd.Process.Pid)
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		var expired <-chan time.Time
+		if timeout > 0 {
+			t := time.NewTimer(timeout)
+			defer t.Stop()
+			expired = t.C
+		}
+		select {
+		case <-expired:
+			log.Printf("sending INT signal to process %d after %v", cmd.Process.Pid, timeout)
+		case <-stop:
+			log.Printf("sending INT signal to process %d, target has exited", cmd.Process.Pid)
+		case <-finished:
+			return
+		}
+		if err := signalPerfGroup(cmd.Process.Pid, syscall.SIGINT); err != nil {
+			logErrorf("interrupt failed: %s", err)
+		}
+		t := time.NewTimer(perfExitTimeout)
+		defer t.Stop()
+		select {
+		case <-t.C:
+			logWarnf("killing process %d, still running %v after interrupt", cmd.Process.Pid, perfExitTimeout)
+			signalPerfGroup(cmd.Process.Pid, syscall.SIGKILL)
+		case <-finished:
+		}
+	}()
+
+	err := cmd.Wait()
+	if err != nil {
+		if exit, ok := err.(*exec.ExitError); ok {
+			if exit.ExitCode() == -1 {
+				// the process terminated from a signal
+				return stderr.String(), nil
+			} else {
+				return "", fmt.Errorf("Command %q failed: exit status %d; %s",
+					cmd.Args, exit.ExitCode(), stderr.String())
+			}
+		} else {
+			return "", fmt.Errorf("Failed to run perf: %s", err)
+		}
+	}
+	return stderr.String(), nil
+}
+
+// In order to properly symbolize the resulting pprof proto, the converter
+// needs to find the debug symbols. It only looks in the tree of symlinks
+// this function constructs, laid out as pprof searches $PPROF_BINARY_PATH.
+// https://github.com/google/pprof/blob/1ebb73c60ed3b70bd749d4f798d7ae427263e2c5/doc/README.md#annotated-code
+// Binaries replaced since they were mapped are copied to the directory
+// replaced. buildSymbolLookup returns the number of binaries it linked
+// and the number whose symbols it could not find, and the paths of
+// binaries that had been replaced by another build since they were
+// mapped.
+func buildSymbolLookup(dst, perfData, replaced string, filter binaryFilter) (n, failed int, mismatched []string, err error) {
+	resolver := binaryResolver{dir: replaced}
+	logDebugf("building pprof symbol lookup tree from %s", perfData)
+	ids, err := perf.BuildIDs(perfData)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	for _, line := range ids {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			logWarnf("skipping malformed build ID %q", line)
+			continue
+		}
+		buildid := fields[0]
+		symbols := fields[1]
+		binary := filepath.Base(fields[1])
+
+		if filter.excluded(symbols) {
+			log.Printf("not symbolizing excluded binary %s", symbols)
+			continue
+		}
+
+		// the kernel symbols are a special case
+		if strings.HasPrefix(binary, "vmlinux") {
+			binary = "vmlinux"
+		}
+
+		// the binary may have been replaced by a deploy since
+		// it was mapped
+		symbols, err := resolver.resolve(symbols, buildid)
+		if err != nil {
+			if ok, lerr := linkDebugFile(dst, "", buildid); lerr != nil {
+				return n, failed, resolver.mismatched, lerr
+			} else if ok {
+				logWarnf("symbolizing with debug symbols only: %s", err)
+				n++
+				continue
+			}
+			logWarnf("not symbolizing %s", err)
+			failed++
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Join(dst, buildid), 0777); err != nil {
+			return n, failed, resolver.mismatched, err
+		}
+
+		err = os.Symlink(symbols, filepath.Join(dst, buildid, binary))
+		if err != nil && !os.IsExist(err) {
+			return n, failed, resolver.mismatched, err
+		}
+		if binary != "vmlinux" {
+			if _, err := linkDebugFile(dst, symbols, buildid); err != nil {
+				return n, failed, resolver.mismatched, err
+			}
+		}
+		n++
+	}
+	log.Printf("linked debug symbols for %d binaries", n)
+	if copied, err := copyPerfMaps(dst, perfData); err != nil {
+		logWarnf("could not copy perf map files: %s", err)
+	} else if copied > 0 {
+		log.Printf("copied the perf map files of %d processes", copied)
+	}
+	if len(resolver.mismatched) > 0 {
+		logWarnf("build IDs of %d binaries on disk do not match those recorded: %s",
+			len(resolver.mismatched), strings.Join(resolver.mismatched, ", "))
+	}
+	return n, failed, resolver.mismatched, nil
+}
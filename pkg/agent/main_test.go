@@ -0,0 +1,164 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	pprof "github.com/google/pprof/profile"
+	cloudprofiler "google.golang.org/genproto/googleapis/devtools/cloudprofiler/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/droyo/cloud-profiler-perf/internal/fakeprofiler"
+	"github.com/droyo/cloud-profiler-perf/pkg/uploader"
+)
+
+// The wait between failed calls of the agents under test, and how late
+// a call may come after it.
+var (
+	testBackoff = uploader.BackoffPolicy{Base: 50 * time.Millisecond, Max: 100 * time.Millisecond}
+	testSlack   = 500 * time.Millisecond
+)
+
+// collectTestProfile stands in for perf, collecting a profile of one
+// sample at once.
+func collectTestProfile(ctx context.Context, profile *cloudprofiler.Profile) ([]byte, error) {
+	p := &pprof.Profile{
+		SampleType: []*pprof.ValueType{{Type: "samples", Unit: "count"}},
+		Sample:     []*pprof.Sample{{Value: []int64{1}}},
+	}
+	var buf bytes.Buffer
+	err := p.Write(&buf)
+	return buf.Bytes(), err
+}
+
+// startTestAgent runs the polling loop of an agent collecting CPU
+// profiles for srv until the test ends.
+func startTestAgent(t *testing.T, srv *fakeprofiler.Server) *agent {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	a := &agent{
+		ctx:     ctx,
+		tmpdir:  t.TempDir(),
+		service: "e2e",
+		project: "fake",
+		collectors: map[cloudprofiler.ProfileType]uploader.Collector{
+			cloudprofiler.ProfileType_CPU: uploader.CollectorFunc(collectTestProfile),
+		},
+		transport:   grpc.WithInsecure(),
+		pollTimeout: time.Minute,
+		backoff:     testBackoff,
+	}
+	var err error
+	if a.endpoints, err = newEndpointSet(srv.Addr); err == nil {
+		err = a.connect(false)
+	}
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- a.run() }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; a.ctx.Err() == nil {
+			t.Errorf("agent stopped: %v", err)
+		}
+		a.endpoints.conn.Close()
+	})
+	return a
+}
+
+func newTestServer(t *testing.T) *fakeprofiler.Server {
+	t.Helper()
+	srv, err := fakeprofiler.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// waitUploads waits for n profiles to be uploaded to srv.
+func waitUploads(t *testing.T, srv *fakeprofiler.Server, n int) []fakeprofiler.Upload {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	uploads, err := srv.WaitUploads(ctx, n)
+	if err != nil {
+		t.Fatalf("waiting for %d uploads: %s; got %d CreateProfile calls", n, err, len(srv.Calls()))
+	}
+	return uploads
+}
+
+func TestAgentBackoffAndUpload(t *testing.T) {
+	srv := newTestServer(t)
+	const retryDelay = 300 * time.Millisecond
+	srv.Script(
+		fakeprofiler.Step{Err: status.Error(codes.Unavailable, "down")},
+		fakeprofiler.Step{Err: status.Error(codes.Unavailable, "still down")},
+		fakeprofiler.Step{Err: status.Error(codes.Aborted, "not now"), RetryDelay: retryDelay},
+		fakeprofiler.Step{Type: cloudprofiler.ProfileType_CPU, Duration: time.Second},
+	)
+	srv.FailUploads(status.Error(codes.Unavailable, "down"))
+	retries := uploadRetries.Value()
+	startTestAgent(t, srv)
+
+	uploads := waitUploads(t, srv, 1)
+	calls := srv.Calls()
+	if len(calls) < 4 {
+		t.Fatalf("got %d CreateProfile calls, want at least 4", len(calls))
+	}
+	for i := 1; i < 3; i++ {
+		gap := calls[i].Time.Sub(calls[i-1].Time)
+		if max := testBackoff.Max + testSlack; gap > max {
+			t.Errorf("call %d came %v after a failed call, want at most %v", i+1, gap, max)
+		}
+	}
+	if gap := calls[3].Time.Sub(calls[2].Time); gap < retryDelay {
+		t.Errorf("call 4 came %v after the server advised a delay of %v", gap, retryDelay)
+	}
+	for i, c := range calls {
+		req := c.Request
+		if req.Parent != "projects/fake" || req.Deployment.GetTarget() != "e2e" ||
+			len(req.ProfileType) != 1 || req.ProfileType[0] != cloudprofiler.ProfileType_CPU {
+			t.Errorf("call %d: got request %v, want CPU profiles of e2e in fake", i+1, req)
+		}
+	}
+
+	u := uploads[0]
+	if u.Offline || u.Profile.Name != "projects/fake/profiles/1" || u.Profile.ProfileType != cloudprofiler.ProfileType_CPU {
+		t.Errorf("got upload of %s profile %s, offline %v, want the CPU profile asked for", u.Profile.ProfileType, u.Profile.Name, u.Offline)
+	}
+	p, err := u.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Sample) != 1 || p.DurationNanos != time.Second.Nanoseconds() {
+		t.Errorf("got %d samples over %v, want the one collected over 1s", len(p.Sample), time.Duration(p.DurationNanos))
+	}
+	if got := uploadRetries.Value() - retries; got != 1 {
+		t.Errorf("upload retried %d times, want once", got)
+	}
+}
+
+func TestAgentRejectedUpload(t *testing.T) {
+	srv := newTestServer(t)
+	srv.Every(50*time.Millisecond, cloudprofiler.ProfileType_CPU)
+	srv.FailUploads(status.Error(codes.InvalidArgument, "rejected"))
+	retries := uploadRetries.Value()
+	startTestAgent(t, srv)
+
+	// the rejected profile is dropped, not retried, and the agent
+	// goes on to the next
+	uploads := waitUploads(t, srv, 1)
+	if name := uploads[0].Profile.Name; name != "projects/fake/profiles/2" {
+		t.Errorf("got upload of %s, want projects/fake/profiles/2", name)
+	}
+	if got := uploadRetries.Value() - retries; got != 0 {
+		t.Errorf("rejected upload retried %d times", got)
+	}
+}
@@ -0,0 +1,201 @@
+package agent
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/droyo/cloud-profiler-perf/pkg/symbolize"
+)
+
+// Deploys replace shared libraries and executables while processes that
+// mapped the old versions keep running. perf records the path a file was
+// mapped from, but by the time the profile is symbolized that path holds
+// a different build, or nothing, and linking it into the symbol lookup
+// tree would leave pprof with a dangling or wrong symlink. The old file
+// can still be found in perf's build-id cache, or read through
+// /proc/<pid>/map_files of a process that still maps it.
+//
+// Processes in containers map files from their own mount namespace, and
+// perf records the paths they see there. The host's file at the same
+// path, if there is one, is another build; the container's is read
+// through /proc/<pid>/root of a process that maps it.
+
+// The directory, in the agent's temporary directory, replaced binaries
+// are copied to. Copies are named by build ID and kept for later
+// profiles.
+const replacedDir = "replaced"
+
+// perfBuildIDCache returns the path of the binary with the given build ID
+// in the build-id cache perf record fills in, or "" if it is not there.
+func perfBuildIDCache(id string) string {
+	if len(id) < 3 {
+		return ""
+	}
+	home := os.Getenv("HOME")
+	if home == "" {
+		home = "/root"
+	}
+	dir := filepath.Join(home, ".debug", ".build-id", id[:2], id[2:])
+	// newer versions of perf store a directory holding the binary,
+	// older ones a symlink to it
+	for _, path := range []string{filepath.Join(dir, "elf"), dir} {
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			if got, _ := symbolize.BuildID(path); got == id {
+				return path
+			}
+		}
+	}
+	return ""
+}
+
+// A mapIndex lists, for each mapped file path, the /proc/<pid>/map_files
+// entries of the processes mapping it. It is built on first use.
+type mapIndex map[string][]string
+
+func readMapIndex() mapIndex {
+	index := make(mapIndex)
+	paths, _ := filepath.Glob("/proc/[0-9]*/maps")
+	for _, maps := range paths {
+		file, err := os.Open(maps)
+		if err != nil {
+			continue
+		}
+		dir := filepath.Dir(maps)
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			// address perms offset dev inode pathname
+			fields := strings.SplitN(scanner.Text(), " ", 6)
+			if len(fields) < 6 {
+				continue
+			}
+			path := strings.TrimSpace(fields[5])
+			if !strings.HasPrefix(path, "/") {
+				continue
+			}
+			path = strings.TrimSuffix(path, " (deleted)")
+			index[path] = append(index[path], filepath.Join(dir, "map_files", fields[0]))
+		}
+		file.Close()
+	}
+	return index
+}
+
+// roots returns the /proc/<pid>/root directories of the processes
+// mapping path.
+func (index mapIndex) roots(path string) []string {
+	var roots []string
+	seen := make(map[string]bool)
+	for _, mapped := range index[path] {
+		// /proc/<pid>/map_files/<range>
+		root := filepath.Join(filepath.Dir(filepath.Dir(mapped)), "root")
+		if !seen[root] {
+			seen[root] = true
+			roots = append(roots, root)
+		}
+	}
+	return roots
+}
+
+// A binaryResolver finds the file perf saw for each binary listed in a
+// recording.
+type binaryResolver struct {
+	// where replaced binaries are copied to
+	dir   string
+	index mapIndex
+	// paths found holding a build other than the one mapped
+	mismatched []string
+	// chroots, snaps and flatpaks; found on first use
+	roots       []packageRoot
+	rootsLoaded bool
+}
+
+// resolve returns the path of a file with path's build ID id. This is
+// path itself unless it was mapped in a chroot, snap or flatpak (see
+// roots.go) or a container, or has been replaced or removed since it was
+// mapped.
+func (r *binaryResolver) resolve(path, id string) (string, error) {
+	path = strings.TrimSuffix(path, " (deleted)")
+	if !strings.HasPrefix(path, "/") {
+		// [kernel.kallsyms], [vdso] and the like
+		return path, nil
+	}
+	got, err := symbolize.BuildID(path)
+	if err == nil && got == id {
+		return path, nil
+	}
+	if !r.rootsLoaded {
+		r.roots, r.rootsLoaded = findPackageRoots(), true
+	}
+	for _, root := range r.roots {
+		moved := root.path(path)
+		if moved == "" {
+			continue
+		}
+		if got, err := symbolize.BuildID(moved); err == nil && got == id {
+			return moved, nil
+		}
+	}
+	saved := filepath.Join(r.dir, id, filepath.Base(path))
+	if r.index == nil {
+		r.index = readMapIndex()
+	}
+	for _, root := range r.index.roots(path) {
+		inRoot := filepath.Join(root, path)
+		if got, err := symbolize.BuildID(inRoot); err != nil || got != id {
+			continue
+		}
+		// copied, as the process may exit before the profile is
+		// symbolized
+		if got, err := symbolize.BuildID(saved); err == nil && got == id {
+			return saved, nil
+		}
+		if ok, err := preserveBinary(saved, inRoot, id); err != nil {
+			return "", err
+		} else if ok {
+			log.Printf("preserved %s, build %s, from the container of %s", path, id, filepath.Dir(root))
+			return saved, nil
+		}
+	}
+	if err == nil {
+		// a deploy has replaced it since it was mapped; its
+		// symbols would be those of another build
+		r.mismatched = append(r.mismatched, path)
+	}
+	if got, err := symbolize.BuildID(saved); err == nil && got == id {
+		return saved, nil
+	}
+	if cached := perfBuildIDCache(id); cached != "" {
+		log.Printf("%s has been replaced, using build %s from the perf build-id cache", path, id)
+		return cached, nil
+	}
+	for _, mapped := range r.index[path] {
+		if ok, err := preserveBinary(saved, mapped, id); err != nil {
+			return "", err
+		} else if ok {
+			log.Printf("%s has been replaced, preserved build %s from %s", path, id, mapped)
+			return saved, nil
+		}
+	}
+	return "", fmt.Errorf("%s has been replaced and build %s is no longer available", path, id)
+}
+
+// preserveBinary copies the file at src to dst if it has build ID id,
+// and reports whether it did.
+func preserveBinary(dst, src, id string) (bool, error) {
+	if got, err := symbolize.BuildID(src); err != nil || got != id {
+		return false, nil
+	}
+	file, err := os.Open(src)
+	if err != nil {
+		return false, nil
+	}
+	defer file.Close()
+	if err := copyFile(dst, file); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,43 @@
+package agent
+
+import (
+	pprof "github.com/google/pprof/profile"
+)
+
+// pprof.Merge adds up sample values as they are. Profiles whose first
+// value counts samples taken at different frequencies cannot be added
+// that way: a source sampled twice as often would weigh twice as much in
+// the result. Such profiles are first converted to the time their
+// samples stand for, so the merged proportions are those of the time
+// spent, whatever each source's frequency.
+
+// A sampledProfile is a profile whose samples were taken at freq Hz.
+type sampledProfile struct {
+	p    *pprof.Profile
+	freq int
+}
+
+// The sample type of merged profiles of different frequencies.
+var mergedSampleType = sampleType{name: "cpu", unit: "nanoseconds"}
+
+// mergeSampled merges sources. If their frequencies differ, the sample
+// counts of each are weighted by its sampling period, and the result
+// is in nanoseconds.
+func mergeSampled(sources []sampledProfile) (*pprof.Profile, error) {
+	profiles := make([]*pprof.Profile, len(sources))
+	normalize := false
+	for i, s := range sources {
+		profiles[i] = s.p
+		if s.freq != sources[0].freq {
+			normalize = true
+		}
+	}
+	if normalize {
+		for _, s := range sources {
+			if err := mergedSampleType.apply(s.p, s.freq); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return pprof.Merge(profiles)
+}
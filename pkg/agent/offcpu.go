@@ -0,0 +1,290 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	pprof "github.com/google/pprof/profile"
+)
+
+// Hosts older than perf 6.0 or kernel 5.19 cannot record off-CPU time
+// with --off-cpu. On those, a WALL profile combines the on-CPU samples of
+// the CPU command with a trace of sched:sched_switch, recorded alongside
+// it. Each switch records the stack a thread blocked or was preempted in,
+// and the switch events perf records with --switch-events tell when the
+// thread ran again; the time in between is added to the profile as
+// off-CPU samples of that stack.
+
+const offCPUData = "offcpu.data"
+
+// The sched_switch tracepoint, sampled at every occurrence regardless of
+// the command's -F.
+const schedSwitchEvent = "sched:sched_switch/period=1/"
+
+// Where the kernel exposes the sched_switch tracepoint.
+var schedSwitchPaths = []string{
+	"/sys/kernel/tracing/events/sched/sched_switch",
+	"/sys/kernel/debug/tracing/events/sched/sched_switch",
+}
+
+// schedSwitchTraceable reports whether the sched_switch tracepoint can be
+// recorded on this host.
+func schedSwitchTraceable() bool {
+	for _, path := range schedSwitchPaths {
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// offCPUArgs derives the perf record arguments of the switch trace from
+// those of the CPU command, recording the same processes.
+func offCPUArgs(args []string) []string {
+	args = removePerfEvents(args)
+	opts := []string{"-e", schedSwitchEvent, "--switch-events", "-o", offCPUData}
+	if !callGraphs(args) {
+		opts = append(opts, "-g")
+	}
+	return addPerfOptions(args, opts...)
+}
+
+// callGraphs reports whether perf record arguments args record call
+// graphs.
+func callGraphs(args []string) bool {
+	if hasPerfOption(args, "--call-graph") {
+		return true
+	}
+	for _, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if strings.HasPrefix(arg, "-") && !strings.HasPrefix(arg, "--") && shortFlagSet(arg, 'g') {
+			return true
+		}
+	}
+	return false
+}
+
+// An offCPUTrace is a recording of sched_switch running alongside the
+// recording of a WALL profile's on-CPU samples.
+type offCPUTrace struct {
+	// the work directory the trace is recorded in
+	dir  string
+	done chan struct{}
+	err  error
+}
+
+// startOffCPUTrace starts tracing, in the work directory dir, the
+// processes perf record arguments args record.
+func startOffCPUTrace(dir string, args []string, timeout time.Duration, stop <-chan struct{}) *offCPUTrace {
+	t := &offCPUTrace{dir: dir, done: make(chan struct{})}
+	cmd := exec.Command("perf", append([]string{"record"}, offCPUArgs(args)...)...)
+	go func() {
+		defer close(t.done)
+		_, t.err = runPerfCommand(dir, cmd, timeout, stop)
+	}()
+	return t
+}
+
+// wait waits for the trace to end.
+func (t *offCPUTrace) wait() error {
+	<-t.done
+	return t.err
+}
+
+// addTo waits for the trace to end and adds its off-CPU time to p, the
+// on-CPU profile recorded at freq Hz, converting p's samples to
+// nanoseconds of wall time.
+func (t *offCPUTrace) addTo(p *pprof.Profile, freq int) error {
+	if err := t.wait(); err != nil {
+		return fmt.Errorf("could not trace off-CPU time: %s", err)
+	}
+	if err := (sampleType{name: "wall", unit: "nanoseconds"}).apply(p, freq); err != nil {
+		return err
+	}
+	cmd := exec.Command("perf", "script", "-i", filepath.Join(t.dir, offCPUData), "--ns", "--show-switch-events", "-F", "tid,time,ip,sym,dso")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	blocked, switches, err := addOffCPUSamples(p, out)
+	if werr := cmd.Wait(); werr != nil && err == nil {
+		err = fmt.Errorf("perf script failed: %s; %s", werr, bytes.TrimSpace(stderr.Bytes()))
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("traced %v off CPU over %d context switches", blocked, switches)
+	addComment(p, fmt.Sprintf("%v off CPU over %d context switches, traced with sched:sched_switch", blocked.Round(time.Millisecond), switches))
+	return nil
+}
+
+var (
+	// tid, and time in seconds with nanoseconds, of every event
+	scriptEventRegexp = regexp.MustCompile(`^\s*(\d+)\s+(\d+)\.(\d{9}):\s*(.*)$`)
+	// address, symbol and binary of a callchain entry
+	scriptFrameRegexp = regexp.MustCompile(`^\s+([0-9a-f]+)\s+(.*?)\s+\((.*)\)$`)
+)
+
+// A switchOut is a thread's switch off a CPU, awaiting its return.
+type switchOut struct {
+	time  int64
+	stack []*pprof.Location
+}
+
+// addOffCPUSamples reads the output of perf script for a switch trace,
+// adding to p a sample for every stretch a thread spent off CPU. Threads
+// still off CPU at the end of the trace are counted until then.
+func addOffCPUSamples(p *pprof.Profile, r io.Reader) (blocked time.Duration, switches int, err error) {
+	b := newProfileBuilder(p)
+	pending := make(map[int]*switchOut)
+	var last int64
+	var out *switchOut
+	add := func(tid int, until int64) {
+		s := pending[tid]
+		delete(pending, tid)
+		if s == nil || len(s.stack) == 0 || until <= s.time {
+			return
+		}
+		b.addSample(s.stack, until-s.time)
+		blocked += time.Duration(until - s.time)
+		switches++
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := scriptFrameRegexp.FindStringSubmatch(line); m != nil && out != nil {
+			addr, _ := strconv.ParseUint(m[1], 16, 64)
+			out.stack = append(out.stack, b.location(addr, m[2], m[3]))
+			continue
+		}
+		m := scriptEventRegexp.FindStringSubmatch(line)
+		if m == nil {
+			out = nil
+			continue
+		}
+		tid, _ := strconv.Atoi(m[1])
+		sec, _ := strconv.ParseInt(m[2], 10, 64)
+		nsec, _ := strconv.ParseInt(m[3], 10, 64)
+		now := sec*int64(time.Second) + nsec
+		last = now
+		out = nil
+		switch rest := m[4]; {
+		case tid == 0:
+			// the idle task
+		case strings.HasPrefix(rest, "PERF_RECORD_SWITCH"):
+			if strings.Contains(rest, " IN") {
+				add(tid, now)
+			}
+		default:
+			// a sched_switch sample, followed by its callchain
+			out = &switchOut{time: now}
+			pending[tid] = out
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return blocked, switches, err
+	}
+	for tid := range pending {
+		add(tid, last)
+	}
+	return blocked, switches, nil
+}
+
+// A profileBuilder adds samples to a profile, reusing its mappings,
+// functions and locations.
+type profileBuilder struct {
+	p         *pprof.Profile
+	mappings  map[string]*pprof.Mapping
+	functions map[[2]string]*pprof.Function
+	locations map[string]*pprof.Location
+	nextID    uint64
+}
+
+func newProfileBuilder(p *pprof.Profile) *profileBuilder {
+	b := &profileBuilder{
+		p:         p,
+		mappings:  make(map[string]*pprof.Mapping),
+		functions: make(map[[2]string]*pprof.Function),
+		locations: make(map[string]*pprof.Location),
+	}
+	for _, m := range p.Mapping {
+		b.mappings[m.File] = m
+		if m.ID > b.nextID {
+			b.nextID = m.ID
+		}
+	}
+	for _, f := range p.Function {
+		if f.ID > b.nextID {
+			b.nextID = f.ID
+		}
+	}
+	for _, l := range p.Location {
+		if l.ID > b.nextID {
+			b.nextID = l.ID
+		}
+	}
+	return b
+}
+
+func (b *profileBuilder) id() uint64 {
+	b.nextID++
+	return b.nextID
+}
+
+// location returns the location of addr in the function sym of the
+// binary file.
+func (b *profileBuilder) location(addr uint64, sym, file string) *pprof.Location {
+	key := strconv.FormatUint(addr, 16) + " " + file
+	if loc, ok := b.locations[key]; ok {
+		return loc
+	}
+	m, ok := b.mappings[file]
+	if !ok {
+		m = &pprof.Mapping{ID: b.id(), File: file, HasFunctions: true}
+		b.mappings[file] = m
+		b.p.Mapping = append(b.p.Mapping, m)
+	}
+	// perf script appends the offset into the symbol, as in read+0x12
+	if i := strings.LastIndex(sym, "+0x"); i > 0 {
+		sym = sym[:i]
+	}
+	fn, ok := b.functions[[2]string{sym, file}]
+	if !ok {
+		fn = &pprof.Function{ID: b.id(), Name: sym, SystemName: sym}
+		b.functions[[2]string{sym, file}] = fn
+		b.p.Function = append(b.p.Function, fn)
+	}
+	loc := &pprof.Location{ID: b.id(), Mapping: m, Address: addr, Line: []pprof.Line{{Function: fn}}}
+	b.locations[key] = loc
+	b.p.Location = append(b.p.Location, loc)
+	return loc
+}
+
+// addSample adds a sample of stack, leaf first, with value as its first
+// values.
+func (b *profileBuilder) addSample(stack []*pprof.Location, value ...int64) {
+	values := make([]int64, len(b.p.SampleType))
+	if len(values) == 0 {
+		return
+	}
+	copy(values, value)
+	b.p.Sample = append(b.p.Sample, &pprof.Sample{Location: stack, Value: values})
+}
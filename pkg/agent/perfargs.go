@@ -0,0 +1,277 @@
+package agent
+
+import "strings"
+
+// perfOption returns the value of a perf record option given either
+// in its short or long form.
+func perfOption(args []string, short, long string) (string, bool) {
+	for i, arg := range args {
+		switch {
+		case arg == "--":
+			return "", false
+		case (arg == short || arg == long) && i+1 < len(args):
+			return args[i+1], true
+		case strings.HasPrefix(arg, long+"="):
+			return strings.TrimPrefix(arg, long+"="), true
+		case strings.HasPrefix(arg, short) && len(arg) > len(short) && !strings.HasPrefix(arg, "--"):
+			return strings.TrimPrefix(arg, short), true
+		}
+	}
+	return "", false
+}
+
+// setPerfOption replaces the value of a perf record option, adding it
+// if it is not present.
+func setPerfOption(args []string, short, long, value string) []string {
+	result := make([]string, 0, len(args)+2)
+	var found bool
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			if !found {
+				result = append(result, short, value)
+				found = true
+			}
+			result = append(result, args[i:]...)
+			return result
+		case (arg == short || arg == long) && i+1 < len(args):
+			result = append(result, arg, value)
+			i++
+			found = true
+			continue
+		case strings.HasPrefix(arg, long+"="):
+			arg = long + "=" + value
+			found = true
+		case strings.HasPrefix(arg, short) && len(arg) > len(short) && !strings.HasPrefix(arg, "--"):
+			arg = short + value
+			found = true
+		}
+		result = append(result, arg)
+	}
+	if !found {
+		result = append(result, short, value)
+	}
+	return result
+}
+
+// perfEvents returns the events named in perf record arguments args.
+func perfEvents(args []string) []string {
+	var events []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		var list string
+		switch {
+		case arg == "--":
+			return events
+		case (arg == "-e" || arg == "--event") && i+1 < len(args):
+			i++
+			list = args[i]
+		case strings.HasPrefix(arg, "--event="):
+			list = strings.TrimPrefix(arg, "--event=")
+		case strings.HasPrefix(arg, "-e") && !strings.HasPrefix(arg, "--"):
+			list = strings.TrimPrefix(arg, "-e")
+		default:
+			continue
+		}
+		events = append(events, strings.Split(list, ",")...)
+	}
+	return events
+}
+
+// removePerfEvents removes the events named in perf record arguments
+// args.
+func removePerfEvents(args []string) []string {
+	result := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			return append(result, args[i:]...)
+		case (arg == "-e" || arg == "--event") && i+1 < len(args):
+			i++
+			continue
+		case strings.HasPrefix(arg, "--event="):
+			continue
+		case strings.HasPrefix(arg, "-e") && !strings.HasPrefix(arg, "--"):
+			continue
+		}
+		result = append(result, arg)
+	}
+	return result
+}
+
+// The modifiers of perf events, such as the u of cycles:u, that carry
+// over to the events replacing them. Other suffixes, such as the
+// sched_switch of sched:sched_switch, name the event itself.
+const eventModifiers = "ukhGHpPS"
+
+// eventModifier returns the modifiers e ends with, with their colon, or
+// "" if it has none.
+func eventModifier(e string) string {
+	n := strings.LastIndex(e, ":")
+	if n < 0 || n == len(e)-1 || strings.Trim(e[n+1:], eventModifiers) != "" {
+		return ""
+	}
+	return e[n:]
+}
+
+// replacePerfEvents replaces each event named in perf record arguments
+// args with event, keeping modifiers such as :u. If args name no events,
+// event is added.
+func replacePerfEvents(args []string, event string) []string {
+	replace := func(list string) string {
+		var events []string
+		seen := make(map[string]bool)
+		for _, e := range strings.Split(list, ",") {
+			mod := eventModifier(e)
+			if !seen[event+mod] {
+				seen[event+mod] = true
+				events = append(events, event+mod)
+			}
+		}
+		return strings.Join(events, ",")
+	}
+	result := make([]string, 0, len(args)+2)
+	var found bool
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			if !found {
+				result = append(result, "-e", event)
+				found = true
+			}
+			return append(result, args[i:]...)
+		case (arg == "-e" || arg == "--event") && i+1 < len(args):
+			i++
+			result = append(result, arg, replace(args[i]))
+			found = true
+			continue
+		case strings.HasPrefix(arg, "--event="):
+			arg = "--event=" + replace(strings.TrimPrefix(arg, "--event="))
+			found = true
+		case strings.HasPrefix(arg, "-e") && !strings.HasPrefix(arg, "--"):
+			arg = "-e" + replace(strings.TrimPrefix(arg, "-e"))
+			found = true
+		}
+		result = append(result, arg)
+	}
+	if !found {
+		result = append(result, "-e", event)
+	}
+	return result
+}
+
+// hasPerfOption reports whether the perf record option opt, which may be
+// followed by a value, appears in args.
+func hasPerfOption(args []string, opt string) bool {
+	for _, arg := range args {
+		if arg == "--" {
+			return false
+		}
+		if arg == opt || strings.HasPrefix(arg, opt+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// removePerfOption removes the perf record option opt, which must not
+// take a separate value argument, from args.
+func removePerfOption(args []string, opt string) []string {
+	result := make([]string, 0, len(args))
+	for i, arg := range args {
+		if arg == "--" {
+			return append(result, args[i:]...)
+		}
+		if arg == opt || strings.HasPrefix(arg, opt+"=") {
+			continue
+		}
+		result = append(result, arg)
+	}
+	return result
+}
+
+// addPerfOptions inserts opts into the perf record arguments args,
+// before the command perf should run, if any.
+func addPerfOptions(args []string, opts ...string) []string {
+	result := make([]string, 0, len(args)+len(opts))
+	for i, arg := range args {
+		if arg == "--" {
+			result = append(result, opts...)
+			return append(result, args[i:]...)
+		}
+		result = append(result, arg)
+	}
+	return append(result, opts...)
+}
+
+// perfWorkload reports whether args name a command for perf to run, after
+// a -- separator, whose exit ends the recording.
+func perfWorkload(args []string) bool {
+	for _, arg := range args {
+		if arg == "--" {
+			return true
+		}
+	}
+	return false
+}
+
+// systemWide reports whether perf arguments args record every CPU on
+// the host, rather than specific processes.
+func systemWide(args []string) bool {
+	for _, arg := range args {
+		switch {
+		case arg == "--":
+			return false
+		case arg == "--all-cpus":
+			return true
+		case strings.HasPrefix(arg, "--"):
+			continue
+		case strings.HasPrefix(arg, "-"):
+			if shortFlagSet(arg, 'a') {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// shortFlagSet reports whether the flag c appears in a group of
+// combined short perf options such as -ag. Letters following an option
+// that takes a value, as in -F99, are part of the value.
+func shortFlagSet(arg string, c rune) bool {
+	const takesValue = "CDFGIbcejkmoprtu"
+	for _, r := range strings.TrimPrefix(arg, "-") {
+		if r == c {
+			return true
+		}
+		if strings.ContainsRune(takesValue, r) {
+			return false
+		}
+	}
+	return false
+}
+
+// removeSystemWide removes the options recording every CPU on the host
+// from args, including -a in groups of short options such as -ag.
+func removeSystemWide(args []string) []string {
+	result := make([]string, 0, len(args))
+	for i, arg := range args {
+		switch {
+		case arg == "--":
+			return append(result, args[i:]...)
+		case arg == "--all-cpus":
+			continue
+		case strings.HasPrefix(arg, "--"):
+		case strings.HasPrefix(arg, "-") && shortFlagSet(arg, 'a'):
+			arg = strings.Replace(arg, "a", "", 1)
+			if arg == "-" {
+				continue
+			}
+		}
+		result = append(result, arg)
+	}
+	return result
+}
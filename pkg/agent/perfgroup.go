@@ -0,0 +1,93 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// perf runs in a process group of its own, with the workload it is given,
+// such as the sleep of `perf record ... -- sleep 10`, so that the two are
+// interrupted, and if need be killed, together. Signalling perf alone
+// would leave the workload running past the recording, and past the
+// removal of the directory it was recorded in. Whatever is left in the
+// group when perf exits is killed. Being in its own group, perf no longer
+// receives the signals a terminal sends the agent's, so the groups of the
+// perf commands running are sent the signals that end the agent. perf
+// also holds the lock on the agent's temporary directory (see
+// recover.go), so that its recording is not recovered while it is still
+// being written, should the agent die first.
+
+// The process groups of the perf commands running, by the pid of perf,
+// which leads its group.
+var perfGroups = struct {
+	sync.Mutex
+	pids map[int]bool
+}{pids: make(map[int]bool)}
+
+// startPerfGroup starts cmd, a perf command, in a process group of its
+// own.
+func startPerfGroup(cmd *exec.Cmd) error {
+	attr := new(syscall.SysProcAttr)
+	if cmd.SysProcAttr != nil {
+		*attr = *cmd.SysProcAttr
+	}
+	attr.Setpgid = true
+	cmd.SysProcAttr = attr
+	if tmpdirLock != nil {
+		cmd.ExtraFiles = append(cmd.ExtraFiles, tmpdirLock)
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	perfGroups.Lock()
+	perfGroups.pids[cmd.Process.Pid] = true
+	perfGroups.Unlock()
+	return nil
+}
+
+// signalPerfGroup sends sig to the process group of perf, whose pid is
+// pid.
+func signalPerfGroup(pid int, sig syscall.Signal) error {
+	return syscall.Kill(-pid, sig)
+}
+
+// endPerfGroup kills what is left of the process group of perf, whose pid
+// is pid, once perf has exited.
+func endPerfGroup(pid int) {
+	perfGroups.Lock()
+	delete(perfGroups.pids, pid)
+	perfGroups.Unlock()
+	if err := syscall.Kill(-pid, syscall.SIGKILL); err == nil {
+		logDebugf("killed the processes perf %d left running", pid)
+	}
+}
+
+// signalPerfGroups sends sig to the process groups of the perf commands
+// running.
+func signalPerfGroups(sig syscall.Signal) {
+	perfGroups.Lock()
+	defer perfGroups.Unlock()
+	for pid := range perfGroups.pids {
+		signalPerfGroup(pid, sig)
+	}
+}
+
+// perfAttached reports whether a perf command running has opened its
+// events.
+func perfAttached() bool {
+	perfGroups.Lock()
+	defer perfGroups.Unlock()
+	for pid := range perfGroups.pids {
+		fds, _ := filepath.Glob(fmt.Sprintf("/proc/%d/fd/*", pid))
+		for _, fd := range fds {
+			if link, err := os.Readlink(fd); err == nil && link == "anon_inode:[perf_event]" {
+				return true
+			}
+		}
+	}
+	return false
+}
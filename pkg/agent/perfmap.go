@@ -0,0 +1,118 @@
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/droyo/cloud-profiler-perf/pkg/perf"
+	"github.com/droyo/cloud-profiler-perf/pkg/symbolize"
+)
+
+// Runtimes that generate code without writing it to a file, such as Node
+// with --perf-basic-prof or the JVM with perf-map-agent, name it in
+// /tmp/perf-<pid>.map, a line of start address, size and name in hex for
+// each function. When a recording is symbolized, the map files of the
+// processes it recorded are copied into the symbol tree, as
+// perf-<pid>.map by the pid perf recorded, and addresses in anonymous
+// memory, or in none perf saw mapped, are named by the process's map. The
+// map of a process in a container is read through its root, by the pid
+// it has there. The container controls what is at that path, so only a
+// regular file is read: a symlink would be followed from the host's
+// root, and opening a FIFO would block.
+
+// namespacePid returns the pid process pid has in its own pid namespace.
+func namespacePid(pid int) int {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return pid
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "NSpid:") {
+			fields := strings.Fields(line)
+			if n, err := strconv.Atoi(fields[len(fields)-1]); err == nil {
+				return n
+			}
+		}
+	}
+	return pid
+}
+
+// hostPerfMaps returns the paths of the map files of the processes on
+// this host that have one, by pid.
+func hostPerfMaps() map[int]string {
+	maps := make(map[int]string)
+	dirs, _ := filepath.Glob("/proc/[0-9]*")
+	for _, dir := range dirs {
+		pid, err := strconv.Atoi(filepath.Base(dir))
+		if err != nil {
+			continue
+		}
+		path := filepath.Join(dir, "root/tmp", symbolize.PerfMapName(namespacePid(pid)))
+		if info, err := os.Lstat(path); err == nil && info.Mode().IsRegular() {
+			maps[pid] = path
+		}
+	}
+	return maps
+}
+
+// copyPerfMaps copies the map files of the processes recorded in the
+// perf.data file perfData into the symbol tree dst, returning how many
+// it copied.
+func copyPerfMaps(dst, perfData string) (int, error) {
+	maps := hostPerfMaps()
+	if len(maps) == 0 {
+		return 0, nil
+	}
+	f, err := os.Open(perfData)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	recorded, err := perf.Mappings(f)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for pid := range recorded {
+		path, ok := maps[int(pid)]
+		if !ok {
+			continue
+		}
+		src, err := openPerfMap(path)
+		if err != nil {
+			logDebugf("not copying perf map file: %s", err)
+			continue
+		}
+		err = copyFile(filepath.Join(dst, symbolize.PerfMapName(int(pid))), src)
+		src.Close()
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// openPerfMap opens the map file at path, which must be a regular file.
+// It is checked again once open, as it may have been replaced since it
+// was found.
+func openPerfMap(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err == nil && !info.Mode().IsRegular() {
+		err = fmt.Errorf("%s is not a regular file", path)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,38 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestOpenPerfMap(t *testing.T) {
+	dir := t.TempDir()
+	regular := filepath.Join(dir, "perf-1.map")
+	if err := os.WriteFile(regular, []byte("1000 10 f\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	f, err := openPerfMap(regular)
+	if err != nil {
+		t.Fatalf("regular file: %s", err)
+	}
+	f.Close()
+
+	link := filepath.Join(dir, "perf-2.map")
+	if err := os.Symlink(regular, link); err != nil {
+		t.Fatal(err)
+	}
+	fifo := filepath.Join(dir, "perf-3.map")
+	if err := syscall.Mkfifo(fifo, 0666); err != nil {
+		t.Fatal(err)
+	}
+	// a FIFO with no writer would block an open without O_NONBLOCK,
+	// failing the test by its timeout
+	for _, path := range []string{link, fifo, dir} {
+		if f, err := openPerfMap(path); err == nil {
+			f.Close()
+			t.Errorf("opened %s, want an error", path)
+		}
+	}
+}
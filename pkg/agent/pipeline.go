@@ -0,0 +1,53 @@
+package agent
+
+import (
+	cloudprofiler "google.golang.org/genproto/googleapis/devtools/cloudprofiler/v2"
+)
+
+// The API asks an agent for a profile by answering the CreateProfile
+// call it is holding. An agent busy converting and uploading the last
+// profile holds none, and the profiles it could have been asked for in
+// the meantime go to other agents, or nowhere. With -pipeline n,
+// CreateProfile is called from a goroutine of its own, which keeps
+// asking while profiles are collected and uploaded, until n profiles it
+// was asked for are waiting. Profiles are still collected one at a time,
+// in the order they were asked for, as recordings made at once would
+// measure each other.
+
+// A polledProfile is the outcome of a CreateProfile call made ahead.
+type polledProfile struct {
+	profile *cloudprofiler.Profile
+	err     error
+}
+
+// pollAhead starts asking for profiles ahead of their collection, up to
+// n at a time, and returns the function that takes the next. After an
+// error, which is passed on, no more profiles are asked for.
+func (a *agent) pollAhead(n int) func() (*cloudprofiler.Profile, error) {
+	queue := make(chan polledProfile, n)
+	// a slot is taken for each profile asked for and not yet taken
+	slots := make(chan struct{}, n)
+	go func() {
+		for {
+			select {
+			case slots <- struct{}{}:
+			case <-a.ctx.Done():
+				return
+			}
+			profile, err := a.tryCreateProfile()
+			queue <- polledProfile{profile, err}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return func() (*cloudprofiler.Profile, error) {
+		select {
+		case polled := <-queue:
+			<-slots
+			return polled.profile, polled.err
+		case <-a.ctx.Done():
+			return nil, a.ctx.Err()
+		}
+	}
+}
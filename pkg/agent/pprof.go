@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	cloudprofiler "google.golang.org/genproto/googleapis/devtools/cloudprofiler/v2"
+
+	pprof "github.com/google/pprof/profile"
+)
+
+func readPprof(path string) (*pprof.Profile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return pprof.Parse(file)
+}
+
+// setProfileBytes encodes p as the payload of profile.
+func setProfileBytes(profile *cloudprofiler.Profile, p *pprof.Profile) error {
+	var buf bytes.Buffer
+	if err := p.Write(&buf); err != nil {
+		return err
+	}
+	profile.ProfileBytes = buf.Bytes()
+	return nil
+}
+
+// How far in the future a profile's start may be, allowing for clocks
+// adjusted during the recording.
+const maxClockSkew = time.Minute
+
+// normalizeProfile checks the payload of profile before it is uploaded,
+// so that a conversion gone wrong is reported as such rather than as an
+// error of the API, and fills in what the API expects and converters
+// leave out: the start and duration of the profile, a period type
+// matching its sample types, and gzip compression. Empty and invalid
+// profiles are skipped.
+func normalizeProfile(profile *cloudprofiler.Profile) error {
+	invalid := func(format string, args ...interface{}) error {
+		return &skipError{kind: "invalid-profile", reason: fmt.Sprintf(format, args...)}
+	}
+	if len(profile.ProfileBytes) == 0 {
+		return invalid("the %s profile is empty", profile.ProfileType)
+	}
+	p, err := pprof.ParseData(profile.ProfileBytes)
+	if err != nil {
+		return invalid("the %s profile is not valid pprof: %s", profile.ProfileType, err)
+	}
+	if err := p.CheckValid(); err != nil {
+		return invalid("the %s profile is not valid pprof: %s", profile.ProfileType, err)
+	}
+	switch {
+	case len(p.SampleType) == 0:
+		return invalid("the %s profile has no sample types", profile.ProfileType)
+	case len(p.Sample) == 0:
+		return invalid("the %s profile has no samples", profile.ProfileType)
+	}
+
+	now := time.Now()
+	if p.DurationNanos <= 0 {
+		if d, err := ptypes.Duration(profile.Duration); err == nil && d > 0 {
+			p.DurationNanos = d.Nanoseconds()
+		}
+	}
+	switch start := time.Unix(0, p.TimeNanos); {
+	case p.TimeNanos <= 0:
+		p.TimeNanos = now.Add(-time.Duration(p.DurationNanos)).UnixNano()
+	case start.After(now.Add(maxClockSkew)):
+		return invalid("the %s profile starts in the future, at %s", profile.ProfileType, start.Format(time.RFC3339))
+	}
+	if p.PeriodType == nil {
+		st := p.SampleType[len(p.SampleType)-1]
+		p.PeriodType = &pprof.ValueType{Type: st.Type, Unit: st.Unit}
+	}
+	if p.Period <= 0 {
+		p.Period = 1
+	}
+	if p.DefaultSampleType != "" {
+		var found bool
+		for _, st := range p.SampleType {
+			found = found || st.Type == p.DefaultSampleType
+		}
+		if !found {
+			p.DefaultSampleType = ""
+		}
+	}
+	// encoding it again also compresses it
+	return setProfileBytes(profile, p)
+}
@@ -0,0 +1,193 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	cloudprofiler "google.golang.org/genproto/googleapis/devtools/cloudprofiler/v2"
+
+	pprof "github.com/google/pprof/profile"
+
+	"github.com/droyo/cloud-profiler-perf/pkg/uploader"
+)
+
+// Go services serve their own profiles from net/http/pprof, including
+// what perf cannot see: the Go heap, and goroutines. A profile type given
+// the base URL of a service's pprof handlers in -config, such as
+//
+//	profiles:
+//	  heap:
+//	    pprof: http://localhost:6060/debug/pprof
+//
+// is collected by fetching the service's profile of that type rather
+// than by the -collector, and uploaded as the service wrote it, less the
+// sample types the profile type does not report. A CPU profile lasts as
+// long as the API asks; the others are snapshots.
+
+// The handlers under a net/http/pprof base URL serving each profile type.
+var pprofHandlers = map[cloudprofiler.ProfileType]string{
+	cloudprofiler.ProfileType_CPU:        "profile",
+	cloudprofiler.ProfileType_HEAP:       "heap?gc=1",
+	cloudprofiler.ProfileType_HEAP_ALLOC: "allocs",
+	cloudprofiler.ProfileType_THREADS:    "goroutine",
+	cloudprofiler.ProfileType_CONTENTION: "mutex",
+}
+
+const (
+	// how much longer than a CPU profile a fetch may take
+	pprofFetchGrace = 30 * time.Second
+	// the largest profile fetched
+	maxPprofBytes = 64 << 20
+)
+
+// A pprofCollector fetches profiles from a Go service's net/http/pprof
+// handlers.
+type pprofCollector struct {
+	agent *agent
+	t     cloudprofiler.ProfileType
+	// the handler of t
+	url string
+}
+
+// newPprofCollector returns the collector of profile type t from the
+// net/http/pprof handlers at base.
+func newPprofCollector(a *agent, t cloudprofiler.ProfileType, base string) (uploader.Collector, error) {
+	handler, ok := pprofHandlers[t]
+	if !ok {
+		return nil, fmt.Errorf("%s profiles cannot be fetched from net/http/pprof", t)
+	}
+	if _, err := url.Parse(base); err != nil {
+		return nil, fmt.Errorf("pprof URL of %s profiles: %s", t, err)
+	}
+	return &pprofCollector{agent: a, t: t, url: strings.TrimSuffix(base, "/") + "/" + handler}, nil
+}
+
+// Collect fetches the profile of c's type.
+func (c *pprofCollector) Collect(ctx context.Context, profile *cloudprofiler.Profile) ([]byte, error) {
+	u := c.url
+	timeout := pprofFetchGrace
+	if c.t == cloudprofiler.ProfileType_CPU {
+		d, err := ptypes.Duration(profile.Duration)
+		if err != nil {
+			d = defaultProfileDuration
+		}
+		seconds := int((d + time.Second - 1) / time.Second)
+		u += "?seconds=" + strconv.Itoa(seconds)
+		timeout += time.Duration(seconds) * time.Second
+		setPhase("recording", d)
+	} else {
+		setPhase("fetching", 0)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	data, err := fetchPprof(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	setPhase("converting", 0)
+	p, err := pprof.ParseData(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse profile from %s: %s", u, err)
+	}
+	keepPprofSampleTypes(p, c.t)
+	if err := p.CheckValid(); err != nil {
+		return nil, fmt.Errorf("invalid profile from %s: %s", u, err)
+	}
+	setProfileLabel(profile, "collector", "pprof")
+	addComment(p, "fetched from "+u)
+	c.agent.addTemplateComments(profile, p)
+	if err := c.agent.dedup.check(p); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := p.Write(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// fetchPprof returns the profile served at u.
+func fetchPprof(ctx context.Context, u string) ([]byte, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("%s: %s: %s", u, resp.Status, bytes.TrimSpace(msg))
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxPprofBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxPprofBytes {
+		return nil, fmt.Errorf("%s: profile larger than %d bytes", u, maxPprofBytes)
+	}
+	return data, nil
+}
+
+// keepPprofSampleTypes drops the sample types of p, a Go profile, that
+// profiles of type t do not report: the allocations of HEAP profiles,
+// and what remains in use of HEAP_ALLOC profiles.
+func keepPprofSampleTypes(p *pprof.Profile, t cloudprofiler.ProfileType) {
+	var prefix string
+	switch t {
+	case cloudprofiler.ProfileType_HEAP:
+		prefix = "inuse_"
+	case cloudprofiler.ProfileType_HEAP_ALLOC:
+		prefix = "alloc_"
+	default:
+		return
+	}
+	var keep []int
+	for i, st := range p.SampleType {
+		if strings.HasPrefix(st.Type, prefix) {
+			keep = append(keep, i)
+		}
+	}
+	if len(keep) == 0 || len(keep) == len(p.SampleType) {
+		return
+	}
+	types := make([]*pprof.ValueType, len(keep))
+	for j, i := range keep {
+		types[j] = p.SampleType[i]
+	}
+	p.SampleType = types
+	for _, s := range p.Sample {
+		values := make([]int64, len(keep))
+		for j, i := range keep {
+			values[j] = s.Value[i]
+		}
+		s.Value = values
+	}
+	if !strings.HasPrefix(p.DefaultSampleType, prefix) {
+		p.DefaultSampleType = ""
+	}
+}
+
+// pprofAddrs returns the addresses of the pprof handlers -config names.
+func pprofAddrs() []string {
+	var addrs []string
+	for _, p := range conf.profiles {
+		if p.pprof != "" {
+			if addr := urlAddr(p.pprof); addr != "" {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,176 @@
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The agent need not run as root. A user holding CAP_PERFMON, or
+// CAP_SYS_ADMIN on kernels older than 5.8, which do not know CAP_PERFMON,
+// may use perf events as root would, and CAP_SYSLOG lets it read kernel
+// symbol addresses under kernel.kptr_restrict=1. The capabilities are
+// read from /proc/self/status at startup. perf, which the agent runs,
+// keeps them only if they are ambient, as systemd's AmbientCapabilities=
+// makes them, or if the perf binary is granted them itself with setcap.
+//
+// An agent without them is held to kernel.perf_event_paranoid, and
+// the perf arguments are adjusted to what it allows where that leaves a
+// useful profile: -a is dropped when perf is given processes to record,
+// and kernel code is excluded when only user code may be sampled.
+// Otherwise, the capability to grant, and how, is reported at startup.
+
+// Capability bits from linux/capability.h.
+const (
+	capSysAdmin = 21
+	capSyslog   = 34
+	capPerfmon  = 38
+	capBPF      = 39
+)
+
+var capNames = []struct {
+	bit  uint
+	name string
+}{
+	{capSysAdmin, "CAP_SYS_ADMIN"},
+	{capSyslog, "CAP_SYSLOG"},
+	{capPerfmon, "CAP_PERFMON"},
+	{capBPF, "CAP_BPF"},
+}
+
+// privileges are the user and capabilities the agent runs with.
+type privileges struct {
+	uid                int
+	effective, ambient uint64
+	// whether the kernel knows CAP_PERFMON
+	perfmon bool
+}
+
+// readPrivileges determines the privileges of the agent.
+func readPrivileges() privileges {
+	p := privileges{uid: os.Geteuid()}
+	if v, err := hostKernelVersion(); err == nil {
+		p.perfmon = v.atLeast(version{5, 8})
+	}
+	status, err := ioutil.ReadFile("/proc/self/status")
+	if err != nil {
+		return p
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		field := strings.SplitN(line, ":", 2)
+		if len(field) != 2 {
+			continue
+		}
+		caps, err := strconv.ParseUint(strings.TrimSpace(field[1]), 16, 64)
+		if err != nil {
+			continue
+		}
+		switch field[0] {
+		case "CapEff":
+			p.effective = caps
+		case "CapAmb":
+			p.ambient = caps
+		}
+	}
+	return p
+}
+
+func (p privileges) root() bool { return p.uid == 0 }
+
+func (p privileges) has(bit uint) bool { return p.root() || p.effective&(1<<bit) != 0 }
+
+// perfCaps returns the capabilities that lift the restrictions of
+// kernel.perf_event_paranoid.
+func (p privileges) perfCaps() uint64 {
+	if p.perfmon {
+		return 1<<capSysAdmin | 1<<capPerfmon
+	}
+	return 1 << capSysAdmin
+}
+
+// perfEvents reports whether the agent may use perf events without the
+// restrictions of kernel.perf_event_paranoid.
+func (p privileges) perfEvents() bool {
+	return p.root() || p.effective&p.perfCaps() != 0
+}
+
+// symbols reports whether the agent may read kernel symbol addresses
+// under kernel.kptr_restrict=1.
+func (p privileges) symbols() bool { return p.has(capSyslog) }
+
+func (p privileges) String() string {
+	if p.root() {
+		return "root"
+	}
+	var names []string
+	for _, c := range capNames {
+		if p.effective&(1<<c.bit) == 0 {
+			continue
+		}
+		if p.ambient&(1<<c.bit) != 0 {
+			names = append(names, c.name+" (ambient)")
+		} else {
+			names = append(names, c.name)
+		}
+	}
+	if len(names) == 0 {
+		return fmt.Sprintf("uid %d, without capabilities", p.uid)
+	}
+	return fmt.Sprintf("uid %d, with %s", p.uid, strings.Join(names, ", "))
+}
+
+// privileged reports whether the agent may use perf events without the
+// restrictions of kernel.perf_event_paranoid.
+func privileged() bool {
+	return readPrivileges().perfEvents()
+}
+
+// privilegeProblems returns the problems with capabilities that perf
+// would not keep.
+func (a *agent) privilegeProblems(p privileges) []depProblem {
+	if p.root() || a.ebpf || p.effective&^p.ambient&(p.perfCaps()|1<<capSyslog) == 0 || perfFileCaps() {
+		return nil
+	}
+	return []depProblem{{
+		problem: fmt.Sprintf("the agent runs as %s, and perf inherits only ambient capabilities", p),
+		fix:     "grant them with AmbientCapabilities=CAP_PERFMON CAP_SYSLOG in the agent's systemd unit, or to perf itself with setcap cap_perfmon,cap_syslog+ep $(which perf)",
+	}}
+}
+
+// perfTargets reports whether perf arguments args name processes, threads
+// or users to record.
+func perfTargets(args []string) bool {
+	for _, opt := range [][2]string{{"-p", "--pid"}, {"-t", "--tid"}, {"-u", "--uid"}} {
+		if _, ok := perfOption(args, opt[0], opt[1]); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// adaptToPrivileges adjusts the agent's perf commands and execution mode
+// to what kernel.perf_event_paranoid allows an agent with privileges p,
+// where a useful profile can still be recorded. What cannot be adjusted
+// is left to checkDependencies to report.
+func (a *agent) adaptToPrivileges(p privileges) {
+	paranoid, ok := readSysctl("kernel.perf_event_paranoid")
+	if !ok || p.perfEvents() || *collectWith != collectorPerf {
+		return
+	}
+	if paranoid > 0 {
+		for _, cmd := range a.perfCommands() {
+			args := cmd.Args[2:]
+			if systemWide(args) && (perfTargets(args) || perfWorkload(args)) {
+				cmd.Args = append(cmd.Args[:2:2], removeSystemWide(args)...)
+				log.Printf("kernel.perf_event_paranoid is %d: recording only the processes perf is given, rather than every CPU", paranoid)
+			}
+		}
+	}
+	if paranoid > 1 && a.mode == modeAll {
+		log.Printf("kernel.perf_event_paranoid is %d: profiling only user code; grant CAP_PERFMON to include the kernel", paranoid)
+		a.mode = modeUser
+	}
+}
@@ -0,0 +1,17 @@
+package agent
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// perfFileCaps reports whether the perf binary in PATH is granted
+// capabilities of its own.
+func perfFileCaps() bool {
+	path, err := exec.LookPath("perf")
+	if err != nil {
+		return false
+	}
+	n, err := syscall.Getxattr(path, "security.capability", nil)
+	return err == nil && n > 0
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+// +build !linux
+
+package agent
+
+// perfFileCaps reports false, as file capabilities are Linux's.
+func perfFileCaps() bool { return false }
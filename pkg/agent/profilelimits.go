@@ -0,0 +1,103 @@
+package agent
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	cloudprofiler "google.golang.org/genproto/googleapis/devtools/cloudprofiler/v2"
+)
+
+// One duration and sampling frequency rarely suits every profile type:
+// a WALL profile needs longer to show where threads block than a CPU
+// profile needs to show where they run. -profile-limits caps the duration
+// the server asks for, and sets the sampling frequency, by type.
+
+// A profileLimit is the maximum duration and the sampling frequency of a
+// profile type. Zero values leave the server's duration and the perf
+// command's frequency alone.
+type profileLimit struct {
+	duration time.Duration
+	freq     int
+	// set if duration is given, as it may be zero
+	hasDuration bool
+}
+
+// parseProfileLimits parses limits of the form type=duration@frequency,
+// either part optional, such as "cpu=10s@99,wall=30s,heap=0s".
+func parseProfileLimits(s string) (map[cloudprofiler.ProfileType]profileLimit, error) {
+	limits := make(map[cloudprofiler.ProfileType]profileLimit)
+	for _, field := range strings.Split(s, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("profile limit %q must be given as type=duration@frequency", field)
+		}
+		name, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		t, ok := profileTypeNames[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown profile type %q", name)
+		}
+		var lim profileLimit
+		d, f := value, ""
+		if i := strings.Index(value, "@"); i >= 0 {
+			d, f = value[:i], value[i+1:]
+		}
+		if d != "" {
+			var err error
+			if lim.duration, err = time.ParseDuration(d); err != nil || lim.duration < 0 {
+				return nil, fmt.Errorf("profile limit %s: invalid duration %q", name, d)
+			}
+			lim.hasDuration = true
+		}
+		if f != "" {
+			var err error
+			if lim.freq, err = strconv.Atoi(strings.TrimSuffix(f, "Hz")); err != nil || lim.freq <= 0 {
+				return nil, fmt.Errorf("profile limit %s: invalid frequency %q", name, f)
+			}
+		}
+		if !lim.hasDuration && lim.freq == 0 {
+			return nil, fmt.Errorf("profile limit %s sets neither a duration nor a frequency", name)
+		}
+		limits[t] = lim
+	}
+	return limits, nil
+}
+
+// clampDuration shortens the duration the server asked for of profile to
+// its type's limit.
+func (a *agent) clampDuration(profile *cloudprofiler.Profile) {
+	lim, ok := a.limits[profile.ProfileType]
+	if !ok || !lim.hasDuration || profile.Duration == nil {
+		return
+	}
+	d, err := ptypes.Duration(profile.Duration)
+	if err != nil || d <= lim.duration {
+		return
+	}
+	log.Printf("shortening %s profile from %v to %v", profile.ProfileType, d, lim.duration)
+	profile.Duration = ptypes.DurationProto(lim.duration)
+}
+
+// frequency returns the sampling frequency of profiles of type t. A
+// frequency set by -profile-limits is lowered in proportion when the
+// sampler has lowered the command's to stop losing samples.
+func (a *agent) frequency(t cloudprofiler.ProfileType) int {
+	lim, ok := a.limits[t]
+	if !ok || lim.freq == 0 || a.sampler.frequency == 0 {
+		return a.sampler.freq
+	}
+	freq := lim.freq * a.sampler.freq / a.sampler.frequency
+	if freq < minFrequency {
+		freq = minFrequency
+	}
+	if freq > lim.freq {
+		freq = lim.freq
+	}
+	return freq
+}
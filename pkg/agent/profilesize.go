@@ -0,0 +1,180 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+
+	cloudprofiler "google.golang.org/genproto/googleapis/devtools/cloudprofiler/v2"
+
+	pprof "github.com/google/pprof/profile"
+)
+
+// The API rejects profiles over its size limit, and system-wide
+// recordings of busy hosts, with many distinct stacks, can reach tens of
+// megabytes. With -max-profile-bytes, a profile larger than the limit is
+// downsampled before it is uploaded, in steps that each lose more: first
+// its lightest samples are dropped, as long as they add up to at most
+// maxDroppedWeight of the profile, then its stacks are capped at fewer
+// and fewer frames, down to minFitDepth, and last, lighter samples are
+// dropped until it fits. What was trimmed is recorded in a comment, and
+// the profile's downsampled label is set to the number of samples
+// dropped.
+
+// The most of a profile's weight the first step may drop.
+const maxDroppedWeight = 0.05
+
+// The stack depth the second step starts capping at, and the least it
+// caps at.
+const (
+	maxFitDepth = 128
+	minFitDepth = 16
+)
+
+// How many times the last step drops samples before the profile is
+// uploaded as it is.
+const maxFitAttempts = 5
+
+// fitSize downsamples profile until it is at most a.maxBytes.
+func (a *agent) fitSize(profile *cloudprofiler.Profile) {
+	size := len(profile.ProfileBytes)
+	if a.maxBytes <= 0 || size <= a.maxBytes {
+		return
+	}
+	p, err := pprof.ParseData(profile.ProfileBytes)
+	if err != nil {
+		logWarnf("could not downsample %s profile of %d bytes: %s", profile.ProfileType, size, err)
+		return
+	}
+	samples, weight := len(p.Sample), totalWeight(p)
+	var dropped, droppedWeight int64
+	depth := 0
+	data := profile.ProfileBytes
+	drop := func(limit float64) error {
+		keep := int(float64(len(p.Sample)) * float64(a.maxBytes) / float64(len(data)) * 0.9)
+		n, w := dropLightSamples(p, keep, limit-float64(droppedWeight))
+		dropped, droppedWeight = dropped+int64(n), droppedWeight+w
+		p = p.Compact()
+		data, err = encodePprof(p)
+		return err
+	}
+
+	if err := drop(float64(weight) * maxDroppedWeight); err != nil {
+		logWarnf("could not downsample %s profile: %s", profile.ProfileType, err)
+		return
+	}
+	for d := maxFitDepth; len(data) > a.maxBytes && d >= minFitDepth; d /= 2 {
+		var elided int
+		if p, elided = limitStackDepth(p, d); elided > 0 {
+			depth = d
+		}
+		if data, err = encodePprof(p); err != nil {
+			logWarnf("could not downsample %s profile: %s", profile.ProfileType, err)
+			return
+		}
+	}
+	for i := 0; len(data) > a.maxBytes && i < maxFitAttempts && len(p.Sample) > 0; i++ {
+		if err := drop(float64(weight)); err != nil {
+			logWarnf("could not downsample %s profile: %s", profile.ProfileType, err)
+			return
+		}
+	}
+
+	summary := fmt.Sprintf("downsampled from %d to %d bytes to fit -max-profile-bytes %d: dropped the %d lightest of %d samples, %.1f%% of the profile's weight",
+		size, len(data), a.maxBytes, dropped, samples, percent(droppedWeight, weight))
+	if depth > 0 {
+		summary += fmt.Sprintf(", and capped stacks at %d frames", depth)
+	}
+	addComment(p, summary)
+	if data, err = encodePprof(p); err != nil {
+		logWarnf("could not downsample %s profile: %s", profile.ProfileType, err)
+		return
+	}
+	if len(data) > a.maxBytes {
+		logWarnf("%s profile is still %d bytes after downsampling, over -max-profile-bytes %d", profile.ProfileType, len(data), a.maxBytes)
+	}
+	logAt(levelInfo, profileFields(profile), "%s profile %s", profile.ProfileType, summary)
+	profile.ProfileBytes = data
+	setProfileLabel(profile, "downsampled", strconv.FormatInt(dropped, 10))
+}
+
+// encodePprof returns the encoding of p.
+func encodePprof(p *pprof.Profile) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := p.Write(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// weightIndex returns the index of the sample value samples are weighed
+// by: that of the profile's default sample type, or else its last, as
+// pprof shows by default.
+func weightIndex(p *pprof.Profile) int {
+	for i, st := range p.SampleType {
+		if st.Type == p.DefaultSampleType {
+			return i
+		}
+	}
+	return len(p.SampleType) - 1
+}
+
+func sampleWeight(s *pprof.Sample, i int) int64 {
+	if i < 0 || i >= len(s.Value) {
+		return 0
+	}
+	if v := s.Value[i]; v >= 0 {
+		return v
+	}
+	return -s.Value[i]
+}
+
+func totalWeight(p *pprof.Profile) int64 {
+	var total int64
+	i := weightIndex(p)
+	for _, s := range p.Sample {
+		total += sampleWeight(s, i)
+	}
+	return total
+}
+
+// dropLightSamples drops the lightest samples of p, keeping at least
+// keep, and dropping at most limit of their weight. It returns the
+// number of samples and the weight dropped.
+func dropLightSamples(p *pprof.Profile, keep int, limit float64) (int, int64) {
+	i := weightIndex(p)
+	order := make([]*pprof.Sample, len(p.Sample))
+	copy(order, p.Sample)
+	sort.SliceStable(order, func(a, b int) bool {
+		return sampleWeight(order[a], i) < sampleWeight(order[b], i)
+	})
+	drop := make(map[*pprof.Sample]bool)
+	var weight int64
+	for _, s := range order {
+		w := sampleWeight(s, i)
+		if len(p.Sample)-len(drop) <= keep || float64(weight+w) > limit {
+			break
+		}
+		drop[s] = true
+		weight += w
+	}
+	if len(drop) == 0 {
+		return 0, 0
+	}
+	kept := p.Sample[:0]
+	for _, s := range p.Sample {
+		if !drop[s] {
+			kept = append(kept, s)
+		}
+	}
+	p.Sample = kept
+	return len(drop), weight
+}
+
+func percent(part, whole int64) float64 {
+	if whole == 0 {
+		return 0
+	}
+	return 100 * float64(part) / float64(whole)
+}
@@ -0,0 +1,81 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const metadataURL = "http://metadata.google.internal/computeMetadata/v1/"
+
+// gceMetadata returns the value at path on the GCE metadata server, which
+// GKE nodes and pods also reach.
+func gceMetadata(path string) (string, error) {
+	req, err := http.NewRequest("GET", metadataURL+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	client := &http.Client{Timeout: metadataTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata server: %s", resp.Status)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// inferCloudProject determines the project to upload profiles to when
+// -project is not given: the project of the GCE instance the agent runs
+// on, $GOOGLE_CLOUD_PROJECT, or the project of the service account key
+// the agent's credentials come from.
+func inferCloudProject() (string, error) {
+	if project, err := gceMetadata("project/project-id"); err == nil && project != "" {
+		return project, nil
+	}
+	if project := os.Getenv("GOOGLE_CLOUD_PROJECT"); project != "" {
+		return project, nil
+	}
+	file := *credsJSON
+	if file == "" {
+		file = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if file == "" {
+		return "", errors.New("not on GCE, and neither $GOOGLE_CLOUD_PROJECT nor a credentials file to take it from is set; use -project")
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	var key struct {
+		ProjectID string `json:"project_id"`
+	}
+	if err := json.Unmarshal(data, &key); err != nil {
+		return "", fmt.Errorf("could not parse %s: %s", file, err)
+	}
+	if key.ProjectID == "" {
+		return "", fmt.Errorf("%s does not name a project; use -project", file)
+	}
+	return key.ProjectID, nil
+}
+
+// instanceZone returns the zone of the GCE instance the agent runs on.
+func instanceZone() (string, error) {
+	// projects/<number>/zones/<zone>
+	zone, err := gceMetadata("instance/zone")
+	if err != nil {
+		return "", err
+	}
+	return zone[strings.LastIndex(zone, "/")+1:], nil
+}
@@ -0,0 +1,100 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// In networks that allow no direct connections out, the agent reaches
+// the API through the proxy $HTTPS_PROXY names, unless $NO_PROXY
+// excludes the API's host, as it does every other Google API it calls
+// over HTTP. The gRPC connection is tunnelled through the proxy with an
+// HTTP CONNECT request for the API's host name, which the proxy
+// resolves, so its endpoints are neither resolved nor ranked, and the
+// latency probed is that of the proxy. Proxies reached over TLS, or
+// through SOCKS, are not supported, and the agent will not start with
+// one rather than try to connect directly.
+
+// apiProxy returns the proxy to reach the API at addr, a host:port,
+// through, or nil if it is reached directly.
+func apiProxy(addr string) (*url.URL, error) {
+	proxy, err := http.ProxyFromEnvironment(&http.Request{URL: &url.URL{Scheme: "https", Host: addr}})
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy for %s: %s", addr, err)
+	}
+	if proxy != nil && proxy.Scheme != "http" {
+		return nil, fmt.Errorf("the proxy %s for %s is %s://, but only http:// proxies are supported", proxy.Host, addr, proxy.Scheme)
+	}
+	return proxy, nil
+}
+
+// proxyAddr returns the host:port of proxy.
+func proxyAddr(proxy *url.URL) string {
+	if proxy.Port() != "" {
+		return proxy.Host
+	}
+	return net.JoinHostPort(proxy.Hostname(), "80")
+}
+
+// proxyAddrs returns the addresses of the proxies the API is reached
+// through, for -restrict-egress to allow.
+func proxyAddrs() []string {
+	var addrs []string
+	for _, api := range strings.Split(*serverAddr, ",") {
+		if proxy, _ := apiProxy(api); proxy != nil {
+			addrs = append(addrs, proxyAddr(proxy))
+		}
+	}
+	return addrs
+}
+
+// dialProxy connects to addr, a host:port, through proxy.
+func dialProxy(ctx context.Context, proxy *url.URL, addr string) (net.Conn, error) {
+	conn, err := dialContext(ctx, "tcp", proxyAddr(proxy))
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %s", proxy.Host, err)
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %s", proxy.Host, err)
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode != http.StatusOK:
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused to connect to %s: %s", proxy.Host, addr, resp.Status)
+	case r.Buffered() > 0:
+		// the API speaks only once the agent has
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s sent data past its response", proxy.Host)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
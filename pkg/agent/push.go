@@ -0,0 +1,283 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	cloudprofiler "google.golang.org/genproto/googleapis/devtools/cloudprofiler/v2"
+
+	pprof "github.com/google/pprof/profile"
+)
+
+// Profiles need not wait for the server to ask for them. With -push the
+// agent records a profile of each enabled type as soon as it starts,
+// uploads them with CreateOfflineProfile and exits, for investigations
+// that cannot wait for the server's cadence. The upload subcommand
+// uploads profiles recorded elsewhere, such as on hosts with no route to
+// the API.
+//
+// Fleets pushing often use up the API's quota quickly. With
+// -push-merge-window, the agent keeps recording profiles of each type,
+// one after another, and uploads a single profile of each type every
+// window, merging those it recorded, until it is stopped.
+const uploadCommand = "upload"
+
+// push records a profile of each of the agent's types for duration, and
+// uploads them. It returns an error if any could not be uploaded.
+func (a *agent) push(duration time.Duration) error {
+	var failed int
+	types := a.profileTypes()
+	for _, t := range types {
+		profile := &cloudprofiler.Profile{
+			ProfileType: t,
+			Deployment:  a.deployment(),
+			Duration:    ptypes.DurationProto(duration),
+		}
+		logAt(levelInfo, profileFields(profile), "pushing %v %s profile", duration, t)
+		if err := a.retrieveProfile(profile); err != nil {
+			if skip, ok := err.(*skipError); ok {
+				logAt(levelInfo, profileFields(profile), "not uploading %s profile: %s", t, skip.reason)
+				cycleSkipped(t, skip)
+			} else {
+				logAt(levelWarn, profileFields(profile), "could not collect %s profile: %s", t, err)
+				cycleAborted(t, errCollect, err)
+			}
+			failed++
+			continue
+		}
+		if !a.uploadOffline(profile) {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d profiles were not uploaded", failed, len(types))
+	}
+	return nil
+}
+
+// pushMerged records profiles of each of the agent's types for duration,
+// one after another, and every window uploads one profile of each type
+// merging those recorded in it, until the agent is stopped. It returns an
+// error if no profile could be recorded in a window, or none of a
+// window's could be uploaded.
+func (a *agent) pushMerged(duration, window time.Duration) error {
+	types := a.profileTypes()
+	for a.ctx.Err() == nil {
+		start := time.Now()
+		sources := make(map[cloudprofiler.ProfileType][]sampledProfile)
+		last := make(map[cloudprofiler.ProfileType]*cloudprofiler.Profile)
+		var idle int
+		for time.Since(start) < window && a.ctx.Err() == nil {
+			var recorded int
+			for _, t := range types {
+				profile := &cloudprofiler.Profile{
+					ProfileType: t,
+					Deployment:  a.deployment(),
+					Duration:    ptypes.DurationProto(duration),
+				}
+				logAt(levelDebug, profileFields(profile), "recording %v %s profile to merge", duration, t)
+				if err := a.retrieveProfile(profile); err != nil {
+					if skip, ok := err.(*skipError); ok {
+						logAt(levelInfo, profileFields(profile), "not merging %s profile: %s", t, skip.reason)
+						cycleSkipped(t, skip)
+					} else {
+						logAt(levelWarn, profileFields(profile), "could not collect %s profile: %s", t, err)
+						cycleAborted(t, errCollect, err)
+					}
+					continue
+				}
+				p, err := pprof.ParseData(profile.ProfileBytes)
+				if err != nil {
+					logWarnf("could not parse %s profile to merge: %s", t, err)
+					continue
+				}
+				sources[t] = append(sources[t], sampledProfile{p, a.frequency(t)})
+				last[t] = profile
+				recorded++
+			}
+			// perf may fail at once, such as when it is missing;
+			// rather than retrying at once for the rest of the
+			// window, wait longer after each round recording nothing.
+			if recorded > 0 {
+				idle = 0
+				continue
+			}
+			idle++
+			wait := a.backoff.Delay(idle)
+			if rest := window - time.Since(start); wait > rest {
+				wait = rest
+			}
+			select {
+			case <-time.After(wait):
+			case <-a.ctx.Done():
+			}
+		}
+		if len(sources) == 0 && a.ctx.Err() == nil {
+			return fmt.Errorf("no profiles were recorded in %v", window)
+		}
+		var uploaded, failed int
+		for _, t := range types {
+			if len(sources[t]) == 0 {
+				continue
+			}
+			profile, err := mergePushed(last[t], sources[t], time.Since(start))
+			if err != nil {
+				logWarnf("could not merge %d %s profiles: %s", len(sources[t]), t, err)
+				failed++
+				continue
+			}
+			if a.uploadOffline(profile) {
+				uploaded++
+			} else {
+				failed++
+			}
+		}
+		if failed > 0 && uploaded == 0 && a.ctx.Err() == nil {
+			return fmt.Errorf("none of %d merged profiles were uploaded", failed)
+		}
+	}
+	return nil
+}
+
+// mergePushed returns a profile like profile, the last of its type
+// recorded in a window of length window, whose payload merges sources.
+func mergePushed(profile *cloudprofiler.Profile, sources []sampledProfile, window time.Duration) (*cloudprofiler.Profile, error) {
+	p, err := mergeSampled(sources)
+	if err != nil {
+		return nil, err
+	}
+	addComment(p, fmt.Sprintf("merged from %d profiles recorded over %v", len(sources), window.Round(time.Second)))
+	merged := &cloudprofiler.Profile{
+		ProfileType: profile.ProfileType,
+		Deployment:  profile.Deployment,
+		Duration:    ptypes.DurationProto(time.Duration(p.DurationNanos)),
+		Labels:      profile.Labels,
+	}
+	setProfileLabel(merged, "merged", strconv.Itoa(len(sources)))
+	return merged, setProfileBytes(merged, p)
+}
+
+// uploadOffline uploads profile with CreateOfflineProfile, spooling it if
+// it cannot be uploaded, and reports whether it was.
+func (a *agent) uploadOffline(profile *cloudprofiler.Profile) bool {
+	_, err := a.pushProfile(profile)
+	return err == nil
+}
+
+// pushProfile uploads profile with CreateOfflineProfile, spooling it if
+// it cannot be uploaded, and returns the profile the API created.
+func (a *agent) pushProfile(profile *cloudprofiler.Profile) (*cloudprofiler.Profile, error) {
+	setPhase("uploading", 0)
+	uploaded, err := a.tryCreateOfflineProfile(profile)
+	if err != nil {
+		logAt(levelWarn, profileFields(profile), "failed to upload %s profile: %s", profile.ProfileType, err)
+		cycleAborted(profile.ProfileType, errUpload, err)
+		a.spoolProfile(profile)
+		return nil, err
+	}
+	fields := profileFields(profile)
+	fields["profile"] = uploaded.Name
+	logAt(levelInfo, fields, "uploaded %s profile %s", uploaded.ProfileType, uploaded.Name)
+	profileUploaded(uploaded.ProfileType, uploaded.Name)
+	cycleDone("uploaded " + uploaded.Name)
+	if err := a.audit.record(uploaded); err != nil {
+		logWarnf("failed to write audit record for %s: %s", uploaded.Name, err)
+	}
+	return uploaded, nil
+}
+
+// runUpload runs the upload subcommand with its arguments args: the
+// pprof files to upload, as profiles of the deployment the agent's flags
+// describe.
+func runUpload(args []string) error {
+	fs := flag.NewFlagSet(uploadCommand, flag.ContinueOnError)
+	typeName := fs.String("type", "cpu", "the profile `type` of the files")
+	duration := fs.Duration("duration", 0, "the `duration` the profiles cover, if the files do not say")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("usage: upload [-type cpu] [-duration 10s] profile.pb.gz ...")
+	}
+	t, ok := profileTypeNames[*typeName]
+	if !ok {
+		return fmt.Errorf("unknown profile type %q", *typeName)
+	}
+
+	var a agent
+	var err error
+	a.ctx = context.Background()
+	for k, v := range conf.labels {
+		if a.labels == nil {
+			a.labels = make(map[string]string)
+		}
+		a.labels[k] = v
+	}
+	if err := a.addDeploymentLabels(); err != nil {
+		return err
+	}
+	if a.service = *service; a.service == "" {
+		if a.service, err = inferService(); err != nil {
+			return fmt.Errorf("could not determine service: %s", err)
+		}
+	}
+	if a.project = *cloudProject; a.project == "" {
+		if a.project, err = inferCloudProject(); err != nil {
+			return fmt.Errorf("could not determine project: %s", err)
+		}
+	}
+	if *auditPath != "" {
+		if a.audit, err = openAuditLog(*auditPath); err != nil {
+			return fmt.Errorf("failed to open audit log: %s", err)
+		}
+	}
+	if err := a.useCredentials(); err != nil {
+		return err
+	}
+	if a.backoff, err = backoffPolicy(); err != nil {
+		return err
+	}
+	if a.endpoints, err = newEndpointSet(*serverAddr); err != nil {
+		return err
+	}
+	if err := a.connect(false); err != nil {
+		return err
+	}
+	defer a.endpoints.conn.Close()
+
+	var failed int
+	for _, path := range fs.Args() {
+		p, err := readPprof(path)
+		if err != nil {
+			logErrorf("could not read %s: %s", path, err)
+			failed++
+			continue
+		}
+		d := time.Duration(p.DurationNanos)
+		if d == 0 {
+			d = *duration
+		}
+		profile := &cloudprofiler.Profile{
+			ProfileType: t,
+			Deployment:  a.deployment(),
+			Duration:    ptypes.DurationProto(d),
+		}
+		if err := setProfileBytes(profile, p); err != nil {
+			return err
+		}
+		log.Printf("uploading %s as a %s profile of %s", path, t, a.service)
+		if !a.uploadOffline(profile) {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d profiles could not be uploaded", failed, fs.NArg())
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	cloudprofiler "google.golang.org/genproto/googleapis/devtools/cloudprofiler/v2"
+)
+
+// Operators often run the agent in a slice with a CPU quota. Recording,
+// and above all converting, can use more than the quota for a while, and
+// the kernel then throttles the agent at unpredictable points, stretching
+// conversions into the next profile. Instead the agent measures the CPU
+// time its cgroup, perf included, used in each cycle, and rests before
+// asking for the next profile for as long as it takes to bring its
+// average back within -quota-share of the quota. A cycle that needs to
+// rest longer than it ran also halves the sampling frequency, and the
+// frequency is not raised again above the one that fit.
+
+// The root of the cgroup filesystem.
+var cgroupRoot = "/sys/fs/cgroup"
+
+// A cpuQuota is the CPU quota of the agent's cgroup and the means to
+// measure what the cgroup uses.
+type cpuQuota struct {
+	// CPUs the cgroup may use
+	cpus float64
+	// the fraction of cpus the agent keeps to
+	share float64
+	// file with the cgroup's cumulative CPU usage, in unit
+	usageFile string
+	unit      time.Duration
+	// usage and time at the start of the cycle
+	used  time.Duration
+	start time.Time
+}
+
+// findCPUQuota returns the CPU quota of the cgroup the agent runs in, or
+// of the closest of its ancestors to set one, or nil if there is none.
+func findCPUQuota(share float64) (*cpuQuota, error) {
+	data, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return nil, err
+	}
+	q := &cpuQuota{share: share}
+	var dir string
+	if path, ok := procCgroup(string(data), "cpu"); ok {
+		// v1: cpu and cpuacct are usually mounted together
+		base := filepath.Join(cgroupRoot, "cpu,cpuacct")
+		if _, err := ioutil.ReadDir(base); err != nil {
+			base = filepath.Join(cgroupRoot, "cpu")
+		}
+		dir = filepath.Join(base, path)
+		q.cpus = quotaV1(dir, base)
+		q.usageFile, q.unit = filepath.Join(dir, "cpuacct.usage"), time.Nanosecond
+	} else if path, ok := procCgroup(string(data), ""); ok {
+		dir = filepath.Join(cgroupRoot, path)
+		q.cpus = quotaV2(dir)
+		q.usageFile, q.unit = filepath.Join(dir, "cpu.stat"), time.Microsecond
+	} else {
+		return nil, errors.New("the agent's cgroup could not be found")
+	}
+	if q.cpus == 0 {
+		return nil, nil
+	}
+	if _, err := q.usage(); err != nil {
+		return nil, fmt.Errorf("could not read the CPU usage of cgroup %s: %s", dir, err)
+	}
+	return q, nil
+}
+
+// procCgroup returns the path of the cgroup of controller in the
+// contents of /proc/<pid>/cgroup, or of the unified hierarchy if
+// controller is empty.
+func procCgroup(data, controller string) (string, bool) {
+	for _, line := range strings.Split(data, "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if controller == "" {
+			if parts[0] == "0" && parts[1] == "" {
+				return parts[2], true
+			}
+			continue
+		}
+		for _, ctrl := range strings.Split(parts[1], ",") {
+			if ctrl == controller {
+				return parts[2], true
+			}
+		}
+	}
+	return "", false
+}
+
+// quotaV2 returns the smallest quota, in CPUs, set by the cpu.max files
+// of dir and its ancestors, or 0 if none sets one.
+func quotaV2(dir string) float64 {
+	var cpus float64
+	for ; strings.HasPrefix(dir, cgroupRoot); dir = filepath.Dir(dir) {
+		// "max 100000" or "<quota> <period>"
+		data, err := ioutil.ReadFile(filepath.Join(dir, "cpu.max"))
+		if err == nil {
+			fields := strings.Fields(string(data))
+			if len(fields) == 2 {
+				cpus = minQuota(cpus, fields[0], fields[1])
+			}
+		}
+		if dir == cgroupRoot {
+			break
+		}
+	}
+	return cpus
+}
+
+// quotaV1 returns the smallest quota, in CPUs, set in dir and its
+// ancestors up to the hierarchy's root, or 0 if none sets one.
+func quotaV1(dir, root string) float64 {
+	var cpus float64
+	for ; strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		quota, err1 := ioutil.ReadFile(filepath.Join(dir, "cpu.cfs_quota_us"))
+		period, err2 := ioutil.ReadFile(filepath.Join(dir, "cpu.cfs_period_us"))
+		if err1 == nil && err2 == nil {
+			cpus = minQuota(cpus, strings.TrimSpace(string(quota)), strings.TrimSpace(string(period)))
+		}
+		if dir == root {
+			break
+		}
+	}
+	return cpus
+}
+
+// minQuota returns the smaller of cpus, if it is set, and the quota
+// of quota per period. Unlimited quotas are "max" or -1.
+func minQuota(cpus float64, quota, period string) float64 {
+	q, err1 := strconv.ParseFloat(quota, 64)
+	p, err2 := strconv.ParseFloat(period, 64)
+	if err1 != nil || err2 != nil || q <= 0 || p <= 0 {
+		return cpus
+	}
+	if c := q / p; cpus == 0 || c < cpus {
+		return c
+	}
+	return cpus
+}
+
+// usage returns the cumulative CPU time used by the cgroup.
+func (q *cpuQuota) usage() (time.Duration, error) {
+	data, err := ioutil.ReadFile(q.usageFile)
+	if err != nil {
+		return 0, err
+	}
+	s := strings.TrimSpace(string(data))
+	if strings.HasSuffix(q.usageFile, "cpu.stat") {
+		s = ""
+		for _, line := range strings.Split(string(data), "\n") {
+			if f := strings.Fields(line); len(f) == 2 && f[0] == "usage_usec" {
+				s = f[1]
+			}
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("malformed %s", q.usageFile)
+	}
+	return time.Duration(n) * q.unit, nil
+}
+
+func (q *cpuQuota) String() string {
+	return fmt.Sprintf("%.2f CPUs", q.cpus)
+}
+
+// startCycle marks the start of a profiling cycle.
+func (q *cpuQuota) startCycle() {
+	if used, err := q.usage(); err == nil {
+		q.used, q.start = used, time.Now()
+	}
+}
+
+// endCycle returns how long the agent needs to rest for the cycle just
+// ended to stay within its share of the quota, and whether it used so
+// much more that sampling should be reduced.
+func (q *cpuQuota) endCycle() (rest time.Duration, over bool) {
+	used, err := q.usage()
+	if err != nil || q.start.IsZero() {
+		return 0, false
+	}
+	elapsed := time.Since(q.start)
+	cost := used - q.used
+	// the wall time over which cost is within the budget
+	fits := time.Duration(math.Ceil(float64(cost) / (q.cpus * q.share)))
+	if fits <= elapsed {
+		return 0, false
+	}
+	rest = fits - elapsed
+	return rest, rest > elapsed
+}
+
+// restWithinQuota rests after a cycle for as long as the CPU quota
+// requires, lowering the sampling frequency if the cycle used much more
+// than the quota allows.
+func (a *agent) restWithinQuota() {
+	if a.quota == nil {
+		return
+	}
+	rest, over := a.quota.endCycle()
+	if over {
+		if change := a.sampler.capFrequency(a.sampler.freq / 2); change != "" {
+			log.Printf("perf sampling adjusted for the CPU quota: %s", change)
+		}
+	}
+	if rest > 0 {
+		log.Printf("resting %v to stay within %.0f%% of the CPU quota of %s", rest.Round(time.Second), a.quota.share*100, a.quota)
+		emitEvent(eventDeferred, deferQuota, cloudprofiler.ProfileType_PROFILE_TYPE_UNSPECIFIED,
+			fmt.Sprintf("resting %v within the CPU quota of %s", rest.Round(time.Second), a.quota))
+		setPhase("resting within CPU quota", rest)
+		time.Sleep(rest)
+	}
+}
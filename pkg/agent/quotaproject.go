@@ -0,0 +1,36 @@
+package agent
+
+import (
+	"context"
+	"os"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// API calls are billed to, and counted against the quota of, the
+// project of the agent's credentials. Where that project may not use the
+// profiler API, as behind VPC Service Controls whose perimeter excludes
+// it, -quota-project, or $GOOGLE_CLOUD_QUOTA_PROJECT, names the project
+// to bill instead, in the x-goog-user-project header of every call. The
+// agent's identity needs serviceusage.services.use on that project.
+
+const quotaProjectHeader = "x-goog-user-project"
+
+// userQuotaProject returns the project API calls are billed to, or ""
+// for the project of the credentials.
+func userQuotaProject() string {
+	if *quotaProject != "" {
+		return *quotaProject
+	}
+	return os.Getenv("GOOGLE_CLOUD_QUOTA_PROJECT")
+}
+
+// quotaProjectInterceptor adds the quota project header naming project
+// to every call.
+func quotaProjectInterceptor(project string) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		ctx = metadata.AppendToOutgoingContext(ctx, quotaProjectHeader, project)
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"net"
+	"os"
+	"sync"
+)
+
+// The agent reports that it is ready to systemd, if it was started by a
+// unit of Type=notify, and in the "ready" field of its status. With
+// -ready-after-upload it waits until a profile has been collected,
+// converted and uploaded, so that rollouts to hosts where that fails are
+// stopped by their health checks.
+var (
+	readyOnce sync.Once
+	ready     = new(boolVar)
+)
+
+func init() {
+	agentStatus.Set("ready", ready)
+}
+
+// markReady reports the agent ready, once.
+func markReady() {
+	readyOnce.Do(func() {
+		ready.set(true)
+		if err := sdNotify("READY=1"); err != nil {
+			logWarnf("failed to notify systemd: %s", err)
+		}
+	})
+}
+
+// sdNotify sends state to the service manager's notification socket. It
+// does nothing if the agent was not started with one.
+func sdNotify(state string) error {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return nil
+	}
+	if name[0] == '@' {
+		// abstract namespace
+		name = "\x00" + name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// boolVar is an expvar.Var holding a bool.
+type boolVar struct {
+	mu sync.RWMutex
+	v  bool
+}
+
+func (b *boolVar) set(v bool) {
+	b.mu.Lock()
+	b.v = v
+	b.mu.Unlock()
+}
+
+func (b *boolVar) String() string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.v {
+		return "true"
+	}
+	return "false"
+}
@@ -0,0 +1,206 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	cloudprofiler "google.golang.org/genproto/googleapis/devtools/cloudprofiler/v2"
+)
+
+// While a profile is being recorded or converted, the agent keeps a note
+// of it in the profile's work directory. If the agent crashes, the note
+// and perf.data are left behind, and the next agent to start finishes
+// the job, uploading the profile with CreateOfflineProfile.
+const pendingFile = "pending.json"
+
+// An agent holds a lock on this file in its temporary directory while it
+// runs, as do the perf commands it starts, which may outlive it. A
+// directory whose lock is free has been left behind. Pids are not
+// compared, as in a container the next agent is often given the same
+// pid as the last.
+const lockFile = "lock"
+
+// the lock on the agent's temporary directory, once it is taken
+var tmpdirLock *os.File
+
+type pendingProfile struct {
+	Pid         int
+	Service     string
+	Project     string
+	ProfileType cloudprofiler.ProfileType
+	Labels      map[string]string
+	Start       time.Time
+}
+
+// markPending notes that profile is being recorded in the work directory
+// dir.
+func (a *agent) markPending(dir string, profile *cloudprofiler.Profile) {
+	data, err := json.Marshal(pendingProfile{
+		Pid:         os.Getpid(),
+		Service:     a.service,
+		Project:     a.project,
+		ProfileType: profile.ProfileType,
+		Labels:      profile.Labels,
+		Start:       time.Now(),
+	})
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dir, pendingFile), data, 0600)
+	}
+	if err != nil {
+		logWarnf("could not note pending profile, it will not be recovered after a crash: %s", err)
+	}
+}
+
+// lockTmpDir takes the lock on dir, the agent's temporary directory, and
+// releases that of the directory it used before, if any.
+func lockTmpDir(dir string) error {
+	file, err := os.OpenFile(filepath.Join(dir, lockFile), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		return err
+	}
+	if tmpdirLock != nil {
+		tmpdirLock.Close()
+	}
+	tmpdirLock = file
+	return nil
+}
+
+// locked reports whether an agent, or a perf command it started, holds
+// the lock on dir, the temporary directory of an agent.
+func locked(dir string) bool {
+	file, err := os.Open(filepath.Join(dir, lockFile))
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return true
+	}
+	if err == nil {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+	}
+	return false
+}
+
+// recoverProfiles uploads the profiles left behind by agents that crashed
+// while recording or converting them, and removes their temporary
+// directories. Recordings older than maxAge are only removed.
+func (a *agent) recoverProfiles(maxAge time.Duration) {
+	dirs, err := filepath.Glob(filepath.Join(os.TempDir(), filepath.Base(os.Args[0])+"*"))
+	if err != nil {
+		return
+	}
+	for _, dir := range dirs {
+		if dir == a.tmpdir || locked(dir) {
+			continue
+		}
+		notes, _ := filepath.Glob(filepath.Join(dir, "*", pendingFile))
+		if len(notes) == 0 {
+			continue
+		}
+		var keep bool
+		for _, note := range notes {
+			keep = !a.recoverWorkDir(filepath.Dir(note), maxAge) || keep
+		}
+		if !keep {
+			os.RemoveAll(dir)
+		}
+	}
+}
+
+// recoverWorkDir uploads the profile left pending in the work directory
+// dir, unless it is too old, and removes dir. It returns false if dir is
+// left for its own agent, or for an agent of another deployment.
+func (a *agent) recoverWorkDir(dir string, maxAge time.Duration) bool {
+	data, err := ioutil.ReadFile(filepath.Join(dir, pendingFile))
+	if err != nil {
+		return true
+	}
+	var pending pendingProfile
+	if err := json.Unmarshal(data, &pending); err != nil {
+		logWarnf("removing %s: malformed %s: %s", dir, pendingFile, err)
+		os.RemoveAll(dir)
+		return true
+	}
+	info, err := os.Stat(filepath.Join(dir, "perf.data"))
+	switch {
+	case err != nil:
+		log.Printf("removing %s: no perf.data to recover", dir)
+	case time.Since(info.ModTime()) > maxAge:
+		log.Printf("removing %s: its profile is older than %v", dir, maxAge)
+	case pending.Service != a.service || pending.Project != a.project:
+		// left for an agent of that deployment
+		return false
+	default:
+		if err := a.recoverProfile(dir, pending, info.ModTime()); err != nil {
+			logWarnf("could not recover profile from %s: %s", dir, err)
+		}
+	}
+	os.RemoveAll(dir)
+	return true
+}
+
+func (a *agent) recoverProfile(dir string, pending pendingProfile, end time.Time) error {
+	log.Printf("recovering %s profile recorded by crashed agent %d", pending.ProfileType, pending.Pid)
+	job := &conversion{
+		dst:      filepath.Join(dir, "perf.pprof"),
+		src:      filepath.Join(dir, "perf.data"),
+		symbols:  filepath.Join(dir, "binaries"),
+		replaced: filepath.Join(a.tmpdir, replacedDir),
+		filter:   a.binaries,
+	}
+	if a.late != nil {
+		job.symbols = ""
+	}
+	if err := a.convert.convert(a.ctx, job); err != nil {
+		return err
+	}
+	p, err := readPprof(job.dst)
+	if err != nil {
+		return fmt.Errorf("could not parse converted profile: %s", err)
+	}
+	addComment(p, "recovered after the agent recording it crashed")
+	p, _ = limitStackDepth(p, a.maxDepth)
+	p = a.binaries.strip(p)
+	p = restrictSamples(p, a.mode)
+	rewriteSourcePaths(p, a.sources)
+	p, _ = stripIdle(p, a.idle)
+
+	profile := &cloudprofiler.Profile{
+		ProfileType: pending.ProfileType,
+		Deployment:  a.deployment(),
+		Duration:    ptypes.DurationProto(end.Sub(pending.Start)),
+	}
+	for k, v := range pending.Labels {
+		setProfileLabel(profile, k, v)
+	}
+	setProfileLabel(profile, "recovered", "true")
+	if job.partial {
+		setProfileLabel(profile, "partial", "true")
+	}
+	if err := setProfileBytes(profile, p); err != nil {
+		return err
+	}
+	uploaded, err := a.tryCreateOfflineProfile(profile)
+	if err != nil {
+		return err
+	}
+	log.Printf("uploaded recovered %s profile %s", uploaded.ProfileType, uploaded.Name)
+	profileUploaded(uploaded.ProfileType, uploaded.Name)
+	if err := a.audit.record(uploaded); err != nil {
+		logWarnf("failed to write audit record for %s: %s", uploaded.Name, err)
+	}
+	return nil
+}
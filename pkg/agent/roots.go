@@ -0,0 +1,76 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// perf records the path a binary was mapped from as the process saw it.
+// Processes in a chroot, and snaps and flatpaks, which run in mount
+// namespaces of their own, see their root, or /usr, somewhere else than
+// the agent does: the libc of a snap on a core22 base is mapped from
+// /usr/lib/x86_64-linux-gnu/libc.so.6, but is found on the host in
+// /snap/core22/current/usr/lib/x86_64-linux-gnu/libc.so.6. When the
+// file at a recorded path does not have the recorded build ID, the same
+// path is looked for under each of these roots.
+
+// A packageRoot is a directory holding the files a process sees under
+// prefix.
+type packageRoot struct {
+	prefix, dir string
+}
+
+// path returns where the file a process saw at path would be under r, or
+// "" if r does not hold it.
+func (r packageRoot) path(path string) string {
+	if r.prefix != "/" && !strings.HasPrefix(path, r.prefix+"/") {
+		return ""
+	}
+	return filepath.Join(r.dir, strings.TrimPrefix(path, r.prefix))
+}
+
+// The roots of snaps and flatpaks, as installed system-wide and by users.
+var packageRootGlobs = []packageRoot{
+	// the base snap a snap runs on is mounted at /; the snap's own
+	// files are at the same path inside and out
+	{"/", "/snap/*/current"},
+	{"/usr", "/var/lib/flatpak/runtime/*/*/*/active/files"},
+	{"/app", "/var/lib/flatpak/app/*/*/*/active/files"},
+	{"/usr", "/home/*/.local/share/flatpak/runtime/*/*/*/active/files"},
+	{"/app", "/home/*/.local/share/flatpak/app/*/*/*/active/files"},
+}
+
+// findPackageRoots returns the -chroot directories, then the roots of the
+// snaps and flatpaks installed on the host.
+func findPackageRoots() []packageRoot {
+	var roots []packageRoot
+	for _, dir := range chrootDirs {
+		roots = append(roots, packageRoot{"/", dir})
+	}
+	for _, g := range packageRootGlobs {
+		dirs, _ := filepath.Glob(g.dir)
+		for _, dir := range dirs {
+			roots = append(roots, packageRoot{g.prefix, dir})
+		}
+	}
+	return roots
+}
+
+// checkChroots returns an error if a -chroot directory does not exist.
+func checkChroots(dirs []string) error {
+	for _, dir := range dirs {
+		if !filepath.IsAbs(dir) {
+			return fmt.Errorf("-chroot %s: not an absolute path", dir)
+		}
+		info, err := os.Stat(dir)
+		if err != nil {
+			return fmt.Errorf("-chroot: %s", err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("-chroot %s: not a directory", dir)
+		}
+	}
+	return nil
+}
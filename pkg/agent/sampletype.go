@@ -0,0 +1,77 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	pprof "github.com/google/pprof/profile"
+)
+
+// Units of time a sample count can be converted to, in nanoseconds.
+var timeUnits = map[string]int64{
+	"nanoseconds":  int64(time.Nanosecond),
+	"microseconds": int64(time.Microsecond),
+	"milliseconds": int64(time.Millisecond),
+	"seconds":      int64(time.Second),
+}
+
+// A sampleType overrides the type and unit of the first sample value in a
+// converted profile. The converter reports sample counts, which Cloud
+// Profiler renders less usefully than CPU time.
+type sampleType struct {
+	name, unit string
+}
+
+// parseSampleType parses a sample type given as type/unit, for instance
+// cpu/nanoseconds or samples/count.
+func parseSampleType(s string) (sampleType, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return sampleType{}, fmt.Errorf("sample type %q is not of the form type/unit", s)
+	}
+	return sampleType{name: parts[0], unit: parts[1]}, nil
+}
+
+func (st sampleType) timed() bool {
+	_, ok := timeUnits[st.unit]
+	return ok
+}
+
+// apply relabels the first sample value of p. When a count of samples
+// taken at freq Hz is given a unit of time, each sample is weighted by
+// the sampling period. Values in a unit of time are converted to st's.
+func (st sampleType) apply(p *pprof.Profile, freq int) error {
+	if st.name == "" || len(p.SampleType) == 0 {
+		return nil
+	}
+	from := p.SampleType[0]
+	if st.timed() && from.Unit != st.unit {
+		if from.Unit != "count" {
+			if unit, ok := timeUnits[from.Unit]; ok {
+				// merged from sources of different frequencies
+				freq = int(int64(time.Second) / unit)
+			} else {
+				return fmt.Errorf("cannot convert %s/%s samples to %s", from.Type, from.Unit, st.unit)
+			}
+		}
+		if freq <= 0 {
+			return fmt.Errorf("converting samples to %s needs a sampling frequency", st.unit)
+		}
+		period := float64(time.Second) / float64(freq) / float64(timeUnits[st.unit])
+		for _, s := range p.Sample {
+			if len(s.Value) > 0 {
+				s.Value[0] = int64(float64(s.Value[0])*period + 0.5)
+			}
+		}
+		if from.Unit == "count" {
+			p.Period = int64(period + 0.5)
+		} else {
+			p.Period = int64(float64(p.Period)*period + 0.5)
+		}
+		p.PeriodType = &pprof.ValueType{Type: st.name, Unit: st.unit}
+	}
+	p.SampleType[0] = &pprof.ValueType{Type: st.name, Unit: st.unit}
+	p.DefaultSampleType = st.name
+	return nil
+}
@@ -0,0 +1,181 @@
+package agent
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+const (
+	perfDefaultFrequency = 4000
+	minFrequency         = 9
+
+	// perf's default ring buffer is 512KiB per CPU. Buffer sizes must
+	// be a power of two number of pages.
+	defaultMmapPages = 128
+	maxMmapPages     = 4096
+
+	// clean recordings needed before a reduced frequency is raised
+	// again
+	recoveryCycles = 5
+)
+
+var (
+	capturedRegexp   = regexp.MustCompile(`Captured and wrote .*\(~?(\d+) samples\)`)
+	lostChunksRegexp = regexp.MustCompile(`Processed (\d+) events and lost (\d+) chunks`)
+	lostSampleRegexp = regexp.MustCompile(`Processed (\d+) samples and lost ([0-9.]+)\s*% samples`)
+)
+
+// perfStats summarizes what perf record reported about a recording on
+// its standard error.
+type perfStats struct {
+	samples    uint64
+	events     uint64
+	lostChunks uint64
+	// percentage of samples lost, if reported
+	lostPercent float64
+}
+
+func parsePerfStats(stderr string) perfStats {
+	var st perfStats
+	if m := capturedRegexp.FindStringSubmatch(stderr); m != nil {
+		st.samples, _ = strconv.ParseUint(m[1], 10, 64)
+	}
+	if m := lostChunksRegexp.FindStringSubmatch(stderr); m != nil {
+		st.events, _ = strconv.ParseUint(m[1], 10, 64)
+		st.lostChunks, _ = strconv.ParseUint(m[2], 10, 64)
+	}
+	if m := lostSampleRegexp.FindStringSubmatch(stderr); m != nil {
+		st.lostPercent, _ = strconv.ParseFloat(m[2], 64)
+	}
+	return st
+}
+
+func (st perfStats) String() string {
+	return fmt.Sprintf("%d samples, %d lost chunks, %.2f%% lost samples",
+		st.samples, st.lostChunks, st.lostPercent)
+}
+
+// A sampler tracks the sampling frequency and ring buffer size used for
+// each recording. When perf reports lost samples the buffer is grown,
+// and once it is as large as we are willing to make it, the frequency is
+// lowered. After a run of clean recordings the frequency is restored.
+type sampler struct {
+	// The frequency in the configured perf command, or 0 if the
+	// command sets a sample period instead.
+	frequency int
+	// Current frequency and buffer size
+	freq, pages int
+	// Percentage of lost samples that triggers an adjustment
+	threshold float64
+	clean     int
+	// The highest frequency that kept within the CPU quota, or 0
+	ceiling int
+}
+
+func newSampler(args []string, threshold float64) *sampler {
+	freq := perfFrequency(args)
+	return &sampler{
+		frequency: freq,
+		freq:      freq,
+		pages:     perfMmapPages(args),
+		threshold: threshold,
+	}
+}
+
+// adjust updates the sampling parameters after a recording. It returns a
+// description of the change, or the empty string if nothing changed.
+func (s *sampler) adjust(st perfStats) string {
+	if st.lostChunks == 0 && st.lostPercent <= s.threshold {
+		s.clean++
+		max := s.frequency
+		if s.ceiling > 0 && s.ceiling < max {
+			max = s.ceiling
+		}
+		if s.clean >= recoveryCycles && s.freq < max {
+			s.clean = 0
+			old := s.freq
+			s.freq *= 2
+			if s.freq > max {
+				s.freq = max
+			}
+			return fmt.Sprintf("raised frequency %d->%d Hz after %d clean recordings", old, s.freq, recoveryCycles)
+		}
+		return ""
+	}
+	s.clean = 0
+	if s.pages < maxMmapPages {
+		old := s.pages
+		s.pages *= 2
+		return fmt.Sprintf("increased buffer %d->%d pages after %s", old, s.pages, st)
+	}
+	if s.freq > minFrequency {
+		old := s.freq
+		s.freq /= 2
+		if s.freq < minFrequency {
+			s.freq = minFrequency
+		}
+		return fmt.Sprintf("lowered frequency %d->%d Hz after %s", old, s.freq, st)
+	}
+	logWarnf("perf lost samples (%s) but sampling cannot be reduced further", st)
+	return ""
+}
+
+// capFrequency lowers the frequency to freq, and keeps it from being
+// raised above it again. It returns a description of the change, or the
+// empty string if nothing changed.
+func (s *sampler) capFrequency(freq int) string {
+	if freq < minFrequency {
+		freq = minFrequency
+	}
+	if s.freq <= freq {
+		return ""
+	}
+	old := s.freq
+	s.freq, s.ceiling = freq, freq
+	return fmt.Sprintf("lowered frequency %d->%d Hz", old, freq)
+}
+
+// args returns the perf record arguments with the sampler's frequency
+// and buffer size substituted.
+func (s *sampler) args(args []string) []string {
+	if s.freq > 0 && s.freq != s.frequency {
+		args = setPerfOption(args, "-F", "--freq", strconv.Itoa(s.freq))
+	}
+	if s.pages != perfMmapPages(args) {
+		args = setPerfOption(args, "-m", "--mmap-pages", strconv.Itoa(s.pages))
+	}
+	return args
+}
+
+// perfFrequency returns the sampling frequency used by perf record
+// arguments args, or 0 if they use a fixed period or the maximum
+// frequency, which we leave alone.
+func perfFrequency(args []string) int {
+	if _, ok := perfOption(args, "-c", "--count"); ok {
+		return 0
+	}
+	v, ok := perfOption(args, "-F", "--freq")
+	if !ok {
+		return perfDefaultFrequency
+	}
+	freq, err := strconv.Atoi(v)
+	if err != nil {
+		// "max"
+		return 0
+	}
+	return freq
+}
+
+func perfMmapPages(args []string) int {
+	v, ok := perfOption(args, "-m", "--mmap-pages")
+	if !ok {
+		return defaultMmapPages
+	}
+	pages, err := strconv.Atoi(v)
+	if err != nil {
+		// sizes such as 1M
+		return defaultMmapPages
+	}
+	return pages
+}
@@ -0,0 +1,75 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// On a busy host, symbolizing a recording can take longer than the API
+// waits between profile requests, so that the agent answers each request
+// later than the last and never catches up. The agent estimates when the
+// next profile will be requested from the interval between the last two
+// requests, and a conversion that has yet to symbolize its recording by
+// then does what -late-conversion says: with unsymbolized, the default,
+// it converts the recording without symbols, and the profile is labeled
+// symbols=skipped; with skip, the profile is not uploaded; with wait, it
+// is symbolized however long that takes. Conversions are checked between
+// stages, so one already symbolizing runs to completion.
+
+// What a conversion does when it would delay the next profile.
+const (
+	lateUnsymbolized = "unsymbolized"
+	lateSkip         = "skip"
+	lateWait         = "wait"
+)
+
+// The value of the symbols label of profiles converted without symbols
+// to keep to the schedule.
+const symbolsSkipped = "skipped"
+
+// errBehindSchedule is returned by conversions given up on under
+// -late-conversion=skip.
+var errBehindSchedule = errors.New("conversion would delay the next profile")
+
+// parseLateConversion checks the -late-conversion policy.
+func parseLateConversion(s string) (string, error) {
+	switch s {
+	case lateUnsymbolized, lateSkip, lateWait:
+		return s, nil
+	}
+	return "", fmt.Errorf("-late-conversion %s: want %s, %s or %s", s, lateUnsymbolized, lateSkip, lateWait)
+}
+
+// conversionDeadline returns when the conversion of the current profile
+// should have symbolized it by, or the zero time if it may take as long
+// as it needs.
+func (a *agent) conversionDeadline() time.Time {
+	if a.lateConversion == lateWait {
+		return time.Time{}
+	}
+	return a.clock.nextRequest()
+}
+
+// hurry decides whether job, still to be symbolized, must do without
+// symbols to keep to the schedule. It returns errBehindSchedule if the
+// job should be given up on instead.
+func (job *conversion) hurry() error {
+	if job.symbols == "" || job.deadline.IsZero() || time.Now().Before(job.deadline) {
+		return nil
+	}
+	if job.late == lateSkip {
+		return errBehindSchedule
+	}
+	job.symbols, job.hurried = "", true
+	return nil
+}
+
+// behindSchedule returns the *skipError a conversion given up on is
+// reported as.
+func behindSchedule(src string) *skipError {
+	return &skipError{
+		kind:   "behind-schedule",
+		reason: fmt.Sprintf("symbolizing %s would delay the next profile", src),
+	}
+}
@@ -0,0 +1,117 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"time"
+
+	cloudprofiler "google.golang.org/genproto/googleapis/devtools/cloudprofiler/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The check subcommand configures the agent as its other flags and
+// arguments would, then checks everything a host needs to profile
+// without profiling: that perf is installed, that the kernel's sysctls
+// allow the configured recording, that the credentials yield a token,
+// that the project is known, and that the API accepts a CreateProfile
+// call for the deployment. The call is given a short deadline, which
+// the API reaching without asking for a profile is the expected outcome;
+// a profile it does ask for is not collected. Every check is run and
+// reported, and the subcommand fails if any did.
+
+const checkCommand = "check"
+
+// How long the check's CreateProfile call waits for the API.
+const checkPollTimeout = 10 * time.Second
+
+// checkModeArgs returns the perf arguments args gives after the check
+// subcommand, and whether args runs it.
+func checkModeArgs(args []string) ([]string, bool) {
+	if len(args) == 0 || args[0] != checkCommand {
+		return args, false
+	}
+	return args[1:], true
+}
+
+// selfCheck runs the checks of the check subcommand, printing the
+// outcome of each.
+func (a *agent) selfCheck() error {
+	var failed int
+	report := func(name, detail string, err error) bool {
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL  %s: %s\n", name, err)
+			return false
+		}
+		fmt.Printf("ok    %s: %s\n", name, detail)
+		return true
+	}
+
+	if !a.ebpf {
+		path, err := exec.LookPath("perf")
+		if err == nil {
+			var version []byte
+			if version, err = exec.Command(path, "version").Output(); err == nil {
+				path += ", " + string(bytes.TrimSpace(version))
+			}
+		}
+		report("perf", path, err)
+	}
+	for _, name := range []string{"kernel.perf_event_paranoid", "kernel.kptr_restrict"} {
+		detail := "unknown"
+		if v, ok := readSysctl(name); ok {
+			detail = strconv.Itoa(v)
+		}
+		if privileged() {
+			detail += ", privileged"
+		}
+		fmt.Printf("      %s: %s\n", name, detail)
+	}
+	report("host", "the configured recording is allowed", a.checkDependencies())
+
+	err := a.useCredentials()
+	if err == nil && a.creds != nil {
+		_, err = a.creds.GetRequestMetadata(a.ctx)
+	}
+	credsOK := report("credentials", "a token was obtained", err)
+
+	a.project = *cloudProject
+	if a.project == "" {
+		a.project, err = inferCloudProject()
+	}
+	projectOK := report("project", a.project, err)
+
+	a.endpoints, err = newEndpointSet(*serverAddr)
+	if err == nil {
+		err = a.connect(false)
+	}
+	if !report("connection", *serverAddr, err) || !credsOK || !projectOK {
+		return fmt.Errorf("%d checks failed", failed)
+	}
+	defer a.endpoints.conn.Close()
+
+	ctx, cancel := context.WithTimeout(a.ctx, checkPollTimeout)
+	defer cancel()
+	profile, err := a.CreateProfile(ctx, &cloudprofiler.CreateProfileRequest{
+		Parent:      "projects/" + a.project,
+		Deployment:  a.deployment(),
+		ProfileType: a.profileTypes(),
+	})
+	switch {
+	case err == nil:
+		report("CreateProfile", fmt.Sprintf("accepted, and asked for a %s profile, which was not collected", profile.ProfileType), nil)
+	case status.Code(err) == codes.DeadlineExceeded && ctx.Err() != nil:
+		report("CreateProfile", fmt.Sprintf("accepted for service %s, with no profile asked for within %v", a.service, checkPollTimeout), nil)
+	default:
+		report("CreateProfile", "", fmt.Errorf("%s (%s)", err, classifyAPIError(err)))
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d checks failed", failed)
+	}
+	fmt.Println("all checks passed")
+	return nil
+}
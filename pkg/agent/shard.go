@@ -0,0 +1,79 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// When several agents can profile the same workload, such as a host agent
+// and the sidecars of the containers on the host, each deployment should
+// be profiled by only one of them. Every agent is given the same list of
+// agent IDs, and the owner of a deployment is chosen from it by rendezvous
+// hashing: each agent computes the same owner without talking to the
+// others, and removing an agent from the list only moves the deployments
+// it owned.
+
+// shardOwner returns the member of agents that owns the deployment key.
+func shardOwner(key string, agents []string) string {
+	var owner string
+	var best uint64
+	for _, id := range agents {
+		sum := sha256.Sum256([]byte(key + "\x00" + id))
+		if w := binary.BigEndian.Uint64(sum[:8]); owner == "" || w > best {
+			owner, best = id, w
+		}
+	}
+	return owner
+}
+
+// deploymentKey identifies the agent's deployment for sharding: its target
+// and labels. The project is left out, as agents may be configured with it
+// or infer it later.
+func (a *agent) deploymentKey() string {
+	keys := make([]string, 0, len(a.labels))
+	for k := range a.labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := []string{a.service}
+	for _, k := range keys {
+		parts = append(parts, k+"="+a.labels[k])
+	}
+	return strings.Join(parts, ",")
+}
+
+// checkShard returns an error unless id is a member of agents.
+func checkShard(id string, agents []string) error {
+	for _, a := range agents {
+		if a == id {
+			return nil
+		}
+	}
+	return fmt.Errorf("agent ID %q is not one of the shard agents %s", id, strings.Join(agents, ","))
+}
+
+// standBy is what an agent that does not own its deployment does instead
+// of profiling. In run mode the command is still run, and its exit status
+// returned. Otherwise it waits to be stopped, so that the agent is not
+// restarted over and over by its supervisor.
+func (a *agent) standBy(owner string) error {
+	log.Printf("deployment %s is profiled by agent %s, not profiling", a.deploymentKey(), owner)
+	if a.target != nil {
+		if err := a.target.start(false); err != nil {
+			return err
+		}
+		<-a.target.done
+		return &childExit{code: a.target.exitCode()}
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	log.Printf("received %s, exiting", <-sig)
+	return nil
+}
@@ -0,0 +1,114 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	pprof "github.com/google/pprof/profile"
+)
+
+// Samples in time-sliced profiles carry this label, whose value is the
+// interval of the recording the sample falls in, such as "10s-20s".
+const timeSliceLabel = "time-slice"
+
+// sliceOptions returns the perf record options that rotate the output
+// file every slice, a whole number of seconds.
+func sliceOptions(slice time.Duration) []string {
+	return []string{fmt.Sprintf("--switch-output=%ds", int(slice/time.Second))}
+}
+
+// perfSegments returns the files written by perf record --switch-output
+// when recording to base, oldest first. perf names each segment after
+// the time it was written, so lexical order is chronological.
+func perfSegments(base string) ([]string, error) {
+	matches, err := filepath.Glob(base + ".[0-9]*")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+func removeSegments(base string) {
+	segments, _ := perfSegments(base)
+	for _, seg := range segments {
+		os.Remove(seg)
+		os.Remove(seg + ".pprof")
+	}
+}
+
+// convertSlices converts each segment of a time-sliced recording,
+// labels its samples with the segment's interval, and merges the
+// results into a single profile, accounting for the conversions in cycle.
+// The segments were sampled at freq Hz. The returned bool is true if any
+// segment was damaged or could not be converted.
+func (a *agent) convertSlices(perfData string, slice time.Duration, freq int, cycle *cycleStats) (*pprof.Profile, bool, error) {
+	segments, err := perfSegments(perfData)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(segments) == 0 {
+		return nil, false, fmt.Errorf("perf did not write any %s segments", perfData)
+	}
+	defer removeSegments(perfData)
+
+	type result struct {
+		i       int
+		p       *pprof.Profile
+		partial bool
+		err     error
+	}
+	results := make(chan result, len(segments))
+	for i, seg := range segments {
+		go func(i int, seg string) {
+			p, partial, err := a.convertFile(seg+".pprof", seg, cycle)
+			results <- result{i, p, partial, err}
+		}(i, seg)
+	}
+
+	var partial bool
+	profiles := make([]*pprof.Profile, len(segments))
+	for range segments {
+		r := <-results
+		if r.err != nil {
+			// A signal may cut the last segment short.
+			logWarnf("skipping time slice %d: %s", r.i, r.err)
+			partial = true
+			continue
+		}
+		partial = partial || r.partial
+		label := sliceName(r.i, slice)
+		for _, s := range r.p.Sample {
+			if s.Label == nil {
+				s.Label = make(map[string][]string)
+			}
+			s.Label[timeSliceLabel] = []string{label}
+		}
+		profiles[r.i] = r.p
+	}
+
+	var merge []sampledProfile
+	for _, p := range profiles {
+		if p != nil {
+			merge = append(merge, sampledProfile{p, freq})
+		}
+	}
+	if len(merge) == 0 {
+		return nil, false, fmt.Errorf("no time slices of %s could be converted", perfData)
+	}
+	p, err := mergeSampled(merge)
+	if err != nil {
+		return nil, false, fmt.Errorf("could not merge time slices: %s", err)
+	}
+	addComment(p, fmt.Sprintf("%d time slices of %v, labeled %q",
+		len(merge), slice, timeSliceLabel))
+	return p, partial, nil
+}
+
+func sliceName(i int, slice time.Duration) string {
+	start := time.Duration(i) * slice
+	return fmt.Sprintf("%v-%v", start, start+slice)
+}
@@ -0,0 +1,48 @@
+package agent
+
+import (
+	"path"
+	"runtime"
+	"time"
+)
+
+// The default perf command is cheap on most hosts, but sampling every CPU
+// at 99 Hz and symbolizing kernel stacks is a noticeable share of a tiny
+// VM. On those the agent defaults to sampling user code at a lower
+// frequency instead.
+const smallVMFrequency = "49"
+
+// Machine types with a fraction of a CPU, or bursting on shared cores.
+var sharedCoreMachineTypes = map[string]bool{
+	"e2-micro":  true,
+	"e2-small":  true,
+	"e2-medium": true,
+	"f1-micro":  true,
+	"g1-small":  true,
+}
+
+// How long to wait for the metadata server, which does not exist off GCE.
+const metadataTimeout = 500 * time.Millisecond
+
+// gceMachineType returns the machine type of the GCE instance the agent
+// runs on, or "" if it is not on GCE.
+func gceMachineType() string {
+	t, err := gceMetadata("instance/machine-type")
+	if err != nil {
+		return ""
+	}
+	// projects/<number>/machineTypes/<type>
+	return path.Base(t)
+}
+
+// smallInstance describes why this host is too small for the default perf
+// command, or returns "" if it is not.
+func smallInstance() string {
+	if runtime.NumCPU() <= 1 {
+		return "1 vCPU"
+	}
+	if t := gceMachineType(); sharedCoreMachineTypes[t] {
+		return "shared-core " + t
+	}
+	return ""
+}
@@ -0,0 +1,63 @@
+package agent
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	pprof "github.com/google/pprof/profile"
+)
+
+// Binaries record the paths their sources had on the machine that built
+// them, such as /home/builder/src/github.com/org/repo/server.go. Rules
+// given with -source-path rewrite those to paths relative to a
+// repository, so that the profiler's source view and pprof -source_path
+// find the files without manual fixups.
+
+// A sourceRule replaces the prefix from of source file names with to.
+type sourceRule struct {
+	from, to string
+}
+
+// parseSourceRules parses rules of the form from=to. An empty to, as in
+// /build/src/=, trims the prefix.
+func parseSourceRules(rules []string) ([]sourceRule, error) {
+	var parsed []sourceRule
+	for _, r := range rules {
+		i := strings.Index(r, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("source path rule %q must be of the form prefix=replacement", r)
+		}
+		parsed = append(parsed, sourceRule{from: r[:i], to: r[i+1:]})
+	}
+	// the longest prefix wins
+	sort.SliceStable(parsed, func(i, j int) bool { return len(parsed[i].from) > len(parsed[j].from) })
+	return parsed, nil
+}
+
+// rewriteSourcePaths applies rules to the file names of the functions of
+// p, and records the rules that matched in a comment.
+func rewriteSourcePaths(p *pprof.Profile, rules []sourceRule) {
+	if len(rules) == 0 {
+		return
+	}
+	used := make([]bool, len(rules))
+	for _, fn := range p.Function {
+		for i, r := range rules {
+			if strings.HasPrefix(fn.Filename, r.from) {
+				fn.Filename = r.to + strings.TrimPrefix(fn.Filename, r.from)
+				used[i] = true
+				break
+			}
+		}
+	}
+	var applied []string
+	for i, r := range rules {
+		if used[i] {
+			applied = append(applied, fmt.Sprintf("%s => %s", r.from, r.to))
+		}
+	}
+	if len(applied) > 0 {
+		addComment(p, "source paths rewritten: "+strings.Join(applied, ", "))
+	}
+}
@@ -0,0 +1,46 @@
+package agent
+
+import (
+	"hash/fnv"
+	"log"
+	"os"
+	"time"
+)
+
+// Agents restarted together by configuration management would otherwise
+// all ask for their first profile at once, and, as the server answers
+// them at the same cadence, keep calling the API and collecting in step.
+// With -start-splay each waits a fraction of the splay first. The
+// fraction is derived from the host, so an agent keeps its place in the
+// fleet across restarts.
+
+// splayDelay returns how long the agent identified by id waits within
+// splay.
+func splayDelay(id string, splay time.Duration) time.Duration {
+	if splay <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	return time.Duration(h.Sum64() % uint64(splay))
+}
+
+// startDelay returns the delay of this agent within splay, by its
+// hostname and -agent-id.
+func startDelay(splay time.Duration) (time.Duration, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return 0, err
+	}
+	return splayDelay(host+"\x00"+*agentID, splay), nil
+}
+
+// waitSplay waits out the agent's delay before its first profile.
+func waitSplay(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	log.Printf("waiting %v before the first profile request (-start-splay)", d.Round(time.Second))
+	setPhase("waiting out start splay", d)
+	time.Sleep(d)
+}
@@ -0,0 +1,250 @@
+package agent
+
+import (
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	cloudprofiler "google.golang.org/genproto/googleapis/devtools/cloudprofiler/v2"
+
+	"github.com/droyo/cloud-profiler-perf/pkg/uploader"
+)
+
+// Profiles that could not be uploaded are kept in the spool directory
+// given with -spool, and uploaded again with CreateOfflineProfile once the
+// API is reachable. Entries expire after -spool-max-age, and the oldest
+// are evicted once the spool outgrows -spool-max-bytes, so a long outage
+// does not end with days of stale profiles being replayed.
+
+// How often spooled profiles are retried.
+const spoolRetryInterval = time.Minute
+
+const spoolSuffix = ".pb"
+
+var spoolDropped = new(expvar.Int)
+
+func init() {
+	agentStatus.Set("spool-dropped", spoolDropped)
+}
+
+type spool struct {
+	dir string
+	// upload the newest entries first, rather than the oldest
+	newestFirst bool
+	maxAge      time.Duration
+	maxBytes    int64
+	// encrypts entries, if set
+	cipher *spoolCipher
+
+	mu sync.Mutex
+}
+
+func parseSpoolOrder(s string) (newestFirst bool, err error) {
+	switch s {
+	case "newest":
+		return true, nil
+	case "oldest":
+		return false, nil
+	}
+	return false, fmt.Errorf("unknown spool order %q, must be newest or oldest", s)
+}
+
+func newSpool(dir string, newestFirst bool, maxAge time.Duration, maxBytes int64) (*spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &spool{
+		dir:         dir,
+		newestFirst: newestFirst,
+		maxAge:      maxAge,
+		maxBytes:    maxBytes,
+	}
+	agentStatus.Set("spooled", expvar.Func(func() interface{} { return len(s.entries()) }))
+	return s, nil
+}
+
+type spoolEntry struct {
+	path string
+	size int64
+	time time.Time
+}
+
+// entries returns the entries of the spool, oldest first.
+func (s *spool) entries() []spoolEntry {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil
+	}
+	var entries []spoolEntry
+	for _, info := range infos {
+		name := strings.TrimSuffix(info.Name(), encryptedSuffix)
+		if info.IsDir() || !strings.HasSuffix(name, spoolSuffix) {
+			continue
+		}
+		entries = append(entries, spoolEntry{
+			path: filepath.Join(s.dir, info.Name()),
+			size: info.Size(),
+			time: info.ModTime(),
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].path < entries[j].path })
+	return entries
+}
+
+// add spools profile for a later upload.
+func (s *spool) add(profile *cloudprofiler.Profile) error {
+	data, err := proto.Marshal(profile)
+	if err != nil {
+		return err
+	}
+	suffix := spoolSuffix
+	if s.cipher != nil {
+		if data, err = s.cipher.seal(data); err != nil {
+			return err
+		}
+		suffix += encryptedSuffix
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tmp, err := ioutil.TempFile(s.dir, ".spool")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// named by time, so that they sort in the order they were added
+	name := fmt.Sprintf("%020d%s", time.Now().UnixNano(), suffix)
+	if err := os.Rename(tmp.Name(), filepath.Join(s.dir, name)); err != nil {
+		return err
+	}
+	s.evict()
+	return nil
+}
+
+// evict removes expired entries, then the oldest entries until the spool
+// fits in maxBytes. s.mu must be held.
+func (s *spool) evict() {
+	var total int64
+	var kept []spoolEntry
+	for _, e := range s.entries() {
+		if s.maxAge > 0 && time.Since(e.time) > s.maxAge {
+			log.Printf("dropping spooled profile %s: older than %v", filepath.Base(e.path), s.maxAge)
+			os.Remove(e.path)
+			spoolDropped.Add(1)
+			continue
+		}
+		kept = append(kept, e)
+		total += e.size
+	}
+	for len(kept) > 0 && s.maxBytes > 0 && total > s.maxBytes {
+		e := kept[0]
+		log.Printf("dropping spooled profile %s: spool exceeds %d bytes", filepath.Base(e.path), s.maxBytes)
+		os.Remove(e.path)
+		spoolDropped.Add(1)
+		total -= e.size
+		kept = kept[1:]
+	}
+}
+
+// drainSpool uploads the profiles in a's spool with CreateOfflineProfile,
+// in the spool's order, every spoolRetryInterval. A pass stops at the
+// first failure that would fail the rest as well, as when the API is
+// still unreachable; profiles the API rejects are dropped.
+func (a *agent) drainSpool() {
+	s := a.spool
+	for {
+		time.Sleep(spoolRetryInterval)
+		s.mu.Lock()
+		s.evict()
+		entries := s.entries()
+		s.mu.Unlock()
+		if s.newestFirst {
+			for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+				entries[i], entries[j] = entries[j], entries[i]
+			}
+		}
+		for _, e := range entries {
+			if err := a.uploadSpooled(e.path); err != nil {
+				logWarnf("failed to upload spooled profile %s: %s", filepath.Base(e.path), err)
+				break
+			}
+		}
+	}
+}
+
+func (a *agent) uploadSpooled(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		// evicted meanwhile
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if strings.HasSuffix(path, encryptedSuffix) {
+		if a.spool.cipher == nil {
+			// kept until it expires, in case the key is given again
+			logWarnf("not uploading spooled profile %s: it is encrypted, and no spool key was given", filepath.Base(path))
+			return nil
+		}
+		if data, err = a.spool.cipher.open(data); err != nil {
+			logWarnf("not uploading spooled profile %s: %s", filepath.Base(path), err)
+			return nil
+		}
+	}
+	profile := new(cloudprofiler.Profile)
+	if err := proto.Unmarshal(data, profile); err != nil {
+		logWarnf("dropping malformed spooled profile %s: %s", filepath.Base(path), err)
+		os.Remove(path)
+		return nil
+	}
+	// the name of the online profile the server gave up on
+	profile.Name = ""
+	uploaded, err := a.tryCreateOfflineProfile(profile)
+	if err != nil && rejected(err) && a.ctx.Err() == nil {
+		logWarnf("dropping spooled profile %s, which was rejected: %s", filepath.Base(path), err)
+		os.Remove(path)
+		spoolDropped.Add(1)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	os.Remove(path)
+	fields := profileFields(profile)
+	fields["profile"] = uploaded.Name
+	logAt(levelInfo, fields, "uploaded spooled %s profile %s", uploaded.ProfileType, uploaded.Name)
+	profileUploaded(uploaded.ProfileType, uploaded.Name)
+	if err := a.audit.record(uploaded); err != nil {
+		logWarnf("failed to write audit record for %s: %s", uploaded.Name, err)
+	}
+	return nil
+}
+
+// rejected reports whether err, the failure to upload a spooled profile,
+// is particular to that profile, which would fail the same way if
+// retried, rather than a failure to reach the API or to authenticate
+// with it.
+func rejected(err error) bool {
+	if uploader.Temporary(err) {
+		return false
+	}
+	switch classifyAPIError(err) {
+	case apiPermission, apiTransient:
+		return false
+	}
+	return true
+}
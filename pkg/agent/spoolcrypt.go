@@ -0,0 +1,225 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/oauth2"
+)
+
+// Profiles can reveal the paths and symbols of the software on a host,
+// and spooled ones may sit on disk through a long outage. With
+// -spool-key or -spool-kms-key, they are encrypted with AES-256-GCM.
+// A local key is used directly. A Cloud KMS key wraps a data key
+// generated when the agent starts, which is stored, wrapped, with each
+// entry, so that entries can be decrypted by later runs. The data key is
+// wrapped when the first entry is spooled, rather than at startup, so
+// that an agent started while KMS cannot be reached still runs.
+
+// Encrypted spool entries have this suffix and start with this magic.
+const (
+	encryptedSuffix = ".enc"
+	spoolMagic      = "SPE1"
+)
+
+const (
+	kmsScope      = "https://www.googleapis.com/auth/cloudkms"
+	kmsAPI        = "https://cloudkms.googleapis.com/v1/"
+	kmsEndpoint   = "cloudkms.googleapis.com:443"
+	dataKeyLength = 32
+)
+
+// A spoolCipher encrypts and decrypts spool entries.
+type spoolCipher struct {
+	key []byte
+	kms *kmsKey
+
+	mu sync.Mutex
+	// key, wrapped by KMS; empty for a local key, or until the key
+	// is first used
+	wrapped []byte
+	// data keys of earlier runs, by their wrapped form
+	unwrapped map[string][]byte
+}
+
+// localSpoolCipher reads a 32-byte key, raw or base64-encoded, from path.
+func localSpoolCipher(path string) (*spoolCipher, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key := data
+	if len(key) != dataKeyLength {
+		if key, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(data))); err != nil || len(key) != dataKeyLength {
+			return nil, fmt.Errorf("%s must hold a %d-byte key, raw or base64-encoded", path, dataKeyLength)
+		}
+	}
+	return &spoolCipher{key: key}, nil
+}
+
+// kmsSpoolCipher generates a data key, to be wrapped with the Cloud KMS
+// key name, projects/p/locations/l/keyRings/r/cryptoKeys/k.
+func kmsSpoolCipher(ctx context.Context, name string, ts oauth2.TokenSource) (*spoolCipher, error) {
+	key := make([]byte, dataKeyLength)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	return &spoolCipher{
+		key:       key,
+		kms:       &kmsKey{name: name, client: oauth2.NewClient(ctx, ts)},
+		unwrapped: make(map[string][]byte),
+	}, nil
+}
+
+// wrappedKey returns the data key wrapped by KMS, wrapping it if it has
+// not been yet, or nil for a local key.
+func (c *spoolCipher) wrappedKey() ([]byte, error) {
+	if c.kms == nil {
+		return nil, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.wrapped != nil {
+		return c.wrapped, nil
+	}
+	wrapped, err := c.kms.call("encrypt", "plaintext", c.key, "ciphertext")
+	if err != nil {
+		return nil, fmt.Errorf("could not wrap spool key with %s: %s", c.kms.name, err)
+	}
+	c.wrapped = wrapped
+	c.unwrapped[string(wrapped)] = c.key
+	return wrapped, nil
+}
+
+// seal encrypts data as
+//
+//	magic | wrapped key length (2 bytes) | wrapped key | nonce | ciphertext
+func (c *spoolCipher) seal(data []byte) ([]byte, error) {
+	wrapped, err := c.wrappedKey()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(c.key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteString(spoolMagic)
+	binary.Write(&buf, binary.BigEndian, uint16(len(wrapped)))
+	buf.Write(wrapped)
+	header := buf.Len()
+	buf.Write(nonce)
+	// the header is authenticated along with the profile
+	return aead.Seal(buf.Bytes(), nonce, data, buf.Bytes()[:header]), nil
+}
+
+// open decrypts data sealed by this or an earlier run of the agent.
+func (c *spoolCipher) open(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(spoolMagic)) || len(data) < len(spoolMagic)+2 {
+		return nil, errors.New("not an encrypted spool entry")
+	}
+	n := int(binary.BigEndian.Uint16(data[len(spoolMagic):]))
+	header := len(spoolMagic) + 2 + n
+	if len(data) < header {
+		return nil, errors.New("truncated spool entry")
+	}
+	key, err := c.dataKey(data[len(spoolMagic)+2 : header])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < header+aead.NonceSize() {
+		return nil, errors.New("truncated spool entry")
+	}
+	nonce := data[header : header+aead.NonceSize()]
+	return aead.Open(nil, nonce, data[header+aead.NonceSize():], data[:header])
+}
+
+// dataKey returns the key an entry with the wrapped key was sealed with.
+func (c *spoolCipher) dataKey(wrapped []byte) ([]byte, error) {
+	if len(wrapped) == 0 {
+		if c.kms != nil {
+			return nil, errors.New("entry was encrypted with a local key")
+		}
+		return c.key, nil
+	}
+	if c.kms == nil {
+		return nil, errors.New("entry was encrypted with a KMS key")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if key, ok := c.unwrapped[string(wrapped)]; ok {
+		return key, nil
+	}
+	key, err := c.kms.call("decrypt", "ciphertext", wrapped, "plaintext")
+	if err != nil {
+		return nil, fmt.Errorf("could not unwrap spool key: %s", err)
+	}
+	c.unwrapped[string(wrapped)] = key
+	return key, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// A kmsKey is a Cloud KMS key, used through its REST API.
+type kmsKey struct {
+	name   string
+	client *http.Client
+}
+
+// call calls the method encrypt or decrypt of the key, sending data as the
+// field in and returning the field out of the response.
+func (k *kmsKey) call(method, in string, data []byte, out string) ([]byte, error) {
+	body, err := json.Marshal(map[string]string{in: base64.StdEncoding.EncodeToString(data)})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := k.client.Post(kmsAPI+k.name+":"+method, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(respBody))
+	}
+	// responses have fields other than out, not all of them strings
+	var result map[string]json.RawMessage
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return nil, err
+	}
+	var encoded string
+	if err := json.Unmarshal(result[out], &encoded); err != nil {
+		return nil, fmt.Errorf("no %s in response: %s", out, err)
+	}
+	return base64.StdEncoding.DecodeString(encoded)
+}
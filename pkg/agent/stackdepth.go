@@ -0,0 +1,47 @@
+package agent
+
+import (
+	"fmt"
+	"log"
+
+	pprof "github.com/google/pprof/profile"
+)
+
+// Deeply recursive code can produce stacks thousands of frames deep,
+// which bloat a profile past the API's size limit. With -max-stack-depth,
+// the frames of such stacks nearest the root are replaced by a single
+// [truncated] frame.
+const truncatedFrame = "[truncated]"
+
+// limitStackDepth caps the stacks of p at depth frames, including the
+// [truncated] frame that replaces those elided. It returns the number of
+// frames elided. A depth of zero leaves p unchanged.
+func limitStackDepth(p *pprof.Profile, depth int) (*pprof.Profile, int) {
+	if depth <= 0 {
+		return p, 0
+	}
+	if depth < 2 {
+		// room for one frame of the stack besides [truncated]
+		depth = 2
+	}
+	var elided, samples int
+	var frame *pprof.Location
+	for _, s := range p.Sample {
+		if len(s.Location) <= depth {
+			continue
+		}
+		if frame == nil {
+			frame = addPseudoFrame(p, truncatedFrame)
+		}
+		// Location[0] is the leaf.
+		elided += len(s.Location) - depth + 1
+		samples++
+		s.Location = append(s.Location[:depth-1:depth-1], frame)
+	}
+	if elided == 0 {
+		return p, 0
+	}
+	log.Printf("elided %d frames from %d samples deeper than %d frames", elided, samples, depth)
+	addComment(p, fmt.Sprintf("elided %d frames from %d samples deeper than %d frames", elided, samples, depth))
+	return p.Compact(), elided
+}
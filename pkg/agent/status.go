@@ -0,0 +1,182 @@
+package agent
+
+import (
+	"expvar"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	cloudprofiler "google.golang.org/genproto/googleapis/devtools/cloudprofiler/v2"
+	"google.golang.org/grpc"
+)
+
+// How often the status file is rewritten.
+const statusInterval = 15 * time.Second
+
+// The agent's state, published with expvar and written to the status
+// file given with -status-file for health checks that cannot query an
+// HTTP listener.
+var (
+	agentStatus = expvar.NewMap("agent")
+
+	lastCycle      = new(expvar.String)
+	lastCycleTime  = new(expvar.String)
+	nextCollection = new(expvar.String)
+	endpointName   = new(expvar.String)
+	uploadCount    = new(expvar.Int)
+	uploadRetries  = new(expvar.Int)
+	skipCount      = new(expvar.Int)
+	errorCounts    = new(expvar.Map).Init()
+	skipKinds      = new(expvar.Map).Init()
+
+	// the *grpc.ClientConn in use
+	statusConn atomic.Value
+)
+
+func init() {
+	agentStatus.Set("last-cycle", lastCycle)
+	agentStatus.Set("last-cycle-time", lastCycleTime)
+	agentStatus.Set("next-collection", nextCollection)
+	agentStatus.Set("endpoint", endpointName)
+	agentStatus.Set("connection", expvar.Func(func() interface{} { return connectionState() }))
+	agentStatus.Set("phase", expvar.Func(func() interface{} {
+		name, _, _ := currentPhase()
+		return name
+	}))
+	agentStatus.Set("uploaded", uploadCount)
+	agentStatus.Set("upload-retries", uploadRetries)
+	agentStatus.Set("skipped", skipCount)
+	agentStatus.Set("skips", skipKinds)
+	agentStatus.Set("errors", errorCounts)
+}
+
+func connectionState() string {
+	if conn, ok := statusConn.Load().(*grpc.ClientConn); ok {
+		return conn.GetState().String()
+	}
+	return "NONE"
+}
+
+// Kinds of errors counted in the status.
+const (
+	errCreateProfile = "create-profile"
+	errCollect       = "collect"
+	errUpload        = "upload"
+	errLateSymbols   = "late-symbols"
+)
+
+// cycleDone records the outcome of a profile cycle.
+func cycleDone(result string) {
+	lastCycle.Set(result)
+	lastCycleTime.Set(time.Now().UTC().Format(time.RFC3339))
+}
+
+// profileUploaded records the upload of profile, named name, of type t.
+func profileUploaded(t cloudprofiler.ProfileType, name string) {
+	uploadCount.Add(1)
+	webhooks.uploaded(t, name)
+}
+
+// cycleSkipped records a cycle whose profile, of type t, was
+// deliberately not uploaded.
+func cycleSkipped(t cloudprofiler.ProfileType, skip *skipError) {
+	skipCount.Add(1)
+	skipKinds.Add(skip.kind, 1)
+	cycleDone(skip.Error())
+	emitEvent(eventSkipped, skip.kind, t, skip.reason)
+}
+
+// cycleAborted records a cycle whose profile, of type t, could not be
+// uploaded because of err, an error of the given kind.
+func cycleAborted(t cloudprofiler.ProfileType, kind string, err error) {
+	errorCounts.Add(kind, 1)
+	abortKinds.Add(kind, 1)
+	cycleDone(kind + " failed: " + err.Error())
+	emitEvent(eventAborted, kind, t, err.Error())
+	webhooks.aborted(t, kind, err)
+}
+
+// A requestClock estimates when the next profile will be requested from
+// the interval between the last two requests.
+type requestClock struct {
+	last, next time.Time
+}
+
+func (c *requestClock) requested() {
+	now := time.Now()
+	if !c.last.IsZero() {
+		c.next = now.Add(now.Sub(c.last))
+		nextCollection.Set(c.next.UTC().Format(time.RFC3339))
+	}
+	c.last = now
+}
+
+// nextRequest returns when the next profile is expected to be requested,
+// or the zero time until two requests have been seen.
+func (c *requestClock) nextRequest() time.Time {
+	return c.next
+}
+
+// writeStatus writes the agent's status to path as JSON, replacing the
+// file atomically so readers never see a partial write.
+func writeStatus(path string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".status")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(agentStatus.String() + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// writeStatusLoop rewrites the status file every statusInterval.
+func writeStatusLoop(path string) {
+	for {
+		if err := writeStatus(path); err != nil {
+			logWarnf("failed to write status file: %s", err)
+		}
+		time.Sleep(statusInterval)
+	}
+}
+
+// logSummary logs the outcome of the agent's session as it exits.
+func logSummary() {
+	log.Printf("session summary: %d profiles uploaded, %d skipped; skips %s; aborts %s; api errors %s",
+		uploadCount.Value(), skipCount.Value(), skipKinds, abortKinds, apiErrors)
+}
+
+// exitOnSignal ends the session when a is interrupted or terminated: it
+// gives the terminal back from -tui, logs the summary, waits for the
+// webhooks, passes the signal on to perf and removes a's temporary
+// directory, then lets the signal end the agent as it would have.
+func exitOnSignal(a *agent) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		s := <-sig
+		stopTUI()
+		logSummary()
+		webhooks.stop("received " + s.String())
+		signalPerfGroups(s.(syscall.Signal))
+		if a.tmpdir != "" {
+			os.RemoveAll(a.tmpdir)
+		}
+		signal.Reset(s)
+		syscall.Kill(os.Getpid(), s.(syscall.Signal))
+	}()
+}
@@ -0,0 +1,142 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	pprof "github.com/google/pprof/profile"
+)
+
+// The server may ask for profiles minutes long, whose perf.data can fill
+// the disk of a busy host before it is converted, and is lost whole if
+// the recording is cut short. With -stream-segments, such recordings are
+// rotated by perf record --switch-output, and each segment is converted
+// and removed as soon as perf writes it. The profiles of the segments are
+// merged as they come in, so only the current segment is ever on disk,
+// and whatever was converted before a failure can still be uploaded.
+
+// How often the recording directory is checked for new segments.
+const streamPoll = time.Second
+
+// A segmentStream converts the segments of a recording to base while
+// perf is writing them.
+type segmentStream struct {
+	a     *agent
+	base  string
+	freq  int
+	cycle *cycleStats
+	quit  chan struct{}
+	done  chan struct{}
+	once  sync.Once
+
+	// set by the conversion loop, and read once it has finished
+	converted map[string]bool
+	merged    *pprof.Profile
+	n         int
+	damaged   bool
+	// time spent converting
+	converting time.Duration
+}
+
+// startStream starts converting the segments of the recording to base,
+// sampled at freq Hz, accounting for the conversions in cycle.
+func (a *agent) startStream(base string, freq int, cycle *cycleStats) *segmentStream {
+	removeSegments(base)
+	s := &segmentStream{
+		a:         a,
+		base:      base,
+		freq:      freq,
+		cycle:     cycle,
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+		converted: make(map[string]bool),
+	}
+	go s.loop()
+	return s
+}
+
+func (s *segmentStream) loop() {
+	defer close(s.done)
+	tick := time.NewTicker(streamPoll)
+	defer tick.Stop()
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-tick.C:
+			s.convertNew()
+		}
+	}
+}
+
+// convertNew converts the segments written since it was last called.
+// perf renames each segment into place once it is complete.
+func (s *segmentStream) convertNew() {
+	segments, err := perfSegments(s.base)
+	if err != nil {
+		return
+	}
+	for _, seg := range segments {
+		if s.converted[seg] {
+			continue
+		}
+		s.converted[seg] = true
+		start := time.Now()
+		p, partial, err := s.a.convertFile(seg+".pprof", seg, s.cycle)
+		os.Remove(seg)
+		os.Remove(seg + ".pprof")
+		s.converting += time.Since(start)
+		if err != nil {
+			// a signal may cut the last segment short
+			logWarnf("skipping segment %s: %s", seg, err)
+			s.damaged = true
+			continue
+		}
+		s.damaged = s.damaged || partial
+		if s.merged != nil {
+			if p, err = mergeSampled([]sampledProfile{{s.merged, s.freq}, {p, s.freq}}); err != nil {
+				logWarnf("skipping segment %s: could not merge it: %s", seg, err)
+				s.damaged = true
+				continue
+			}
+		}
+		s.merged = p
+		s.n++
+	}
+}
+
+// stop stops the conversion loop, and waits for it to finish.
+func (s *segmentStream) stop() {
+	s.once.Do(func() { close(s.quit) })
+	<-s.done
+}
+
+// close stops the stream and removes any segments left on disk.
+func (s *segmentStream) close() {
+	if s == nil {
+		return
+	}
+	s.stop()
+	removeSegments(s.base)
+}
+
+// any reports whether any segment has been converted. It must only be
+// called once the stream has stopped.
+func (s *segmentStream) any() bool {
+	return s.merged != nil
+}
+
+// finish converts the segments perf wrote last, and returns the merged
+// profile of the whole recording. The returned bool is true if any
+// segment was damaged or could not be converted.
+func (s *segmentStream) finish() (*pprof.Profile, bool, error) {
+	s.stop()
+	s.convertNew()
+	if s.merged == nil {
+		return nil, false, fmt.Errorf("no segments of %s could be converted", s.base)
+	}
+	addComment(s.merged, fmt.Sprintf("recorded in %d segments, converted as they were written", s.n))
+	return s.merged, s.damaged, nil
+}
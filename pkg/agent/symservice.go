@@ -0,0 +1,282 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+
+	"github.com/droyo/cloud-profiler-perf/pkg/perf"
+	"github.com/droyo/cloud-profiler-perf/pkg/symbolize"
+)
+
+// With -symbolizer, the agent leaves symbolization to a companion
+// service, run on machines with the CPU, memory and binaries to spare:
+// each recording is sent with the build IDs of the binaries it may
+// symbolize, and the service returns the converted profile. Should the
+// service fail, the recording is converted on the host as usual. The
+// service is described in symbolizer.proto, and implemented by the
+// symbolize-server subcommand.
+const symbolizeServerCommand = "symbolize-server"
+
+const symbolizeMethod = "/cloudprofilerperf.Symbolizer/Symbolize"
+
+// How long the service may take to convert a recording, sending it
+// included.
+const remoteSymbolizeTimeout = 5 * time.Minute
+
+// The largest recording or profile exchanged with the service.
+const maxSymbolizeMessage = 1 << 30
+
+// The messages of symbolizer.proto.
+type symbolizeBuildID struct {
+	BuildId string `protobuf:"bytes,1,opt,name=build_id,json=buildId,proto3" json:"build_id,omitempty"`
+	Path    string `protobuf:"bytes,2,opt,name=path,proto3" json:"path,omitempty"`
+}
+
+type symbolizeRequest struct {
+	PerfData []byte              `protobuf:"bytes,1,opt,name=perf_data,json=perfData,proto3" json:"perf_data,omitempty"`
+	BuildIds []*symbolizeBuildID `protobuf:"bytes,2,rep,name=build_ids,json=buildIds,proto3" json:"build_ids,omitempty"`
+	Kallsyms []byte              `protobuf:"bytes,3,opt,name=kallsyms,proto3" json:"kallsyms,omitempty"`
+}
+
+type symbolizeResponse struct {
+	Profile []byte `protobuf:"bytes,1,opt,name=profile,proto3" json:"profile,omitempty"`
+	Linked  int32  `protobuf:"varint,2,opt,name=linked,proto3" json:"linked,omitempty"`
+	Failed  int32  `protobuf:"varint,3,opt,name=failed,proto3" json:"failed,omitempty"`
+}
+
+func (m *symbolizeBuildID) Reset()         { *m = symbolizeBuildID{} }
+func (m *symbolizeBuildID) String() string { return proto.CompactTextString(m) }
+func (*symbolizeBuildID) ProtoMessage()    {}
+
+func (m *symbolizeRequest) Reset()         { *m = symbolizeRequest{} }
+func (m *symbolizeRequest) String() string { return proto.CompactTextString(m) }
+func (*symbolizeRequest) ProtoMessage()    {}
+
+func (m *symbolizeResponse) Reset()         { *m = symbolizeResponse{} }
+func (m *symbolizeResponse) String() string { return proto.CompactTextString(m) }
+func (*symbolizeResponse) ProtoMessage()    {}
+
+// A symbolService is a connection to the symbolization service.
+type symbolService struct {
+	addr string
+	conn *grpc.ClientConn
+}
+
+func newSymbolService(addr string) (*symbolService, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("symbolizer %q is not a host:port address", addr)
+	}
+	conn, err := grpc.Dial(addr,
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return dialContext(ctx, "tcp", addr)
+		}),
+		grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{ServerName: host})),
+		grpc.WithDefaultCallOptions(
+			grpc.MaxCallSendMsgSize(maxSymbolizeMessage),
+			grpc.MaxCallRecvMsgSize(maxSymbolizeMessage)))
+	if err != nil {
+		return nil, err
+	}
+	return &symbolService{addr: addr, conn: conn}, nil
+}
+
+// symbolize has the service convert the perf.data file src to the pprof
+// file dst, symbolizing only the binaries filter allows. It returns the
+// number of binaries symbolized and the number the service could not
+// find.
+func (s *symbolService) symbolize(dst, src string, filter binaryFilter) (linked, failed int, err error) {
+	ids, err := perf.BuildIDs(src)
+	if err != nil {
+		return 0, 0, err
+	}
+	req := new(symbolizeRequest)
+	var kernel bool
+	for _, line := range ids {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || filter.excluded(fields[1]) {
+			continue
+		}
+		kernel = kernel || fields[1] == "[kernel.kallsyms]"
+		req.BuildIds = append(req.BuildIds, &symbolizeBuildID{BuildId: fields[0], Path: fields[1]})
+	}
+	if req.PerfData, err = ioutil.ReadFile(src); err != nil {
+		return 0, 0, err
+	}
+	if kernel {
+		// the service cannot know where this host's kernel was
+		// loaded
+		req.Kallsyms, _ = ioutil.ReadFile("/proc/kallsyms")
+	}
+	log.Printf("sending %s to %s for symbolization", src, s.addr)
+	ctx, cancel := context.WithTimeout(context.Background(), remoteSymbolizeTimeout)
+	defer cancel()
+	resp := new(symbolizeResponse)
+	if err := s.conn.Invoke(ctx, symbolizeMethod, req, resp); err != nil {
+		return 0, 0, err
+	}
+	if err := ioutil.WriteFile(dst, resp.Profile, 0666); err != nil {
+		return 0, 0, err
+	}
+	return int(resp.Linked), int(resp.Failed), nil
+}
+
+// runSymbolizeServer runs the symbolize-server subcommand with its
+// arguments args, serving the symbolization service with a -symbols
+// directory of binaries, in the layouts the symbolize subcommand reads.
+func runSymbolizeServer(args []string) error {
+	fs := flag.NewFlagSet(symbolizeServerCommand, flag.ContinueOnError)
+	listen := fs.String("listen", ":8443", "`address` to serve on")
+	symbols := fs.String("symbols", "", "`directory` of binaries to symbolize recordings with")
+	cert := fs.String("cert", "", "TLS certificate `file`")
+	key := fs.String("key", "", "TLS private key `file`")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *symbols == "" || *cert == "" || *key == "" {
+		return errors.New("usage: symbolize-server -symbols dir -cert file -key file [-listen address]")
+	}
+	dir, err := filepath.Abs(*symbols)
+	if err != nil {
+		return err
+	}
+	creds, err := credentials.NewServerTLSFromFile(*cert, *key)
+	if err != nil {
+		return fmt.Errorf("could not load TLS certificate: %s", err)
+	}
+	tmpdir, err := ioutil.TempDir("", filepath.Base(os.Args[0]))
+	if err != nil {
+		return fmt.Errorf("failed to create temp directory: %s", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	if debuginfod != nil {
+		debuginfod.cache = filepath.Join(tmpdir, debuginfodDir)
+	}
+
+	s := &symbolizeServer{
+		symbols: dir,
+		tmpdir:  tmpdir,
+		convert: newConverterPool(context.Background(), *conversions),
+	}
+	srv := grpc.NewServer(grpc.Creds(creds),
+		grpc.MaxRecvMsgSize(maxSymbolizeMessage),
+		grpc.MaxSendMsgSize(maxSymbolizeMessage))
+	srv.RegisterService(&symbolizerService, s)
+	lis, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
+	}
+	log.Printf("serving symbolization on %s with the binaries in %s", lis.Addr(), dir)
+	return srv.Serve(lis)
+}
+
+type symbolizeServer struct {
+	symbols string
+	tmpdir  string
+	convert *converterPool
+}
+
+var symbolizerService = grpc.ServiceDesc{
+	ServiceName: "cloudprofilerperf.Symbolizer",
+	HandlerType: (*interface {
+		Symbolize(context.Context, *symbolizeRequest) (*symbolizeResponse, error)
+	})(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Symbolize",
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			req := new(symbolizeRequest)
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			return srv.(*symbolizeServer).Symbolize(ctx, req)
+		},
+	}},
+	Metadata: "symbolizer.proto",
+}
+
+// Symbolize converts the recording of req in a scratch directory of its
+// own, with a symbol tree holding only the binaries req lists.
+func (s *symbolizeServer) Symbolize(ctx context.Context, req *symbolizeRequest) (*symbolizeResponse, error) {
+	dir, err := ioutil.TempDir(s.tmpdir, "request")
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "%s", err)
+	}
+	defer os.RemoveAll(dir)
+	job := &conversion{
+		dst:      filepath.Join(dir, "perf.pprof"),
+		src:      filepath.Join(dir, "perf.data"),
+		symbols:  filepath.Join(dir, "symbols"),
+		prebuilt: true,
+	}
+	if err := ioutil.WriteFile(job.src, req.PerfData, 0666); err != nil {
+		return nil, status.Errorf(codes.Internal, "%s", err)
+	}
+	linked, failed := s.link(job.symbols, req)
+	if err := s.convert.convert(ctx, job); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "could not convert recording: %s", err)
+	}
+	data, err := ioutil.ReadFile(job.dst)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "%s", err)
+	}
+	log.Printf("symbolized a %d byte recording with %d binaries, %d not found", len(req.PerfData), linked, failed)
+	return &symbolizeResponse{Profile: data, Linked: int32(linked), Failed: int32(failed)}, nil
+}
+
+// link builds the symbol tree of req in tree, from the binaries in the
+// server's directory whose build IDs match those listed. It returns the
+// number of binaries linked, and of those not found.
+func (s *symbolizeServer) link(tree string, req *symbolizeRequest) (linked, failed int) {
+	store := symbolize.New(s.symbols)
+	for _, b := range req.BuildIds {
+		id := strings.ToLower(b.BuildId)
+		if id == "" || strings.Trim(id, "0123456789abcdef") != "" {
+			continue
+		}
+		// rooted, so that it cannot lead out of the directory
+		file := filepath.Join("/", b.Path)
+		name := filepath.Base(file)
+		if err := os.MkdirAll(filepath.Join(tree, id), 0777); err != nil {
+			failed++
+			continue
+		}
+		if b.Path == "[kernel.kallsyms]" {
+			if len(req.Kallsyms) > 0 {
+				if err := ioutil.WriteFile(filepath.Join(tree, id, b.Path), req.Kallsyms, 0666); err == nil {
+					linked++
+					continue
+				}
+			}
+			file, name = "vmlinux", "vmlinux"
+		}
+		var found string
+		for _, path := range store.Candidates(file, id) {
+			if got, err := symbolize.BuildID(path); err == nil && got == id {
+				found = path
+				break
+			}
+		}
+		if found == "" || os.Symlink(found, filepath.Join(tree, id, name)) != nil {
+			failed++
+			continue
+		}
+		linked++
+	}
+	return linked, failed
+}
@@ -0,0 +1,57 @@
+package agent
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// The API's certificate is verified against the system's trusted roots,
+// to which -ca-cert adds those of a proxy that intercepts TLS, or of a
+// private front end. With -mtls-cert, the agent presents a client
+// certificate, as endpoints that require mutual TLS ask. The files are
+// read again each time the agent connects, so that certificates rotated
+// underneath it are picked up when it next fails over.
+
+// apiTLSConfig returns the TLS configuration to connect to the API at
+// host with.
+func apiTLSConfig(host string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: host}
+	if *caCert != "" {
+		pem, err := ioutil.ReadFile(*caCert)
+		if err != nil {
+			return nil, fmt.Errorf("could not read -ca-cert: %s", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates in %s", *caCert)
+		}
+		config.RootCAs = pool
+	}
+	if *mtlsCert != "" {
+		keyFile := *mtlsKey
+		if keyFile == "" {
+			keyFile = *mtlsCert
+		}
+		cert, err := tls.LoadX509KeyPair(*mtlsCert, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load -mtls-cert: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	} else if *mtlsKey != "" {
+		return nil, errors.New("-mtls-key needs -mtls-cert")
+	}
+	return config, nil
+}
+
+// checkAPITLS reports problems with the TLS flags at startup, rather than
+// on the first connection.
+func checkAPITLS() error {
+	_, err := apiTLSConfig("")
+	return err
+}
@@ -0,0 +1,213 @@
+package agent
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	cloudprofiler "google.golang.org/genproto/googleapis/devtools/cloudprofiler/v2"
+
+	pprof "github.com/google/pprof/profile"
+)
+
+// Incident responders cannot wait for the server to ask for a profile.
+// With -trigger-listen, the agent serves
+//
+//	POST /profile?type=cpu&duration=30s&pid=1234
+//
+// which records a profile at once, of the type and duration given, and
+// uploads it with CreateOfflineProfile, as -push does, labelled
+// trigger=on-demand. With pid, only the samples of that process are
+// kept. Requests must present the token of -trigger-token-file as a
+// bearer token. A profile the server asks for meanwhile waits for the
+// triggered one, as profiles are recorded one at a time.
+
+const triggerPath = "/profile"
+
+// The duration of triggered profiles by default, and at most.
+const (
+	defaultTriggerDuration = 10 * time.Second
+	maxTriggerDuration     = 5 * time.Minute
+)
+
+// Time allowed to read a request, and to answer it. The answer comes
+// once the profile is recorded, which may first wait for another
+// recording to finish, and uploaded.
+const (
+	triggerReadTimeout  = 10 * time.Second
+	triggerWriteTimeout = 2*maxTriggerDuration + uploadTimeout
+)
+
+// A triggerResponse is the reply to a request to record a profile.
+type triggerResponse struct {
+	Profile  string `json:"profile,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Duration string `json:"duration,omitempty"`
+	Samples  int    `json:"samples,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// serveTrigger serves requests to record profiles on addr, authenticated
+// with the token in tokenFile.
+func (a *agent) serveTrigger(addr, tokenFile string) error {
+	data, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return fmt.Errorf("could not read -trigger-token-file: %s", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return fmt.Errorf("-trigger-token-file %s is empty", tokenFile)
+	}
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(triggerPath, func(w http.ResponseWriter, r *http.Request) {
+		a.handleTrigger(w, r, token)
+	})
+	log.Printf("serving on-demand profiles on http://%s%s", lis.Addr(), triggerPath)
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: triggerReadTimeout,
+		ReadTimeout:       triggerReadTimeout,
+		WriteTimeout:      triggerWriteTimeout,
+	}
+	go func() {
+		logErrorf("on-demand profile server stopped: %s", srv.Serve(lis))
+	}()
+	return nil
+}
+
+func (a *agent) handleTrigger(w http.ResponseWriter, r *http.Request, token string) {
+	reply := func(code int, resp triggerResponse) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(resp)
+	}
+	fail := func(code int, err error) {
+		reply(code, triggerResponse{Error: err.Error()})
+	}
+	presented := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+		logWarnf("refusing on-demand profile request from %s: bad token", r.RemoteAddr)
+		fail(http.StatusUnauthorized, errors.New("missing or wrong bearer token"))
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		fail(http.StatusMethodNotAllowed, errors.New("use POST"))
+		return
+	}
+	profile, pid, err := a.triggeredProfile(r)
+	if err != nil {
+		fail(http.StatusBadRequest, err)
+		return
+	}
+	duration, _ := ptypes.Duration(profile.Duration)
+	logAt(levelInfo, profileFields(profile), "recording %v %s profile requested by %s", duration, profile.ProfileType, r.RemoteAddr)
+	if err := a.retrieveProfile(profile); err != nil {
+		if skip, ok := err.(*skipError); ok {
+			cycleSkipped(profile.ProfileType, skip)
+			fail(http.StatusUnprocessableEntity, err)
+		} else {
+			cycleAborted(profile.ProfileType, errCollect, err)
+			fail(http.StatusInternalServerError, err)
+		}
+		return
+	}
+	samples, err := keepProcess(profile, pid)
+	if err != nil {
+		fail(http.StatusUnprocessableEntity, err)
+		return
+	}
+	uploaded, err := a.pushProfile(profile)
+	if err != nil {
+		fail(http.StatusBadGateway, err)
+		return
+	}
+	reply(http.StatusOK, triggerResponse{
+		Profile:  uploaded.Name,
+		Type:     profile.ProfileType.String(),
+		Duration: duration.String(),
+		Samples:  samples,
+	})
+}
+
+// triggeredProfile returns the profile r asks for, and the process whose
+// samples it keeps, if any.
+func (a *agent) triggeredProfile(r *http.Request) (*cloudprofiler.Profile, int, error) {
+	q := r.URL.Query()
+	t := cloudprofiler.ProfileType_CPU
+	if name := q.Get("type"); name != "" {
+		var ok bool
+		if t, ok = profileTypeNames[name]; !ok {
+			return nil, 0, fmt.Errorf("unknown profile type %q", name)
+		}
+	}
+	if _, ok := a.collectors[t]; !ok {
+		return nil, 0, fmt.Errorf("%s profiles are not enabled", t)
+	}
+	duration := defaultTriggerDuration
+	if s := q.Get("duration"); s != "" {
+		var err error
+		if duration, err = time.ParseDuration(s); err != nil || duration <= 0 || duration > maxTriggerDuration {
+			return nil, 0, fmt.Errorf("duration must be positive and at most %v", maxTriggerDuration)
+		}
+	}
+	var pid int
+	if s := q.Get("pid"); s != "" {
+		var err error
+		if pid, err = strconv.Atoi(s); err != nil || pid <= 0 {
+			return nil, 0, fmt.Errorf("invalid pid %q", s)
+		}
+		if _, err := os.Stat(fmt.Sprintf("/proc/%d", pid)); err != nil {
+			return nil, 0, fmt.Errorf("no process %d", pid)
+		}
+	}
+	profile := &cloudprofiler.Profile{
+		ProfileType: t,
+		Deployment:  a.deployment(),
+		Duration:    ptypes.DurationProto(duration),
+	}
+	setProfileLabel(profile, "trigger", "on-demand")
+	if pid > 0 {
+		setProfileLabel(profile, "pid", strconv.Itoa(pid))
+	}
+	return profile, pid, nil
+}
+
+// keepProcess drops the samples of processes other than pid from
+// profile, unless pid is 0, and returns the number of samples left.
+func keepProcess(profile *cloudprofiler.Profile, pid int) (int, error) {
+	p, err := pprof.ParseData(profile.ProfileBytes)
+	if err != nil {
+		return 0, err
+	}
+	if pid == 0 {
+		return len(p.Sample), nil
+	}
+	kept := p.Sample[:0]
+	for _, s := range p.Sample {
+		if pids := s.NumLabel["pid"]; len(pids) == 1 && pids[0] == int64(pid) {
+			kept = append(kept, s)
+		}
+	}
+	if len(kept) == 0 {
+		return 0, fmt.Errorf("the %s profile has no samples of process %d", profile.ProfileType, pid)
+	}
+	p.Sample = kept
+	p = p.Compact()
+	addComment(p, fmt.Sprintf("samples of process %d, recorded on demand", pid))
+	return len(p.Sample), setProfileBytes(profile, p)
+}
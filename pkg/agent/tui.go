@@ -0,0 +1,187 @@
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The agent's current phase, shown in the status and the terminal UI.
+type phaseState struct {
+	mu    sync.Mutex
+	name  string
+	since time.Time
+	// expected end of the phase, if known
+	until time.Time
+}
+
+var phase phaseState
+
+// setPhase records that the agent has entered a phase expected to last
+// d, or an unknown time if d is zero.
+func setPhase(name string, d time.Duration) {
+	phase.mu.Lock()
+	defer phase.mu.Unlock()
+	phase.name = name
+	phase.since = time.Now()
+	phase.until = time.Time{}
+	if d > 0 {
+		phase.until = phase.since.Add(d)
+	}
+}
+
+func currentPhase() (string, time.Time, time.Time) {
+	phase.mu.Lock()
+	defer phase.mu.Unlock()
+	return phase.name, phase.since, phase.until
+}
+
+// A logRing keeps the last lines written to the log, which the terminal
+// UI shows in place of the log going to the terminal.
+type logRing struct {
+	mu    sync.Mutex
+	lines []string
+	max   int
+	buf   bytes.Buffer
+}
+
+func (r *logRing) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.buf.Write(p)
+	for {
+		line, err := r.buf.ReadString('\n')
+		if err != nil {
+			// keep the incomplete line for the next write
+			r.buf.Reset()
+			r.buf.WriteString(line)
+			break
+		}
+		r.lines = append(r.lines, strings.TrimRight(line, "\n"))
+		if len(r.lines) > r.max {
+			r.lines = r.lines[len(r.lines)-r.max:]
+		}
+	}
+	return len(p), nil
+}
+
+func (r *logRing) tail() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.lines...)
+}
+
+const (
+	tuiRefresh  = time.Second
+	tuiLogLines = 12
+
+	// switch to and from the terminal's alternate screen, as editors
+	// and pagers do, so the agent's output before and after the
+	// dashboard is left alone
+	enterAltScreen = "\x1b[?1049h\x1b[H"
+	leaveAltScreen = "\x1b[?1049l"
+	clearScreen    = "\x1b[H\x1b[2J"
+)
+
+// A tui is a live dashboard of the agent's state on the terminal.
+type tui struct {
+	a    *agent
+	logs *logRing
+	stop chan struct{}
+	once sync.Once
+}
+
+var dashboard *tui
+
+// startTUI takes over the terminal, which must be the agent's standard
+// output, and sends the log to the dashboard.
+func startTUI(a *agent) error {
+	info, err := os.Stdout.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return errors.New("-tui needs a terminal on standard output")
+	}
+	t := &tui{a: a, logs: &logRing{max: tuiLogLines}, stop: make(chan struct{})}
+	setLogOutput(t.logs)
+	os.Stdout.WriteString(enterAltScreen)
+	dashboard = t
+	go t.loop()
+	return nil
+}
+
+// stopTUI gives the terminal back, so that a final error is visible.
+func stopTUI() {
+	t := dashboard
+	if t == nil {
+		return
+	}
+	t.once.Do(func() {
+		close(t.stop)
+		os.Stdout.WriteString(leaveAltScreen)
+		setLogOutput(os.Stderr)
+		for _, line := range t.logs.tail() {
+			fmt.Fprintln(os.Stderr, line)
+		}
+	})
+}
+
+func (t *tui) loop() {
+	tick := time.NewTicker(tuiRefresh)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			os.Stdout.WriteString(clearScreen + t.render(time.Now()))
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+func countdown(now, then time.Time) string {
+	d := then.Sub(now).Round(time.Second)
+	if d < 0 {
+		return "overdue"
+	}
+	return "in " + d.String()
+}
+
+func (t *tui) render(now time.Time) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "sd-perf-profiler   service %s   project %s\n", t.a.service, t.a.project)
+	endpoint := endpointName.Value()
+	if endpoint == "" {
+		endpoint = "not connected"
+	}
+	fmt.Fprintf(&b, "endpoint           %s [%s]\n\n", endpoint, connectionState())
+
+	name, since, until := currentPhase()
+	fmt.Fprintf(&b, "phase              %s, for %s", name, now.Sub(since).Round(time.Second))
+	if !until.IsZero() {
+		fmt.Fprintf(&b, ", done %s", countdown(now, until))
+	}
+	b.WriteString("\n")
+	next := "unknown until two profiles have been requested"
+	if v := nextCollection.Value(); v != "" {
+		if when, err := time.Parse(time.RFC3339, v); err == nil {
+			next = "expected " + countdown(now, when)
+		}
+	}
+	fmt.Fprintf(&b, "next profile       %s\n", next)
+	last := "none yet"
+	if v := lastCycle.Value(); v != "" {
+		last = fmt.Sprintf("%s (%s)", v, lastCycleTime.Value())
+	}
+	fmt.Fprintf(&b, "last result        %s\n", last)
+	fmt.Fprintf(&b, "profiles           %s uploaded, %s skipped, errors %s\n\n",
+		uploadCount, skipCount, errorCounts)
+
+	b.WriteString("recent log\n")
+	for _, line := range t.logs.tail() {
+		fmt.Fprintf(&b, "  %s\n", line)
+	}
+	return b.String()
+}
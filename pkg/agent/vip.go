@@ -0,0 +1,121 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Projects behind VPC Service Controls, or without external access, may
+// only reach Google APIs through the private.googleapis.com or
+// restricted.googleapis.com virtual IPs. With -google-apis-vip, every
+// connection to a *.googleapis.com host is made to the chosen VIP
+// instead, keeping the original host name for TLS and the gRPC
+// authority, so the agent needs no DNS overrides of its own.
+
+// The addresses of the VIPs, which are fixed.
+var googleVIPs = map[string][]string{
+	"private":    {"199.36.153.8", "199.36.153.9", "199.36.153.10", "199.36.153.11"},
+	"restricted": {"199.36.153.4", "199.36.153.5", "199.36.153.6", "199.36.153.7"},
+}
+
+// The ranges of the VIPs, for DNS guidance.
+var googleVIPRanges = map[string]string{
+	"private":    "199.36.153.8/30",
+	"restricted": "199.36.153.4/30",
+}
+
+func checkGoogleVIP(name string) error {
+	if _, ok := googleVIPs[name]; name != "" && !ok {
+		return fmt.Errorf("unknown Google APIs VIP %q, must be private or restricted", name)
+	}
+	return nil
+}
+
+// vipIPs returns the VIP addresses to connect to in place of host, or
+// nil if host is not reached through a VIP.
+func vipIPs(host string) []string {
+	ips, ok := googleVIPs[*googleVIP]
+	if !ok || !strings.HasSuffix(strings.ToLower(strings.TrimSuffix(host, ".")), ".googleapis.com") {
+		return nil
+	}
+	return ips
+}
+
+// vipEndpoints returns the ip:port addresses of the chosen VIP, or nil if
+// there is none.
+func vipEndpoints() []string {
+	var addrs []string
+	for _, ip := range googleVIPs[*googleVIP] {
+		addrs = append(addrs, net.JoinHostPort(ip, "443"))
+	}
+	return addrs
+}
+
+var vipNext uint32
+
+// vipAddr returns the address to connect to in place of the host:port
+// addr, spreading connections over the addresses of the VIP.
+func vipAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	ips := vipIPs(host)
+	if len(ips) == 0 {
+		return addr
+	}
+	n := atomic.AddUint32(&vipNext, 1)
+	return net.JoinHostPort(ips[int(n)%len(ips)], port)
+}
+
+// vipProblems reports the chosen VIP if it cannot be reached, with
+// guidance on routing it. It also logs how to set up DNS for the VIP if
+// googleapis.com names resolve to public addresses: the agent does not
+// need it, but other clients on the host will.
+func vipProblems() []depProblem {
+	name := *googleVIP
+	if name == "" {
+		return nil
+	}
+	if ips, err := lookupHostTimeout("cloudprofiler.googleapis.com", probeTimeout); err == nil && !containsAny(ips, googleVIPs[name]) {
+		log.Printf("googleapis.com names resolve to public addresses (%s); the agent connects to %s.googleapis.com regardless, "+
+			"but other software on this host needs a private DNS zone for googleapis.com with *.googleapis.com CNAME %s.googleapis.com "+
+			"and A records for %s", strings.Join(ips, ", "), name, name, strings.Join(googleVIPs[name], ", "))
+	}
+	for _, addr := range vipEndpoints() {
+		ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+		conn, err := agentDialer.DialContext(ctx, "tcp", addr)
+		cancel()
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+	}
+	return []depProblem{{
+		problem: fmt.Sprintf("%s.googleapis.com (%s) cannot be reached", name, googleVIPRanges[name]),
+		fix: fmt.Sprintf("enable Private Google Access on the subnet, and route %s through the default internet gateway",
+			googleVIPRanges[name]),
+	}}
+}
+
+func lookupHostTimeout(host string, timeout time.Duration) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return net.DefaultResolver.LookupHost(ctx, host)
+}
+
+func containsAny(list, want []string) bool {
+	for _, s := range list {
+		for _, w := range want {
+			if s == w {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,292 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	cloudprofiler "google.golang.org/genproto/googleapis/devtools/cloudprofiler/v2"
+)
+
+// Teams want to hear of an agent that stopped or keeps failing without
+// building a watcher around its logs or status. With -webhook, the agent
+// posts a JSON payload to each given URL when it starts and stops, when
+// an upload succeeds or fails, and when -webhook-errors cycles in a row
+// have failed. The payload is the webhookEvent itself, or the output of
+// the -webhook-template, which lets it take the shape Slack, PagerDuty
+// or another receiver expects. Deliveries are made in the background
+// and never hold up profiling; those that fail are logged and dropped.
+
+// Events posted to webhooks.
+const (
+	webhookStarted      = "started"
+	webhookStopped      = "stopped"
+	webhookUploaded     = "uploaded"
+	webhookUploadFailed = "upload-failed"
+	webhookErrors       = "errors"
+)
+
+var webhookEventNames = []string{webhookStarted, webhookStopped, webhookUploaded, webhookUploadFailed, webhookErrors}
+
+// How many deliveries may wait to be made before new ones are dropped,
+// and how long the agent waits for them when it stops.
+const (
+	webhookQueue   = 64
+	webhookTimeout = 10 * time.Second
+)
+
+// A webhookEvent is what a template is executed with, and the payload
+// posted if there is none.
+type webhookEvent struct {
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+	Hostname string    `json:"hostname"`
+	Instance string    `json:"instance,omitempty"`
+	Project  string    `json:"project,omitempty"`
+	Service  string    `json:"service,omitempty"`
+	Type     string    `json:"type,omitempty"`
+	Detail   string    `json:"detail"`
+}
+
+// A webhookSender posts events to the -webhook URLs.
+type webhookSender struct {
+	urls   []string
+	events map[string]bool
+	tmpl   *template.Template
+	client *http.Client
+	queue  chan []byte
+	wg     sync.WaitGroup
+
+	mu sync.Mutex
+	// the fields every event is filled in with
+	base webhookEvent
+	// set once the queue is closed
+	stopped bool
+	// failed cycles since the last upload, and the threshold at which
+	// an errors event is posted
+	failures, threshold int
+}
+
+// the sender of the -webhook flags, if any
+var webhooks *webhookSender
+
+// newWebhookSender returns a sender posting the named events, a
+// comma-separated list, to urls, formatted by the template in the file
+// at tmplPath if it is set.
+func newWebhookSender(urls []string, events, tmplPath string, threshold int) (*webhookSender, error) {
+	w := &webhookSender{
+		urls:      urls,
+		events:    make(map[string]bool),
+		client:    &http.Client{Timeout: 30 * time.Second},
+		queue:     make(chan []byte, webhookQueue),
+		threshold: threshold,
+	}
+	for _, u := range urls {
+		if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+			return nil, fmt.Errorf("-webhook %s: not an http or https URL", u)
+		}
+	}
+	for _, e := range strings.Split(events, ",") {
+		if e = strings.TrimSpace(e); e == "" {
+			continue
+		}
+		if !containsString(webhookEventNames, e) {
+			return nil, fmt.Errorf("-webhook-events: unknown event %q, want one of %s", e, strings.Join(webhookEventNames, ", "))
+		}
+		w.events[e] = true
+	}
+	if threshold < 1 {
+		return nil, errors.New("-webhook-errors must be at least 1")
+	}
+	if tmplPath != "" {
+		text, err := ioutil.ReadFile(tmplPath)
+		if err != nil {
+			return nil, fmt.Errorf("-webhook-template: %s", err)
+		}
+		w.tmpl, err = template.New(tmplPath).Funcs(template.FuncMap{"json": jsonString}).Parse(string(text))
+		if err != nil {
+			return nil, fmt.Errorf("-webhook-template: %s", err)
+		}
+		// catch templates that do not produce JSON before any event
+		sample := webhookEvent{Event: webhookStarted, Time: time.Now().UTC(), Detail: `a "sample" event`}
+		if _, err := w.payload(sample); err != nil {
+			return nil, fmt.Errorf("-webhook-template: %s", err)
+		}
+	}
+	w.base.Hostname, _ = os.Hostname()
+	w.wg.Add(1)
+	go w.loop()
+	return w, nil
+}
+
+// jsonString returns s as a JSON string, quotes included, for templates.
+func jsonString(s string) (string, error) {
+	b, err := json.Marshal(s)
+	return string(b), err
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// payload returns the body posted for e.
+func (w *webhookSender) payload(e webhookEvent) ([]byte, error) {
+	if w.tmpl == nil {
+		return json.Marshal(e)
+	}
+	var buf bytes.Buffer
+	if err := w.tmpl.Execute(&buf, e); err != nil {
+		return nil, err
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, fmt.Errorf("the template did not produce valid JSON: %.200s", buf.String())
+	}
+	return buf.Bytes(), nil
+}
+
+// identify sets the agent details every later event carries.
+func (w *webhookSender) identify(a *agent, instance string) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.base.Instance = instance
+	w.base.Project = a.project
+	w.base.Service = a.service
+}
+
+// post queues event, concerning a profile of type t unless it is
+// unspecified, for delivery if it is one of the events to post.
+func (w *webhookSender) post(event string, t cloudprofiler.ProfileType, detail string) {
+	if w == nil || !w.events[event] {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stopped {
+		return
+	}
+	e := w.base
+	e.Event, e.Time, e.Detail = event, time.Now().UTC(), detail
+	if t != cloudprofiler.ProfileType_PROFILE_TYPE_UNSPECIFIED {
+		e.Type = t.String()
+	}
+	body, err := w.payload(e)
+	if err != nil {
+		logWarnf("could not format %s webhook: %s", event, err)
+		return
+	}
+	select {
+	case w.queue <- body:
+	default:
+		logWarnf("dropping %s webhook: too many deliveries pending", event)
+	}
+}
+
+// uploaded records an upload of a profile of type t, named name.
+func (w *webhookSender) uploaded(t cloudprofiler.ProfileType, name string) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	w.failures = 0
+	w.mu.Unlock()
+	w.post(webhookUploaded, t, "uploaded "+name)
+}
+
+// aborted records a cycle that failed with err, of the given kind.
+func (w *webhookSender) aborted(t cloudprofiler.ProfileType, kind string, err error) {
+	if w == nil {
+		return
+	}
+	if kind == errUpload {
+		w.post(webhookUploadFailed, t, err.Error())
+	}
+	w.mu.Lock()
+	w.failures++
+	// once per run of failures, not at every failure past the threshold
+	repeated := w.failures == w.threshold
+	n := w.failures
+	w.mu.Unlock()
+	if repeated {
+		w.post(webhookErrors, t, fmt.Sprintf("%d cycles in a row failed, the last with %s: %s", n, kind, err))
+	}
+}
+
+// stop posts a stopped event with detail, and waits for the pending
+// deliveries to be made, for up to webhookTimeout. Events posted after
+// it are dropped.
+func (w *webhookSender) stop(detail string) {
+	if w == nil {
+		return
+	}
+	w.post(webhookStopped, cloudprofiler.ProfileType_PROFILE_TYPE_UNSPECIFIED, detail)
+	w.mu.Lock()
+	if w.stopped {
+		w.mu.Unlock()
+		return
+	}
+	w.stopped = true
+	close(w.queue)
+	w.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(webhookTimeout):
+		log.Printf("gave up waiting for webhooks after %v", webhookTimeout)
+	}
+}
+
+func (w *webhookSender) loop() {
+	defer w.wg.Done()
+	for body := range w.queue {
+		for _, url := range w.urls {
+			if err := postWebhook(w.client, url, body); err != nil {
+				logWarnf("failed to post webhook: %s", err)
+			}
+		}
+	}
+}
+
+func postWebhook(client *http.Client, url string, body []byte) error {
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return nil
+}
+
+// webhookAddrs returns the addresses of the -webhook URLs.
+func webhookAddrs() []string {
+	var addrs []string
+	for _, u := range webhookURLs {
+		if addr := urlAddr(u); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,53 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	cloudprofiler "google.golang.org/genproto/googleapis/devtools/cloudprofiler/v2"
+)
+
+// Each profile is recorded and converted in a work directory of its own
+// under the agent's temporary directory, which perf runs in and every
+// file of the collection is named in, rather than in the agent's working
+// directory. Collections cannot clobber each other's files, and nothing
+// depends on the directory the agent runs from. The work directory,
+// with the recording, the symbol tree built for it and the note that
+// the profile is pending, is removed once the profile is collected; a
+// crash leaves it for the next agent to recover.
+
+// newWorkDir makes a work directory for a profile of type t.
+func (a *agent) newWorkDir(t cloudprofiler.ProfileType) (string, error) {
+	return ioutil.TempDir(a.tmpdir, strings.ToLower(t.String())+"-")
+}
+
+// inWorkDir calls collect with a new work directory for profile, and
+// removes the directory once collect returns. If collect filled the
+// filesystem, the size of what it left is noted as the room the next
+// collection needs.
+func (a *agent) inWorkDir(profile *cloudprofiler.Profile, collect func(dir string) ([]byte, error)) ([]byte, error) {
+	dir, err := a.newWorkDir(profile.ProfileType)
+	if err != nil {
+		return nil, err
+	}
+	data, err := collect(dir)
+	if diskFull(err) {
+		a.disk.need = dirSize(dir)
+	}
+	os.RemoveAll(dir)
+	return data, err
+}
+
+// dirSize returns the size of the files under dir.
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,419 @@
+package agent
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The configuration file is read with this parser of the subset of YAML
+// configuration files are written in: block mappings and sequences, flow
+// sequences and mappings on one line, plain and quoted scalars, and
+// comments. Anchors, aliases, tags, block scalars and multiple documents
+// are rejected rather than misread.
+
+type yamlKind int
+
+const (
+	yamlScalar yamlKind = iota
+	yamlSequence
+	yamlMapping
+)
+
+// A yamlNode is a scalar, a sequence of items, or a mapping of keys to
+// items. Null scalars, such as the value of a key left empty, are empty.
+type yamlNode struct {
+	kind  yamlKind
+	line  int
+	value string
+	keys  []string
+	items []*yamlNode
+}
+
+// get returns the value of key in mapping n, or nil.
+func (n *yamlNode) get(key string) *yamlNode {
+	for i, k := range n.keys {
+		if k == key {
+			return n.items[i]
+		}
+	}
+	return nil
+}
+
+func (n *yamlNode) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", n.line, fmt.Sprintf(format, args...))
+}
+
+type yamlLine struct {
+	num, indent int
+	text        string
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	i     int
+}
+
+// parseYAML parses a YAML document. It returns nil if the document is
+// empty.
+func parseYAML(data []byte) (*yamlNode, error) {
+	p := new(yamlParser)
+	for i, s := range strings.Split(string(data), "\n") {
+		l := yamlLine{num: i + 1}
+		s = strings.TrimRight(s, "\r")
+		l.text = strings.TrimLeft(s, " ")
+		l.indent = len(s) - len(l.text)
+		if strings.HasPrefix(l.text, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed in indentation", l.num)
+		}
+		l.text = strings.TrimRight(stripYAMLComment(l.text), " \t")
+		switch {
+		case l.text == "":
+			continue
+		case l.text == "---" && l.indent == 0 && len(p.lines) == 0:
+			continue
+		case (l.text == "---" || l.text == "...") && l.indent == 0:
+			return nil, fmt.Errorf("line %d: multiple documents are not supported", l.num)
+		case strings.HasPrefix(l.text, "%") && l.indent == 0:
+			return nil, fmt.Errorf("line %d: directives are not supported", l.num)
+		}
+		p.lines = append(p.lines, l)
+	}
+	if len(p.lines) == 0 {
+		return nil, nil
+	}
+	if p.lines[0].indent > 0 {
+		return nil, fmt.Errorf("line %d: unexpected indentation", p.lines[0].num)
+	}
+	n, err := p.block(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.i < len(p.lines) {
+		return nil, fmt.Errorf("line %d: unexpected %q", p.lines[p.i].num, p.lines[p.i].text)
+	}
+	return n, nil
+}
+
+// stripYAMLComment removes the comment, if any, from the end of a line.
+// A comment starts with a # at the start of the line or after white
+// space, outside quoted scalars.
+func stripYAMLComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote == '\'' && c == '\'' && i+1 < len(s) && s[i+1] == '\'':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+		case (c == '"' || c == '\'') && (i == 0 || strings.IndexByte(" \t[{,", s[i-1]) >= 0):
+			quote = c
+		case c == '#' && (i == 0 || s[i-1] == ' ' || s[i-1] == '\t'):
+			return s[:i]
+		}
+	}
+	return s
+}
+
+// block parses the sequence or mapping starting at the current line,
+// whose entries are indented by indent.
+func (p *yamlParser) block(indent int) (*yamlNode, error) {
+	if isYAMLItem(p.lines[p.i].text) {
+		return p.sequence(indent)
+	}
+	return p.mapping(indent)
+}
+
+func isYAMLItem(s string) bool {
+	return s == "-" || strings.HasPrefix(s, "- ")
+}
+
+func (p *yamlParser) sequence(indent int) (*yamlNode, error) {
+	n := &yamlNode{kind: yamlSequence, line: p.lines[p.i].num}
+	for p.i < len(p.lines) {
+		l := p.lines[p.i]
+		if l.indent < indent || (l.indent == indent && !isYAMLItem(l.text)) {
+			break
+		}
+		if l.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", l.num)
+		}
+		rest := strings.TrimLeft(l.text[1:], " ")
+		var item *yamlNode
+		var err error
+		switch {
+		case rest == "":
+			p.i++
+			item, err = p.nested(indent, l.num)
+		case isYAMLItem(rest) || isYAMLEntry(rest):
+			// a collection starting on the item's line, indented
+			// by the column it starts in
+			l.indent += len(l.text) - len(rest)
+			l.text = rest
+			p.lines[p.i] = l
+			item, err = p.block(l.indent)
+		default:
+			p.i++
+			item, err = parseYAMLValue(rest, l.num)
+		}
+		if err != nil {
+			return nil, err
+		}
+		n.items = append(n.items, item)
+	}
+	return n, nil
+}
+
+func (p *yamlParser) mapping(indent int) (*yamlNode, error) {
+	n := &yamlNode{kind: yamlMapping, line: p.lines[p.i].num}
+	for p.i < len(p.lines) {
+		l := p.lines[p.i]
+		if l.indent < indent {
+			break
+		}
+		if l.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", l.num)
+		}
+		key, rest, ok := splitYAMLEntry(l.text)
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key: value, not %q", l.num, l.text)
+		}
+		if n.get(key) != nil {
+			return nil, fmt.Errorf("line %d: duplicate key %q", l.num, key)
+		}
+		p.i++
+		var value *yamlNode
+		var err error
+		switch {
+		case rest != "":
+			value, err = parseYAMLValue(rest, l.num)
+		case p.i < len(p.lines) && p.lines[p.i].indent == indent && isYAMLItem(p.lines[p.i].text):
+			// a sequence need not be indented below its key
+			value, err = p.sequence(indent)
+		default:
+			value, err = p.nested(indent, l.num)
+		}
+		if err != nil {
+			return nil, err
+		}
+		n.keys = append(n.keys, key)
+		n.items = append(n.items, value)
+	}
+	return n, nil
+}
+
+// nested parses the block indented below the line num, which is indented
+// by indent, or returns a null scalar if there is none.
+func (p *yamlParser) nested(indent, num int) (*yamlNode, error) {
+	if p.i < len(p.lines) && p.lines[p.i].indent > indent {
+		return p.block(p.lines[p.i].indent)
+	}
+	return &yamlNode{kind: yamlScalar, line: num}, nil
+}
+
+func isYAMLEntry(s string) bool {
+	if strings.HasPrefix(s, "[") || strings.HasPrefix(s, "{") {
+		return false
+	}
+	_, _, ok := splitYAMLEntry(s)
+	return ok
+}
+
+// splitYAMLEntry splits a mapping entry into its key and the rest of the
+// line, its value if it is not in a block below.
+func splitYAMLEntry(s string) (key, rest string, ok bool) {
+	i := 0
+	if s != "" && (s[0] == '"' || s[0] == '\'') {
+		end, err := quotedYAMLEnd(s)
+		if err != nil {
+			return "", "", false
+		}
+		if key, err = unquoteYAML(s[:end]); err != nil {
+			return "", "", false
+		}
+		i = end
+		if i == len(s) || s[i] != ':' {
+			return "", "", false
+		}
+	} else {
+		for i < len(s) && !(s[i] == ':' && (i+1 == len(s) || s[i+1] == ' ')) {
+			i++
+		}
+		if i == len(s) {
+			return "", "", false
+		}
+		key = strings.TrimRight(s[:i], " ")
+	}
+	if i+1 < len(s) && s[i+1] != ' ' {
+		return "", "", false
+	}
+	return key, strings.TrimLeft(s[i+1:], " "), true
+}
+
+// quotedYAMLEnd returns the length of the quoted scalar s starts with.
+func quotedYAMLEnd(s string) (int, error) {
+	q := s[0]
+	for i := 1; i < len(s); i++ {
+		switch {
+		case q == '"' && s[i] == '\\':
+			i++
+		case q == '\'' && s[i] == '\'' && i+1 < len(s) && s[i+1] == '\'':
+			i++
+		case s[i] == q:
+			return i + 1, nil
+		}
+	}
+	return 0, fmt.Errorf("unterminated quoted scalar %s", s)
+}
+
+func unquoteYAML(s string) (string, error) {
+	if s[0] == '\'' {
+		return strings.Replace(s[1:len(s)-1], "''", "'", -1), nil
+	}
+	v, err := strconv.Unquote(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid quoted scalar %s", s)
+	}
+	return v, nil
+}
+
+// parseYAMLValue parses a value given on the line num of its key or
+// sequence item.
+func parseYAMLValue(s string, num int) (*yamlNode, error) {
+	switch s[0] {
+	case '|', '>':
+		return nil, fmt.Errorf("line %d: block scalars are not supported", num)
+	case '&', '*', '!':
+		return nil, fmt.Errorf("line %d: anchors, aliases and tags are not supported", num)
+	case '?':
+		return nil, fmt.Errorf("line %d: complex keys are not supported", num)
+	}
+	f := &yamlFlow{s: s, line: num}
+	n, err := f.value()
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %s", num, err)
+	}
+	if f.space(); f.pos < len(s) {
+		return nil, fmt.Errorf("line %d: unexpected %q after value", num, s[f.pos:])
+	}
+	return n, nil
+}
+
+// yamlFlow parses a value in flow style: a scalar, or a sequence or
+// mapping in brackets or braces.
+type yamlFlow struct {
+	s    string
+	pos  int
+	line int
+	// nesting level of brackets and braces
+	depth int
+}
+
+func (f *yamlFlow) space() {
+	for f.pos < len(f.s) && (f.s[f.pos] == ' ' || f.s[f.pos] == '\t') {
+		f.pos++
+	}
+}
+
+func (f *yamlFlow) value() (*yamlNode, error) {
+	f.space()
+	if f.pos == len(f.s) {
+		return &yamlNode{kind: yamlScalar, line: f.line}, nil
+	}
+	switch f.s[f.pos] {
+	case '[':
+		return f.collection(yamlSequence, ']')
+	case '{':
+		return f.collection(yamlMapping, '}')
+	}
+	quoted := f.s[f.pos] == '"' || f.s[f.pos] == '\''
+	v, err := f.scalar()
+	if err != nil {
+		return nil, err
+	}
+	if !quoted && (v == "~" || v == "null" || v == "Null" || v == "NULL") {
+		v = ""
+	}
+	return &yamlNode{kind: yamlScalar, line: f.line, value: v}, nil
+}
+
+func (f *yamlFlow) collection(kind yamlKind, end byte) (*yamlNode, error) {
+	n := &yamlNode{kind: kind, line: f.line}
+	f.pos++
+	f.depth++
+	for {
+		f.space()
+		if f.pos == len(f.s) {
+			return nil, fmt.Errorf("missing %c", end)
+		}
+		if f.s[f.pos] == end {
+			f.pos++
+			f.depth--
+			return n, nil
+		}
+		if kind == yamlMapping {
+			key, err := f.scalar()
+			if err != nil {
+				return nil, err
+			}
+			if f.space(); f.pos == len(f.s) || f.s[f.pos] != ':' {
+				return nil, fmt.Errorf("expected : after key %q", key)
+			}
+			f.pos++
+			if n.get(key) != nil {
+				return nil, fmt.Errorf("duplicate key %q", key)
+			}
+			n.keys = append(n.keys, key)
+		}
+		item, err := f.value()
+		if err != nil {
+			return nil, err
+		}
+		n.items = append(n.items, item)
+		f.space()
+		switch {
+		case f.pos < len(f.s) && f.s[f.pos] == ',':
+			f.pos++
+		case f.pos < len(f.s) && f.s[f.pos] == end:
+		case f.pos == len(f.s):
+			return nil, fmt.Errorf("missing %c", end)
+		default:
+			return nil, fmt.Errorf("expected , or %c", end)
+		}
+	}
+}
+
+// scalar reads a quoted scalar, or a plain one. Inside brackets and
+// braces, a plain scalar ends at a comma, bracket, brace or key
+// separator.
+func (f *yamlFlow) scalar() (string, error) {
+	s := f.s[f.pos:]
+	if s[0] == '"' || s[0] == '\'' {
+		end, err := quotedYAMLEnd(s)
+		if err != nil {
+			return "", err
+		}
+		f.pos += end
+		return unquoteYAML(s[:end])
+	}
+	if f.depth == 0 {
+		f.pos = len(f.s)
+		return strings.TrimRight(s, " \t"), nil
+	}
+	i := 0
+	for ; i < len(s); i++ {
+		c := s[i]
+		if c == ',' || c == ']' || c == '}' {
+			break
+		}
+		if c == ':' && (i+1 == len(s) || strings.IndexByte(" \t,]}", s[i+1]) >= 0) {
+			break
+		}
+	}
+	f.pos += i
+	return strings.TrimRight(s[:i], " \t"), nil
+}
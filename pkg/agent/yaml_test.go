@@ -0,0 +1,120 @@
+package agent
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// dumpYAML renders n on one line, with scalars quoted, so that tests can
+// compare documents as strings.
+func dumpYAML(n *yamlNode) string {
+	if n == nil {
+		return "<nil>"
+	}
+	var b strings.Builder
+	switch n.kind {
+	case yamlScalar:
+		b.WriteString(strconv.Quote(n.value))
+	case yamlSequence:
+		b.WriteString("[")
+		for i, item := range n.items {
+			if i > 0 {
+				b.WriteString(" ")
+			}
+			b.WriteString(dumpYAML(item))
+		}
+		b.WriteString("]")
+	case yamlMapping:
+		b.WriteString("{")
+		for i, key := range n.keys {
+			if i > 0 {
+				b.WriteString(" ")
+			}
+			b.WriteString(key + ":" + dumpYAML(n.items[i]))
+		}
+		b.WriteString("}")
+	}
+	return b.String()
+}
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		name, doc, want string
+	}{
+		{"empty", "", "<nil>"},
+		{"only comments", "# nothing\n\n  # here\n", "<nil>"},
+		{"document start", "---\na: 1\n", `{a:"1"}`},
+		{"plain scalars", "a: 1\nb: two words\nc: http://host:80/x\n", `{a:"1" b:"two words" c:"http://host:80/x"}`},
+		{"null values", "a:\nb: ~\nc: null\nd: 'null'\n", `{a:"" b:"" c:"" d:"null"}`},
+
+		{"double quoted", `a: "x: y # z"`, `{a:"x: y # z"}`},
+		{"double quoted escapes", `a: "tab\there \"q\" \u00e9"`, `{a:"tab\there \"q\" é"}`},
+		{"single quoted", `a: 'it''s # not a comment'`, `{a:"it's # not a comment"}`},
+		{"quoted key", `"a b": 1` + "\n'c:d': 2\n", `{a b:"1" c:d:"2"}`},
+
+		{"comment after value", "a: 1 # one\nb: x#y\n", `{a:"1" b:"x#y"}`},
+		{"comment lines between entries", "a: 1\n# b: 2\nc: 3\n", `{a:"1" c:"3"}`},
+
+		{"nested mappings", "a:\n  b:\n    c: 1\n  d: 2\ne: 3\n", `{a:{b:{c:"1"} d:"2"} e:"3"}`},
+		{"sequence under key", "a:\n  - x\n  - y\n", `{a:["x" "y"]}`},
+		{"sequence not indented", "a:\n- x\n- y\nb: 1\n", `{a:["x" "y"] b:"1"}`},
+		{"sequence of mappings", "a:\n  - name: x\n    n: 1\n  - name: y\n", `{a:[{name:"x" n:"1"} {name:"y"}]}`},
+		{"nested sequences", "- - a\n  - b\n- c\n", `[["a" "b"] "c"]`},
+		{"empty item", "a:\n  -\n  - x\n", `{a:["" "x"]}`},
+		{"item with block below", "-\n  a: 1\n", `[{a:"1"}]`},
+
+		{"flow sequence", "a: [x, 'y, z', \"w\"]\n", `{a:["x" "y, z" "w"]}`},
+		{"flow mapping", "a: {b: 1, c: [2, 3], d: {e: f}}\n", `{a:{b:"1" c:["2" "3"] d:{e:"f"}}}`},
+		{"empty flow collections", "a: []\nb: {}\n", `{a:[] b:{}}`},
+		{"flow url", "a: [http://x:1/y]\n", `{a:["http://x:1/y"]}`},
+	}
+	for _, test := range tests {
+		n, err := parseYAML([]byte(test.doc))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got := dumpYAML(n); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	tests := []struct {
+		name, doc, want string
+	}{
+		{"tab indentation", "a:\n\tb: 1\n", "line 2: tabs are not allowed"},
+		{"indented first line", "  a: 1\n", "line 1: unexpected indentation"},
+		{"over-indented entry", "a: 1\n  b: 2\n", "line 2: unexpected indentation"},
+		{"not a mapping entry", "a: 1\nb\n", `line 2: expected key: value, not "b"`},
+		{"duplicate key", "a: 1\nb: 2\na: 3\n", `line 3: duplicate key "a"`},
+		{"duplicate flow key", "x: {a: 1, a: 2}\n", `line 1: duplicate key "a"`},
+		{"unterminated double quote", "a: 1\nb: \"x\n", "line 2: unterminated quoted scalar"},
+		{"unterminated flow sequence", "a: [x, y\n", "line 1: missing ]"},
+		{"junk after flow", "a: [x] y\n", `line 1: unexpected "y" after value`},
+		{"junk after quote", "a: 'x' y\n", `line 1: unexpected "y" after value`},
+		{"bad escape", `a: "\q"`, "line 1: invalid quoted scalar"},
+		{"block scalar", "a: 1\nb: |\n  text\n", "line 2: block scalars are not supported"},
+		{"anchor", "a: &x 1\n", "line 1: anchors, aliases and tags are not supported"},
+		{"alias", "a: 1\nb: *x\n", "line 2: anchors, aliases and tags are not supported"},
+		{"tag", "a: !!str 1\n", "line 1: anchors, aliases and tags are not supported"},
+		{"complex key", "a: ? x\n", "line 1: complex keys are not supported"},
+		{"second document", "a: 1\n---\nb: 2\n", "line 2: multiple documents are not supported"},
+		{"document end", "a: 1\n...\n", "line 2: multiple documents are not supported"},
+		{"directive", "%YAML 1.2\na: 1\n", "line 1: directives are not supported"},
+		{"item in mapping", "a: 1\n- x\n", `line 2: expected key: value, not "- x"`},
+		{"entry after sequence", "- x\nb: 1\n", `line 2: unexpected "b: 1"`},
+	}
+	for _, test := range tests {
+		n, err := parseYAML([]byte(test.doc))
+		if err == nil {
+			t.Errorf("%s: parsed as %s, want error %q", test.name, dumpYAML(n), test.want)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), test.want) {
+			t.Errorf("%s: got error %q, want %q", test.name, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,805 @@
+package perf
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	pprof "github.com/google/pprof/profile"
+
+	"github.com/droyo/cloud-profiler-perf/pkg/symbolize"
+)
+
+// Debugf and Warnf log the progress of a conversion, and what went wrong
+// in it, with the standard logger unless a program sets them to its own.
+// Nothing is logged with Debugf by default.
+var (
+	Debugf = func(format string, v ...interface{}) {}
+	Warnf  = log.Printf
+)
+
+// ToPprof converts the perf.data file src to the pprof file dst. The
+// binaries are looked up in the symbol tree symbols, or the profile is
+// left with addresses only if symbols is empty.
+func ToPprof(dst, src, symbols string) error {
+	Debugf("converting %s to pprof format", src)
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	c := newConverter(symbols)
+	if err := c.read(f); err != nil {
+		return fmt.Errorf("could not convert %s: %s", src, err)
+	}
+	if info, err := f.Stat(); err == nil {
+		c.p.TimeNanos = info.ModTime().UnixNano() - c.p.DurationNanos
+	}
+	if err := c.p.CheckValid(); err != nil {
+		return fmt.Errorf("converted %s to an invalid profile: %s", src, err)
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if err := c.p.Write(out); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Record types of the data section.
+const (
+	RecordMmap   = 1
+	RecordComm   = 3
+	RecordFork   = 7
+	RecordSample = 9
+	RecordMmap2  = 10
+)
+
+// Bits of perf_event_attr.sample_type, in the order their fields appear
+// in a sample.
+const (
+	SampleIP = 1 << iota
+	SampleTID
+	SampleTime
+	SampleAddr
+	SampleRead
+	SampleCallchain
+	SampleID
+	SampleCPU
+	SamplePeriod
+	SampleStreamID
+	SampleIdentifier = 1 << 16
+)
+
+// Bits of perf_event_attr.read_format.
+const (
+	readTimeEnabled = 1 << iota
+	readTimeRunning
+	readID
+	readGroup
+	readLost
+)
+
+// Bits of perf_event_header.misc.
+const (
+	MiscCPUMode     = 7
+	MiscKernel      = 1
+	MiscUser        = 2
+	MiscCommExec    = 1 << 13
+	MiscMmapBuildID = 1 << 14
+	MiscBuildIDSize = 1 << 15
+)
+
+// AttrFreq is the freq bit of perf_event_attr's flags: the sample period
+// is a frequency.
+const AttrFreq = 1 << 10
+
+// Callchains are split into kernel and user parts by these markers,
+// which are the negative numbers -32, -128 and so on. Anything above
+// ContextMax is a marker rather than an address.
+const (
+	ContextHV          = ^uint64(31)
+	ContextKernel      = ^uint64(127)
+	ContextUser        = ^uint64(511)
+	ContextGuestKernel = ^uint64(2175)
+	ContextGuestUser   = ^uint64(2559)
+	ContextMax         = ^uint64(4094)
+)
+
+// Feature sections following the data section.
+const (
+	FeatureBuildID   = 2
+	FeatureEventDesc = 12
+)
+
+// KernelPID is the pid of the kernel's mmap records.
+const KernelPID = ^uint32(0)
+
+// A perfAttr is the part of a perf_event_attr the converter uses.
+type perfAttr struct {
+	typ        uint32
+	config     uint64
+	period     uint64
+	sampleType uint64
+	readFormat uint64
+	flags      uint64
+	name       string
+	// index of the attr's value in each sample
+	value int
+}
+
+// A perfMap is a mapping of a binary into a process, and the profile's
+// mapping of it, once it has one.
+type perfMap struct {
+	symbolize.Mapping
+	mapping *pprof.Mapping
+}
+
+// A converter builds a profile from the records of a perf.data file.
+type converter struct {
+	p     *pprof.Profile
+	sym   *symbolize.Symbolizer
+	attrs []*perfAttr
+	byID  map[uint64]*perfAttr
+	// build IDs, by file name
+	buildIDs map[string]string
+	// the maps of each process, sorted by start address; the kernel
+	// and its modules are under KernelPID
+	maps map[uint32][]*perfMap
+
+	mappings  map[symbolize.Mapping]*pprof.Mapping
+	locations map[locationKey]*pprof.Location
+	functions map[[2]string]*pprof.Function
+	samples   map[string]*pprof.Sample
+
+	first, last uint64
+}
+
+type locationKey struct {
+	m    *pprof.Mapping
+	addr uint64
+}
+
+func newConverter(symbols string) *converter {
+	c := &converter{
+		p:         new(pprof.Profile),
+		byID:      make(map[uint64]*perfAttr),
+		buildIDs:  make(map[string]string),
+		maps:      make(map[uint32][]*perfMap),
+		mappings:  make(map[symbolize.Mapping]*pprof.Mapping),
+		locations: make(map[locationKey]*pprof.Location),
+		functions: make(map[[2]string]*pprof.Function),
+		samples:   make(map[string]*pprof.Sample),
+	}
+	if symbols != "" {
+		c.sym = symbolize.New(symbols)
+	}
+	return c
+}
+
+func (c *converter) read(r io.ReaderAt) error {
+	hdr, err := readPerfHeader(r)
+	if err != nil {
+		return err
+	}
+	if err := c.readAttrs(r, hdr); err != nil {
+		return err
+	}
+	// a file salvaged after a crash has no feature sections, and its
+	// binaries go unsymbolized unless its mmaps carry build IDs
+	if err := c.readFeatures(r, hdr); err != nil {
+		Warnf("could not read perf.data feature sections: %s", err)
+	}
+
+	c.p.SampleType = []*pprof.ValueType{{Type: "samples", Unit: "count"}}
+	for i, attr := range c.attrs {
+		attr.value = i + 1
+		c.p.SampleType = append(c.p.SampleType, &pprof.ValueType{Type: attr.name, Unit: "count"})
+	}
+	if a := c.attrs[0]; a.flags&AttrFreq == 0 {
+		c.p.PeriodType = &pprof.ValueType{Type: a.name, Unit: "count"}
+		c.p.Period = int64(a.period)
+	}
+
+	data := bufio.NewReaderSize(io.NewSectionReader(r, int64(hdr.Data.Offset), int64(hdr.Data.Size)), 1<<16)
+	buf := make([]byte, 1<<16)
+	for pos := hdr.Data.Offset; pos < hdr.Data.Offset+hdr.Data.Size; {
+		if _, err := io.ReadFull(data, buf[:EventHeaderSize]); err != nil {
+			return fmt.Errorf("truncated record at offset %d", pos)
+		}
+		h := EventHeader{
+			Type: binary.LittleEndian.Uint32(buf[0:]),
+			Misc: binary.LittleEndian.Uint16(buf[4:]),
+			Size: binary.LittleEndian.Uint16(buf[6:]),
+		}
+		if h.Size < EventHeaderSize || !validRecordType(h.Type) {
+			return fmt.Errorf("malformed record at offset %d", pos)
+		}
+		body := buf[:h.Size-EventHeaderSize]
+		if _, err := io.ReadFull(data, body); err != nil {
+			return fmt.Errorf("truncated record at offset %d", pos)
+		}
+		c.record(h, body)
+		pos += uint64(h.Size)
+	}
+	if c.last > c.first {
+		c.p.DurationNanos = int64(c.last - c.first)
+	}
+	return nil
+}
+
+func (c *converter) readAttrs(r io.ReaderAt, hdr *FileHeader) error {
+	// each entry is a perf_event_attr followed by the file section
+	// holding the IDs of its events
+	const idsSize = 16
+	if hdr.AttrSize < idsSize+48 || hdr.Attrs.Size%hdr.AttrSize != 0 || hdr.Attrs.Size == 0 {
+		return fmt.Errorf("malformed attr section of %d bytes", hdr.Attrs.Size)
+	}
+	buf := make([]byte, hdr.Attrs.Size)
+	if _, err := r.ReadAt(buf, int64(hdr.Attrs.Offset)); err != nil {
+		return fmt.Errorf("could not read attr section: %s", err)
+	}
+	for entry := buf; len(entry) > 0; entry = entry[hdr.AttrSize:] {
+		attr := &perfAttr{
+			typ:        le32(entry[0:]),
+			config:     le64(entry[8:]),
+			period:     le64(entry[16:]),
+			sampleType: le64(entry[24:]),
+			readFormat: le64(entry[32:]),
+			flags:      le64(entry[40:]),
+		}
+		attr.name = perfEventName(attr.typ, attr.config)
+		c.attrs = append(c.attrs, attr)
+
+		ids := entry[hdr.AttrSize-idsSize:]
+		idbuf := make([]byte, le64(ids[8:]))
+		if _, err := r.ReadAt(idbuf, int64(le64(ids[0:]))); err != nil {
+			return fmt.Errorf("could not read event IDs: %s", err)
+		}
+		for ; len(idbuf) >= 8; idbuf = idbuf[8:] {
+			c.byID[le64(idbuf)] = attr
+		}
+	}
+	return nil
+}
+
+// Names of the generic hardware (type 0) and software (type 1) events.
+var (
+	hardwareEvents = []string{"cycles", "instructions", "cache-references", "cache-misses",
+		"branch-instructions", "branch-misses", "bus-cycles", "stalled-cycles-frontend",
+		"stalled-cycles-backend", "ref-cycles"}
+	softwareEvents = []string{"cpu-clock", "task-clock", "page-faults", "context-switches",
+		"cpu-migrations", "minor-faults", "major-faults", "alignment-faults",
+		"emulation-faults", "dummy", "bpf-output"}
+)
+
+// perfEventName names the event of the given type and config, when the
+// file does not.
+func perfEventName(typ uint32, config uint64) string {
+	switch {
+	case typ == 0 && config < uint64(len(hardwareEvents)):
+		return hardwareEvents[config]
+	case typ == 1 && config < uint64(len(softwareEvents)):
+		return softwareEvents[config]
+	case typ == 2:
+		return "tracepoint"
+	}
+	return fmt.Sprintf("event-%d-%#x", typ, config)
+}
+
+// readFeatures reads the build IDs and event names from the feature
+// sections.
+func (c *converter) readFeatures(r io.ReaderAt, hdr *FileHeader) error {
+	return readFeatureSections(r, hdr, func(bit int, buf []byte) {
+		switch bit {
+		case FeatureBuildID:
+			c.readBuildIDs(buf)
+		case FeatureEventDesc:
+			c.readEventDesc(buf)
+		}
+	}, FeatureBuildID, FeatureEventDesc)
+}
+
+// readFeatureSections calls fn with each of the feature sections bits
+// that the file has.
+func readFeatureSections(r io.ReaderAt, hdr *FileHeader, fn func(bit int, buf []byte), bits ...int) error {
+	pos := int64(hdr.Data.Offset + hdr.Data.Size)
+	for bit := 0; bit < 256; bit++ {
+		if hdr.Features[bit/64]&(1<<uint(bit%64)) == 0 {
+			continue
+		}
+		var sec FileSection
+		if err := binary.Read(io.NewSectionReader(r, pos, 16), binary.LittleEndian, &sec); err != nil {
+			return err
+		}
+		pos += 16
+		wanted := false
+		for _, b := range bits {
+			wanted = wanted || b == bit
+		}
+		if !wanted {
+			continue
+		}
+		buf := make([]byte, sec.Size)
+		if _, err := r.ReadAt(buf, int64(sec.Offset)); err != nil {
+			return err
+		}
+		fn(bit, buf)
+	}
+	return nil
+}
+
+func (c *converter) readBuildIDs(buf []byte) {
+	for _, b := range parseBuildIDs(buf) {
+		c.buildIDs[b[1]] = b[0]
+	}
+}
+
+// parseBuildIDs returns the build IDs and file names of the build ID
+// feature section buf.
+func parseBuildIDs(buf []byte) [][2]string {
+	var ids [][2]string
+	// perf_event_header, pid, a 24 byte build ID and the file name
+	for len(buf) >= 36 {
+		misc := binary.LittleEndian.Uint16(buf[4:])
+		size := int(binary.LittleEndian.Uint16(buf[6:]))
+		if size < 36 || size > len(buf) {
+			break
+		}
+		id := buf[12:32]
+		if misc&MiscBuildIDSize != 0 && int(buf[32]) <= len(id) {
+			id = id[:buf[32]]
+		}
+		ids = append(ids, [2]string{hex.EncodeToString(id), cString(buf[36:size])})
+		buf = buf[size:]
+	}
+	return ids
+}
+
+// BuildIDs lists the build IDs of the binaries in the perf.data file
+// path, one "<build id> <file>" line each, as perf buildid-list does. A
+// recording without the build ID section, such as one made with
+// --buildid-mmap, is read through for the build IDs of its mmaps.
+func BuildIDs(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	hdr, err := readPerfHeader(f)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[[2]string]bool)
+	var ids []string
+	add := func(id, file string) {
+		if key := [2]string{id, file}; id != "" && !seen[key] {
+			seen[key] = true
+			ids = append(ids, id+" "+file)
+		}
+	}
+	err = readFeatureSections(f, hdr, func(bit int, buf []byte) {
+		for _, b := range parseBuildIDs(buf) {
+			add(b[0], b[1])
+		}
+	}, FeatureBuildID)
+	if err != nil {
+		return nil, fmt.Errorf("could not read build IDs of %s: %s", path, err)
+	}
+	if len(ids) == 0 {
+		c := newConverter("")
+		if err := c.read(f); err != nil {
+			return nil, fmt.Errorf("could not read build IDs of %s: %s", path, err)
+		}
+		for _, maps := range c.maps {
+			for _, m := range maps {
+				add(m.BuildID, m.File)
+			}
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// Mappings returns the mappings of the processes recorded in the
+// perf.data file r, by pid, as they were when the recording ended. The
+// kernel's are under KernelPID.
+func Mappings(r io.ReaderAt) (map[uint32][]symbolize.Mapping, error) {
+	c := newConverter("")
+	if err := c.read(r); err != nil {
+		return nil, err
+	}
+	maps := make(map[uint32][]symbolize.Mapping, len(c.maps))
+	for pid, pm := range c.maps {
+		ms := make([]symbolize.Mapping, len(pm))
+		for i, m := range pm {
+			ms[i] = m.Mapping
+		}
+		maps[pid] = ms
+	}
+	return maps, nil
+}
+
+func (c *converter) readEventDesc(buf []byte) {
+	if len(buf) < 8 {
+		return
+	}
+	nr, attrSize := le32(buf), int(le32(buf[4:]))
+	buf = buf[8:]
+	for i := uint32(0); i < nr && len(buf) >= attrSize+8; i++ {
+		buf = buf[attrSize:]
+		nids, n := le32(buf), int(le32(buf[4:]))
+		buf = buf[8:]
+		if len(buf) < n+int(nids)*8 {
+			return
+		}
+		name := cString(buf[:n])
+		buf = buf[n:]
+		if name != "" && nr == 1 && len(c.attrs) == 1 {
+			// there may be no IDs to match it by
+			c.attrs[0].name = name
+		}
+		for j := uint32(0); j < nids; j++ {
+			if attr := c.byID[le64(buf)]; attr != nil && name != "" {
+				attr.name = name
+			}
+			buf = buf[8:]
+		}
+	}
+}
+
+func (c *converter) record(h EventHeader, body []byte) {
+	switch h.Type {
+	case RecordMmap, RecordMmap2:
+		if len(body) < 32 {
+			return
+		}
+		m := &perfMap{Mapping: symbolize.Mapping{
+			Start:  le64(body[8:]),
+			Offset: le64(body[24:]),
+		}}
+		m.Limit = m.Start + le64(body[16:])
+		name := body[32:]
+		if h.Type == RecordMmap2 {
+			if len(body) < 64 {
+				return
+			}
+			if h.Misc&MiscMmapBuildID != 0 && int(body[32]) <= 20 {
+				m.BuildID = hex.EncodeToString(body[36 : 36+body[32]])
+			}
+			name = body[64:]
+		}
+		m.File = cString(name)
+		if m.File == "[kernel.kallsyms]_text" || m.File == "[kernel.kallsyms]_stext" {
+			m.File = "[kernel.kallsyms]"
+		}
+		if m.BuildID == "" {
+			m.BuildID = c.buildIDs[m.File]
+		}
+		pid := le32(body)
+		c.maps[pid] = addPerfMap(c.maps[pid], m)
+	case RecordComm:
+		if h.Misc&MiscCommExec != 0 && len(body) >= 4 {
+			// the process image is replaced
+			delete(c.maps, le32(body))
+		}
+	case RecordFork:
+		if len(body) < 8 {
+			return
+		}
+		if pid, ppid := le32(body), le32(body[4:]); pid != ppid {
+			c.maps[pid] = c.maps[ppid]
+		}
+	case RecordSample:
+		c.sample(h, body)
+	}
+}
+
+// addPerfMap inserts m into maps, where it replaces whatever it overlaps.
+func addPerfMap(maps []*perfMap, m *perfMap) []*perfMap {
+	if m.Limit <= m.Start {
+		return maps
+	}
+	out := make([]*perfMap, 0, len(maps)+2)
+	for _, old := range maps {
+		if old.Limit <= m.Start || old.Start >= m.Limit {
+			out = append(out, old)
+			continue
+		}
+		if old.Start < m.Start {
+			head := *old
+			head.Limit, head.mapping = m.Start, nil
+			out = append(out, &head)
+		}
+		if old.Limit > m.Limit {
+			tail := *old
+			tail.Offset += m.Limit - old.Start
+			tail.Start, tail.mapping = m.Limit, nil
+			out = append(out, &tail)
+		}
+	}
+	out = append(out, m)
+	sort.Slice(out, func(i, j int) bool { return out[i].Start < out[j].Start })
+	return out
+}
+
+func findPerfMap(maps []*perfMap, addr uint64) *perfMap {
+	i := sort.Search(len(maps), func(i int) bool { return maps[i].Limit > addr })
+	if i < len(maps) && maps[i].Start <= addr {
+		return maps[i]
+	}
+	return nil
+}
+
+func (c *converter) sample(h EventHeader, body []byte) {
+	attr := c.attrs[0]
+	if len(c.attrs) > 1 {
+		var id uint64
+		switch {
+		case attr.sampleType&SampleIdentifier != 0 && len(body) >= 8:
+			id = le64(body)
+		case attr.sampleType&SampleID != 0:
+			// ID follows IP, TID, TIME and ADDR
+			off := 0
+			for _, bit := range []uint64{SampleIP, SampleTID, SampleTime, SampleAddr} {
+				if attr.sampleType&bit != 0 {
+					off += 8
+				}
+			}
+			if len(body) >= off+8 {
+				id = le64(body[off:])
+			}
+		}
+		if a := c.byID[id]; a != nil {
+			attr = a
+		}
+	}
+
+	var ip, t, period uint64
+	var pid uint32
+	var callchain []uint64
+	st := attr.sampleType
+	next := func() uint64 {
+		if len(body) < 8 {
+			body = nil
+			return 0
+		}
+		v := le64(body)
+		body = body[8:]
+		return v
+	}
+	if st&SampleIdentifier != 0 {
+		next()
+	}
+	if st&SampleIP != 0 {
+		ip = next()
+	}
+	if st&SampleTID != 0 {
+		pid = uint32(next())
+	}
+	if st&SampleTime != 0 {
+		t = next()
+	}
+	for _, bit := range []uint64{SampleAddr, SampleID, SampleStreamID, SampleCPU} {
+		if st&bit != 0 {
+			next()
+		}
+	}
+	period = 1
+	if st&SamplePeriod != 0 {
+		period = next()
+	} else if attr.flags&AttrFreq == 0 && attr.period > 0 {
+		period = attr.period
+	}
+	if st&SampleRead != 0 {
+		skipReadValues(attr.readFormat, next)
+	}
+	if st&SampleCallchain != 0 {
+		n := next()
+		if n > uint64(len(body)/8) {
+			return
+		}
+		callchain = make([]uint64, n)
+		for i := range callchain {
+			callchain[i] = next()
+		}
+	}
+	if body == nil {
+		// the record is shorter than its fields
+		return
+	}
+
+	if t != 0 {
+		if c.first == 0 || t < c.first {
+			c.first = t
+		}
+		if t > c.last {
+			c.last = t
+		}
+	}
+	kernel := h.Misc&MiscCPUMode == MiscKernel
+	if len(callchain) == 0 {
+		callchain = []uint64{ip}
+	}
+	stack := make([]*pprof.Location, 0, len(callchain))
+	// the first address after each marker is where the CPU was, the
+	// others return addresses
+	exact := true
+	for _, addr := range callchain {
+		if addr >= ContextMax {
+			switch addr {
+			case ContextKernel, ContextGuestKernel, ContextHV:
+				kernel = true
+			case ContextUser, ContextGuestUser:
+				kernel = false
+			}
+			exact = true
+			continue
+		}
+		if !exact && addr > 0 {
+			// look up the call instruction
+			addr--
+		}
+		exact = false
+		stack = append(stack, c.location(pid, addr, kernel))
+	}
+	c.addSample(stack, pid, attr, period)
+}
+
+// skipReadValues skips the counter values of a sample with a READ
+// field in read format.
+func skipReadValues(format uint64, next func() uint64) {
+	n := uint64(1)
+	if format&readGroup != 0 {
+		n = next()
+	}
+	if format&readTimeEnabled != 0 {
+		next()
+	}
+	if format&readTimeRunning != 0 {
+		next()
+	}
+	for i := uint64(0); i < n && i < 1<<12; i++ {
+		next()
+		if format&readID != 0 {
+			next()
+		}
+		if format&readLost != 0 {
+			next()
+		}
+	}
+}
+
+func (c *converter) addSample(stack []*pprof.Location, pid uint32, attr *perfAttr, period uint64) {
+	var key strings.Builder
+	fmt.Fprint(&key, pid)
+	for _, loc := range stack {
+		fmt.Fprintf(&key, " %d", loc.ID)
+	}
+	s, ok := c.samples[key.String()]
+	if !ok {
+		s = &pprof.Sample{
+			Location: stack,
+			Value:    make([]int64, len(c.p.SampleType)),
+			NumLabel: map[string][]int64{"pid": {int64(pid)}},
+		}
+		c.samples[key.String()] = s
+		c.p.Sample = append(c.p.Sample, s)
+	}
+	s.Value[0]++
+	s.Value[attr.value] += int64(period)
+}
+
+// location returns the location of addr in the kernel, or in the address
+// space of process pid.
+func (c *converter) location(pid uint32, addr uint64, kernel bool) *pprof.Location {
+	if kernel {
+		pid = KernelPID
+	}
+	m := findPerfMap(c.maps[pid], addr)
+	key := locationKey{addr: addr}
+	if m != nil {
+		key.m = c.mapping(m)
+	}
+	if loc, ok := c.locations[key]; ok {
+		return loc
+	}
+	loc := &pprof.Location{ID: uint64(len(c.p.Location) + 1), Mapping: key.m, Address: addr}
+	c.locations[key] = loc
+	c.p.Location = append(c.p.Location, loc)
+	if c.sym == nil {
+		return loc
+	}
+	var frames []symbolize.Frame
+	var ok bool
+	var sm *symbolize.Mapping
+	if m != nil {
+		sm = &m.Mapping
+	}
+	if kernel {
+		frames, ok = c.sym.Kernel(sm, addr)
+	} else {
+		frames, ok = c.sym.User(pid, sm, addr)
+	}
+	if !ok {
+		return loc
+	}
+	for _, frame := range frames {
+		loc.Line = append(loc.Line, pprof.Line{Function: c.function(frame), Line: int64(frame.Line)})
+		if key.m != nil {
+			key.m.HasFunctions = true
+			if frame.Line > 0 {
+				key.m.HasFilenames = true
+				key.m.HasLineNumbers = true
+			}
+		}
+	}
+	if len(frames) > 1 && key.m != nil {
+		key.m.HasInlineFrames = true
+	}
+	return loc
+}
+
+// function returns the profile's function of frame. Its name is
+// demangled, and its system name the one the binary has.
+func (c *converter) function(frame symbolize.Frame) *pprof.Function {
+	key := [2]string{frame.Function, frame.File}
+	fn, ok := c.functions[key]
+	if !ok {
+		fn = &pprof.Function{
+			ID:         uint64(len(c.p.Function) + 1),
+			Name:       symbolize.Demangle(frame.Function),
+			SystemName: frame.Function,
+			Filename:   frame.File,
+			StartLine:  int64(frame.StartLine),
+		}
+		c.functions[key] = fn
+		c.p.Function = append(c.p.Function, fn)
+	}
+	return fn
+}
+
+// mapping returns the profile's mapping for m, shared by every process
+// that maps the same part of a binary at the same address.
+func (c *converter) mapping(m *perfMap) *pprof.Mapping {
+	if m.mapping != nil {
+		return m.mapping
+	}
+	pm, ok := c.mappings[m.Mapping]
+	if !ok {
+		pm = &pprof.Mapping{
+			ID:      uint64(len(c.p.Mapping) + 1),
+			Start:   m.Start,
+			Limit:   m.Limit,
+			Offset:  m.Offset,
+			File:    m.File,
+			BuildID: m.BuildID,
+		}
+		c.mappings[m.Mapping] = pm
+		c.p.Mapping = append(c.p.Mapping, pm)
+	}
+	m.mapping = pm
+	return pm
+}
+
+func le32(b []byte) uint32 { return binary.LittleEndian.Uint32(b) }
+func le64(b []byte) uint64 { return binary.LittleEndian.Uint64(b) }
+
+// cString returns the NUL-terminated string at the start of b.
+func cString(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
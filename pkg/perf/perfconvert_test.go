@@ -0,0 +1,492 @@
+package perf
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	pprof "github.com/google/pprof/profile"
+
+	"github.com/droyo/cloud-profiler-perf/pkg/symbolize"
+)
+
+// A testAttr is an event of a test recording, and the IDs of its
+// events.
+type testAttr struct {
+	config, period, sampleType, flags uint64
+	ids                               []uint64
+}
+
+// The sample_id_all bit of perf_event_attr's flags: every record ends
+// with the sample's ID fields.
+const attrSampleIDAll = 1 << 18
+
+// perfFile is the perf.data file of a recording of attrs, with the
+// given data records and build ID feature section, if any.
+func perfFile(attrs []testAttr, records [][]byte, buildIDs []byte) []byte {
+	const attrSize = 128
+	var hdr FileHeader
+	copy(hdr.Magic[:], Magic)
+	hdr.Size = uint64(binary.Size(hdr))
+	hdr.AttrSize = attrSize
+	hdr.Attrs = FileSection{Offset: hdr.Size, Size: uint64(len(attrs) * attrSize)}
+
+	var ids bytes.Buffer
+	idsAt := hdr.Attrs.Offset + hdr.Attrs.Size
+	attrBuf := make([]byte, hdr.Attrs.Size)
+	for i, a := range attrs {
+		entry := attrBuf[i*attrSize:]
+		binary.LittleEndian.PutUint32(entry[0:], 0)
+		binary.LittleEndian.PutUint32(entry[4:], attrSize-16)
+		binary.LittleEndian.PutUint64(entry[8:], a.config)
+		binary.LittleEndian.PutUint64(entry[16:], a.period)
+		binary.LittleEndian.PutUint64(entry[24:], a.sampleType)
+		binary.LittleEndian.PutUint64(entry[40:], a.flags)
+		binary.LittleEndian.PutUint64(entry[attrSize-16:], idsAt+uint64(ids.Len()))
+		binary.LittleEndian.PutUint64(entry[attrSize-8:], uint64(8*len(a.ids)))
+		for _, id := range a.ids {
+			binary.Write(&ids, binary.LittleEndian, id)
+		}
+	}
+	data := bytes.Join(records, nil)
+	hdr.Data = FileSection{Offset: idsAt + uint64(ids.Len()), Size: uint64(len(data))}
+
+	var features bytes.Buffer
+	if buildIDs != nil {
+		hdr.Features[0] = 1 << FeatureBuildID
+		table := FileSection{Offset: hdr.Data.Offset + hdr.Data.Size + 16, Size: uint64(len(buildIDs))}
+		binary.Write(&features, binary.LittleEndian, table)
+		features.Write(buildIDs)
+	}
+
+	var f bytes.Buffer
+	binary.Write(&f, binary.LittleEndian, hdr)
+	f.Write(attrBuf)
+	f.Write(ids.Bytes())
+	f.Write(data)
+	f.Write(features.Bytes())
+	return f.Bytes()
+}
+
+// perfRecord returns a record of type typ with the given body, padded to
+// a multiple of 8 bytes.
+func perfRecord(typ uint32, misc uint16, body []byte) []byte {
+	body = append(body, make([]byte, -len(body)&7)...)
+	rec := make([]byte, EventHeaderSize, EventHeaderSize+len(body))
+	binary.LittleEndian.PutUint32(rec[0:], typ)
+	binary.LittleEndian.PutUint16(rec[4:], misc)
+	binary.LittleEndian.PutUint16(rec[6:], uint16(EventHeaderSize+len(body)))
+	return append(rec, body...)
+}
+
+// words encodes values as a record body, or part of one.
+func words(values ...uint64) []byte {
+	b := make([]byte, 8*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint64(b[8*i:], v)
+	}
+	return b
+}
+
+// pidTID encodes a pid and tid as the one field they share.
+func pidTID(pid, tid uint32) uint64 {
+	return uint64(tid)<<32 | uint64(pid)
+}
+
+func mmapRecord(pid uint32, start, length, pgoff uint64, file string) []byte {
+	body := append(words(pidTID(pid, pid), start, length, pgoff), file...)
+	return perfRecord(RecordMmap, MiscUser, append(body, 0))
+}
+
+// mmap2Record returns an MMAP2 record, which carries the build ID of the
+// file if id is not nil. Any trailer follows the file name.
+func mmap2Record(pid uint32, start, length, pgoff uint64, id []byte, file string, trailer []byte) []byte {
+	body := words(pidTID(pid, pid), start, length, pgoff, 0, 0, 0, 0)
+	misc := uint16(MiscUser)
+	if id != nil {
+		misc |= MiscMmapBuildID
+		body[32] = byte(len(id))
+		copy(body[36:56], id)
+	}
+	body = append(append(body, file...), 0)
+	body = append(body, make([]byte, -len(body)&7)...)
+	return perfRecord(RecordMmap2, misc, append(body, trailer...))
+}
+
+func commRecord(pid uint32, comm string, exec bool, trailer []byte) []byte {
+	var misc uint16
+	if exec {
+		misc = MiscCommExec
+	}
+	body := append(append(words(pidTID(pid, pid)), comm...), 0)
+	body = append(body, make([]byte, -len(body)&7)...)
+	return perfRecord(RecordComm, misc, append(body, trailer...))
+}
+
+func forkRecord(pid, ppid uint32, trailer []byte) []byte {
+	body := append(words(pidTID(pid, ppid), pidTID(pid, ppid), 0), trailer...)
+	return perfRecord(RecordFork, 0, body)
+}
+
+func sampleRecord(misc uint16, fields ...uint64) []byte {
+	return perfRecord(RecordSample, misc, words(fields...))
+}
+
+// buildIDEntry returns an entry of the build ID feature section.
+func buildIDEntry(id []byte, file string) []byte {
+	body := make([]byte, 28)
+	binary.LittleEndian.PutUint32(body[0:], ^uint32(0))
+	copy(body[4:24], id)
+	body[24] = byte(len(id))
+	body = append(append(body, file...), 0)
+	return perfRecord(0, MiscBuildIDSize, body)
+}
+
+// testBuildID returns a 20 byte build ID made of b.
+func testBuildID(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 20)
+}
+
+// convertPerfFile converts the recording data to a profile, symbolized
+// with the symbol tree symbols, if it is not empty.
+func convertPerfFile(t *testing.T, data []byte, symbols string) *pprof.Profile {
+	t.Helper()
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "perf.data"), filepath.Join(dir, "perf.pprof")
+	if err := os.WriteFile(src, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := ToPprof(dst, src, symbols); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	p, err := pprof.Parse(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// stacks returns the samples of p, one line each, sorted: the pid, the
+// sample values and each location, as the address and the file it is
+// mapped from.
+func stacks(p *pprof.Profile) []string {
+	var lines []string
+	for _, s := range p.Sample {
+		line := fmt.Sprint(s.NumLabel["pid"], " ", s.Value)
+		for _, loc := range s.Location {
+			file := "?"
+			if loc.Mapping != nil {
+				file = loc.Mapping.File
+			}
+			line += fmt.Sprintf(" %x@%s", loc.Address, file)
+		}
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func checkStacks(t *testing.T, p *pprof.Profile, want ...string) {
+	t.Helper()
+	got := stacks(p)
+	sort.Strings(want)
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got samples\n\t%s\nwant\n\t%s", strings.Join(got, "\n\t"), strings.Join(want, "\n\t"))
+	}
+}
+
+func TestPerfConvertCallchain(t *testing.T) {
+	attrs := []testAttr{{
+		config:     0, // cycles
+		period:     1000,
+		sampleType: SampleIP | SampleTID | SampleTime | SamplePeriod | SampleCallchain,
+	}}
+	records := [][]byte{
+		mmapRecord(KernelPID, 0xffff0000, 0x10000, 0xffff0000, "[kernel.kallsyms]_text"),
+		mmapRecord(10, 0x400000, 0x1000, 0, "/bin/app"),
+		// the kernel part, then the user part, of one stack
+		sampleRecord(MiscKernel, 0xffff0010, pidTID(10, 10), 1e9, 1000,
+			6, ContextKernel, 0xffff0010, 0xffff0020, ContextUser, 0x400100, 0x400200),
+		// a user stack, without markers
+		sampleRecord(MiscUser, 0x400100, pidTID(10, 10), 2e9, 500,
+			2, 0x400100, 0x400300),
+		// the same user stack, and two addresses outside any mapping
+		sampleRecord(MiscUser, 0x400100, pidTID(10, 10), 3e9, 700,
+			2, 0x400100, 0x400300),
+		sampleRecord(MiscUser, 0x900000, pidTID(10, 10), 3e9, 1,
+			3, ContextUser, 0x900000, 0x900010),
+	}
+	p := convertPerfFile(t, perfFile(attrs, records, nil), "")
+
+	// each address after the first of a context is a return address,
+	// and is looked up one byte before
+	checkStacks(t, p,
+		"[10] [1 1000] ffff0010@[kernel.kallsyms] ffff001f@[kernel.kallsyms] 400100@/bin/app 4001ff@/bin/app",
+		"[10] [2 1200] 400100@/bin/app 4002ff@/bin/app",
+		"[10] [1 1] 900000@? 90000f@?",
+	)
+	if got, want := p.DurationNanos, int64(2e9); got != want {
+		t.Errorf("got duration %d, want %d", got, want)
+	}
+	if len(p.SampleType) != 2 || p.SampleType[1].Type != "cycles" {
+		t.Errorf("got sample types %v, want samples and cycles", p.SampleType)
+	}
+	if p.PeriodType == nil || p.PeriodType.Type != "cycles" || p.Period != 1000 {
+		t.Errorf("got period %v %d, want 1000 cycles", p.PeriodType, p.Period)
+	}
+}
+
+func TestPerfConvertBuildIDs(t *testing.T) {
+	attrs := []testAttr{{sampleType: SampleIP | SampleTID}}
+	records := [][]byte{
+		// the build ID of the one from the MMAP2 record, of the other
+		// from the feature section
+		mmap2Record(10, 0x400000, 0x1000, 0, testBuildID(0xab), "/bin/app", nil),
+		mmapRecord(10, 0x500000, 0x1000, 0, "/lib/libc.so"),
+		mmap2Record(10, 0x600000, 0x1000, 0, nil, "/lib/libm.so", nil),
+		sampleRecord(MiscUser, 0x400010, pidTID(10, 10)),
+		sampleRecord(MiscUser, 0x500010, pidTID(10, 10)),
+		sampleRecord(MiscUser, 0x600010, pidTID(10, 10)),
+	}
+	buildIDs := append(buildIDEntry(testBuildID(0xcd), "/lib/libc.so"), buildIDEntry(testBuildID(0xef)[:16], "/lib/libm.so")...)
+	p := convertPerfFile(t, perfFile(attrs, records, buildIDs), "")
+
+	want := map[string]string{
+		"/bin/app":     strings.Repeat("ab", 20),
+		"/lib/libc.so": strings.Repeat("cd", 20),
+		"/lib/libm.so": strings.Repeat("ef", 16),
+	}
+	if len(p.Mapping) != len(want) {
+		t.Errorf("got %d mappings, want %d", len(p.Mapping), len(want))
+	}
+	for _, m := range p.Mapping {
+		if m.BuildID != want[m.File] {
+			t.Errorf("%s: got build ID %q, want %q", m.File, m.BuildID, want[m.File])
+		}
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "perf.data")
+	if err := os.WriteFile(path, perfFile(attrs, records, buildIDs), 0666); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := BuildIDs(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantIDs := []string{
+		strings.Repeat("cd", 20) + " /lib/libc.so",
+		strings.Repeat("ef", 16) + " /lib/libm.so",
+	}
+	if strings.Join(ids, "\n") != strings.Join(wantIDs, "\n") {
+		t.Errorf("got build IDs %q, want %q", ids, wantIDs)
+	}
+
+	// without the feature section, the mmaps are read for theirs
+	if err := os.WriteFile(path, perfFile(attrs, records, nil), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if ids, err = BuildIDs(path); err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Repeat("ab", 20) + " /bin/app"; len(ids) != 1 || ids[0] != want {
+		t.Errorf("got build IDs %q, want %q", ids, want)
+	}
+}
+
+func TestPerfConvertForkComm(t *testing.T) {
+	attrs := []testAttr{{sampleType: SampleIP | SampleTID}}
+	records := [][]byte{
+		mmapRecord(10, 0x400000, 0x1000, 0, "/bin/parent"),
+		// the child shares its parent's maps, until it executes
+		// another program
+		forkRecord(11, 10, nil),
+		sampleRecord(MiscUser, 0x400010, pidTID(11, 11)),
+		commRecord(11, "child", true, nil),
+		sampleRecord(MiscUser, 0x400020, pidTID(11, 11)),
+		mmapRecord(11, 0x400000, 0x1000, 0, "/bin/child"),
+		sampleRecord(MiscUser, 0x400030, pidTID(11, 11)),
+		// a thread is not a new process
+		forkRecord(10, 10, nil),
+		// a comm that is only a rename keeps the maps
+		commRecord(10, "renamed", false, nil),
+		sampleRecord(MiscUser, 0x400040, pidTID(10, 10)),
+	}
+	p := convertPerfFile(t, perfFile(attrs, records, nil), "")
+	checkStacks(t, p,
+		"[11] [1 1] 400010@/bin/parent",
+		"[11] [1 1] 400020@?",
+		"[11] [1 1] 400030@/bin/child",
+		"[10] [1 1] 400040@/bin/parent",
+	)
+}
+
+func TestPerfConvertSampleIDAll(t *testing.T) {
+	// two events told apart by the identifier of each sample, with
+	// every record carrying the sample's ID fields
+	const st = SampleIdentifier | SampleIP | SampleTID | SampleTime | SamplePeriod
+	attrs := []testAttr{
+		{config: 0, sampleType: st, flags: attrSampleIDAll, ids: []uint64{100, 101}},
+		{config: 1, sampleType: st, flags: attrSampleIDAll, ids: []uint64{200}},
+	}
+	trailer := func(id uint64) []byte {
+		// tid, time and identifier, in the order of the sample
+		return words(pidTID(10, 10), 1e9, id)
+	}
+	records := [][]byte{
+		commRecord(10, "app", true, trailer(100)),
+		mmap2Record(10, 0x400000, 0x1000, 0, testBuildID(1), "/bin/app", trailer(100)),
+		forkRecord(12, 10, trailer(200)),
+		sampleRecord(MiscUser, 100, 0x400010, pidTID(10, 10), 1e9, 3),
+		sampleRecord(MiscUser, 101, 0x400010, pidTID(10, 10), 2e9, 4),
+		sampleRecord(MiscUser, 200, 0x400010, pidTID(10, 10), 2e9, 50),
+		sampleRecord(MiscUser, 200, 0x400020, pidTID(12, 12), 2e9, 60),
+	}
+	p := convertPerfFile(t, perfFile(attrs, records, nil), "")
+	checkStacks(t, p,
+		"[10] [3 7 50] 400010@/bin/app",
+		"[12] [1 0 60] 400020@/bin/app",
+	)
+	var names []string
+	for _, st := range p.SampleType {
+		names = append(names, st.Type)
+	}
+	if got, want := strings.Join(names, " "), "samples cycles instructions"; got != want {
+		t.Errorf("got sample types %s, want %s", got, want)
+	}
+	if len(p.Mapping) != 1 || p.Mapping[0].BuildID != strings.Repeat("01", 20) {
+		t.Errorf("got mappings %v, want /bin/app with its build ID", p.Mapping)
+	}
+}
+
+func TestPerfConvertMalformed(t *testing.T) {
+	attrs := []testAttr{{sampleType: SampleIP | SampleTID | SampleCallchain}}
+	good := sampleRecord(MiscUser, 0x400010, pidTID(10, 10), 1, 0x400010)
+	tests := []struct {
+		name    string
+		records [][]byte
+	}{
+		{"truncated record", [][]byte{good, good[:len(good)-8]}},
+		{"bad record type", [][]byte{good, perfRecord(0, 0, words(1))}},
+	}
+	for _, test := range tests {
+		dir := t.TempDir()
+		src := filepath.Join(dir, "perf.data")
+		if err := os.WriteFile(src, perfFile(attrs, test.records, nil), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if err := ToPprof(filepath.Join(dir, "perf.pprof"), src, ""); err == nil {
+			t.Errorf("%s: converted without error", test.name)
+		}
+	}
+
+	// a callchain longer than its record is dropped
+	records := [][]byte{
+		mmapRecord(10, 0x400000, 0x1000, 0, "/bin/app"),
+		good,
+		sampleRecord(MiscUser, 0x400010, pidTID(10, 10), 100, 0x400010),
+	}
+	p := convertPerfFile(t, perfFile(attrs, records, nil), "")
+	checkStacks(t, p, "[10] [1 1] 400010@/bin/app")
+}
+
+// The test binary of package symbolize, and the names of its functions.
+// shapes::area is inlined into shapes::total.
+const (
+	inlineBinary = "../symbolize/testdata/inline"
+	totalName    = "_ZN6shapes5totalEPKiS1_i"
+)
+
+// inlinedOffset returns the offset in the test binary of an instruction
+// of shapes::total at which a call of shapes::area is inlined.
+func inlinedOffset(t *testing.T) uint64 {
+	t.Helper()
+	f, err := elf.Open(inlineBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	syms, err := f.Symbols()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := symbolize.New(filepath.Dir(inlineBinary))
+	m := &symbolize.Mapping{Limit: ^uint64(0), File: "/inline"}
+	for _, sym := range syms {
+		if sym.Name != totalName {
+			continue
+		}
+		for _, p := range f.Progs {
+			if p.Type != elf.PT_LOAD || sym.Value < p.Vaddr || sym.Value >= p.Vaddr+p.Filesz {
+				continue
+			}
+			for addr := sym.Value; addr < sym.Value+sym.Size; addr++ {
+				off := addr - p.Vaddr + p.Off
+				if frames, _ := s.User(0, m, off); len(frames) > 1 {
+					return off
+				}
+			}
+		}
+		t.Fatalf("no calls are inlined into %s", totalName)
+	}
+	t.Fatalf("%s not found in %s", totalName, inlineBinary)
+	return 0
+}
+
+// sourceLine returns the number of the line of the test binary's source
+// that ends with the comment s.
+func sourceLine(t *testing.T, s string) int {
+	t.Helper()
+	data, err := os.ReadFile(inlineBinary + ".cc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		if strings.HasSuffix(line, "// "+s) {
+			return i + 1
+		}
+	}
+	t.Fatalf("no line of %s.cc ends with // %s", inlineBinary, s)
+	return 0
+}
+
+func TestPerfConvertSymbolized(t *testing.T) {
+	off := inlinedOffset(t)
+	const start = 0x7f0000000000
+	attrs := []testAttr{{sampleType: SampleIP | SampleTID}}
+	records := [][]byte{
+		mmapRecord(10, start, 0x10000, 0, "/inline"),
+		sampleRecord(MiscUser, start+off, pidTID(10, 10)),
+	}
+	p := convertPerfFile(t, perfFile(attrs, records, nil), filepath.Dir(inlineBinary))
+
+	if len(p.Sample) != 1 || len(p.Sample[0].Location) != 1 {
+		t.Fatalf("got samples %v, want one of one location", p.Sample)
+	}
+	loc := p.Sample[0].Location[0]
+	var got []string
+	for _, line := range loc.Line {
+		got = append(got, fmt.Sprintf("%s %s:%d", line.Function.Name, line.Function.SystemName, line.Line))
+	}
+	want := []string{
+		fmt.Sprintf("shapes::area shapes::area:%d", sourceLine(t, "area")),
+		fmt.Sprintf("shapes::total %s:%d", totalName, sourceLine(t, "total")),
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got lines\n\t%s\nwant\n\t%s", strings.Join(got, "\n\t"), strings.Join(want, "\n\t"))
+	}
+	if m := loc.Mapping; m == nil || !m.HasFunctions || !m.HasLineNumbers || !m.HasInlineFrames {
+		t.Errorf("got mapping %+v, want one with functions, lines and inline frames", m)
+	}
+}
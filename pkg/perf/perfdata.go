@@ -0,0 +1,187 @@
+// Package perf reads the perf.data files perf record writes, salvaging
+// those it left damaged, and converts them to pprof profiles.
+package perf
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// The on-disk perf.data format is described in
+// https://github.com/torvalds/linux/blob/master/tools/perf/Documentation/perf.data-file-format.txt
+
+// Magic is the start of every perf.data file.
+const Magic = "PERFILE2"
+
+// A FileSection is where a section of a perf.data file is.
+type FileSection struct {
+	Offset, Size uint64
+}
+
+// A FileHeader is the header at the start of a perf.data file.
+type FileHeader struct {
+	Magic      [8]byte
+	Size       uint64
+	AttrSize   uint64
+	Attrs      FileSection
+	Data       FileSection
+	EventTypes FileSection
+	// Bitmap of the optional feature sections that follow the data
+	// section.
+	Features [4]uint64
+}
+
+// An EventHeader starts every record of the data section.
+type EventHeader struct {
+	Type uint32
+	Misc uint16
+	Size uint16
+}
+
+const EventHeaderSize = 8
+
+// validRecordType reports whether t is a kernel (1-63) or perf tool
+// (64-127) record type. Anything else means we have walked into garbage.
+func validRecordType(t uint32) bool {
+	return t >= 1 && t < 128
+}
+
+func readPerfHeader(r io.ReaderAt) (*FileHeader, error) {
+	var hdr FileHeader
+	if err := binary.Read(io.NewSectionReader(r, 0, 1<<20), binary.LittleEndian, &hdr); err != nil {
+		return nil, fmt.Errorf("could not read perf.data header: %s", err)
+	}
+	if string(hdr.Magic[:]) != Magic {
+		return nil, errors.New("not a perf.data file")
+	}
+	return &hdr, nil
+}
+
+// completeRecords walks the records in the data section of a perf.data
+// file, starting at offset start and going no further than end, and
+// returns the length of the leading run of complete, plausible records.
+func completeRecords(r io.ReaderAt, start, end int64) int64 {
+	var buf [EventHeaderSize]byte
+	pos := start
+	for pos+EventHeaderSize <= end {
+		if _, err := r.ReadAt(buf[:], pos); err != nil {
+			break
+		}
+		h := EventHeader{
+			Type: binary.LittleEndian.Uint32(buf[0:]),
+			Misc: binary.LittleEndian.Uint16(buf[4:]),
+			Size: binary.LittleEndian.Uint16(buf[6:]),
+		}
+		if h.Size < EventHeaderSize || !validRecordType(h.Type) || pos+int64(h.Size) > end {
+			break
+		}
+		pos += int64(h.Size)
+	}
+	return pos - start
+}
+
+// Salvage checks the perf.data file at path for truncation, as
+// happens when perf is killed before it can finish writing or the disk
+// fills up. If the file is damaged, it is rewritten in place to contain
+// only its complete records, and Salvage returns true.
+//
+// When check is true, the records are walked even if the header looks
+// intact, to recover from corruption in the middle of the data section.
+func Salvage(path string, check bool) (bool, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return false, err
+	}
+	salvaged, err := salvageFile(file, path, check)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return salvaged, err
+}
+
+func salvageFile(file *os.File, path string, check bool) (bool, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	hdr, err := readPerfHeader(file)
+	if err != nil {
+		return false, err
+	}
+	fileSize := info.Size()
+	start := int64(hdr.Data.Offset)
+	claimed := start + int64(hdr.Data.Size)
+	if start <= 0 || start > fileSize {
+		return false, fmt.Errorf("%s: data section at offset %d is outside the %d byte file", path, start, fileSize)
+	}
+
+	// perf writes the data size and the feature sections when it
+	// exits cleanly. A zero size means it never got the chance.
+	intact := hdr.Data.Size > 0 && claimed <= fileSize
+	if intact && !check {
+		return false, nil
+	}
+	end := fileSize
+	if intact {
+		end = claimed
+	}
+	size := completeRecords(file, start, end)
+	if intact && size == int64(hdr.Data.Size) {
+		return false, nil
+	}
+	if size == 0 {
+		return false, fmt.Errorf("%s: no complete records to salvage", path)
+	}
+
+	Warnf("%s is damaged, salvaging %d of %d bytes of sample data", path, size, end-start)
+	// The feature sections follow the data, and are lost with it,
+	// but for the build ID table, which is kept if perf wrote it.
+	var buildIDs []byte
+	if intact {
+		buildIDs = readBuildIDFeature(file, hdr)
+	}
+	hdr.Data.Size = uint64(size)
+	hdr.Features = [4]uint64{}
+	if buildIDs != nil {
+		hdr.Features[0] = 1 << FeatureBuildID
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	if err := binary.Write(file, binary.LittleEndian, hdr); err != nil {
+		return false, err
+	}
+	if err := file.Truncate(start + size); err != nil {
+		return false, err
+	}
+	if buildIDs != nil {
+		// the table of feature sections, then the one section
+		pos := start + size
+		table := FileSection{Offset: uint64(pos) + 16, Size: uint64(len(buildIDs))}
+		if _, err := file.Seek(pos, io.SeekStart); err != nil {
+			return false, err
+		}
+		if err := binary.Write(file, binary.LittleEndian, table); err != nil {
+			return false, err
+		}
+		if _, err := file.Write(buildIDs); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// readBuildIDFeature returns the build ID table of the perf.data file
+// with header hdr, or nil if it has none, or it is damaged.
+func readBuildIDFeature(r io.ReaderAt, hdr *FileHeader) []byte {
+	var table []byte
+	readFeatureSections(r, hdr, func(bit int, buf []byte) {
+		if len(parseBuildIDs(buf)) > 0 {
+			table = buf
+		}
+	}, FeatureBuildID)
+	return table
+}
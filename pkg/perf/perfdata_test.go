@@ -0,0 +1,131 @@
+package perf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The offset of the data section's size in the file header.
+const dataSizeOffset = 48
+
+// writeSalvageFile writes the recording data to a file, with the size of
+// its data section set to size, and returns its path.
+func writeSalvageFile(t *testing.T, data []byte, size uint64) string {
+	t.Helper()
+	binary.LittleEndian.PutUint64(data[dataSizeOffset:], size)
+	path := filepath.Join(t.TempDir(), "perf.data")
+	if err := os.WriteFile(path, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func salvageAttrs() []testAttr {
+	return []testAttr{{sampleType: SampleIP | SampleTID}}
+}
+
+func TestSalvagePerfDataTruncated(t *testing.T) {
+	records := [][]byte{
+		mmapRecord(10, 0x400000, 0x1000, 0, "/bin/app"),
+		sampleRecord(MiscUser, 0x400010, pidTID(10, 10)),
+		sampleRecord(MiscUser, 0x400020, pidTID(10, 10)),
+	}
+	data := perfFile(salvageAttrs(), records, nil)
+	complete := len(data)
+	// perf was killed in the middle of a record, before it wrote the
+	// size of the data section
+	data = append(data, sampleRecord(MiscUser, 0x400030, pidTID(10, 10))[:12]...)
+	path := writeSalvageFile(t, data, 0)
+
+	salvaged, err := Salvage(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !salvaged {
+		t.Fatal("truncated file not salvaged")
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != complete {
+		t.Errorf("salvaged file is %d bytes, want %d", len(got), complete)
+	}
+	checkStacks(t, convertPerfFile(t, got, ""),
+		"[10] [1 1] 400010@/bin/app",
+		"[10] [1 1] 400020@/bin/app",
+	)
+}
+
+func TestSalvagePerfDataIntact(t *testing.T) {
+	records := [][]byte{
+		mmapRecord(10, 0x400000, 0x1000, 0, "/bin/app"),
+		sampleRecord(MiscUser, 0x400010, pidTID(10, 10)),
+	}
+	data := perfFile(salvageAttrs(), records, buildIDEntry(testBuildID(1), "/bin/app"))
+	path := writeSalvageFile(t, data, uint64(len(bytes.Join(records, nil))))
+	for _, check := range []bool{false, true} {
+		salvaged, err := Salvage(path, check)
+		if err != nil || salvaged {
+			t.Errorf("check %v: got %v, %v, want the intact file left alone", check, salvaged, err)
+		}
+	}
+	if got, err := os.ReadFile(path); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("intact file was changed")
+	}
+}
+
+func TestSalvagePerfDataCorrupt(t *testing.T) {
+	records := [][]byte{
+		mmapRecord(10, 0x400000, 0x1000, 0, "/bin/app"),
+		sampleRecord(MiscUser, 0x400010, pidTID(10, 10)),
+		// garbage in the middle of the data section
+		perfRecord(0, 0, words(0xdeadbeef)),
+		sampleRecord(MiscUser, 0x400020, pidTID(10, 10)),
+	}
+	data := perfFile(salvageAttrs(), records, buildIDEntry(testBuildID(0xab), "/bin/app"))
+	path := writeSalvageFile(t, data, uint64(len(bytes.Join(records, nil))))
+
+	if salvaged, err := Salvage(path, false); err != nil || salvaged {
+		t.Fatalf("got %v, %v without check, want the file left alone", salvaged, err)
+	}
+	salvaged, err := Salvage(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !salvaged {
+		t.Fatal("corrupt file not salvaged")
+	}
+
+	// the build ID table is kept, and the data up to the garbage
+	wantID := strings.Repeat("ab", 20)
+	ids, err := BuildIDs(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != wantID+" /bin/app" {
+		t.Errorf("got build IDs %q, want %s /bin/app", ids, wantID)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := convertPerfFile(t, got, "")
+	checkStacks(t, p, "[10] [1 1] 400010@/bin/app")
+	if len(p.Mapping) != 1 || p.Mapping[0].BuildID != wantID {
+		t.Errorf("got mappings %v, want /bin/app with build ID %s", p.Mapping, wantID)
+	}
+}
+
+func TestSalvagePerfDataNothingComplete(t *testing.T) {
+	data := perfFile(salvageAttrs(), nil, nil)
+	data = append(data, sampleRecord(MiscUser, 0x400010, pidTID(10, 10))[:12]...)
+	path := writeSalvageFile(t, data, 0)
+	if salvaged, err := Salvage(path, false); err == nil {
+		t.Errorf("got %v, want an error", salvaged)
+	}
+}
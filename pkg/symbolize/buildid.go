@@ -0,0 +1,57 @@
+package symbolize
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"encoding/hex"
+)
+
+// Binaries are matched to the mappings of a recording by their GNU build
+// ID, so that a binary rebuilt since it was recorded is not used to name
+// its addresses.
+
+// BuildID returns the GNU build ID of the ELF file at path.
+func BuildID(path string) (string, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	for _, s := range f.Sections {
+		if s.Type != elf.SHT_NOTE {
+			continue
+		}
+		data, err := s.Data()
+		if err != nil {
+			continue
+		}
+		if id := NoteBuildID(data, f.ByteOrder); id != "" {
+			return id, nil
+		}
+	}
+	return "", nil
+}
+
+// NoteBuildID returns the GNU build ID among the ELF notes in data.
+func NoteBuildID(data []byte, order binary.ByteOrder) string {
+	// Elf_Nhdr: namesz, descsz, type, then the padded name and
+	// descriptor
+	for len(data) >= 12 {
+		namesz := int(order.Uint32(data[0:]))
+		descsz := int(order.Uint32(data[4:]))
+		typ := order.Uint32(data[8:])
+		name := (12 + namesz + 3) &^ 3
+		end := (name + descsz + 3) &^ 3
+		if name+descsz > len(data) {
+			break
+		}
+		if typ == 3 && namesz == 4 && string(data[12:15]) == "GNU" {
+			return hex.EncodeToString(data[name : name+descsz])
+		}
+		if end > len(data) {
+			break
+		}
+		data = data[end:]
+	}
+	return ""
+}
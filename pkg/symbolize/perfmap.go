@@ -0,0 +1,66 @@
+package symbolize
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Runtimes that generate code without writing it to a file, such as Node
+// with --perf-basic-prof or the JVM with perf-map-agent, name it in
+// /tmp/perf-<pid>.map, a line of start address, size and name in hex for
+// each function. Addresses in anonymous memory, or in none perf saw
+// mapped, are named by the map file of the process in the tree, if it
+// has one, named by the pid perf recorded.
+
+// PerfMapName returns the name of the map file of process pid.
+func PerfMapName(pid int) string { return fmt.Sprintf("perf-%d.map", pid) }
+
+// anonymousCode reports whether file, the name of a mapping, is memory
+// code may be generated in rather than a binary.
+func anonymousCode(file string) bool {
+	return file == "" || file == "//anon" || strings.HasPrefix(file, "[anon") || strings.HasPrefix(file, "/memfd:")
+}
+
+// readPerfMap reads the map file at path.
+func readPerfMap(path string) (*symbolTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	t := new(symbolTable)
+	// code regenerated at an address replaces what was there
+	at := make(map[uint64]int)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		// start size name, the name possibly with spaces
+		fields := strings.SplitN(scanner.Text(), " ", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		addr, err := strconv.ParseUint(strings.TrimPrefix(fields[0], "0x"), 16, 64)
+		if err != nil {
+			continue
+		}
+		size, err := strconv.ParseUint(strings.TrimPrefix(fields[1], "0x"), 16, 64)
+		if err != nil {
+			continue
+		}
+		sym := symbol{addr: addr, size: size, name: fields[2]}
+		if i, ok := at[addr]; ok {
+			t.syms[i] = sym
+			continue
+		}
+		at[addr] = len(t.syms)
+		t.syms = append(t.syms, sym)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	t.sort()
+	return t, nil
+}
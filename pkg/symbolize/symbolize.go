@@ -0,0 +1,634 @@
+// Package symbolize names the addresses of a profile: the functions,
+// files and lines of the binaries, the kernel and the generated code of
+// the processes it recorded, looked up in a symbol tree.
+package symbolize
+
+import (
+	"bufio"
+	"debug/dwarf"
+	"debug/elf"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ianlancetaylor/demangle"
+)
+
+// The converter symbolizes profiles itself, looking binaries up in the
+// symbol tree of the conversion only: binaries excluded from
+// symbolization are never linked into it. The tree may use the layouts
+// pprof searches with $PPROF_BINARY_PATH: <dir>/<build-id>/<name>,
+// <dir>/<first two digits of build-id>/<rest>.debug, <dir>/<path> and
+// <dir>/<name>. A stripped binary found in the tree is completed by its
+// separate debug file, if the tree has one, as when it was fetched from
+// debuginfod, or one is installed. The kernel is symbolized
+// with a vmlinux found the same way, or with /proc/kallsyms if the tree
+// links [kernel.kallsyms], as the trees built from the host's binaries
+// do. A [kernel.kallsyms] file in the tree is read in its place.
+//
+// C++ and Rust names are demangled, and simplified as pprof shows them
+// by default, without parameters or template arguments. Calls inlined
+// into a function are expanded into frames of their own, found in the
+// inlined subroutines of the binary's DWARF.
+
+// Warnf logs what could not be symbolized, and why, with the standard
+// logger unless a program sets it to its own.
+var Warnf = log.Printf
+
+// A Frame is the function and line an address is in.
+type Frame struct {
+	Function, File string
+	Line           int
+	// the first line of Function, if it is in File
+	StartLine int
+}
+
+// A Mapping is a mapping of a binary into a process, or of the kernel
+// or one of its modules.
+type Mapping struct {
+	Start, Limit, Offset uint64
+	File, BuildID        string
+}
+
+// A Symbolizer looks up the names of addresses in the binaries of a
+// symbol tree. It is not safe for concurrent use.
+type Symbolizer struct {
+	dir string
+	// by file and build ID; nil if the binary could not be found or read
+	binaries map[[2]string]*elfSymbols
+	kallsyms *symbolTable
+	// set once the kernel's symbols have been looked for
+	kernelLoaded bool
+	vmlinux      *elfSymbols
+	// the map files of processes, by pid; nil if a process has none
+	perfMaps map[uint32]*symbolTable
+}
+
+// New returns a Symbolizer looking binaries up in the tree dir.
+func New(dir string) *Symbolizer {
+	return &Symbolizer{dir: dir, binaries: make(map[[2]string]*elfSymbols), perfMaps: make(map[uint32]*symbolTable)}
+}
+
+// Candidates returns the paths in the tree where the binary file with
+// build ID id may be.
+func (s *Symbolizer) Candidates(file, id string) []string {
+	base := filepath.Base(file)
+	var paths []string
+	if id != "" {
+		paths = append(paths, filepath.Join(s.dir, id, base))
+		if len(id) > 2 {
+			paths = append(paths, filepath.Join(s.dir, id[:2], id[2:]+".debug"))
+		}
+	}
+	if strings.HasPrefix(file, "/") {
+		paths = append(paths, filepath.Join(s.dir, file))
+	}
+	return append(paths, filepath.Join(s.dir, base))
+}
+
+// binary returns the symbols of the binary file with build ID id.
+func (s *Symbolizer) binary(file, id string) *elfSymbols {
+	key := [2]string{file, id}
+	if b, ok := s.binaries[key]; ok {
+		return b
+	}
+	var b *elfSymbols
+	for _, path := range s.Candidates(file, id) {
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if id != "" {
+			// a stale binary would give wrong names
+			if got, err := BuildID(path); err == nil && got != id {
+				continue
+			}
+		}
+		var err error
+		if b, err = readELFSymbols(path); err != nil {
+			Warnf("could not read symbols of %s: %s", file, err)
+			continue
+		}
+		if len(b.lines) == 0 && len(id) > 2 {
+			// fetched from debuginfod into the tree, or installed
+			debug := filepath.Join(s.dir, id[:2], id[2:]+".debug")
+			if path == debug || !b.addDebugFile(debug) {
+				b.addDebugFile(filepath.Join(DebugDir, ".build-id", id[:2], id[2:]+".debug"))
+			}
+		}
+		break
+	}
+	s.binaries[key] = b
+	return b
+}
+
+// DebugDir is where the separate debug files of the binaries in a tree
+// are looked for, as installed by the -dbgsym and -debuginfo packages.
+var DebugDir = "/usr/lib/debug"
+
+// User returns the frames of addr in process pid, which is in m, or in
+// no mapping if m is nil. The frames are those of the calls inlined at
+// addr, innermost first, and last that of the function they are in.
+func (s *Symbolizer) User(pid uint32, m *Mapping, addr uint64) ([]Frame, bool) {
+	if m == nil || anonymousCode(m.File) {
+		if t := s.perfMap(pid); t != nil {
+			return t.lookup(addr)
+		}
+		return nil, false
+	}
+	if strings.HasPrefix(m.File, "[") {
+		// [vdso], [heap] and the like
+		return nil, false
+	}
+	b := s.binary(m.File, m.BuildID)
+	if b == nil {
+		return nil, false
+	}
+	vaddr, ok := b.vaddr(addr - m.Start + m.Offset)
+	if !ok {
+		return nil, false
+	}
+	return b.lookup(vaddr)
+}
+
+// perfMap returns the symbols of the map file of process pid in the
+// tree, if it has one.
+func (s *Symbolizer) perfMap(pid uint32) *symbolTable {
+	t, ok := s.perfMaps[pid]
+	if ok {
+		return t
+	}
+	path := filepath.Join(s.dir, PerfMapName(int(pid)))
+	if _, err := os.Stat(path); err == nil {
+		var err error
+		if t, err = readPerfMap(path); err != nil {
+			Warnf("could not read symbols of process %d: %s", pid, err)
+		}
+	}
+	s.perfMaps[pid] = t
+	return t
+}
+
+// Kernel returns the frames of the kernel address addr, in m if the
+// kernel's mmap records cover it.
+func (s *Symbolizer) Kernel(m *Mapping, addr uint64) ([]Frame, bool) {
+	if !s.kernelLoaded {
+		s.loadKernel(m)
+	}
+	if s.kallsyms != nil {
+		return s.kallsyms.lookup(addr)
+	}
+	if s.vmlinux != nil && m != nil && m.File == "[kernel.kallsyms]" {
+		// the mmap's offset is the address _text was relocated to
+		if s.vmlinux.text != 0 {
+			return s.vmlinux.lookup(addr - m.Offset + s.vmlinux.text)
+		}
+	}
+	return nil, false
+}
+
+func (s *Symbolizer) loadKernel(m *Mapping) {
+	if m == nil || m.File != "[kernel.kallsyms]" {
+		// wait for an address in the kernel proper, whose build ID
+		// identifies the kernel
+		return
+	}
+	s.kernelLoaded = true
+	if m.BuildID == "" {
+		return
+	}
+	path := filepath.Join(s.dir, m.BuildID, "[kernel.kallsyms]")
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSymlink != 0 {
+			// linked by buildSymbolLookup; otherwise a copy of
+			// the recording host's, sent to the symbolization
+			// service
+			path = "/proc/kallsyms"
+		}
+		if t, err := readKallsyms(path); err != nil {
+			Warnf("not symbolizing the kernel: %s", err)
+		} else if len(t.syms) == 0 {
+			Warnf("not symbolizing the kernel: kallsyms hides its addresses; try sysctl -w kernel.kptr_restrict=0")
+		} else {
+			s.kallsyms = t
+		}
+		return
+	}
+	s.vmlinux = s.binary("vmlinux", m.BuildID)
+}
+
+// A symbolTable is a list of functions sorted by address.
+type symbolTable struct {
+	syms []symbol
+}
+
+type symbol struct {
+	addr, size uint64
+	name       string
+}
+
+func (t *symbolTable) sort() {
+	sort.Slice(t.syms, func(i, j int) bool { return t.syms[i].addr < t.syms[j].addr })
+}
+
+// find returns the symbol addr is in. Symbols without a size extend to
+// the next one.
+func (t *symbolTable) find(addr uint64) (symbol, bool) {
+	i := sort.Search(len(t.syms), func(i int) bool { return t.syms[i].addr > addr }) - 1
+	if i < 0 {
+		return symbol{}, false
+	}
+	sym := t.syms[i]
+	if sym.size > 0 && addr >= sym.addr+sym.size {
+		return symbol{}, false
+	}
+	return sym, true
+}
+
+func (t *symbolTable) lookup(addr uint64) ([]Frame, bool) {
+	sym, ok := t.find(addr)
+	if !ok {
+		return nil, false
+	}
+	return []Frame{{Function: sym.name}}, true
+}
+
+// Demangle returns name demangled, if it is a C++ or Rust name, and
+// simplified as pprof shows names by default.
+func Demangle(name string) string {
+	return demangle.Filter(name, demangle.NoParams, demangle.NoEnclosingParams, demangle.NoTemplateParams)
+}
+
+// readKallsyms reads the kernel's text symbols. The table is empty if
+// kernel.kptr_restrict hides their addresses.
+func readKallsyms(path string) (*symbolTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	t := new(symbolTable)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// address, type, name and the module, if any
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || (fields[1] != "t" && fields[1] != "T") {
+			continue
+		}
+		addr, err := strconv.ParseUint(fields[0], 16, 64)
+		if err != nil || addr == 0 {
+			continue
+		}
+		t.syms = append(t.syms, symbol{addr: addr, name: fields[2]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	t.sort()
+	return t, nil
+}
+
+// elfSymbols are the symbols and line table of an ELF binary.
+type elfSymbols struct {
+	symbols symbolTable
+	loads   []*elf.Prog
+	// sorted by address
+	lines []lineEntry
+	// the address of _text, in a kernel
+	text uint64
+	// sorted by address
+	subprograms []subprogram
+}
+
+type lineEntry struct {
+	addr uint64
+	file string
+	line int
+	// the entry ends a sequence, and covers no instructions
+	end bool
+}
+
+func readELFSymbols(path string) (*elfSymbols, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b := new(elfSymbols)
+	for _, p := range f.Progs {
+		if p.Type == elf.PT_LOAD {
+			b.loads = append(b.loads, p)
+		}
+	}
+	syms, _ := f.Symbols()
+	dyn, _ := f.DynamicSymbols()
+	for _, sym := range append(syms, dyn...) {
+		if sym.Name == "_text" {
+			b.text = sym.Value
+		}
+		if elf.ST_TYPE(sym.Info) != elf.STT_FUNC || sym.Value == 0 {
+			continue
+		}
+		b.symbols.syms = append(b.symbols.syms, symbol{addr: sym.Value, size: sym.Size, name: sym.Name})
+	}
+	b.symbols.sort()
+	if d, err := f.DWARF(); err == nil {
+		b.lines = readLineTable(d)
+		b.subprograms = readSubprograms(d)
+	}
+	return b, nil
+}
+
+// addDebugFile adds the symbols and line table of the separate debug
+// file path, if there is one, to those of a stripped binary, and reports
+// whether there was.
+func (b *elfSymbols) addDebugFile(path string) bool {
+	debug, err := readELFSymbols(path)
+	if err != nil {
+		return false
+	}
+	if len(debug.symbols.syms) > len(b.symbols.syms) {
+		b.symbols = debug.symbols
+	}
+	b.lines, b.subprograms = debug.lines, debug.subprograms
+	return true
+}
+
+func readLineTable(d *dwarf.Data) []lineEntry {
+	var lines []lineEntry
+	r := d.Reader()
+	for {
+		cu, err := r.Next()
+		if err != nil || cu == nil {
+			break
+		}
+		if cu.Tag != dwarf.TagCompileUnit {
+			r.SkipChildren()
+			continue
+		}
+		lr, err := d.LineReader(cu)
+		r.SkipChildren()
+		if err != nil || lr == nil {
+			continue
+		}
+		var e dwarf.LineEntry
+		for lr.Next(&e) == nil {
+			file := ""
+			if e.File != nil {
+				file = e.File.Name
+			}
+			lines = append(lines, lineEntry{addr: e.Address, file: file, line: e.Line, end: e.EndSequence})
+		}
+	}
+	// a sequence may end where another begins
+	sort.SliceStable(lines, func(i, j int) bool {
+		if lines[i].addr != lines[j].addr {
+			return lines[i].addr < lines[j].addr
+		}
+		return lines[i].end && !lines[j].end
+	})
+	return lines
+}
+
+// A subprogram is a range of the addresses of a function, and the calls
+// inlined into it.
+type subprogram struct {
+	low, high uint64
+	inlines   []inlinedCall
+}
+
+// An inlinedCall is a range of the addresses of a function inlined into
+// another.
+type inlinedCall struct {
+	low, high uint64
+	function  string
+	// the file and line of the call, in the function it is inlined
+	// into
+	file string
+	line int
+	// the number of inlined calls it is nested in
+	depth int
+}
+
+// readSubprograms reads the functions of d that calls were inlined into.
+func readSubprograms(d *dwarf.Data) []subprogram {
+	var subs []subprogram
+	names := &dwarfNames{d: d, qualified: make(map[dwarf.Offset]string), origins: make(map[dwarf.Offset]string)}
+	r := d.Reader()
+	for {
+		cu, err := r.Next()
+		if err != nil || cu == nil {
+			break
+		}
+		if cu.Tag != dwarf.TagCompileUnit || !cu.Children {
+			r.SkipChildren()
+			continue
+		}
+		var files []*dwarf.LineFile
+		if lr, err := d.LineReader(cu); err == nil && lr != nil {
+			files = lr.Files()
+		}
+		subs = readUnitSubprograms(r, files, names, subs)
+	}
+	kept := subs[:0]
+	for _, sub := range subs {
+		if len(sub.inlines) > 0 {
+			kept = append(kept, sub)
+		}
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i].low < kept[j].low })
+	return kept
+}
+
+// readUnitSubprograms adds the functions of the compile unit r is in to
+// subs. The unit's file names are files.
+func readUnitSubprograms(r *dwarf.Reader, files []*dwarf.LineFile, names *dwarfNames, subs []subprogram) []subprogram {
+	d := names.d
+	// the entries of a scope are in the ranges subs[funcs...] of a
+	// function, within depth inlined calls, and in the namespaces and
+	// classes of prefix
+	type scope struct {
+		funcs  []int
+		depth  int
+		prefix string
+	}
+	// the functions of inlined calls are named once the unit is read,
+	// as their entries may come later
+	type origin struct {
+		sub, call int
+		off       dwarf.Offset
+	}
+	var origins []origin
+	stack := []scope{{}}
+	for len(stack) > 0 {
+		e, err := r.Next()
+		if err != nil || e == nil {
+			break
+		}
+		if e.Tag == 0 {
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		s := stack[len(stack)-1]
+		switch e.Tag {
+		case dwarf.TagNamespace, dwarf.TagClassType, dwarf.TagStructType, dwarf.TagUnionType:
+			name, _ := e.Val(dwarf.AttrName).(string)
+			if name == "" && e.Tag == dwarf.TagNamespace {
+				name = "(anonymous namespace)"
+			}
+			if name != "" {
+				s.prefix += name + "::"
+			}
+		case dwarf.TagSubprogram:
+			if name, ok := e.Val(dwarf.AttrName).(string); ok {
+				names.qualified[e.Offset] = s.prefix + name
+			}
+			s = scope{prefix: s.prefix}
+			ranges, _ := d.Ranges(e)
+			for _, rg := range ranges {
+				if rg[1] > rg[0] {
+					s.funcs = append(s.funcs, len(subs))
+					subs = append(subs, subprogram{low: rg[0], high: rg[1]})
+				}
+			}
+		case dwarf.TagInlinedSubroutine:
+			call := inlinedCall{depth: s.depth}
+			if i, ok := e.Val(dwarf.AttrCallFile).(int64); ok && i >= 0 && i < int64(len(files)) && files[i] != nil {
+				call.file = files[i].Name
+			}
+			if line, ok := e.Val(dwarf.AttrCallLine).(int64); ok {
+				call.line = int(line)
+			}
+			off, _ := e.Val(dwarf.AttrAbstractOrigin).(dwarf.Offset)
+			ranges, _ := d.Ranges(e)
+			for _, rg := range ranges {
+				for _, i := range s.funcs {
+					if rg[0] >= subs[i].low && rg[0] < subs[i].high {
+						call.low, call.high = rg[0], rg[1]
+						origins = append(origins, origin{i, len(subs[i].inlines), off})
+						subs[i].inlines = append(subs[i].inlines, call)
+					}
+				}
+			}
+			s.depth++
+		}
+		if e.Children {
+			stack = append(stack, s)
+		}
+	}
+	for _, o := range origins {
+		if o.off != 0 {
+			subs[o.sub].inlines[o.call].function = names.origin(o.off)
+		}
+	}
+	return subs
+}
+
+// dwarfNames are the names of the functions of a binary's DWARF.
+type dwarfNames struct {
+	d *dwarf.Data
+	// the names of the functions' entries, with their namespaces and
+	// classes, by offset
+	qualified map[dwarf.Offset]string
+	// the names of the functions of inlined calls, by the offset of
+	// their abstract origin
+	origins map[dwarf.Offset]string
+}
+
+// origin returns the name of the function whose abstract instance is at
+// offset off: its linkage name, if it or a declaration it refers to has
+// one, or else its qualified name.
+func (n *dwarfNames) origin(off dwarf.Offset) string {
+	if name, ok := n.origins[off]; ok {
+		return name
+	}
+	var name string
+	r := n.d.Reader()
+	// an abstract instance may refer to a declaration, and that to
+	// another
+	for i, next := 0, off; i < 4; i++ {
+		r.Seek(next)
+		e, err := r.Next()
+		if err != nil || e == nil {
+			break
+		}
+		if linkage, ok := e.Val(dwarf.AttrLinkageName).(string); ok {
+			name = linkage
+			break
+		}
+		if name == "" {
+			name = n.qualified[next]
+		}
+		var ok bool
+		if next, ok = e.Val(dwarf.AttrSpecification).(dwarf.Offset); !ok {
+			if next, ok = e.Val(dwarf.AttrAbstractOrigin).(dwarf.Offset); !ok {
+				break
+			}
+		}
+	}
+	n.origins[off] = name
+	return name
+}
+
+// inlinedCalls returns the calls inlined at vaddr, outermost first.
+func (b *elfSymbols) inlinedCalls(vaddr uint64) []inlinedCall {
+	i := sort.Search(len(b.subprograms), func(i int) bool { return b.subprograms[i].low > vaddr }) - 1
+	if i < 0 || vaddr >= b.subprograms[i].high {
+		return nil
+	}
+	var calls []inlinedCall
+	for _, call := range b.subprograms[i].inlines {
+		if vaddr >= call.low && vaddr < call.high {
+			calls = append(calls, call)
+		}
+	}
+	sort.Slice(calls, func(i, j int) bool { return calls[i].depth < calls[j].depth })
+	return calls
+}
+
+// vaddr returns the virtual address in the binary of the file offset off.
+func (b *elfSymbols) vaddr(off uint64) (uint64, bool) {
+	for _, p := range b.loads {
+		if off >= p.Off && off < p.Off+p.Filesz {
+			return off - p.Off + p.Vaddr, true
+		}
+	}
+	return 0, false
+}
+
+func (b *elfSymbols) line(addr uint64) (lineEntry, bool) {
+	i := sort.Search(len(b.lines), func(i int) bool { return b.lines[i].addr > addr }) - 1
+	if i < 0 || b.lines[i].end {
+		return lineEntry{}, false
+	}
+	return b.lines[i], true
+}
+
+func (b *elfSymbols) lookup(vaddr uint64) ([]Frame, bool) {
+	sym, ok := b.symbols.find(vaddr)
+	if !ok {
+		return nil, false
+	}
+	var file string
+	var line int
+	if l, ok := b.line(vaddr); ok {
+		file, line = l.file, l.line
+	}
+	// the line table has the line of the innermost inlined function,
+	// and each call the line of the function it is inlined into
+	calls := b.inlinedCalls(vaddr)
+	frames := make([]Frame, 0, len(calls)+1)
+	for i := len(calls) - 1; i >= 0; i-- {
+		if calls[i].function != "" {
+			frames = append(frames, Frame{Function: calls[i].function, File: file, Line: line})
+		}
+		file, line = calls[i].file, calls[i].line
+	}
+	frame := Frame{Function: sym.name, File: file, Line: line}
+	if start, ok := b.line(sym.addr); ok && start.file == file && file != "" {
+		frame.StartLine = start.line
+	}
+	return append(frames, frame), true
+}
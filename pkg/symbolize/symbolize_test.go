@@ -0,0 +1,92 @@
+package symbolize
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDemangle(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"main", "main"},
+		{"_ZN3foo3barEv", "foo::bar"},
+		{"_ZNSt6vectorIiSaIiEE9push_backERKi", "std::vector::push_back"},
+		{"_ZN4core3fmt5write17h0123456789abcdefE", "core::fmt::write"},
+		{"_RNvCs15kBYyAo9fc_7mycrate7example", "mycrate::example"},
+		{"_Znotmangled", "_Znotmangled"},
+	}
+	for _, test := range tests {
+		if got := Demangle(test.name); got != test.want {
+			t.Errorf("Demangle(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+// The test binary, and the names of its functions. shapes::area is
+// inlined into shapes::total.
+const (
+	inlineBinary = "testdata/inline"
+	totalName    = "_ZN6shapes5totalEPKiS1_i"
+)
+
+// inlinedAddr returns an address of shapes::total in b at which a call
+// of shapes::area is inlined.
+func inlinedAddr(t *testing.T, b *elfSymbols) uint64 {
+	t.Helper()
+	for _, sym := range b.symbols.syms {
+		if sym.name != totalName {
+			continue
+		}
+		for addr := sym.addr; addr < sym.addr+sym.size; addr++ {
+			if len(b.inlinedCalls(addr)) > 0 {
+				return addr
+			}
+		}
+		t.Fatalf("no calls are inlined into %s", totalName)
+	}
+	t.Fatalf("%s not found in %s", totalName, inlineBinary)
+	return 0
+}
+
+// sourceLine returns the number of the line of testdata/inline.cc that
+// ends with the comment s.
+func sourceLine(t *testing.T, s string) int {
+	t.Helper()
+	data, err := os.ReadFile("testdata/inline.cc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		if strings.HasSuffix(line, "// "+s) {
+			return i + 1
+		}
+	}
+	t.Fatalf("no line of testdata/inline.cc ends with // %s", s)
+	return 0
+}
+
+func TestSymbolizeInlined(t *testing.T) {
+	b, err := readELFSymbols(inlineBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := inlinedAddr(t, b)
+	frames, ok := b.lookup(addr)
+	if !ok || len(frames) != 2 {
+		t.Fatalf("got frames %v at %#x, want those of area and total", frames, addr)
+	}
+	want := []Frame{
+		{Function: "shapes::area", File: "inline.cc", Line: sourceLine(t, "area")},
+		{Function: totalName, File: "inline.cc", Line: sourceLine(t, "total")},
+	}
+	for i, frame := range frames {
+		frame.File = filepath.Base(frame.File)
+		frame.StartLine = 0
+		if frame != want[i] {
+			t.Errorf("frame %d: got %+v, want %+v", i, frame, want[i])
+		}
+	}
+}
@@ -0,0 +1,27 @@
+// The binary inline is built from this file for the symbolizer's tests:
+//
+//	g++ -O1 -g -fdebug-prefix-map=$PWD=. -o inline inline.cc
+//
+// shapes::area is inlined into shapes::total.
+
+namespace shapes {
+
+static inline int area(int w, int h) {
+  return w * h;  // area
+}
+
+__attribute__((noinline)) int total(const int *w, const int *h, int n) {
+  int sum = 0;
+  for (int i = 0; i < n; i++) {
+    sum += area(w[i], h[i]);  // total
+  }
+  return sum;
+}
+
+}  // namespace shapes
+
+int main(int argc, char **argv) {
+  int w[] = {argc, 2};
+  int h[] = {3, argc};
+  return shapes::total(w, h, 2);
+}
@@ -0,0 +1,39 @@
+// Package profilertest provides an in-memory Cloud Profiler API, for
+// hermetic tests of programs that embed the cloud-profiler-perf
+// packages. A Server answers CreateProfile calls as a test scripts it
+// to, with profile requests at a given cadence or with errors, and
+// records the profiles uploaded to it.
+//
+// It is the server the agent's own end-to-end tests run against.
+package profilertest
+
+import (
+	"github.com/droyo/cloud-profiler-perf/internal/fakeprofiler"
+)
+
+// DefaultDuration is the duration of the profiles a Server asks for,
+// unless a Step gives one.
+const DefaultDuration = fakeprofiler.DefaultDuration
+
+type (
+	// A Server is an in-memory ProfilerService. Its methods are safe
+	// to call from several goroutines.
+	Server = fakeprofiler.Server
+	// A Step is how a Server answers one CreateProfile call.
+	Step = fakeprofiler.Step
+	// A Call is a CreateProfile call made to a Server.
+	Call = fakeprofiler.Call
+	// An Upload is a profile uploaded to a Server.
+	Upload = fakeprofiler.Upload
+)
+
+// NewServer starts a Server listening on a local port.
+func NewServer() (*Server, error) {
+	return fakeprofiler.NewServer()
+}
+
+// Listen starts a Server listening on addr, such as for a program run
+// apart from the test to connect to.
+func Listen(addr string) (*Server, error) {
+	return fakeprofiler.Listen(addr)
+}
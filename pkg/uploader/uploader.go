@@ -0,0 +1,329 @@
+// Package uploader is the Cloud Profiler API client of the
+// cloud-profiler-perf agent, for programs with their own means of
+// collecting profiles. It asks the API which profile to collect, with the
+// agent's retry policy, and uploads the pprof-encoded profiles a caller
+// collects.
+package uploader
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	cloudprofiler "google.golang.org/genproto/googleapis/devtools/cloudprofiler/v2"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultMaxAttempts is the number of times CreateProfile is attempted
+// before giving up, unless Uploader.MaxAttempts is set.
+const DefaultMaxAttempts = 10
+
+// DefaultTimeout is how long a CreateProfile call waits for the API to
+// ask for a profile before it is issued again, unless Uploader.Timeout
+// is set. The API holds a call for up to an hour.
+const DefaultTimeout = 70 * time.Minute
+
+// DefaultUploadAttempts is the number of times UpdateProfile is
+// attempted before a profile is given up, unless Uploader.UploadAttempts
+// is set.
+const DefaultUploadAttempts = 4
+
+// DefaultUploadTimeout is how long one UpdateProfile call may take before
+// it is abandoned and retried, unless Uploader.UploadTimeout is set.
+const DefaultUploadTimeout = time.Minute
+
+// DefaultBackoff is the backoff of Backoff, and of an Uploader whose
+// Backoff is not set.
+var DefaultBackoff = BackoffPolicy{Base: time.Second, Max: 300 * time.Second}
+
+// A BackoffPolicy is how long to wait between failed attempts at a call.
+type BackoffPolicy struct {
+	// Base is the longest wait after the first failure, doubled with
+	// every further failure up to Max.
+	Base, Max time.Duration
+}
+
+// A Collector collects the profile the API asked for, for the duration
+// it gives, and returns it in pprof format. It may add labels to
+// profile.
+type Collector interface {
+	Collect(ctx context.Context, profile *cloudprofiler.Profile) ([]byte, error)
+}
+
+// A CollectorFunc is a function used as a Collector.
+type CollectorFunc func(ctx context.Context, profile *cloudprofiler.Profile) ([]byte, error)
+
+// Collect calls f.
+func (f CollectorFunc) Collect(ctx context.Context, profile *cloudprofiler.Profile) ([]byte, error) {
+	return f(ctx, profile)
+}
+
+// An Uploader requests and uploads profiles of one deployment.
+type Uploader struct {
+	Client     cloudprofiler.ProfilerServiceClient
+	Deployment *cloudprofiler.Deployment
+	// ProfileTypes are the types of profile the caller can collect.
+	ProfileTypes []cloudprofiler.ProfileType
+	// MaxAttempts is the number of times CreateProfile is attempted;
+	// zero means DefaultMaxAttempts.
+	MaxAttempts int
+	// Timeout is how long each CreateProfile call may wait for the
+	// API; zero means DefaultTimeout.
+	Timeout time.Duration
+	// UploadAttempts is the number of times UpdateProfile is
+	// attempted; zero means DefaultUploadAttempts.
+	UploadAttempts int
+	// UploadTimeout is how long each UpdateProfile call may take;
+	// zero means DefaultUploadTimeout.
+	UploadTimeout time.Duration
+	// Backoff is the wait between failed calls; the zero value means
+	// DefaultBackoff.
+	Backoff BackoffPolicy
+	// Logf, if set, is called to log retries; log.Printf by default.
+	Logf func(format string, v ...interface{})
+	// Retried, if set, is called before each retry of a failed
+	// UpdateProfile call of profile, such as to count them.
+	Retried func(profile *cloudprofiler.Profile, err error)
+}
+
+// New returns an Uploader for deployment that uses client.
+func New(client cloudprofiler.ProfilerServiceClient, deployment *cloudprofiler.Deployment, types ...cloudprofiler.ProfileType) *Uploader {
+	return &Uploader{Client: client, Deployment: deployment, ProfileTypes: types}
+}
+
+func (u *Uploader) logf(format string, v ...interface{}) {
+	if u.Logf != nil {
+		u.Logf(format, v...)
+	} else {
+		log.Printf(format, v...)
+	}
+}
+
+func (u *Uploader) backoff() BackoffPolicy {
+	if u.Backoff == (BackoffPolicy{}) {
+		return DefaultBackoff
+	}
+	return u.Backoff
+}
+
+// CreateProfile waits for the API to ask for a profile. Temporary errors
+// are retried, after the delay the server advises or with exponential
+// backoff. A call that times out without a profile is issued again, and
+// not counted as an attempt.
+func (u *Uploader) CreateProfile(ctx context.Context) (*cloudprofiler.Profile, error) {
+	req := &cloudprofiler.CreateProfileRequest{
+		Parent:      "projects/" + u.Deployment.ProjectId,
+		Deployment:  u.Deployment,
+		ProfileType: u.ProfileTypes,
+	}
+	max := u.MaxAttempts
+	if max <= 0 {
+		max = DefaultMaxAttempts
+	}
+	timeout := u.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	policy := u.backoff()
+	var err error
+	for attempt := 1; attempt <= max; attempt++ {
+		md := metadata.New(nil)
+		var profile *cloudprofiler.Profile
+		call, cancel := context.WithTimeout(ctx, timeout)
+		profile, err = u.Client.CreateProfile(call, req, grpc.Trailer(&md))
+		expired := Expired(ctx, call)
+		cancel()
+		if err == nil {
+			return profile, nil
+		}
+		if expired {
+			u.logf("no profile asked for in %v, asking again", timeout)
+			attempt--
+			continue
+		}
+		if !Temporary(err) {
+			return nil, err
+		}
+		backoff, ok := RetryDelay(err, md)
+		if ok {
+			u.logf("CreateProfile failed: %s, retrying using server-advised delay of %v", err, backoff)
+		} else {
+			backoff = policy.Delay(attempt)
+			u.logf("CreateProfile failed: %s, retrying in %v", err, backoff)
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return nil, fmt.Errorf("CreateProfile max retries(%d) exceeded; last error: %s", max, err)
+}
+
+// UpdateProfile uploads data, a pprof-encoded profile, as the profile the
+// API asked for. Calls that fail with a temporary error, or take longer
+// than the upload timeout, are retried after the delay the server
+// advises or with exponential backoff. Other errors, such as NotFound
+// for a profile the API no longer expects or InvalidArgument for one it
+// rejects, are returned at once, as retrying cannot help.
+func (u *Uploader) UpdateProfile(ctx context.Context, profile *cloudprofiler.Profile, data []byte) error {
+	profile.ProfileBytes = data
+	req := &cloudprofiler.UpdateProfileRequest{Profile: profile}
+	max := u.UploadAttempts
+	if max <= 0 {
+		max = DefaultUploadAttempts
+	}
+	timeout := u.UploadTimeout
+	if timeout <= 0 {
+		timeout = DefaultUploadTimeout
+	}
+	policy := u.backoff()
+	for attempt := 1; ; attempt++ {
+		md := metadata.New(nil)
+		call, cancel := context.WithTimeout(ctx, timeout)
+		_, err := u.Client.UpdateProfile(call, req, grpc.Trailer(&md))
+		cancel()
+		if err == nil {
+			if attempt > 1 {
+				u.logf("uploaded %s after %d failed attempts", profile.Name, attempt-1)
+			}
+			return nil
+		}
+		if !Temporary(err) || ctx.Err() != nil {
+			return err
+		}
+		if attempt >= max {
+			return fmt.Errorf("UpdateProfile max retries(%d) exceeded; last error: %s", max, err)
+		}
+		backoff, ok := RetryDelay(err, md)
+		if !ok {
+			backoff = policy.Delay(attempt)
+		}
+		if u.Retried != nil {
+			u.Retried(profile, err)
+		}
+		u.logf("UpdateProfile of %s failed: %s, retrying in %v", profile.Name, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// Run asks for profiles and uploads what c collects for them until ctx
+// is cancelled or CreateProfile fails. A failure to collect or upload a
+// profile is logged, and the next one asked for.
+func (u *Uploader) Run(ctx context.Context, c Collector) error {
+	for {
+		profile, err := u.CreateProfile(ctx)
+		if err != nil {
+			return err
+		}
+		data, err := c.Collect(ctx, profile)
+		if err != nil {
+			u.logf("failed to collect %s profile: %s", profile.ProfileType, err)
+			continue
+		}
+		if err := u.UpdateProfile(ctx, profile, data); err != nil {
+			u.logf("failed to upload %s profile: %s", profile.ProfileType, err)
+		}
+	}
+}
+
+// Backoff returns how long to wait before the next attempt after attempt
+// failures, with DefaultBackoff.
+func Backoff(attempt int) time.Duration {
+	return DefaultBackoff.Delay(attempt)
+}
+
+// jitter is the source of the random part of backoff delays. A
+// rand.Rand is not safe for concurrent use.
+var jitter = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// Delay returns how long to wait before the next attempt after attempt
+// failures: a random duration up to b.Base, doubled with every failure,
+// capped at b.Max. The randomness keeps the hosts of a fleet that failed
+// together, such as during an outage of the API, from retrying in step.
+func (b BackoffPolicy) Delay(attempt int) time.Duration {
+	ceiling := b.Base
+	for i := 1; i < attempt && ceiling < b.Max; i++ {
+		ceiling *= 2
+	}
+	if ceiling > b.Max {
+		ceiling = b.Max
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	jitter.Lock()
+	defer jitter.Unlock()
+	return time.Duration(jitter.Int63n(int64(ceiling) + 1))
+}
+
+// Expired reports whether call, a context derived from ctx for one API
+// call, has reached its own deadline while ctx is still live.
+func Expired(ctx, call context.Context) bool {
+	return ctx.Err() == nil && call.Err() == context.DeadlineExceeded
+}
+
+// Keepalive returns a dial option that pings the API every interval
+// while calls are in flight, so that NAT gateways and firewalls do not
+// drop the idle connection of a CreateProfile call waiting for the API,
+// and a connection that was dropped anyway fails the call rather than
+// leaving it waiting for good.
+func Keepalive(interval time.Duration) grpc.DialOption {
+	return grpc.WithKeepaliveParams(keepalive.ClientParameters{
+		Time:    interval,
+		Timeout: 20 * time.Second,
+	})
+}
+
+// Temporary reports whether err is a gRPC error worth retrying.
+func Temporary(err error) bool {
+	s, ok := status.FromError(err)
+	if !ok {
+		return false
+	}
+	switch s.Code() {
+	case codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted, codes.Unavailable:
+		return true
+	}
+	return false
+}
+
+// RetryDelay returns the delay the server advised in md, the trailer of
+// the call that failed with err, before retrying it.
+func RetryDelay(err error, md metadata.MD) (time.Duration, bool) {
+	var retryInfo errdetails.RetryInfo
+
+	if s, ok := status.FromError(err); ok && s.Code() == codes.Aborted {
+		pb := md.Get("google.rpc.retryinfo-bin")
+		if len(pb) > 0 {
+			if err := proto.Unmarshal([]byte(pb[0]), &retryInfo); err != nil {
+				log.Printf("failed to read retry trailer: %s", err)
+			} else {
+				d, err := ptypes.Duration(retryInfo.RetryDelay)
+				if err != nil {
+					log.Printf("could not parse retry delay: %s", err)
+				} else {
+					return d, true
+				}
+			}
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,99 @@
+package uploader
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  BackoffPolicy
+		attempt int
+		// the longest delay allowed
+		ceiling time.Duration
+	}{
+		{"zero policy", BackoffPolicy{}, 3, 0},
+		{"first failure", BackoffPolicy{Base: time.Second, Max: time.Minute}, 1, time.Second},
+		{"doubled", BackoffPolicy{Base: time.Second, Max: time.Minute}, 3, 4 * time.Second},
+		{"capped", BackoffPolicy{Base: time.Second, Max: 10 * time.Second}, 5, 10 * time.Second},
+		{"capped long after", BackoffPolicy{Base: time.Second, Max: 10 * time.Second}, 1000, 10 * time.Second},
+		{"base above max", BackoffPolicy{Base: time.Minute, Max: time.Second}, 1, time.Second},
+		{"attempt zero", BackoffPolicy{Base: time.Second, Max: time.Minute}, 0, time.Second},
+	}
+	for _, test := range tests {
+		var longest time.Duration
+		for i := 0; i < 1000; i++ {
+			d := test.policy.Delay(test.attempt)
+			if d < 0 || d > test.ceiling {
+				t.Fatalf("%s: attempt %d waits %v, want 0 to %v", test.name, test.attempt, d, test.ceiling)
+			}
+			if d > longest {
+				longest = d
+			}
+		}
+		// jittered over the whole range, not stuck at its start
+		if longest < test.ceiling/2 {
+			t.Errorf("%s: attempt %d waits at most %v in 1000 tries, want up to %v", test.name, test.attempt, longest, test.ceiling)
+		}
+	}
+}
+
+func TestTemporary(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{status.Error(codes.Unavailable, "down"), true},
+		{status.Error(codes.DeadlineExceeded, "slow"), true},
+		{status.Error(codes.ResourceExhausted, "quota"), true},
+		{status.Error(codes.Aborted, "not now"), true},
+		{status.Error(codes.NotFound, "expired"), false},
+		{status.Error(codes.InvalidArgument, "rejected"), false},
+		{status.Error(codes.PermissionDenied, "denied"), false},
+		{errors.New("not a gRPC error"), false},
+		{nil, false},
+	}
+	for _, test := range tests {
+		if got := Temporary(test.err); got != test.want {
+			t.Errorf("Temporary(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	info, err := proto.Marshal(&errdetails.RetryInfo{RetryDelay: ptypes.DurationProto(90 * time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	advised := metadata.Pairs("google.rpc.retryinfo-bin", string(info))
+	aborted := status.Error(codes.Aborted, "not now")
+	tests := []struct {
+		name string
+		err  error
+		md   metadata.MD
+		want time.Duration
+		ok   bool
+	}{
+		{"advised", aborted, advised, 90 * time.Second, true},
+		{"no trailer", aborted, nil, 0, false},
+		{"other trailers", aborted, metadata.Pairs("x", "y"), 0, false},
+		{"malformed", aborted, metadata.Pairs("google.rpc.retryinfo-bin", "\xff"), 0, false},
+		{"not aborted", status.Error(codes.Unavailable, "down"), advised, 0, false},
+		{"not a gRPC error", errors.New("failed"), advised, 0, false},
+	}
+	for _, test := range tests {
+		got, ok := RetryDelay(test.err, test.md)
+		if got != test.want || ok != test.ok {
+			t.Errorf("%s: got %v, %v, want %v, %v", test.name, got, ok, test.want, test.ok)
+		}
+	}
+}